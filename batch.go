@@ -0,0 +1,99 @@
+package logstructured
+
+// SetBatch writes every id and value in entries to the database as a single append, persisting the hash index
+// once at the end rather than after each record as Set does. Set appends an entry to the index log and, with
+// SyncAlways, syncs the database file for every record, whereas a batch makes one append to the index log for all
+// of its entries and one sync, which is far cheaper when writing many entries at once. The whole batch is written
+// under one acquisition of the lock.
+//
+// Records are always appended, AllowInPlaceUpdate is not applied to a batch. If only part of the batch makes it
+// into the file, the hash index is updated for the records which were written in full and an error is returned.
+func SetBatch(db *DB, entries map[string]string) error {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	// Check the whole batch up front, so that a bad entry means nothing at all is written.
+	newKeys := 0
+	for id, value := range entries {
+		if err := checkKey(db, id); err != nil {
+			return err
+		}
+		if err := checkValue(db, id, value); err != nil {
+			return err
+		}
+		if isNewKey(db, id) {
+			newKeys++
+		}
+	}
+	if err := checkKeyLimit(db, newKeys); err != nil {
+		return err
+	}
+	var total int64
+	for id, value := range entries {
+		total += recordSize(id, value)
+	}
+	if err := checkQuota(db, total); err != nil {
+		return err
+	}
+
+	size, err := dataSize(db)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(entries))
+	sizes := make([]int, 0, len(entries))
+	var batch []byte
+	firstSeq := db.seq + 1
+	writtenAt := db.clock().UnixNano()
+	for id, value := range entries {
+		record := encodeRecord(id, value, 0, nextSeq(db), writtenAt)
+		batch = append(batch, record...)
+		ids = append(ids, id)
+		sizes = append(sizes, len(record))
+	}
+
+	n, writeErr := appendData(db, batch)
+	if n > 0 {
+		if err := syncAppend(db); err != nil {
+			return err
+		}
+		if err := crash(db, CrashAfterWrite); err != nil {
+			return err
+		}
+	}
+
+	// Only index the records which were written in full, anything after a short write isn't in the file.
+	offset := size
+	remaining := int64(n)
+	written := make([]writtenRecord, 0, len(ids))
+	for i, id := range ids {
+		if remaining < int64(sizes[i]) {
+			break
+		}
+		written = append(written, writtenRecord{
+			key: id, offset: offset, size: sizes[i],
+			value: entries[id], seq: firstSeq + uint64(i), writtenAt: writtenAt,
+		})
+		offset += int64(sizes[i])
+		remaining -= int64(sizes[i])
+	}
+
+	err = db.afterWrite(written...)
+	if writeErr != nil {
+
+		// As with Set, a record only partly written is cut off again, leaving those written in full.
+		if db.writer == nil && !db.closed {
+			db.DB.Truncate(offset)
+		}
+		return writeErr
+	}
+	return err
+}
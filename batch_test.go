@@ -0,0 +1,50 @@
+package logstructured
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// BenchmarkSetBatch writes 10k entries to an empty database, one Set at a time and then as a single SetBatch.
+func BenchmarkSetBatch(b *testing.B) {
+	const entries = 10000
+	batch := make(map[string]string, entries)
+	for i := 0; i < entries; i++ {
+		batch[fmt.Sprint("key-", i)] = fmt.Sprint("value-", i)
+	}
+
+	open := func(b *testing.B, i int) *DB {
+		b.StopTimer()
+		defer b.StartTimer()
+		dir := b.TempDir()
+		db, err := Open(filepath.Join(dir, fmt.Sprint(i, ".db")), filepath.Join(dir, fmt.Sprint(i, "-index.db")), false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return db
+	}
+
+	b.Run("Set", func(b *testing.B) {
+		ctx := context.Background()
+		for i := 0; i < b.N; i++ {
+			db := open(b, i)
+			for id, value := range batch {
+				if err := Set(ctx, db, id, value); err != nil {
+					b.Fatal(err)
+				}
+			}
+			db.Close()
+		}
+	})
+	b.Run("SetBatch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			db := open(b, i)
+			if err := SetBatch(db, batch); err != nil {
+				b.Fatal(err)
+			}
+			db.Close()
+		}
+	})
+}
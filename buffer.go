@@ -0,0 +1,75 @@
+package logstructured
+
+import (
+	"bufio"
+)
+
+// appendData writes b onto the end of the database file, going through the write buffer when WriteBufferSize is
+// set. The lock must be held.
+func appendData(db *DB, b []byte) (int, error) {
+
+	// Whatever is buffered is written out first, so that the torn write ends up on the end of the file.
+	if db.CrashPoint == CrashTornWrite {
+		if err := flushWrites(db); err != nil {
+			return 0, err
+		}
+		if _, err := db.DB.Write(b[:len(b)/2]); err != nil {
+			return 0, err
+		}
+		return 0, crash(db, CrashTornWrite)
+	}
+
+	if db.WriteBufferSize <= 0 {
+
+		// Buffering may have just been turned off, anything still held in the buffer must come first.
+		if err := flushWrites(db); err != nil {
+			return 0, err
+		}
+		db.writer = nil
+
+		return db.DB.Write(b)
+	}
+
+	if db.writer == nil || db.writer.Size() != db.WriteBufferSize {
+		if err := flushWrites(db); err != nil {
+			return 0, err
+		}
+		db.writer = bufio.NewWriterSize(db.DB, db.WriteBufferSize)
+	}
+
+	return db.writer.Write(b)
+}
+
+// dataSize is the size of the database file, including any appends which are still held in the write buffer.
+// This is where the next append will start. The lock must be held, although only the read lock is needed, as the
+// buffer's own lock stops a concurrent reader flushing it between finding the size of the file and what is buffered.
+func dataSize(db *DB) (int64, error) {
+	db.writerMu.Lock()
+	defer db.writerMu.Unlock()
+
+	info, err := db.DB.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if db.writer != nil {
+		return info.Size() + int64(db.writer.Buffered()), nil
+	}
+	return info.Size(), nil
+}
+
+// flushWrites writes out any appends which are still held in the write buffer, so that they can be read from
+// the database file. Reads call this whilst only holding the read lock, so the buffer has a lock of its own to
+// stop concurrent readers from flushing it at the same time.
+//
+// A failed flush can't be retried, the buffer keeps returning the same error, and so do all further writes.
+// The hash index may then point beyond the end of the file, which Open recovers from by rebuilding it.
+func flushWrites(db *DB) error {
+	db.writerMu.Lock()
+	defer db.writerMu.Unlock()
+
+	if db.writer == nil || db.writer.Buffered() == 0 {
+		return nil
+	}
+	return db.writer.Flush()
+}
@@ -0,0 +1,35 @@
+package logstructured
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// BenchmarkSetBuffered runs sequential Sets of 100 byte values straight to the file, and through write buffers of a
+// few sizes.
+func BenchmarkSetBuffered(b *testing.B) {
+	ctx := context.Background()
+	value := string(make([]byte, 100))
+
+	for _, size := range []int{0, 4 << 10, 64 << 10} {
+		b.Run(fmt.Sprint("WriteBufferSize=", size), func(b *testing.B) {
+			dir := b.TempDir()
+			db, err := Open(filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db"), false)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			db.WriteBufferSize = size
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := Set(ctx, db, fmt.Sprint("key-", i), value); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
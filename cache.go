@@ -0,0 +1,100 @@
+package logstructured
+
+import (
+	"container/list"
+	"sync"
+)
+
+// CacheStats reports on the read cache, see DB.CacheSize.
+type CacheStats struct {
+	Entries int    // Number of IDs whose values are held in the cache.
+	Bytes   int    // Size of the IDs and values held, which CacheSize bounds.
+	Hits    uint64 // Gets answered from the cache since the database was opened.
+	Misses  uint64 // Gets which had to read the database file since the database was opened.
+}
+
+// CacheStats returns how full the read cache is and how well it has been doing.
+func (db *DB) CacheStats() CacheStats {
+	db.cache.mu.Lock()
+	defer db.cache.mu.Unlock()
+
+	return CacheStats{Entries: db.cache.order.Len(), Bytes: db.cache.size, Hits: db.cache.hits, Misses: db.cache.misses}
+}
+
+// valueCache holds the latest records read for the most recently used IDs, in order of use, up to a total size. Gets
+// share the read lock, so the cache has a lock of its own, as even a hit moves the entry to the front.
+type valueCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element // The element in order for each cached ID, holding its Record.
+	order   *list.List               // Most recently used at the front, the next to be evicted at the back.
+	size    int                      // Bytes of IDs and values held.
+	hits    uint64
+	misses  uint64
+}
+
+func newValueCache() *valueCache {
+	return &valueCache{entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// get returns the cached record for id, if there is one, counting the hit or miss. The record is the latest one for
+// id, which may be a deletion, and is checked for having expired whenever it is read, as with any other record.
+func (c *valueCache) get(id string) (Record, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[id]
+	if !ok {
+		c.misses++
+		return Record{}, false
+	}
+	c.hits++
+	c.order.MoveToFront(e)
+	return e.Value.(Record), true
+}
+
+// put caches r as the record read for its ID, evicting the least recently used entries until the cache fits in
+// capacity bytes. A record which wouldn't fit even in an empty cache isn't cached at all.
+func (c *valueCache) put(r Record, capacity int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(r.Key)
+	size := len(r.Key) + len(r.Value)
+	if size > capacity {
+		return
+	}
+	for c.size+size > capacity {
+		c.remove(c.order.Back().Value.(Record).Key)
+	}
+	c.entries[r.Key] = c.order.PushFront(r)
+	c.size += size
+}
+
+// forget drops the cached record for id, if there is one, as it is about to be written.
+func (c *valueCache) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(id)
+}
+
+// clear drops every cached record.
+func (c *valueCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	c.size = 0
+}
+
+// remove is forget whilst already holding the cache's lock.
+func (c *valueCache) remove(id string) {
+	e, ok := c.entries[id]
+	if !ok {
+		return
+	}
+	r := c.order.Remove(e).(Record)
+	delete(c.entries, id)
+	c.size -= len(r.Key) + len(r.Value)
+}
@@ -0,0 +1,161 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCache checks that repeated Gets are answered from the read cache, that overwriting or deleting a key is
+// seen straight away rather than its cached value, and that the cache stays within CacheSize.
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "cache.db"), filepath.Join(dir, "cache-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.CacheSize = 64
+
+	get := func(id, want string) error {
+		if got, err := Get(ctx, db, id); err != nil || got != want {
+			return fmt.Errorf("get %q: got %q, %v, want %q", id, got, err, want)
+		}
+		return nil
+	}
+
+	if err := Set(ctx, db, "hot", "1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := get("hot", "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := db.CacheStats(); s.Hits != 2 || s.Misses != 1 || s.Entries != 1 {
+		t.Fatalf("cache stats after three gets: got %+v, want 2 hits, 1 miss and 1 entry", s)
+	}
+
+	if err := Set(ctx, db, "hot", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := get("hot", "2"); err != nil {
+		t.Fatalf("after overwrite: %v", err)
+	}
+	if err := Delete(ctx, db, "hot"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Get(ctx, db, "hot"); !errors.Is(err, ErrDeleted) {
+		t.Fatalf("get %q after delete: got %v, want %v", "hot", err, ErrDeleted)
+	}
+
+	// Each of these takes up 20 bytes, so only the last three fit.
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("key-%d", i)
+		if err := Set(ctx, db, id, "fifteen-bytes--"); err != nil {
+			t.Fatal(err)
+		}
+		if err := get(id, "fifteen-bytes--"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := db.CacheStats(); s.Entries != 3 || s.Bytes != 60 {
+		t.Fatalf("cache stats after filling it: got %+v, want 3 entries taking 60 bytes", s)
+	}
+}
+
+// TestCacheInvalidatedOnOverwrite checks that every kind of write drops the cached value of the ID it overwrites.
+func TestCacheInvalidatedOnOverwrite(t *testing.T) {
+	ctx := context.Background()
+
+	writes := []struct {
+		name  string
+		write func(db *DB, value string) error
+	}{
+		{"Set", func(db *DB, value string) error { return Set(ctx, db, "hot", value) }},
+		{"SetWithTTL", func(db *DB, value string) error { return SetWithTTL(ctx, db, "hot", value, time.Hour) }},
+		{"SetBatch", func(db *DB, value string) error { return SetBatch(db, map[string]string{"hot": value}) }},
+		{"SetStream", func(db *DB, value string) error {
+			return SetStream(db, "hot", strings.NewReader(value), int64(len(value)))
+		}},
+		{"CompareAndSwap", func(db *DB, value string) error {
+			_, err := CompareAndSwap(db, "hot", "old", value)
+			return err
+		}},
+		{"Transaction", func(db *DB, value string) error {
+			var txn Transaction
+			txn.Set("hot", value)
+			return txn.Commit(db)
+		}},
+	}
+	for _, w := range writes {
+		t.Run(w.name, func(t *testing.T) {
+			dir := t.TempDir()
+			db, err := Open(filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db"), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			db.CacheSize = 1 << 10
+
+			if err := Set(ctx, db, "hot", "old"); err != nil {
+				t.Fatal(err)
+			}
+			if value, err := Get(ctx, db, "hot"); err != nil || value != "old" {
+				t.Fatalf("get %q: got %q (error %v), want %q", "hot", value, err, "old")
+			}
+			if s := db.CacheStats(); s.Entries != 1 {
+				t.Fatalf("cache stats after a get: got %+v, want the value cached", s)
+			}
+
+			if err := w.write(db, "new"); err != nil {
+				t.Fatal(err)
+			}
+			if value, err := Get(ctx, db, "hot"); err != nil || value != "new" {
+				t.Fatalf("get %q after overwriting it: got %q (error %v), want %q", "hot", value, err, "new")
+			}
+		})
+	}
+}
+
+// BenchmarkGetZipf reads 100k keys picked with a Zipf distribution, so that a few of them are read far more often
+// than the rest, without the read cache and with caches of a few sizes.
+func BenchmarkGetZipf(b *testing.B) {
+	const keys = 100000
+	ctx := context.Background()
+	db := benchDB(b, keys, 100)
+
+	r := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(r, 1.1, 1, keys-1)
+	ids := make([]string, 1<<16)
+	for i := range ids {
+		ids[i] = fmt.Sprint("key-", zipf.Uint64())
+	}
+
+	for _, size := range []int{0, 64 << 10, 1 << 20} {
+		b.Run(fmt.Sprint("CacheSize=", size), func(b *testing.B) {
+			db.CacheSize = size
+			db.cache.clear()
+			before := db.CacheStats()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := Get(ctx, db, ids[i%len(ids)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			s := db.CacheStats()
+			if hits, misses := s.Hits-before.Hits, s.Misses-before.Misses; hits+misses > 0 {
+				b.ReportMetric(float64(hits)/float64(hits+misses), "hit-rate")
+			}
+		})
+	}
+}
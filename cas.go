@@ -0,0 +1,55 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+)
+
+// CompareAndSwap writes newValue for id, but only if its current value is expected, reporting whether it was written.
+// The current value is read and the new one written whilst holding the write lock, so no other write can come in
+// between, which lets concurrent clients update the same ID without losing each other's writes: of several swaps
+// from the same value, only one succeeds and the rest report false, leaving them to read the value again and retry.
+//
+// An ID which is missing, deleted or expired has no current value to compare with, so the swap never happens for
+// one, not even when expected is empty. Use SetIfAbsent to write only an ID which doesn't exist yet.
+func CompareAndSwap(db *DB, id, expected, newValue string) (bool, error) {
+	return swap(db, id, newValue, func(current string, live bool) bool {
+		return live && current == expected
+	})
+}
+
+// SetIfAbsent writes value for id, but only if there is no live value for it yet, reporting whether it was written.
+// As with CompareAndSwap, no other write can come in between the check and the write, so of several clients trying
+// to insert the same ID only one succeeds. A deleted or expired ID counts as absent.
+func SetIfAbsent(db *DB, id, value string) (bool, error) {
+	return swap(db, id, value, func(_ string, live bool) bool {
+		return !live
+	})
+}
+
+// swap writes value for id if ok, called with the current value of id and whether it has a live one, says so.
+func swap(db *DB, id, value string, ok func(current string, live bool) bool) (bool, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return false, ErrClosed
+	}
+	if db.readOnly {
+		return false, ErrReadOnly
+	}
+
+	current, err := get(context.Background(), db, id)
+	live := err == nil
+	if err != nil && !errors.Is(err, ErrKeyNotFound) && !errors.Is(err, ErrDeleted) {
+		return false, err
+	}
+	if !ok(current, live) {
+		return false, nil
+	}
+
+	if err := writeValue(db, id, value, 0); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,87 @@
+package logstructured
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestCompareAndSwap checks that of several concurrent swaps from the same value, and of several concurrent
+// inserts of the same ID, exactly one succeeds, and that a missing or deleted ID only counts as absent.
+func TestCompareAndSwap(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "cas.db"), filepath.Join(dir, "cas-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := Set(ctx, db, "counter", "0"); err != nil {
+		t.Fatalf("set %q: %v", "counter", err)
+	}
+
+	// Every attempt starts from the same value, so only the first to get the lock should find it still there. None of
+	// them swap in the value they start from, otherwise the next would find it there too.
+	const attempts = 20
+	attempt := func(fn func(i int) (bool, error)) ([]int, error) {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var winners []int
+		var firstErr error
+		for i := 0; i < attempts; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				swapped, err := fn(i)
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				if swapped {
+					winners = append(winners, i)
+				}
+			}(i)
+		}
+		wg.Wait()
+		return winners, firstErr
+	}
+
+	winners, err := attempt(func(i int) (bool, error) {
+		return CompareAndSwap(db, "counter", "0", fmt.Sprint(i+1))
+	})
+	if err != nil {
+		t.Fatalf("compare and swap: %v", err)
+	}
+	if len(winners) != 1 {
+		t.Fatalf("concurrent compare and swaps: got %d succeeding, want 1", len(winners))
+	}
+	if value, err := Get(ctx, db, "counter"); err != nil || value != fmt.Sprint(winners[0]+1) {
+		t.Fatalf("get %q after compare and swap: got %q (error %v), want %q", "counter", value, err, fmt.Sprint(winners[0]+1))
+	}
+
+	winners, err = attempt(func(i int) (bool, error) {
+		return SetIfAbsent(db, "new", fmt.Sprint(i))
+	})
+	if err != nil {
+		t.Fatalf("set if absent: %v", err)
+	}
+	if len(winners) != 1 {
+		t.Fatalf("concurrent sets if absent: got %d succeeding, want 1", len(winners))
+	}
+
+	if swapped, err := CompareAndSwap(db, "missing", "", "1"); err != nil || swapped {
+		t.Fatalf("compare and swap of a missing ID: got %t (error %v), want false", swapped, err)
+	}
+	if err := Delete(ctx, db, "new"); err != nil {
+		t.Fatalf("delete %q: %v", "new", err)
+	}
+	if swapped, err := SetIfAbsent(db, "new", "again"); err != nil || !swapped {
+		t.Fatalf("set if absent of a deleted ID: got %t (error %v), want true", swapped, err)
+	}
+}
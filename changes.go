@@ -0,0 +1,145 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// changesBufferSize is how many live records a change feed can fall behind by before it is closed, see Changes.
+const changesBufferSize = 1024
+
+// ErrChangesCompacted is returned by Changes when the records following on from the sequence number asked for may
+// have been dropped by a compaction since.
+var ErrChangesCompacted = errors.New("changes have been compacted away")
+
+// Record is a single write to the database, as delivered by Changes and returned by GetRecord. Op is OpSet or
+// OpDelete, a delete has an empty Value. ExpiresAt is the Unix time, in seconds, after which the entry expires, or
+// zero if it never does. WrittenAt is the Unix time, in nanoseconds, the write was made at, see DB.Clock. Offset is
+// the byte offset in the database file which the record starts at, and Size how many bytes it takes up there.
+type Record struct {
+	Seq       uint64
+	Key       string
+	Value     string
+	ExpiresAt int64
+	WrittenAt int64
+	Op        Op
+	Offset    int64
+	Size      int64
+}
+
+// Changes returns a channel which receives every record written to db with a sequence number after fromSeq, see
+// LastSeq, in order of sequence number. Those already in the database file come first, read by a scan of the whole
+// file, which holds up writes until it is done and holds the records in memory until they have been received. The
+// channel then carries on receiving each new write as it is made, until ctx is cancelled or the database is closed,
+// when it is closed.
+//
+// Records are never left out. A consumer which falls too far behind the live writes instead has its channel closed,
+// and can carry on by calling Changes again with the sequence number of the last record it received. This makes it
+// possible to keep a follower up to date, applying each record in turn.
+//
+// Compaction drops every record but the last live one of each key, deletes included, so once the database has been
+// compacted the records following on from an earlier sequence number may no longer all be there. Changes returns
+// ErrChangesCompacted for these, other than for a fromSeq of zero, since starting from nothing the latest live entry
+// of each key is all a follower needs.
+func Changes(ctx context.Context, db *DB, fromSeq uint64) (<-chan Record, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+	if fromSeq > 0 && fromSeq < db.baseSeq {
+		return nil, fmt.Errorf("%w: from sequence number %d, compacted up to %d", ErrChangesCompacted, fromSeq, db.baseSeq)
+	}
+
+	// The write lock keeps any write from coming in between the scan and the feed starting, which would then be
+	// in neither.
+	var history []Record
+	err := eachRecord(db, func(offset int64, id, value string, expiresAt int64, seq uint64, writtenAt int64) error {
+		if seq > fromSeq {
+			history = append(history, newChangeRecord(id, value, expiresAt, seq, writtenAt, offset))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Records are mostly in order of sequence number in the file already, but updates in place are not.
+	sort.Slice(history, func(i, j int) bool { return history[i].Seq < history[j].Seq })
+
+	live := make(chan Record, changesBufferSize)
+	if db.feeds == nil {
+		db.feeds = make(map[chan Record]struct{})
+	}
+	db.feeds[live] = struct{}{}
+
+	out := make(chan Record)
+	go feedChanges(ctx, db, history, live, out)
+	return out, nil
+}
+
+// feedChanges sends history, then whatever is received from live, to out, closing out once live is closed or ctx
+// is cancelled.
+func feedChanges(ctx context.Context, db *DB, history []Record, live chan Record, out chan<- Record) {
+	defer close(out)
+	defer stopFeed(db, live)
+
+	for _, r := range history {
+		select {
+		case out <- r:
+		case <-ctx.Done():
+			return
+		}
+	}
+	for {
+		select {
+		case r, ok := <-live:
+			if !ok {
+				return
+			}
+			select {
+			case out <- r:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// stopFeed stops sending live records to a change feed, unless this has already happened.
+func stopFeed(db *DB, live chan Record) {
+	db.Lock()
+	defer db.Unlock()
+
+	if _, ok := db.feeds[live]; ok {
+		delete(db.feeds, live)
+		close(live)
+	}
+}
+
+// publishChange sends the record just written to every change feed. A feed which has fallen too far behind to take
+// it is closed instead, so that it never misses a record without knowing. The lock must be held.
+func publishChange(db *DB, r Record) {
+	for live := range db.feeds {
+		select {
+		case live <- r:
+		default:
+			delete(db.feeds, live)
+			close(live)
+		}
+	}
+}
+
+// newChangeRecord is the Record for a write of value for id at offset, which is a delete if value is the tombstone.
+func newChangeRecord(id, value string, expiresAt int64, seq uint64, writtenAt int64, offset int64) Record {
+	size := recordSize(id, value)
+	if value == Tombstone {
+		return Record{Seq: seq, Key: id, WrittenAt: writtenAt, Op: OpDelete, Offset: offset, Size: size}
+	}
+	return Record{Seq: seq, Key: id, Value: value, ExpiresAt: expiresAt, WrittenAt: writtenAt, Op: OpSet, Offset: offset, Size: size}
+}
@@ -0,0 +1,112 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestChanges checks that a change feed from the start receives every record, those already written and then
+// live ones, and that starting again from the last one seen carries on without gaps or duplicates.
+func TestChanges(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "changes.db"), filepath.Join(dir, "changes-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var txn Transaction
+	txn.Set("d", "4")
+	txn.Delete("a")
+	if err := Set(ctx, db, "a", "1"); err != nil {
+		t.Fatalf("set %q: %v", "a", err)
+	}
+	if err := SetBatch(db, map[string]string{"b": "2", "c": "3"}); err != nil {
+		t.Fatalf("set batch: %v", err)
+	}
+	if err := txn.Commit(db); err != nil {
+		t.Fatalf("commit transaction: %v", err)
+	}
+
+	// Each record should be the next in the sequence, whichever feed it came from.
+	var seen uint64
+	receive := func(changes <-chan Record, n int) ([]Record, error) {
+		var records []Record
+		for len(records) < n {
+			select {
+			case r, ok := <-changes:
+				if !ok {
+					return nil, fmt.Errorf("change feed closed after %d of %d records", len(records), n)
+				}
+				if r.Seq != seen+1 {
+					return nil, fmt.Errorf("change feed: got sequence number %d after %d", r.Seq, seen)
+				}
+				seen = r.Seq
+				records = append(records, r)
+			case <-time.After(time.Second):
+				return nil, fmt.Errorf("change feed: timed out after %d of %d records", len(records), n)
+			}
+		}
+		return records, nil
+	}
+
+	feedCtx, stop := context.WithCancel(ctx)
+	changes, err := Changes(feedCtx, db, 0)
+	if err != nil {
+		stop()
+		t.Fatalf("changes: %v", err)
+	}
+	records, err := receive(changes, 5)
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	if last := records[4]; last.Key != "a" || last.Op != OpDelete {
+		stop()
+		t.Fatalf("last record written: got %+v, want the delete of %q", last, "a")
+	}
+	if err := Set(ctx, db, "e", "5"); err != nil {
+		stop()
+		t.Fatalf("set %q: %v", "e", err)
+	}
+	records, err = receive(changes, 1)
+	stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live := records[0]; live.Key != "e" || live.Value != "5" || live.Op != OpSet {
+		t.Fatalf("live record: got %+v, want the set of %q", live, "e")
+	}
+
+	// Written whilst nothing was following along, so it should come first when the feed is started again.
+	if err := Set(ctx, db, "f", "6"); err != nil {
+		t.Fatalf("set %q: %v", "f", err)
+	}
+	feedCtx, stop = context.WithCancel(ctx)
+	defer stop()
+	if changes, err = Changes(feedCtx, db, seen); err != nil {
+		t.Fatalf("changes from %d: %v", seen, err)
+	}
+	if err := Set(ctx, db, "g", "7"); err != nil {
+		t.Fatalf("set %q: %v", "g", err)
+	}
+	if records, err = receive(changes, 2); err != nil {
+		t.Fatal(err)
+	}
+	if records[0].Key != "f" || records[1].Key != "g" {
+		t.Fatalf("records after starting again: got %+v, want those for %q and %q", records, "f", "g")
+	}
+
+	if err := Compact(ctx, db); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if _, err := Changes(ctx, db, 2); !errors.Is(err, ErrChangesCompacted) {
+		t.Fatalf("changes from before a compaction: got error %v, want %v", err, ErrChangesCompacted)
+	}
+}
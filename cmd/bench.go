@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"time"
+
+	logstructured "github.com/jdockerty/log-structured-db-engine"
+)
+
+// benchConfig is what -bench writes and reads, see the -bench-* flags.
+type benchConfig struct {
+	Records   int   // Number of records to write.
+	Keys      int   // Number of distinct keys the records are written to, fewer than Records means overwrites.
+	ValueSize int   // Length of each value in bytes.
+	Reads     int   // Number of keys to read back.
+	Batch     int   // Records written by each SetBatch, and keys read by each GetMulti.
+	Seed      int64 // Seed for the keys and values, so that a run can be repeated exactly.
+}
+
+// benchPhase is how long the writes or reads of a benchmark took, with the latency of each call made for them.
+type benchPhase struct {
+	Ops     int             // Number of records written or keys read.
+	Calls   []time.Duration // Latency of each SetBatch or GetMulti, in the order they were made.
+	Elapsed time.Duration
+}
+
+// percentile returns the latency which the fraction q of calls took no longer than.
+func (p benchPhase) percentile(q float64) time.Duration {
+	if len(p.Calls) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), p.Calls...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(q*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// runBench writes cfg.Records random records to db, spread over cfg.Keys keys, then reads cfg.Reads random keys
+// back, in batches of cfg.Batch. A batch holds each key at most once, as SetBatch only writes the last value given
+// for a key, so every one of the records is written. Keys are picked from the whole key space for the reads, so
+// those never written are missed, which is reported by the number of hits.
+func runBench(db *logstructured.DB, cfg benchConfig) (writes, reads benchPhase, hits int, err error) {
+	if cfg.Records < 0 || cfg.Reads < 0 || cfg.ValueSize < 0 || cfg.Keys < 1 || cfg.Batch < 1 {
+		return benchPhase{}, benchPhase{}, 0, errors.New("benchmark needs at least one key and a batch of at least one, and no negative counts")
+	}
+
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	key := func() string { return fmt.Sprintf("bench-%d", rng.Intn(cfg.Keys)) }
+	const letters = "abcdefghijklmnopqrstuvwxyz"
+	value := make([]byte, cfg.ValueSize)
+
+	start := time.Now()
+	batch := make(map[string]string, cfg.Batch)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		callStart := time.Now()
+		if err := logstructured.SetBatch(db, batch); err != nil {
+			return err
+		}
+		writes.Calls = append(writes.Calls, time.Since(callStart))
+		writes.Ops += len(batch)
+		batch = make(map[string]string, cfg.Batch)
+		return nil
+	}
+	for i := 0; i < cfg.Records; i++ {
+		id := key()
+		if _, ok := batch[id]; ok {
+			if err := flush(); err != nil {
+				return writes, reads, 0, err
+			}
+		}
+		for j := range value {
+			value[j] = letters[rng.Intn(len(letters))]
+		}
+		batch[id] = string(value)
+		if len(batch) >= cfg.Batch {
+			if err := flush(); err != nil {
+				return writes, reads, 0, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return writes, reads, 0, err
+	}
+	writes.Elapsed = time.Since(start)
+
+	start = time.Now()
+	ids := make([]string, 0, cfg.Batch)
+	for reads.Ops < cfg.Reads {
+		ids = ids[:0]
+		for len(ids) < cfg.Batch && reads.Ops+len(ids) < cfg.Reads {
+			ids = append(ids, key())
+		}
+		callStart := time.Now()
+		found, err := logstructured.GetMulti(db, ids)
+		if err != nil {
+			return writes, reads, hits, err
+		}
+		reads.Calls = append(reads.Calls, time.Since(callStart))
+		reads.Ops += len(ids)
+		for _, id := range ids {
+			if _, ok := found[id]; ok {
+				hits++
+			}
+		}
+	}
+	reads.Elapsed = time.Since(start)
+
+	return writes, reads, hits, nil
+}
+
+// printBench writes the throughput and latencies of each phase of a benchmark to out.
+func printBench(out io.Writer, cfg benchConfig, writes, reads benchPhase, hits int) {
+	phase := func(name, op string, p benchPhase) {
+		rate := 0.0
+		if p.Elapsed > 0 {
+			rate = float64(p.Ops) / p.Elapsed.Seconds()
+		}
+		fmt.Fprintf(out, "%s: %d %s in %s (%.0f/s), %d calls of up to %d, p50 %s, p99 %s per call\n",
+			name, p.Ops, op, p.Elapsed.Round(time.Microsecond), rate, len(p.Calls), cfg.Batch, p.percentile(0.5), p.percentile(0.99))
+	}
+	phase("Writes", "records", writes)
+	phase("Reads", "keys", reads)
+	fmt.Fprintf(out, "Read hits: %d of %d\n", hits, reads.Ops)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	logstructured "github.com/jdockerty/log-structured-db-engine"
+)
+
+// TestBench checks that the load generator writes exactly as many records as it is asked to, even with few
+// enough keys that batches would otherwise hold the same key twice, and reads back as many keys, all of them found
+// when every key has been written.
+func TestBench(t *testing.T) {
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "bench.db")
+	indexPath := filepath.Join(dir, "bench-index.db")
+	db, err := logstructured.Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	cfg := benchConfig{Records: 1000, Keys: 20, ValueSize: 10, Reads: 250, Batch: 16, Seed: 1}
+	writes, reads, hits, err := runBench(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if writes.Ops != cfg.Records || reads.Ops != cfg.Reads {
+		t.Fatalf("wrote %d records and read %d keys, want %d and %d", writes.Ops, reads.Ops, cfg.Records, cfg.Reads)
+	}
+	if hits != cfg.Reads {
+		t.Fatalf("found %d of %d keys read, want all of them as all %d keys were written", hits, cfg.Reads, cfg.Keys)
+	}
+
+	// The records themselves are counted from the log, rather than taken from what the generator says.
+	records := 0
+	it := logstructured.LogIterator(db)
+	for it.Next() {
+		if len(it.Value()) != cfg.ValueSize {
+			t.Fatalf("record for %q has a %d byte value, want %d", it.Key(), len(it.Value()), cfg.ValueSize)
+		}
+		records++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if records != cfg.Records {
+		t.Fatalf("%d records in the file, want %d", records, cfg.Records)
+	}
+	if n := db.Len(); n != cfg.Keys {
+		t.Fatalf("%d live keys, want %d", n, cfg.Keys)
+	}
+
+	var out strings.Builder
+	printBench(&out, cfg, writes, reads, hits)
+	if !strings.Contains(out.String(), "Writes: 1000 records") || !strings.Contains(out.String(), "Read hits: 250 of 250") {
+		t.Fatalf("unexpected report %q", out.String())
+	}
+}
@@ -1,108 +1,426 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 
 	logstructured "github.com/jdockerty/log-structured-db-engine"
 )
 
-var (
-	set          = flag.String("set", "", "a string entry to insert, should be in the form '<id>,<string>'")
-	getId        = flag.String("get", "", "the ID of the entry to retrieve from the database.")
-	disableIndex = flag.Bool("disable-index", false, "disable the hash index for retrieving an entry, forcing a search through the entire database.")
+// errUsage is returned by run when the flags don't name exactly one operation, or can't be parsed, once the reason
+// and the usage have been written out.
+var errUsage = errors.New("invalid usage")
 
-	// This is an append-only file. Note that the benefit of this is more useful when including deletion records and compaction, although
-	// this toy implementation does not include those features. It is append only as writing a new line into the file is an extremely
-	// efficient operation.
-	dbName = flag.String("db-file", "log-structure.db", "Database file to use or create")
+func main() {
+	err := run(os.Args[1:], os.Stdout, os.Stderr)
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		return
+	case errors.Is(err, errUsage):
+		os.Exit(2)
+	case err != nil:
+		log.Fatal(err)
+	}
+}
+
+// run parses args as the command line, without the program name, and carries out the one operation it asks for
+// against the database, writing what it reports to stdout and the usage, along with what was wrong, to stderr. Any
+// error means the command failed, which main exits non-zero for.
+func run(args []string, stdout, stderr io.Writer) (err error) {
+	fs := flag.NewFlagSet("db", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	set := fs.String("set", "", "a string entry to insert, should be in the form '<id>,<string>'")
+	ttl := fs.Duration("ttl", 0, "used with -set, how long the entry lives before it expires, e.g. '1h'. Entries never expire by default.")
+	getId := fs.String("get", "", "the ID of the entry to retrieve from the database.")
+	deleteId := fs.String("delete", "", "the ID of the entry to delete from the database.")
+	importPath := fs.String("import", "", "a CSV file of '<id>,<value>' rows, or a .json/.jsonl/.ndjson file of {\"id\": ..., \"value\": ...} lines, to write in a single batch.")
+	fs.Bool("compact", false, "compact the database, keeping only the latest entry for each ID.")
+	fs.Bool("compact-plan", false, "report what -compact would keep and reclaim, by reading through the database without writing anything.")
+	fs.Bool("stats", false, "report the size of the database, how many live keys it holds and how much compaction would reclaim.")
+	fs.Bool("check", false, "check that every entry in the hash index points at a record for its own ID, exiting with an error if any don't.")
+	fs.Bool("rebuild-index", false, "rebuild the hash index from scratch by scanning the entire database.")
+	fs.Bool("upgrade", false, "rewrite a database file in the legacy '<id>,<value>' text format in the current format, so that it can be written to again.")
+	readOnly := fs.Bool("read-only", false, "open the database only for reading, which is safe whilst another process is writing to it. Anything which would write fails.")
+	disableIndex := fs.Bool("disable-index", false, "disable the hash index for retrieving an entry, forcing a search through the entire database.")
+	scanFromEnd := fs.Bool("scan-from-end", true, "run full scans backwards from the end of the database, stopping at the latest entry for the ID.")
+	fs.Bool("interactive", false, "open the database once and read commands from stdin, keeping the hash index in memory between them.")
+	indexFormat := fs.String("index-format", "json", "how to store the hash index, 'json' or 'gob'. An index file stored the other way is converted on the next write.")
+	fs.Bool("dump-index", false, "print every ID in the hash index file with the offset it points at, in sorted order. The database file isn't needed.")
+	fs.Bool("dump-log", false, "print every record in the database file in the order it was written, overwritten entries and tombstones included.")
+	fs.Bool("selftest", false, "run a quick set/get/delete/compact round-trip against a temporary database and report whether it passed.")
+
+	// A load generator, which writes to the database given by -db-file and -index-file like any other command.
+	fs.Bool("bench", false, "write random records with SetBatch, then read random keys with GetMulti, reporting the throughput and p50/p99 latency per call of each.")
+	benchRecords := fs.Int("bench-records", 100000, "used with -bench, how many records to write.")
+	benchKeys := fs.Int("bench-keys", 10000, "used with -bench, how many distinct keys to write the records to. Fewer keys than records means more of them are overwrites.")
+	benchValueSize := fs.Int("bench-value-size", 100, "used with -bench, the size of each value in bytes.")
+	benchReads := fs.Int("bench-reads", 100000, "used with -bench, how many keys to read back.")
+	benchBatch := fs.Int("bench-batch", 100, "used with -bench, how many records each SetBatch writes, and how many keys each GetMulti reads.")
+	benchSeed := fs.Int64("bench-seed", 1, "used with -bench, the seed for the random keys and values, so that a run can be repeated.")
+
+	// This is an append-only file. Note that the benefit of this is more useful when including deletion records and compaction, since
+	// the dead entries which build up can be dropped by compaction later on. It is append only as writing a new line into the file is an
+	// extremely efficient operation.
+	dbName := fs.String("db-file", "log-structure.db", "Database file to use or create")
 
 	// Our hash index which is stored on disk, alongside our database. This mimics the functionality of being resilient to a crash, if we were
 	// to store our index entirely in-memory, then we would lose our entire hash table when a crash occurs. Instead, we can read it from disk
 	// on startup, if there is one present, and then hold it in memory for extremely fast read access to the database.
-	indexName = flag.String("index-file", "hash-index.db", "The hash index file to create or load from disk if it doesn't already exist")
+	indexName := fs.String("index-file", "hash-index.db", "The hash index file to create or load from disk if it doesn't already exist")
 
-	// Our hash index is in the format { ID : byte_offset }
-	// This enables us to jump to the relevant section of the file if the ID we are looking for
-	// is contained within the hash index.
-	hashIndex = make(map[string]int64)
-)
+	// Both files, and everything else kept alongside them, can be put in a directory of their own and created with
+	// stricter permissions, such as when running under a service account.
+	dir := fs.String("dir", "", "directory to keep the database and index files in, created if it doesn't exist. Defaults to the working directory.")
+	fileMode := fs.String("file-mode", "0666", "permissions, in octal, to create new files with, before the umask.")
 
-func main() {
+	// The flag set has already written out what was wrong with the flags, along with the usage.
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return fmt.Errorf("%w: %s", errUsage, err)
+	}
+	usage := func(format string, a ...interface{}) error {
+		msg := fmt.Sprintf(format, a...)
+		fmt.Fprintln(stderr, msg)
+		fs.Usage()
+		return fmt.Errorf("%w: %s", errUsage, msg)
+	}
+	if fs.NArg() > 0 {
+		return usage("unexpected argument %q, every operation is given as a flag", fs.Arg(0))
+	}
+
+	// Only one operation is carried out, so asking for more than one is rejected rather than quietly ignoring the
+	// rest. The flags which only change how an operation is done, such as -ttl or -read-only, aren't counted.
+	var operations []string
+	fs.Visit(func(f *flag.Flag) {
+		if v, ok := f.Value.(flag.Getter); ok && v.Get() == false {
+			return
+		}
+		switch f.Name {
+		case "set", "get", "delete", "import", "compact", "compact-plan", "stats", "check", "rebuild-index", "upgrade", "interactive",
+			"dump-index", "dump-log", "selftest", "bench":
+			operations = append(operations, f.Name)
+		}
+	})
+	switch len(operations) {
+	case 0:
+		return usage("no operation given, use one of -set, -get, -delete, -import, -compact, -compact-plan, -stats, -check, -rebuild-index, -upgrade, -interactive, -dump-index, -dump-log, -bench or -selftest")
+	case 1:
+	default:
+		return usage("-%s can't be used together, give one operation at a time", strings.Join(operations, " and -"))
+	}
+	op := operations[0]
+
+	// The self-test never touches the real database files, so we handle it before opening them.
+	if op == "selftest" {
+		if err := runSelfTest(); err != nil {
+			return fmt.Errorf("selftest: FAIL: %w", err)
+		}
+		fmt.Fprintln(stdout, "selftest: PASS")
+		return nil
+	}
+
+	// Only the index file is read, so this still works when the database file is missing.
+	if op == "dump-index" {
+		return dumpIndex(*indexName, stdout)
+	}
+
+	var format logstructured.IndexFormat
+	switch *indexFormat {
+	case "json":
+		format = logstructured.IndexFormatJSON
+	case "gob":
+		format = logstructured.IndexFormatGob
+	default:
+		return usage("unknown index format %q, it should be 'json' or 'gob'", *indexFormat)
+	}
+
+	mode, err := strconv.ParseUint(*fileMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return usage("file mode %q should be permissions in octal, e.g. '0600'", *fileMode)
+	}
 
-	flag.Parse()
+	// An entry without a comma is caught before opening the database, which would otherwise create the files for
+	// nothing.
+	id, value, ok := strings.Cut(*set, ",")
+	if op == "set" && !ok {
+		return usage("an entry should be in the format '<id>,<string>', e.g. '10,hello'")
+	}
 
-	f, err := os.OpenFile(*dbName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	db, err := logstructured.OpenWithOptions(*dbName, *indexName, logstructured.Options{
+		Dir:          *dir,
+		FileMode:     os.FileMode(mode),
+		DisableIndex: *disableIndex,
+		ReadOnly:     *readOnly,
+		Logger:       log.New(stderr, "", 0),
+	})
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	db.IndexFormat = format
+	db.ScanFromEnd = *scanFromEnd
+	ctx := context.Background()
+
+	// A full scan of a large file can take a while, so show how far it has got.
+	if *disableIndex {
+		db.ScanProgress = printScanProgress(stderr)
 	}
 	defer func() {
-		if err = f.Close(); err != nil {
-			log.Fatal(err)
+		if closeErr := db.Close(); closeErr != nil && err == nil {
+			err = closeErr
 		}
 	}()
 
-	hashFile, err := os.OpenFile(*indexName, os.O_RDWR|os.O_CREATE, 0666)
-	if err != nil {
-		log.Fatal(err)
+	// Run commands from stdin against the already open database, until stdin is closed or 'quit' is read. An
+	// interrupt or SIGTERM lets the command under way finish, then flushes the database to disk and closes it,
+	// rather than killing the process part way through a write.
+	if op == "interactive" {
+		shutdown, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		if err := runREPL(shutdown, db, os.Stdin, stdout, stderr); err != nil {
+			return err
+		}
+		if shutdown.Err() == nil {
+			return nil
+		}
+
+		// Another signal from here on ends the process straight away, for when the flush itself hangs.
+		stop()
+		fmt.Fprintln(stderr, "Shutting down, flushing the database to disk.")
+		if *readOnly {
+			return nil
+		}
+		return db.Flush()
 	}
-	defer func() {
-		if err = hashFile.Close(); err != nil {
-			log.Fatal(err)
+
+	// Write an entry. The ID is everything before the first comma, the value is everything after it and so may
+	// contain commas itself.
+	if op == "set" {
+		if *ttl > 0 {
+			return logstructured.SetWithTTL(ctx, db, id, value, *ttl)
 		}
-	}()
+		return logstructured.Set(ctx, db, id, value)
+	}
 
-	info, err := hashFile.Stat()
-	if err != nil {
-		log.Fatal(err)
+	// Delete an entry using its ID, this appends a tombstone rather than removing anything from the file.
+	if op == "delete" {
+		return logstructured.Delete(ctx, db, *deleteId)
 	}
 
-	// In our toy example, this will basically always be the case, but serves
-	// as a general idea of how this might be implemented.
-	if info.Size() > 0 {
-		fmt.Println("Populating stored hash index")
+	// Load every entry from a file in one batch, so that the hash index is only persisted once.
+	if op == "import" {
+		imported, skipped, err := importFile(db, *importPath)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Imported %d keys, skipped %d rows which were malformed or invalid.\n", imported, skipped)
+		return nil
+	}
 
-		// Read our saved hash index from disk, this is our crash tolerance.
-		d := json.NewDecoder(hashFile)
-		err := d.Decode(&hashIndex)
+	// Generate load against the database, reporting how quickly it is written and read.
+	if op == "bench" {
+		cfg := benchConfig{Records: *benchRecords, Keys: *benchKeys, ValueSize: *benchValueSize, Reads: *benchReads, Batch: *benchBatch, Seed: *benchSeed}
+		writes, reads, hits, err := runBench(db, cfg)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
+		printBench(stdout, cfg, writes, reads, hits)
+		return nil
 	}
 
-	db := logstructured.DB{DB: f, HashStorage: hashFile, Hash: hashIndex, HashDisabled: *disableIndex}
+	// Print the raw log, every record as it was written.
+	if op == "dump-log" {
+		return dumpLog(db, stdout)
+	}
 
-	// Write an entry.
-	if *set != "" {
-		if !strings.Contains(*set, ",") {
-			log.Fatal("an entry should be in the format '<id>,<string>', e.g. '10,hello'")
-		}
-		err := logstructured.Set(&db, *set)
+	// Rewrite the database with only the latest entry for each ID. Interrupting it part way through leaves the
+	// original database as it was.
+	if op == "compact" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		return logstructured.Compact(ctx, db)
+	}
+
+	// Report exactly what compacting would do, without doing it.
+	if op == "compact-plan" {
+		plan, err := logstructured.CompactPlan(db)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		return
+		reclaimed := 0.0
+		if plan.FileSize > 0 {
+			reclaimed = float64(plan.ReclaimedBytes) * 100 / float64(plan.FileSize)
+		}
+		fmt.Fprintf(stdout, "Records: %d\nLive keys kept: %d\nDead records dropped: %d\nFile size: %d bytes\nSize after compaction: %d bytes\nReclaimed by compaction: %d bytes (%.1f%%)\n",
+			plan.Records, plan.LiveKeys, plan.DeadRecords, plan.FileSize, plan.RemainingBytes, plan.ReclaimedBytes, reclaimed)
+		return nil
 	}
 
-	// Get an entry using its ID. We're assuming that the ID is a known quantity here.
-	if *getId != "" {
-		fmt.Printf("Getting record with ID: %s\n", *getId)
+	// Report how much of the database is dead, to help decide whether it is worth compacting.
+	if op == "stats" {
+		s, err := logstructured.Stats(db)
+		if err != nil {
+			return err
+		}
+		indexSize, err := db.IndexBytes()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "File size: %d bytes\nIndex file size: %d bytes\nLive keys: %d\nDead bytes: %d\nReclaimable by compaction: %.1f%%\nIndex memory: ~%d bytes\n",
+			s.FileSize, indexSize, s.LiveKeys, s.DeadBytes, s.Reclaimable*100, db.IndexMemoryBytes())
+		return nil
+	}
 
-		entry, err := logstructured.Get(&db, *getId)
+	// Report the keys whose entry in the hash index doesn't point at their own record.
+	if op == "check" {
+		mismatched, err := logstructured.CheckIndex(db)
 		if err != nil {
-			log.Fatal(err)
+			return err
+		}
+		if len(mismatched) == 0 {
+			fmt.Fprintln(stdout, "Hash index matches the database file.")
+			return nil
 		}
+		for _, id := range mismatched {
+			fmt.Fprintf(stdout, "ID '%s' points at the wrong record.\n", id)
+		}
+		return fmt.Errorf("%d entries in the hash index don't match the database file, rebuild it with -rebuild-index", len(mismatched))
+	}
 
-		if entry == "" {
-			fmt.Printf("ID '%s' is not contained in the database.\n", *getId)
-			return
+	// Throw away the stored hash index and build it again from the database file.
+	if op == "rebuild-index" {
+		return logstructured.RebuildIndex(db)
+	}
+
+	// Rewrite a legacy text database in the current format, which is otherwise only read.
+	if op == "upgrade" {
+		return logstructured.Upgrade(db)
+	}
+
+	// Get an entry using its ID, the only operation left. We're assuming that the ID is a known quantity here.
+	fmt.Fprintf(stdout, "Getting record with ID: %s\n", *getId)
+
+	value, err = logstructured.Get(ctx, db, *getId)
+	if errors.Is(err, logstructured.ErrDeleted) {
+		fmt.Fprintf(stdout, "ID '%s' has been deleted from the database.\n", *getId)
+		return nil
+	}
+	if errors.Is(err, logstructured.ErrKeyNotFound) {
+		fmt.Fprintf(stdout, "ID '%s' is not contained in the database.\n", *getId)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(stdout, "Value:", value)
+	return nil
+}
+
+// runSelfTest exercises the main code paths against a throwaway database in a temporary directory,
+// this gives a quick sanity check that a build (and the storage it runs on) behaves as expected.
+func runSelfTest() error {
+	ctx := context.Background()
+
+	dir, err := os.MkdirTemp("", "log-structured-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := logstructured.Open(filepath.Join(dir, "selftest.db"), filepath.Join(dir, "selftest-index.db"), false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Write a couple of entries, then overwrite one of them so that there are multiple records for it.
+	for _, kv := range [][2]string{{"1", "foo"}, {"2", "bar"}, {"1", "baz"}} {
+		if err := logstructured.Set(ctx, db, kv[0], kv[1]); err != nil {
+			return fmt.Errorf("set %q: %w", kv[0], err)
 		}
-		fmt.Println("Record:", entry)
-		return
+	}
+
+	// Both the hash index and a full scan should agree on the latest entries.
+	for _, disabled := range []bool{false, true} {
+		db.HashDisabled = disabled
+		for id, expected := range map[string]string{"1": "baz", "2": "bar"} {
+			entry, err := logstructured.Get(ctx, db, id)
+			if err != nil {
+				return fmt.Errorf("get %q (index disabled: %t): %w", id, disabled, err)
+			}
+			if entry != expected {
+				return fmt.Errorf("get %q (index disabled: %t): got %q, want %q", id, disabled, entry, expected)
+			}
+		}
+	}
+	db.HashDisabled = false
+
+	// Deleting an entry should hide it, and compaction should leave only the latest entry for each ID.
+	if err := logstructured.Delete(ctx, db, "2"); err != nil {
+		return fmt.Errorf("delete %q: %w", "2", err)
+	}
+	if _, err := logstructured.Get(ctx, db, "2"); !errors.Is(err, logstructured.ErrDeleted) {
+		return fmt.Errorf("get deleted %q: got error %v, want %v", "2", err, logstructured.ErrDeleted)
+	}
+	if err := logstructured.Compact(ctx, db); err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	if entry, err := logstructured.Get(ctx, db, "1"); err != nil || entry != "baz" {
+		return fmt.Errorf("get %q after compaction: got %q (error %v), want %q", "1", entry, err, "baz")
+	}
+	if _, err := logstructured.Get(ctx, db, "2"); err == nil {
+		return fmt.Errorf("get deleted %q after compaction: got no error", "2")
+	}
 
+	// The stored hash index should load back to the same offsets that are held in memory.
+	if _, err := db.HashStorage.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	stored := make(map[string]logstructured.RecordLocation)
+	if err := json.NewDecoder(db.HashStorage).Decode(&stored); err != nil {
+		return fmt.Errorf("load stored hash index: %w", err)
+	}
+	if err := sameIndex(stored, indexContents(db.Hash)); err != nil {
+		return fmt.Errorf("stored hash index: %w", err)
+	}
+	return nil
+}
+
+// indexContents copies every entry out of index into a map, so that two indexes can be compared.
+func indexContents(index logstructured.Index) map[string]logstructured.RecordLocation {
+	contents := make(map[string]logstructured.RecordLocation, index.Len())
+	index.Range(func(id string, loc logstructured.RecordLocation) bool {
+		contents[id] = loc
+		return true
+	})
+	return contents
+}
+
+// sameIndex reports how got differs from want, if it does at all.
+func sameIndex(got, want map[string]logstructured.RecordLocation) error {
+	if len(got) != len(want) {
+		return fmt.Errorf("got %d entries, want %d", len(got), len(want))
+	}
+	for id, loc := range want {
+		if got[id] != loc {
+			return fmt.Errorf("entry for %q: got %+v, want %+v", id, got[id], loc)
+		}
 	}
+	return nil
 }
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	logstructured "github.com/jdockerty/log-structured-db-engine"
+)
+
+// runCLIEnv is set for a subprocess which runs this test binary as the CLI itself, rather than running the tests.
+const runCLIEnv = "LOGSTRUCTURED_RUN_CLI"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runCLIEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// TestShutdown checks that interrupting the CLI in interactive mode, whilst stdin is still open, shuts it down
+// cleanly, by running the test binary as the CLI in a subprocess, leaving every write made before it on disk for the next
+// Open, with the stored hash index matching the file.
+func TestShutdown(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("interrupts can't be sent to another process on Windows")
+	}
+	dir := t.TempDir()
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(dir, "shutdown.db")
+	indexPath := filepath.Join(dir, "shutdown-index.db")
+
+	cmd := exec.Command(exe, "-db-file", dbPath, "-index-file", indexPath, "-interactive")
+	cmd.Env = append(os.Environ(), runCLIEnv+"=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	exited := make(chan error, 1)
+
+	// The value read back last means every command before it has been run.
+	if _, err := io.WriteString(stdin, "set 1 foo\nset 2 bar\ndel 1\nset 3 baz\nget 3\n"); err != nil {
+		cmd.Process.Kill()
+		t.Fatal(err)
+	}
+	ready := make(chan bool, 1)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		found := false
+		for scanner.Scan() {
+			if !found && scanner.Text() == "baz" {
+				found = true
+				ready <- true
+			}
+		}
+		if !found {
+			ready <- false
+		}
+		exited <- cmd.Wait()
+	}()
+	select {
+	case ok := <-ready:
+		if !ok {
+			<-exited
+			t.Fatalf("interactive mode exited before running the commands, stderr %q", stderr.String())
+		}
+	case <-time.After(30 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("interactive mode never ran the commands")
+	}
+
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		cmd.Process.Kill()
+		t.Fatal(err)
+	}
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Fatalf("interactive mode exited with %v after an interrupt, stderr %q", err, stderr.String())
+		}
+	case <-time.After(30 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("interactive mode kept running after an interrupt with stdin still open")
+	}
+	if !strings.Contains(stderr.String(), "Shutting down") {
+		t.Fatalf("got %q on stderr, want it to say it is shutting down", stderr.String())
+	}
+
+	db, err := logstructured.Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatalf("open after an interrupt: %v", err)
+	}
+	defer db.Close()
+	if mismatched, err := logstructured.CheckIndex(db); err != nil || len(mismatched) > 0 {
+		t.Fatalf("index after an interrupt: %q don't match, error %v", mismatched, err)
+	}
+	ctx := context.Background()
+	for id, want := range map[string]string{"2": "bar", "3": "baz"} {
+		if got, err := logstructured.Get(ctx, db, id); err != nil || got != want {
+			t.Fatalf("get %q after an interrupt: got %q and error %v, want %q", id, got, err, want)
+		}
+	}
+	if _, err := logstructured.Get(ctx, db, "1"); !errors.Is(err, logstructured.ErrDeleted) {
+		t.Fatalf("get deleted ID after an interrupt: got error %v, want %v", err, logstructured.ErrDeleted)
+	}
+}
+
+// TestRun checks that the command line only carries out a single operation, rejecting flags with none or more
+// than one as invalid usage, before anything is opened, and that each operation it is given does run.
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+
+	files := []string{"-db-file", filepath.Join(dir, "run.db"), "-index-file", filepath.Join(dir, "run-index.db")}
+	cli := func(args ...string) (string, string, error) {
+		var stdout, stderr bytes.Buffer
+		err := run(append(append([]string(nil), files...), args...), &stdout, &stderr)
+		return stdout.String(), stderr.String(), err
+	}
+
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "no operation given"},
+		{[]string{"-compact=false"}, "no operation given"},
+		{[]string{"-read-only", "-ttl", "1h"}, "no operation given"},
+		{[]string{"-set", "1,foo", "-get", "1"}, "-get and -set can't be used together"},
+		{[]string{"-stats", "-check", "-compact"}, "-check and -compact and -stats can't be used together"},
+		{[]string{"-set", "1"}, "should be in the format '<id>,<string>'"},
+		{[]string{"-get", "1", "2"}, `unexpected argument "2"`},
+		{[]string{"-no-such-flag"}, "flag provided but not defined"},
+	} {
+		_, stderr, err := cli(c.args...)
+		if !errors.Is(err, errUsage) {
+			t.Fatalf("run %q: got error %v, want %v", c.args, err, errUsage)
+		}
+		if !strings.Contains(stderr, c.want) || !strings.Contains(stderr, "Usage of db") {
+			t.Fatalf("run %q: got %q written out, want %q along with the usage", c.args, stderr, c.want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "run.db")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("run: database file exists after only invalid usage, got error %v", err)
+	}
+	if _, _, err := cli("-h"); !errors.Is(err, flag.ErrHelp) {
+		t.Fatalf("run -h: got error %v, want %v", err, flag.ErrHelp)
+	}
+
+	// An operation given alongside flags which only change how it is done still runs.
+	if _, _, err := cli("-set", "1,foo,bar", "-ttl", "1h"); err != nil {
+		t.Fatalf("run -set: %v", err)
+	}
+	stdout, _, err := cli("-get", "1", "-compact=false")
+	if err != nil {
+		t.Fatalf("run -get: %v", err)
+	}
+	if !strings.Contains(stdout, "Value: foo,bar\n") {
+		t.Fatalf("run -get: got %q, want the value %q", stdout, "foo,bar")
+	}
+	if _, _, err := cli("-delete", "1"); err != nil {
+		t.Fatalf("run -delete: %v", err)
+	}
+	if stdout, _, err = cli("-get", "1"); err != nil || !strings.Contains(stdout, "has been deleted") {
+		t.Fatalf("run -get after -delete: got %q and error %v, want it reported as deleted", stdout, err)
+	}
+	if stdout, _, err = cli("-check"); err != nil || !strings.Contains(stdout, "matches the database file") {
+		t.Fatalf("run -check: got %q and error %v, want the index to match", stdout, err)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	logstructured "github.com/jdockerty/log-structured-db-engine"
+)
+
+// dumpIndex writes every ID in the hash index file at path to out, in sorted order, along with the offset of the
+// record it points at, followed by how many entries there are. Only the index file is read, so this works even
+// with the database file missing, which helps when looking into an index which doesn't match its data.
+func dumpIndex(path string, out io.Writer) error {
+	index, err := logstructured.ReadIndexFile(path, logstructured.NewMapIndex)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, index.Len())
+	index.Range(func(id string, _ logstructured.RecordLocation) bool {
+		ids = append(ids, id)
+		return true
+	})
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		loc, _ := index.Get(id)
+		fmt.Fprintf(out, "%q -> %d\n", id, loc.Offset)
+	}
+	fmt.Fprintf(out, "%d entries\n", len(ids))
+	return nil
+}
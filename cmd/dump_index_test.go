@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	logstructured "github.com/jdockerty/log-structured-db-engine"
+)
+
+// TestDumpIndex checks that the index is dumped in sorted order, with entries from both the snapshot and the
+// index log, once the database file has gone.
+func TestDumpIndex(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "dump.db")
+	indexPath := filepath.Join(dir, "dump-index.db")
+	db, err := logstructured.Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := logstructured.Set(ctx, db, "b", "1"); err != nil {
+		db.Close()
+		t.Fatalf("set %q: %v", "b", err)
+	}
+	if err := logstructured.CompactIndex(db); err != nil {
+		db.Close()
+		t.Fatalf("compact index: %v", err)
+	}
+	for _, id := range []string{"c", "a"} {
+		if err := logstructured.Set(ctx, db, id, "1"); err != nil {
+			db.Close()
+			t.Fatalf("set %q: %v", id, err)
+		}
+	}
+
+	// Copy the index file as it is, before Close folds the index log into a snapshot.
+	index, err := os.ReadFile(indexPath)
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(indexPath, index, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(dbPath); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := dumpIndex(indexPath, &out); err != nil {
+		t.Fatalf("dump index: %v", err)
+	}
+	want := "\"a\" -> 85\n\"b\" -> 9\n\"c\" -> 47\n3 entries\n"
+	if out.String() != want {
+		t.Fatalf("dump index: got %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	logstructured "github.com/jdockerty/log-structured-db-engine"
+)
+
+// dumpLog writes every record in the database file to out, in the order they were written, with its offset and
+// sequence number, followed by how many records there are. Unlike -dump-index this includes every overwritten
+// entry and tombstone, which helps when looking into what compaction would keep or drop.
+func dumpLog(db *logstructured.DB, out io.Writer) error {
+	it := logstructured.LogIterator(db)
+	records := 0
+	for it.Next() {
+		records++
+		switch {
+		case it.TxnMarker():
+			fmt.Fprintf(out, "%d: %q\n", it.Offset(), it.Key())
+		case it.Tombstone():
+			fmt.Fprintf(out, "%d: #%d %q deleted\n", it.Offset(), it.Seq(), it.Key())
+		case it.ExpiresAt() != 0:
+			fmt.Fprintf(out, "%d: #%d %q = %q, expires at %d\n", it.Offset(), it.Seq(), it.Key(), it.Value(), it.ExpiresAt())
+		default:
+			fmt.Fprintf(out, "%d: #%d %q = %q\n", it.Offset(), it.Seq(), it.Key(), it.Value())
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%d records\n", records)
+	return nil
+}
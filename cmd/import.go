@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	logstructured "github.com/jdockerty/log-structured-db-engine"
+)
+
+// importFile reads the entries in the file at path and writes them with a single SetBatch, so that the hash index
+// is persisted once for the whole file rather than once per entry. Files ending in .json, .jsonl or .ndjson are
+// read as newline-delimited JSON objects of the form {"id": "1", "value": "foo"}, anything else as CSV with an
+// ID and a value on each line.
+//
+// Rows without both an ID and a value, which can't be parsed at all, or which the database would turn down, see
+// logstructured.CheckEntry, are skipped and counted rather than failing the import. When an ID appears more than
+// once, the last row for it wins, and it is counted as imported once.
+func importFile(db *logstructured.DB, path string) (imported, skipped int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	entries := make(map[string]string)
+	add := func(id, value string) {
+		// A row the database would turn down would fail the whole batch, so it is treated as a malformed row instead.
+		if id == "" || value == "" || logstructured.CheckEntry(db, id, value) != nil {
+			skipped++
+			return
+		}
+		entries[id] = value
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json", ".jsonl", ".ndjson":
+		err = readNDJSON(f, add)
+	default:
+		err = readCSV(f, add)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(entries) == 0 {
+		return 0, skipped, nil
+	}
+	if err := logstructured.SetBatch(db, entries); err != nil {
+		return 0, 0, err
+	}
+	return len(entries), skipped, nil
+}
+
+// readCSV calls add for each row of r, passing empty strings for a row without exactly two fields.
+func readCSV(r io.Reader, add func(id, value string)) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+
+		// A parse error only spoils its own row, the reader carries on from the next one.
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			add("", "")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(row) != 2 {
+			add("", "")
+			continue
+		}
+		add(row[0], row[1])
+	}
+}
+
+// readNDJSON calls add for each line of r, passing empty strings for a line which isn't an object holding a
+// string id and value. Blank lines are ignored.
+func readNDJSON(r io.Reader, add func(id, value string)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var row struct {
+			ID    string `json:"id"`
+			Value string `json:"value"`
+		}
+		if err := json.Unmarshal([]byte(line), &row); err != nil {
+			add("", "")
+			continue
+		}
+		add(row.ID, row.Value)
+	}
+
+	return scanner.Err()
+}
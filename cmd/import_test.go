@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	logstructured "github.com/jdockerty/log-structured-db-engine"
+)
+
+func TestImportFile(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := logstructured.Open(filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Every valid row is written, and those which are missing an ID or a value are skipped.
+	importCSV := filepath.Join(dir, "import.csv")
+	rows := "10,ten\n11,\"eleven, with a comma\"\n12\n,no id\n13,\n"
+	if err := os.WriteFile(importCSV, []byte(rows), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	imported, skipped, err := importFile(db, importCSV)
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if imported != 2 || skipped != 3 {
+		t.Fatalf("import: got %d imported and %d skipped, want %d and %d", imported, skipped, 2, 3)
+	}
+	for id, want := range map[string]string{"10": "ten", "11": "eleven, with a comma"} {
+		if value, err := logstructured.Get(ctx, db, id); err != nil || value != want {
+			t.Fatalf("get %q after import: got %q (error %v), want %q", id, value, err, want)
+		}
+	}
+	for _, id := range []string{"12", "13"} {
+		if _, err := logstructured.Get(ctx, db, id); !errors.Is(err, logstructured.ErrKeyNotFound) {
+			t.Fatalf("get skipped %q after import: got error %v, want %v", id, err, logstructured.ErrKeyNotFound)
+		}
+	}
+}
+
+// TestImportFileChecksRows checks that rows the database would turn down are skipped rather than failing the whole
+// batch, and that an ID appearing on more than one row is counted as imported once, with its last value.
+func TestImportFileChecksRows(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := logstructured.Open(filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.NumericKeys = true
+
+	importJSON := filepath.Join(dir, "import.jsonl")
+	rows := `{"id": "1", "value": "one"}
+{"id": "2", "value": "two"}
+{"id": "1", "value": "uno"}
+{"id": "abc", "value": "not a number"}
+{"id": " ", "value": "blank"}
+{"id": "3", "value": "` + logstructured.Tombstone + `"}
+`
+	if err := os.WriteFile(importJSON, []byte(rows), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	imported, skipped, err := importFile(db, importJSON)
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if imported != 2 || skipped != 3 {
+		t.Fatalf("import: got %d imported and %d skipped, want %d and %d", imported, skipped, 2, 3)
+	}
+	for id, want := range map[string]string{"1": "uno", "2": "two"} {
+		if value, err := logstructured.Get(ctx, db, id); err != nil || value != want {
+			t.Fatalf("get %q after import: got %q (error %v), want %q", id, value, err, want)
+		}
+	}
+	if _, err := logstructured.Get(ctx, db, "3"); !errors.Is(err, logstructured.ErrKeyNotFound) {
+		t.Fatalf("get skipped %q after import: got error %v, want %v", "3", err, logstructured.ErrKeyNotFound)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	logstructured "github.com/jdockerty/log-structured-db-engine"
+)
+
+// printScanProgress returns a ScanProgress which keeps a line on out up to date with how far a full scan of the
+// database file has got, ending the line once the scan reaches the end of the file.
+func printScanProgress(out io.Writer) logstructured.ProgressFunc {
+	return func(scanned, total int64) {
+		fmt.Fprintf(out, "\rScanned %d of %d bytes (%.0f%%)", scanned, total, float64(scanned)*100/float64(total))
+		if scanned >= total {
+			fmt.Fprintln(out)
+		}
+	}
+}
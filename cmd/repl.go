@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	logstructured "github.com/jdockerty/log-structured-db-engine"
+)
+
+const replUsage = "commands are 'get <id>', 'set <id> <value>', 'del <id>', 'keys' and 'quit'"
+
+// runREPL reads commands from in, one per line, and runs each against db until in runs out, 'quit' is read or
+// shutdown is done. Since the database stays open throughout, the hash index is loaded once rather than for every
+// operation. Results are written to out and errors to errOut, a bad command is reported without ending the loop.
+//
+// A command already under way when shutdown is done is finished first, with no more read after it, so that it
+// isn't cut off part way through writing to the database.
+func runREPL(shutdown context.Context, db *logstructured.DB, in io.Reader, out, errOut io.Writer) error {
+	ctx := context.Background()
+
+	// Reading in is left to run on its own, as a read which is waiting on more input can't be stopped. A line read
+	// once shutdown is done is never run.
+	lines := make(chan string)
+	scanErr := make(chan error, 1)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-shutdown.Done():
+				scanErr <- nil
+				return
+			}
+		}
+		scanErr <- scanner.Err()
+	}()
+
+	for {
+		var line string
+		select {
+		case <-shutdown.Done():
+			return nil
+		case l, ok := <-lines:
+			if !ok {
+				return <-scanErr
+			}
+			line = strings.TrimSpace(l)
+		}
+		if line == "" {
+			continue
+		}
+
+		// The value for 'set' is everything after the ID, so it may contain spaces itself.
+		cmd, args, _ := strings.Cut(line, " ")
+		args = strings.TrimSpace(args)
+
+		switch cmd {
+		case "get":
+			if args == "" {
+				fmt.Fprintln(errOut, "usage: get <id>")
+				continue
+			}
+			value, err := logstructured.Get(ctx, db, args)
+			if errors.Is(err, logstructured.ErrDeleted) {
+				fmt.Fprintf(errOut, "ID '%s' has been deleted from the database.\n", args)
+				continue
+			}
+			if errors.Is(err, logstructured.ErrKeyNotFound) {
+				fmt.Fprintf(errOut, "ID '%s' is not contained in the database.\n", args)
+				continue
+			}
+			if err != nil {
+				fmt.Fprintln(errOut, "error:", err)
+				continue
+			}
+			fmt.Fprintln(out, value)
+
+		case "set":
+			id, value, ok := strings.Cut(args, " ")
+			if !ok || id == "" {
+				fmt.Fprintln(errOut, "usage: set <id> <value>")
+				continue
+			}
+			if err := logstructured.Set(ctx, db, id, value); err != nil {
+				fmt.Fprintln(errOut, "error:", err)
+				continue
+			}
+			fmt.Fprintln(out, "OK")
+
+		case "del":
+			if args == "" {
+				fmt.Fprintln(errOut, "usage: del <id>")
+				continue
+			}
+			if err := logstructured.Delete(ctx, db, args); err != nil {
+				fmt.Fprintln(errOut, "error:", err)
+				continue
+			}
+			fmt.Fprintln(out, "OK")
+
+		case "keys":
+			for _, id := range db.Keys() {
+				fmt.Fprintln(out, id)
+			}
+
+		case "quit":
+			return nil
+
+		default:
+			fmt.Fprintf(errOut, "unknown command %q, %s\n", cmd, replUsage)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	logstructured "github.com/jdockerty/log-structured-db-engine"
+)
+
+// TestREPL pipes a script into the REPL, checking what it writes for each command, that bad commands are reported
+// without ending the session, and that nothing after 'quit' is run.
+func TestREPL(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := logstructured.Open(filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	script := strings.Join([]string{
+		"set a hello world",
+		"get a",
+		"bogus",
+		"set b",
+		"",
+		"get missing",
+		"set c 3",
+		"keys",
+		"del a",
+		"get a",
+		"quit",
+		"set d 4",
+	}, "\n")
+	var stdout, stderr bytes.Buffer
+	if err := runREPL(ctx, db, strings.NewReader(script), &stdout, &stderr); err != nil {
+		t.Fatalf("repl: %v", err)
+	}
+
+	if want := "OK\nhello world\nOK\na\nc\nOK\n"; stdout.String() != want {
+		t.Fatalf("repl: got stdout %q, want %q", stdout.String(), want)
+	}
+	errLines := strings.Split(strings.TrimSuffix(stderr.String(), "\n"), "\n")
+	wantErrs := []string{
+		`unknown command "bogus"`,
+		"usage: set <id> <value>",
+		"ID 'missing' is not contained in the database.",
+		"ID 'a' has been deleted from the database.",
+	}
+	if len(errLines) != len(wantErrs) {
+		t.Fatalf("repl: got stderr %q, want a line for each of %q", stderr.String(), wantErrs)
+	}
+	for i, want := range wantErrs {
+		if !strings.HasPrefix(errLines[i], want) {
+			t.Fatalf("repl: got stderr line %q, want it to start with %q", errLines[i], want)
+		}
+	}
+
+	if _, err := logstructured.Get(ctx, db, "d"); !errors.Is(err, logstructured.ErrKeyNotFound) {
+		t.Fatalf("get of a key set after quit: got %v, want %v", err, logstructured.ErrKeyNotFound)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+
+	logstructured "github.com/jdockerty/log-structured-db-engine"
+)
+
+// sortedIndex is a small Index which keeps its entries in a slice sorted by ID, stored as a JSON array. It is
+// used by the self-test to check that the database works the same through an Index other than MapIndex.
+type sortedIndex struct {
+	entries []sortedEntry
+}
+
+type sortedEntry struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+	Length int32  `json:"length"`
+}
+
+func newSortedIndex() logstructured.Index {
+	return &sortedIndex{}
+}
+
+// find returns where id is, or would be, in the entries and whether it is there.
+func (s *sortedIndex) find(id string) (int, bool) {
+	i := sort.Search(len(s.entries), func(i int) bool { return s.entries[i].ID >= id })
+	return i, i < len(s.entries) && s.entries[i].ID == id
+}
+
+func (s *sortedIndex) Get(id string) (logstructured.RecordLocation, bool) {
+	i, ok := s.find(id)
+	if !ok {
+		return logstructured.RecordLocation{}, false
+	}
+	return logstructured.RecordLocation{Offset: s.entries[i].Offset, Length: s.entries[i].Length}, true
+}
+
+func (s *sortedIndex) Put(id string, loc logstructured.RecordLocation) {
+	e := sortedEntry{ID: id, Offset: loc.Offset, Length: loc.Length}
+	i, ok := s.find(id)
+	if ok {
+		s.entries[i] = e
+		return
+	}
+	s.entries = append(s.entries, sortedEntry{})
+	copy(s.entries[i+1:], s.entries[i:])
+	s.entries[i] = e
+}
+
+func (s *sortedIndex) Delete(id string) {
+	if i, ok := s.find(id); ok {
+		s.entries = append(s.entries[:i], s.entries[i+1:]...)
+	}
+}
+
+func (s *sortedIndex) Len() int {
+	return len(s.entries)
+}
+
+func (s *sortedIndex) Range(fn func(id string, loc logstructured.RecordLocation) bool) {
+	for _, e := range s.entries {
+		if !fn(e.ID, logstructured.RecordLocation{Offset: e.Offset, Length: e.Length}) {
+			return
+		}
+	}
+}
+
+func (s *sortedIndex) Persist(w io.Writer) error {
+	entries := s.entries
+	if entries == nil {
+		entries = []sortedEntry{}
+	}
+	return json.NewEncoder(w).Encode(entries)
+}
+
+func (s *sortedIndex) Load(r io.Reader) error {
+	var entries []sortedEntry
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	s.entries = entries
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	logstructured "github.com/jdockerty/log-structured-db-engine"
+)
+
+// TestIndex runs writes, a compaction and a reopen through an Index other than the default MapIndex, which
+// should make no difference to what is read back.
+func TestIndex(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath, indexPath := filepath.Join(dir, "sorted.db"), filepath.Join(dir, "sorted-index.db")
+	db, err := logstructured.OpenWithIndex(dbPath, indexPath, false, newSortedIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kv := range [][2]string{{"b", "1"}, {"a", "2"}, {"c", "3"}, {"b", "4"}} {
+		if err := logstructured.Set(ctx, db, kv[0], kv[1]); err != nil {
+			db.Close()
+			t.Fatalf("set %q with sorted index: %v", kv[0], err)
+		}
+	}
+	if err := logstructured.Delete(ctx, db, "c"); err != nil {
+		db.Close()
+		t.Fatalf("delete %q with sorted index: %v", "c", err)
+	}
+	if err := logstructured.Compact(ctx, db); err != nil {
+		db.Close()
+		t.Fatalf("compact with sorted index: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening loads the snapshot the sorted index persisted, rather than rebuilding it.
+	db, err = logstructured.OpenWithIndex(dbPath, indexPath, false, newSortedIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, ok := db.Hash.(*sortedIndex); !ok {
+		t.Fatalf("reopened database holds a %T, want a sorted index", db.Hash)
+	}
+	for id, expected := range map[string]string{"a": "2", "b": "4"} {
+		if entry, err := logstructured.Get(ctx, db, id); err != nil || entry != expected {
+			t.Fatalf("get %q with sorted index: got %q (error %v), want %q", id, entry, err, expected)
+		}
+	}
+	if _, err := logstructured.Get(ctx, db, "c"); !errors.Is(err, logstructured.ErrKeyNotFound) {
+		t.Fatalf("get compacted away %q with sorted index: got error %v, want %v", "c", err, logstructured.ErrKeyNotFound)
+	}
+	if keys := db.Keys(); len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Fatalf("keys with sorted index: got %v, want [a b]", keys)
+	}
+}
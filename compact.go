@@ -0,0 +1,465 @@
+package logstructured
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Compact rewrites the database file so that it only holds the latest entry for each ID, dropping every entry
+// which has since been overwritten along with any IDs which have been deleted. As the file is append-only, the
+// dead entries would otherwise grow it forever when the same IDs are set repeatedly.
+//
+// The compacted database and its hash index are written to temporary files alongside the originals, which are
+// only replaced once the new files are fully on disk. If the process dies part way through, the original files
+// are left as they were and are still usable.
+//
+// Cancelling ctx stops the compaction part way through copying the file, in which case the temporary files are
+// removed and ctx's error is returned, leaving the originals untouched. Once the new files start being swapped in,
+// the compaction runs to the end regardless. CompactProgress, when set, is told how far the copy has got. Segments
+// of the memtable older than RetentionDuration, when set, are removed afterwards.
+func Compact(ctx context.Context, db *DB) error {
+
+	// Writes must not interleave with the compaction, otherwise they would be lost when the files are swapped.
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return compact(ctx, db)
+}
+
+// compact is Compact without taking the lock, for use whilst it is already held.
+func compact(ctx context.Context, db *DB) error {
+	latest, records, err := latestOffsets(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	dbPath := db.DB.Name()
+	indexPath := db.HashStorage.Name()
+	compactPath := dbPath + ".compact"
+	compactIndexPath := indexPath + ".compact"
+
+	var progress func(processed int)
+	if db.CompactProgress != nil {
+		progress = func(processed int) { db.CompactProgress(processed, records) }
+	}
+
+	hash, err := writeCompacted(ctx, db, compactPath, latest, progress)
+	if err != nil {
+		os.Remove(compactPath)
+		return err
+	}
+
+	if err := writeCompactedIndex(db, compactIndexPath, hash); err != nil {
+		os.Remove(compactPath)
+		os.Remove(compactIndexPath)
+		return err
+	}
+	if err := crash(db, CrashBeforeCompactionSwap); err != nil {
+		return err
+	}
+
+	if err := swapCompacted(db, compactPath, compactIndexPath, hash); err != nil {
+		return err
+	}
+	return removeAgedSegments(db)
+}
+
+// CompactReport is what Compact would do to the database were it run now, see CompactPlan.
+type CompactReport struct {
+	Records        int   // Records in the database file, bar those marking transactions.
+	LiveKeys       int   // Keys whose latest entry compaction would keep, one record each.
+	DeadRecords    int   // Records compaction would drop, which are overwritten, deleted and expired entries.
+	FileSize       int64 // Size of the database file in bytes.
+	RemainingBytes int64 // Size the database file would be after compaction.
+	ReclaimedBytes int64 // Bytes compaction would reclaim, which is FileSize less RemainingBytes.
+}
+
+// CompactPlan works out what Compact would do, without writing anything, before running what can be a long
+// compaction. It goes through the database file in the same way as Compact, so the figures are exactly what a
+// compaction run straight afterwards would keep and drop. Entries which expire in between are dropped by the
+// compaction even so, which makes the file smaller than RemainingBytes.
+//
+// Unlike Stats, which goes by the dead bytes kept up to date as records are written, this reads through the whole
+// file, twice. It can be used on a read-only database.
+func CompactPlan(db *DB) (CompactReport, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return CompactReport{}, ErrClosed
+	}
+
+	latest, records, err := latestOffsets(context.Background(), db)
+	if err != nil {
+		return CompactReport{}, err
+	}
+	size, err := dataSize(db)
+	if err != nil {
+		return CompactReport{}, err
+	}
+
+	// The compacted file is written nowhere, its index says how big it would have been.
+	hash, err := writeLive(context.Background(), db, io.Discard, latest, nil)
+	if err != nil {
+		return CompactReport{}, err
+	}
+	report := CompactReport{Records: records, LiveKeys: hash.Len(), FileSize: size, RemainingBytes: headerSize}
+	hash.Range(func(_ string, loc RecordLocation) bool {
+		report.RemainingBytes += int64(loc.Length)
+		return true
+	})
+	report.DeadRecords = records - report.LiveKeys
+	report.ReclaimedBytes = size - report.RemainingBytes
+	return report, nil
+}
+
+// swapCompacted replaces the database and index files with those written to compactPath and compactIndexPath, for
+// which hash is the index, and carries on with them in place of the originals. The lock must be held.
+func swapCompacted(db *DB, compactPath, compactIndexPath string, hash Index) error {
+	dbPath := db.DB.Name()
+	indexPath := db.HashStorage.Name()
+
+	dbMode, err := copyMode(compactPath, db.DB)
+	if err != nil {
+		os.Remove(compactPath)
+		os.Remove(compactIndexPath)
+		return err
+	}
+	indexMode, err := copyMode(compactIndexPath, db.HashStorage)
+	if err != nil {
+		os.Remove(compactPath)
+		os.Remove(compactIndexPath)
+		return err
+	}
+
+	// Renaming is atomic, so the database file is either the original or the compacted one, never a mixture
+	// of the two. There is a small window between the two renames where the index on disk still refers to the
+	// original file, if we die there the next Open finishes the job, see finishSwap.
+	if err := os.Rename(compactPath, dbPath); err != nil {
+		os.Remove(compactPath)
+		os.Remove(compactIndexPath)
+		return err
+	}
+	if err := crash(db, CrashMidCompactionSwap); err != nil {
+		return err
+	}
+	if err := os.Rename(compactIndexPath, indexPath); err != nil {
+		os.Remove(compactIndexPath)
+		return err
+	}
+	if err := syncDir(filepath.Dir(dbPath)); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(dbPath, os.O_RDWR|os.O_APPEND, dbMode)
+	if err != nil {
+		return err
+	}
+	hashFile, err := os.OpenFile(indexPath, os.O_RDWR|os.O_APPEND, indexMode)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	// The mapping is of the original file, the next read maps the compacted one instead.
+	unmapData(db)
+	db.DB.Close()
+	db.HashStorage.Close()
+	db.DB = f
+	db.writer = nil
+	db.HashStorage = hashFile
+	db.Hash = hash
+	db.baseSeq = db.seq
+	db.indexFormat = db.IndexFormat
+	db.indexLogEntries = 0
+	db.indexLogFailed = false
+	db.dirty = nil
+
+	// The compacted index has already been written, so any pending debounced write of it is no longer needed,
+	// and there are no tombstones left in the file.
+	if db.indexTimer != nil {
+		db.indexTimer.Stop()
+		db.indexTimer = nil
+	}
+	db.deleted = nil
+	db.deadBytes = 0
+
+	// Deleted and expired entries are gone, so are no longer there to be read, even from the cache.
+	db.cache.clear()
+
+	// Expired entries were dropped, along with their expiries and their place in the value index.
+	for id := range db.expiries {
+		if _, ok := hash.Get(id); !ok {
+			delete(db.expiries, id)
+		}
+	}
+	if db.values != nil {
+		for id := range db.values.prefixes {
+			if _, ok := hash.Get(id); !ok {
+				db.values.remove(id)
+				db.values.dirty = true
+			}
+		}
+	}
+
+	return storeValueIndex(db)
+}
+
+// copyMode gives the file at path the same permissions as f, the file it is about to be renamed over, so that
+// replacing a file leaves its permissions as they were rather than as FileMode. It returns the permissions.
+func copyMode(path string, f *os.File) (os.FileMode, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	mode := info.Mode().Perm()
+	return mode, os.Chmod(path, mode)
+}
+
+// maybeCompact starts a compaction in the background if the dead bytes have reached CompactionThreshold, unless
+// one is already under way. It only goes by the dead bytes kept up to date by writes, expired entries, which only
+// become dead with time, aren't counted. The lock must be held.
+func maybeCompact(db *DB) {
+	if db.CompactionThreshold <= 0 || db.compacting || db.deadBytes == 0 {
+		return
+	}
+
+	size, err := dataSize(db)
+	if err != nil || float64(db.deadBytes) < db.CompactionThreshold*float64(size) {
+		return
+	}
+
+	// The compaction waits for the lock, which the write that triggered it is still holding, so that write can
+	// return without waiting for the compaction.
+	db.compacting = true
+	go func() {
+		err := Compact(context.Background(), db)
+
+		db.Lock()
+		defer db.Unlock()
+
+		db.compacting = false
+
+		// The database being closed whilst the compaction was waiting to start isn't a failure of the compaction.
+		if err != nil && err != ErrClosed {
+			db.compactErr = err
+		}
+	}()
+}
+
+// latestOffsets scans the entire database file and returns the offset of the latest entry for each ID, along
+// with how many records there are in all. The scan stops early if ctx is cancelled.
+func latestOffsets(ctx context.Context, db *DB) (map[string]int64, int, error) {
+	latest := make(map[string]int64)
+	records := 0
+
+	err := eachRecord(db, func(offset int64, id, value string, expiresAt int64, seq uint64, writtenAt int64) error {
+		latest[id] = offset
+		records++
+		return ctx.Err()
+	})
+
+	return latest, records, err
+}
+
+// writeCompacted copies the latest live entry for each ID into a new database file at path, see writeLive.
+// It returns the hash index for the new file.
+func writeCompacted(ctx context.Context, db *DB, path string, latest map[string]int64, progress func(processed int)) (Index, error) {
+	out, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, db.fileMode)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	hash, err := writeLive(ctx, db, w, latest, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	// The original file is replaced by this one, so it must be on disk before that happens.
+	if err := out.Sync(); err != nil {
+		return nil, err
+	}
+
+	return hash, nil
+}
+
+// writeLive writes a header followed by the latest live entry for each ID to w, in the same order as they appear
+// in the database file. Entries which have expired are dropped along with deleted ones. It returns the hash index
+// for what was written, as though it were a database file.
+//
+// Writing stops early if ctx is cancelled. progress, if it isn't nil, is called after each record in the database
+// file with how many have been gone through so far, whether or not they were written.
+func writeLive(ctx context.Context, db *DB, w io.Writer, latest map[string]int64, progress func(processed int)) (Index, error) {
+	if err := writeHeader(w, db.seq); err != nil {
+		return nil, err
+	}
+
+	hash := db.newIndex()
+	size := int64(headerSize)
+	processed := 0
+
+	err := eachRecord(db, func(offset int64, id, value string, expiresAt int64, seq uint64, writtenAt int64) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		processed++
+		if progress != nil {
+			defer progress(processed)
+		}
+
+		if latest[id] != offset || value == Tombstone || db.expired(expiresAt) {
+			return nil
+		}
+
+		// Entries keep the sequence number and write time they were first written with, the header carries on
+		// from the latest sequence number.
+		n, err := w.Write(encodeRecord(id, value, expiresAt, seq, writtenAt))
+		hash.Put(id, newRecordLocation(size, n))
+		size += int64(n)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hash, nil
+}
+
+// writeCompactedIndex stores a snapshot of hash in a new index file at path, in the database's IndexFormat, with nothing
+// in its index log.
+func writeCompactedIndex(db *DB, path string, hash Index) error {
+	out, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, db.fileMode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := writeIndexSnapshot(out, hash, db.IndexFormat); err != nil {
+		return err
+	}
+
+	return out.Sync()
+}
+
+// eachRecord calls fn with every record in the database file, in order, along with the byte offset it starts at.
+// An error from fn stops the walk and is returned.
+//
+// The records written by a transaction are held back until its commit marker is reached, so those of one which was
+// never committed are left out. The markers themselves aren't passed to fn.
+func eachRecord(db *DB, fn func(offset int64, id, value string, expiresAt int64, seq uint64, writtenAt int64) error) error {
+	if err := flushWrites(db); err != nil {
+		return err
+	}
+
+	info, err := db.DB.Stat()
+	if err != nil {
+		return err
+	}
+
+	type heldRecord struct {
+		offset    int64
+		id, value string
+		expiresAt int64
+		seq       uint64
+		writtenAt int64
+	}
+	var held []heldRecord
+	inTxn := false
+
+	r := bufio.NewReader(io.NewSectionReader(db.DB, headerSize, info.Size()-headerSize))
+	offset := int64(headerSize)
+	for {
+		id, value, expiresAt, seq, writtenAt, err := decodeRecord(r)
+
+		// A final record which has been cut short was only partly written, so it isn't included.
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return corruptAt(err, offset)
+		}
+
+		switch {
+		case id == txnBeginKey:
+			inTxn = true
+			held = held[:0]
+		case id == txnCommitKey:
+			for _, h := range held {
+				if err := fn(h.offset, h.id, h.value, h.expiresAt, h.seq, h.writtenAt); err != nil {
+					return err
+				}
+			}
+			inTxn = false
+			held = held[:0]
+		case inTxn:
+			held = append(held, heldRecord{offset: offset, id: id, value: value, expiresAt: expiresAt, seq: seq, writtenAt: writtenAt})
+		default:
+			if err := fn(offset, id, value, expiresAt, seq, writtenAt); err != nil {
+				return err
+			}
+		}
+		offset += recordSize(id, value)
+	}
+}
+
+// finishSwap puts right a compaction, or a new snapshot of the index, which was part way through replacing the files
+// when the process died. If the compacted database file is still there, it never replaced the original, so it is
+// removed along with its index, if that was written. Otherwise a new index file left behind belongs to the database
+// file as it is now, either as it was compacted or as the snapshot was taken of it, so it replaces the index file.
+// Which of the two was done is logged to logger, see DB.Logger.
+func finishSwap(dbPath, indexPath string, logger *log.Logger) error {
+	compactPath := dbPath + ".compact"
+	compactIndexPath := indexPath + ".compact"
+
+	if _, err := os.Stat(compactPath); err == nil {
+		logf(logger, "Discarding a compaction which was never swapped in.")
+		if err := os.Remove(compactPath); err != nil {
+			return err
+		}
+		if err := os.Remove(compactIndexPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if _, err := os.Stat(compactIndexPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	logf(logger, "Swapping in the index file left behind by an unfinished compaction or index snapshot.")
+	if err := os.Rename(compactIndexPath, indexPath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(indexPath))
+}
+
+// syncDir flushes the directory at path to disk, which makes renames of the files within it durable.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,286 @@
+package logstructured
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenDiscardsUnfinishedCompaction(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, indexPath := filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db")
+
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Set(context.Background(), db, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A compacted file which is still alongside the original was never swapped in.
+	if err := os.WriteFile(dbPath+".compact", []byte("unfinished"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var logged bytes.Buffer
+	db, err = OpenWithOptions(dbPath, indexPath, Options{Logger: log.New(&logged, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if !strings.Contains(logged.String(), "Discarding a compaction which was never swapped in.") {
+		t.Fatalf("logged %q, want the compaction discarded", logged.String())
+	}
+	if _, err := os.Stat(dbPath + ".compact"); !os.IsNotExist(err) {
+		t.Fatalf("the unfinished compaction is still there: %v", err)
+	}
+	if value, err := Get(context.Background(), db, "a"); err != nil || value != "1" {
+		t.Fatalf("get %q: got %q (error %v), want %q", "a", value, err, "1")
+	}
+}
+
+// TestCompactPlan checks that a compaction plan leaves the database as it was, and that what it says would be
+// reclaimed is exactly what compacting straight afterwards reclaims.
+func TestCompactPlan(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	db, err := Open(filepath.Join(dir, "plan.db"), filepath.Join(dir, "plan-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+	now := time.Unix(1700000000, 0)
+	db.Clock = func() time.Time { return now }
+
+	// Overwrites, deletes, an entry which expires and a transaction's markers are all dropped by compaction.
+	for i := 0; i < 20; i++ {
+		if err := Set(ctx, db, strconv.Itoa(i), strings.Repeat("v", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if err := Set(ctx, db, strconv.Itoa(i), "overwritten"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"15", "16", "17"} {
+		if err := Delete(ctx, db, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := SetWithTTL(ctx, db, "expiring", "soon", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	var txn Transaction
+	txn.Set("18", "in a transaction")
+	if err := txn.Commit(db); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Hour)
+
+	before, err := db.OnDiskBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := db.LastSeq()
+	plan, err := CompactPlan(db)
+	if err != nil {
+		t.Fatalf("compact plan: %v", err)
+	}
+	if after, err := db.OnDiskBytes(); err != nil || after != before || db.LastSeq() != seq {
+		t.Fatalf("compact plan: changed the database, %d bytes and sequence %d became %d and %d, error %v", before, seq, after, db.LastSeq(), err)
+	}
+
+	// 20 sets, 10 overwrites, 3 deletes, 1 expired set and 1 overwrite in a transaction, leaving 17 keys.
+	if plan.Records != 35 || plan.LiveKeys != 17 || plan.DeadRecords != 18 {
+		t.Fatalf("compact plan: got %d records, %d live keys and %d dead records, want 35, 17 and 18", plan.Records, plan.LiveKeys, plan.DeadRecords)
+	}
+	if plan.FileSize != before || plan.RemainingBytes+plan.ReclaimedBytes != plan.FileSize || plan.ReclaimedBytes <= 0 {
+		t.Fatalf("compact plan: got %d bytes less %d reclaimed leaving %d, want them to add up to the file's %d", plan.FileSize, plan.ReclaimedBytes, plan.RemainingBytes, before)
+	}
+
+	if err := Compact(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	after, err := db.OnDiskBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after != plan.RemainingBytes || before-after != plan.ReclaimedBytes {
+		t.Fatalf("compact plan: compaction took %d bytes to %d, reclaiming %d, but the plan said %d would be left and %d reclaimed", before, after, before-after, plan.RemainingBytes, plan.ReclaimedBytes)
+	}
+	if db.Len() != plan.LiveKeys {
+		t.Fatalf("compact plan: %d live keys after compacting, plan said %d", db.Len(), plan.LiveKeys)
+	}
+}
+
+// TestCompact checks that a compaction cancelled part way through leaves the database exactly as it was, and that
+// one which finishes keeps only the latest entry for each ID, reclaiming exactly the dead bytes reported beforehand.
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, kv := range []KV{{"1", "foo"}, {"2", "bar"}, {"1", "baz"}, {"3", "qux"}} {
+		if err := Set(ctx, db, kv.Key, kv.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Delete(ctx, db, "3"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"1": "baz", "2": "bar"}
+	check := func(stage string) {
+		for id, value := range want {
+			if got, err := Get(ctx, db, id); err != nil || got != value {
+				t.Fatalf("get %q after %s: got %q (error %v), want %q", id, stage, got, err, value)
+			}
+		}
+	}
+
+	before, err := db.DB.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbStats, err := Stats(db)
+	if err != nil {
+		t.Fatalf("stats: %v", err)
+	}
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	db.CompactProgress = func(processed, total int) {
+		if processed == 1 {
+			cancel()
+		}
+	}
+	if err := Compact(cancelCtx, db); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled compact: got error %v, want %v", err, context.Canceled)
+	}
+	if cancelled, err := db.DB.Stat(); err != nil || cancelled.Size() != before.Size() {
+		t.Fatalf("cancelled compact changed the database from %d bytes (error %v)", before.Size(), err)
+	}
+	if leftover, _ := filepath.Glob(filepath.Join(dir, "*.compact")); len(leftover) != 0 {
+		t.Fatalf("cancelled compact left behind %v", leftover)
+	}
+	check("a cancelled compact")
+
+	var processed, total int
+	db.CompactProgress = func(p, n int) { processed, total = p, n }
+	if err := Compact(ctx, db); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if processed == 0 || processed != total {
+		t.Fatalf("compact progress ended at %d of %d records", processed, total)
+	}
+	after, err := db.DB.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed := before.Size() - after.Size(); reclaimed != dbStats.DeadBytes {
+		t.Fatalf("compaction reclaimed %d bytes, but %d were reported as dead", reclaimed, dbStats.DeadBytes)
+	}
+	check("compaction")
+	if n := db.Len(); n != len(want) {
+		t.Fatalf("len after compaction: got %d, want %d", n, len(want))
+	}
+}
+
+// TestCompactionThreshold overwrites the same keys until the dead bytes pass the threshold, checking that the
+// database file is then compacted by itself, without Compact being called, and keeps the latest value of each key.
+func TestCompactionThreshold(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.CompactionThreshold = 0.5
+
+	// The background compaction clears compacting once it is done, under the lock, so taking the lock until it is
+	// clear waits for it without guessing at how long it takes.
+	waitForCompaction := func() {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			db.Lock()
+			compacting := db.compacting
+			db.Unlock()
+			if !compacting {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("the background compaction didn't finish")
+			}
+			runtime.Gosched()
+		}
+	}
+	fileSize := func() int64 {
+		t.Helper()
+		db.RLock()
+		defer db.RUnlock()
+		info, err := db.DB.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+
+	const keys, rounds = 10, 50
+	value := strings.Repeat("v", 100)
+	for i := 0; i < keys; i++ {
+		if err := Set(ctx, db, strconv.Itoa(i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForCompaction()
+	live := fileSize()
+	if stats, err := Stats(db); err != nil || stats.DeadBytes != 0 {
+		t.Fatalf("stats before any overwrite: got %+v (error %v), want no dead bytes", stats, err)
+	}
+
+	var written int64
+	for round := 0; round < rounds; round++ {
+		for i := 0; i < keys; i++ {
+			v := value + strconv.Itoa(round)
+			if err := Set(ctx, db, strconv.Itoa(i), v); err != nil {
+				t.Fatal(err)
+			}
+			written += int64(recordOverhead + len(strconv.Itoa(i)) + len(v))
+		}
+	}
+	waitForCompaction()
+
+	// Without compaction the file would hold every write, with it, the dead bytes stay under half of it.
+	if size := fileSize(); size >= 3*live || size >= written {
+		t.Fatalf("file is %d bytes after %d bytes of overwrites of %d live bytes, want it compacted", size, written, live)
+	}
+	for i := 0; i < keys; i++ {
+		want := value + strconv.Itoa(rounds-1)
+		if got, err := Get(ctx, db, strconv.Itoa(i)); err != nil || got != want {
+			t.Fatalf("get %d after compaction: got %q (error %v), want %q", i, got, err, want)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v, want the background compactions to have succeeded", err)
+	}
+}
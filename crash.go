@@ -0,0 +1,90 @@
+package logstructured
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CrashPoint is a place part way through a write where the database can be made to crash, see DB.CrashPoint. This
+// is for testing that the database recovers from the process dying at any of them, which otherwise only happens by
+// chance.
+type CrashPoint int
+
+const (
+	// CrashNever, the zero value, never crashes.
+	CrashNever CrashPoint = iota
+
+	// CrashTornWrite crashes having appended only the first half of a write to the database file, as when the
+	// process dies part way through the write.
+	CrashTornWrite
+
+	// CrashAfterWrite crashes once a write is in the database file, before the hash index has been told of it.
+	CrashAfterWrite
+
+	// CrashAfterIndexLog crashes once the entries for a write have been appended to the index log.
+	CrashAfterIndexLog
+
+	// CrashTornIndexLog crashes having appended only the first half of a write's entries to the index log.
+	CrashTornIndexLog
+
+	// CrashBeforeIndexSwap crashes once a new snapshot of the index has been written next to the index file,
+	// before it has replaced it.
+	CrashBeforeIndexSwap
+
+	// CrashBeforeCompactionSwap crashes once compaction has written the new database and index files, before
+	// either has replaced the original.
+	CrashBeforeCompactionSwap
+
+	// CrashMidCompactionSwap crashes once compaction has replaced the database file, before the index file, which
+	// still points into the original.
+	CrashMidCompactionSwap
+)
+
+func (p CrashPoint) String() string {
+	switch p {
+	case CrashNever:
+		return "never"
+	case CrashTornWrite:
+		return "torn write"
+	case CrashAfterWrite:
+		return "after write"
+	case CrashAfterIndexLog:
+		return "after index log"
+	case CrashTornIndexLog:
+		return "torn index log"
+	case CrashBeforeIndexSwap:
+		return "before index swap"
+	case CrashBeforeCompactionSwap:
+		return "before compaction swap"
+	case CrashMidCompactionSwap:
+		return "mid compaction swap"
+	}
+	return fmt.Sprintf("CrashPoint(%d)", int(p))
+}
+
+// ErrCrashed is returned by the write which reached the DB's CrashPoint, after which the database is closed.
+var ErrCrashed = errors.New("simulated crash")
+
+// crash simulates the process dying at point, if it is the CrashPoint, by closing the files as they are, without
+// flushing the write buffer or writing anything more to the index, and returning ErrCrashed. Whatever made it into
+// the files stays there, as it would in the page cache of a process which died, although not of a machine which
+// lost power. The database is closed, so it has to be opened again to recover. The lock must be held.
+func crash(db *DB, point CrashPoint) error {
+	if point == CrashNever || db.CrashPoint != point {
+		return nil
+	}
+
+	db.closed = true
+	if db.syncTimer != nil {
+		db.syncTimer.Stop()
+		db.syncTimer = nil
+	}
+	if db.indexTimer != nil {
+		db.indexTimer.Stop()
+		db.indexTimer = nil
+	}
+	db.writer = nil
+	db.closeFiles(nil)
+
+	return fmt.Errorf("%w %s", ErrCrashed, point)
+}
@@ -0,0 +1,212 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestCrashRecovery crashes a database at each of its crash points in turn, then opens it again and checks that
+// every entry written before the crash is still there, that the crashed write either happened in full or not at all,
+// and that the hash index agrees with the database file, so never points at a record which isn't fully on disk.
+func TestCrashRecovery(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	setA := func(db *DB) error { return Set(ctx, db, "a", "new") }
+	cases := []struct {
+		name  string
+		point CrashPoint
+		setup func(db *DB)
+		crash func(db *DB) error
+		keys  []string // Written by crash, and so either still as they were or as they were written.
+	}{
+		{name: "torn set", point: CrashTornWrite, crash: setA, keys: []string{"a"}},
+		{name: "set", point: CrashAfterWrite, crash: setA, keys: []string{"a"}},
+		{name: "set logged", point: CrashAfterIndexLog, crash: setA, keys: []string{"a"}},
+		{name: "torn index log", point: CrashTornIndexLog, crash: setA, keys: []string{"a"}},
+		{
+			name:  "buffered set logged",
+			point: CrashAfterIndexLog,
+			setup: func(db *DB) { db.WriteBufferSize = 4096 },
+			crash: setA,
+			keys:  []string{"a"},
+		},
+		{
+			name:  "debounced set",
+			point: CrashAfterWrite,
+			setup: func(db *DB) { db.IndexDebounce = time.Hour },
+			crash: func(db *DB) error {
+				if err := Set(ctx, db, "d", "new"); err != nil {
+					return err
+				}
+				return setA(db)
+			},
+			keys: []string{"a", "d"},
+		},
+		{
+			name:  "set with flush interval",
+			point: CrashAfterWrite,
+			setup: func(db *DB) { db.IndexFlushInterval = time.Hour },
+			crash: func(db *DB) error {
+				if err := Set(ctx, db, "d", "new"); err != nil {
+					return err
+				}
+				return setA(db)
+			},
+			keys: []string{"a", "d"},
+		},
+		{
+			name:  "batch",
+			point: CrashAfterWrite,
+			crash: func(db *DB) error {
+				return SetBatch(db, map[string]string{"a": "new", "d": "new"})
+			},
+			keys: []string{"a", "d"},
+		},
+		{
+			name:  "torn batch index log",
+			point: CrashTornIndexLog,
+			crash: func(db *DB) error {
+				return SetBatch(db, map[string]string{"a": "new", "b": "new", "d": "new"})
+			},
+			keys: []string{"a", "b", "d"},
+		},
+		{
+			name:  "torn transaction",
+			point: CrashTornWrite,
+			crash: func(db *DB) error {
+				var txn Transaction
+				txn.Set("a", "new")
+				txn.Set("d", "new")
+				return txn.Commit(db)
+			},
+			keys: []string{"a", "d"},
+		},
+		{
+			name:  "transaction",
+			point: CrashAfterWrite,
+			crash: func(db *DB) error {
+				var txn Transaction
+				txn.Set("a", "new")
+				txn.Set("d", "new")
+				return txn.Commit(db)
+			},
+			keys: []string{"a", "d"},
+		},
+		{name: "index snapshot", point: CrashBeforeIndexSwap, crash: CompactIndex},
+		{
+			name:  "compaction",
+			point: CrashBeforeCompactionSwap,
+			crash: func(db *DB) error { return Compact(ctx, db) },
+		},
+		{
+			name:  "compaction swap",
+			point: CrashMidCompactionSwap,
+			crash: func(db *DB) error { return Compact(ctx, db) },
+		},
+	}
+
+	// An empty string stands for an ID with no live value.
+	value := func(db *DB, id string) (string, error) {
+		v, err := Get(ctx, db, id)
+		if errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrDeleted) {
+			return "", nil
+		}
+		return v, err
+	}
+
+	for i, c := range cases {
+		dbPath := filepath.Join(dir, fmt.Sprintf("crash-%d.db", i))
+		indexPath := filepath.Join(dir, fmt.Sprintf("crash-%d-index.db", i))
+
+		// Leave some dead records behind, so that compaction has something to drop.
+		want := map[string]string{"a": "1", "b": "2", "c": "", "d": ""}
+		db, err := Open(dbPath, indexPath, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range [][2]string{{"a", "0"}, {"b", "2"}, {"c", "3"}, {"a", "1"}} {
+			if err := Set(ctx, db, w[0], w[1]); err != nil {
+				db.Close()
+				t.Fatalf("%s: set %q: %v", c.name, w[0], err)
+			}
+		}
+		if err := Delete(ctx, db, "c"); err != nil {
+			db.Close()
+			t.Fatalf("%s: delete %q: %v", c.name, "c", err)
+		}
+
+		if c.setup != nil {
+			c.setup(db)
+		}
+		db.CrashPoint = c.point
+		if err := c.crash(db); !errors.Is(err, ErrCrashed) {
+			db.Close()
+			t.Fatalf("%s: crash: got %v, want %v", c.name, err, ErrCrashed)
+		}
+
+		db, err = Open(dbPath, indexPath, false)
+		if err != nil {
+			t.Fatalf("%s: open after crash: %v", c.name, err)
+		}
+		if mismatched, err := CheckIndex(db); err != nil || len(mismatched) > 0 {
+			db.Close()
+			t.Fatalf("%s: index doesn't match the database file for %v (%v)", c.name, mismatched, err)
+		}
+		if corrupt, err := Verify(db); err != nil || len(corrupt) > 0 {
+			db.Close()
+			t.Fatalf("%s: corrupt records at %v (%v)", c.name, corrupt, err)
+		}
+
+		crashed := make(map[string]bool)
+		for _, id := range c.keys {
+			crashed[id] = true
+		}
+		for _, id := range []string{"a", "b", "c", "d"} {
+			indexed, err := value(db, id)
+			if err != nil {
+				db.Close()
+				t.Fatalf("%s: get %q: %v", c.name, id, err)
+			}
+
+			// The index must lead to the same latest record as reading through the whole file does.
+			db.HashDisabled = true
+			scanned, err := value(db, id)
+			db.HashDisabled = false
+			if err != nil {
+				db.Close()
+				t.Fatalf("%s: scan for %q: %v", c.name, id, err)
+			}
+			if indexed != scanned {
+				db.Close()
+				t.Fatalf("%s: %q is %q through the index but %q in the file", c.name, id, indexed, scanned)
+			}
+			if indexed != want[id] && !(crashed[id] && indexed == "new") {
+				db.Close()
+				t.Fatalf("%s: %q is %q, want %q", c.name, id, indexed, want[id])
+			}
+		}
+
+		// Recovery has to leave the database fit to carry on with, and to open again afterwards.
+		if err := Set(ctx, db, "e", "5"); err != nil {
+			db.Close()
+			t.Fatalf("%s: set after crash: %v", c.name, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("%s: close after crash: %v", c.name, err)
+		}
+		db, err = Open(dbPath, indexPath, false)
+		if err != nil {
+			t.Fatalf("%s: open again: %v", c.name, err)
+		}
+		v, err := Get(ctx, db, "e")
+		db.Close()
+		if err != nil || v != "5" {
+			t.Fatalf("%s: get %q after opening again: got %q, %v", c.name, "e", v, err)
+		}
+	}
+}
@@ -2,56 +2,774 @@ package logstructured
 
 import (
 	"bufio"
-	"encoding/json"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"log"
 	"os"
-	"strings"
+	"path/filepath"
 	"sync"
+	"time"
 )
 
+// Tombstone is the value written by Delete to mark that an ID has been deleted. Since it is a reserved value,
+// it cannot be written by Set.
+const Tombstone = "<TOMBSTONE>"
+
+// ErrDeleted is returned by Get when the latest entry for an ID is a tombstone, meaning that it has been deleted.
+// This lets callers tell a deleted ID apart from one that never existed, which returns ErrKeyNotFound.
+var ErrDeleted = errors.New("key has been deleted")
+
+// ErrKeyNotFound is returned by Get when there is no entry at all for an ID.
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrClosed is returned when using a database which has been closed.
+var ErrClosed = errors.New("database is closed")
+
+// ErrKeyLimitReached is returned by Set when writing a new key would take the database beyond MaxKeys.
+var ErrKeyLimitReached = errors.New("key limit reached")
+
+// ErrValueTooLarge is returned by Set when the value is longer than MaxValueBytes.
+var ErrValueTooLarge = errors.New("value too large")
+
+// ErrInvalidKey is returned when writing an ID which can't be written, such as an empty one, see Set.
+var ErrInvalidKey = errors.New("invalid key")
+
+// ErrInvalidValue is returned when writing a value which can't be written, which is only the Tombstone.
+var ErrInvalidValue = errors.New("invalid value")
+
+// ErrReadOnly is returned when writing to a database opened with OpenReadOnly.
+var ErrReadOnly = errors.New("database is read-only")
+
+// ErrIndexDataMismatch is returned when the hash index points at a record running past the end of the database
+// file, as when the file has been cut short, by a partial restore for instance, underneath an index which outlived
+// it. Open rebuilds an index like this from the file, so it is only seen once the file changes whilst open.
+var ErrIndexDataMismatch = errors.New("hash index doesn't match the database file")
+
+// ProgressFunc is told how far a full scan of the database file has got, see DB.ScanProgress.
+type ProgressFunc func(bytesScanned, totalBytes int64)
+
 type DB struct {
-	DB           *os.File         // Database file written to disk
-	Hash         map[string]int64 // Hash index for fast lookups to the byte offset of the string value.
-	HashDisabled bool             // Force a full scan, no use of the Hash index
-	HashStorage  *os.File         // Hash index file, this is written to disk for persistence and durability between crashes etc. It can simply be loaded again on startup.
-	sync.Mutex                    // Simple lock for writes to ensure safer concurrency.
+	DB           *os.File // Database file written to disk
+	Hash         Index    // Hash index for fast lookups to the byte offset and length of the record.
+	HashDisabled bool     // Force a full scan, no use of the Hash index
+	HashStorage  *os.File // Hash index file, this is written to disk for persistence and durability between crashes etc. It can simply be loaded again on startup.
+	sync.RWMutex          // Writes take the lock exclusively, whereas reads can share it with each other.
+
+	newIndex func() Index // Makes an empty Index of the kind held in Hash, for when it is built afresh.
+
+	// Overwrite the existing record for an id when the new value is exactly the same length, rather than appending.
+	// This departs from append-only: the previous value is destroyed, so a crash part way through the overwrite
+	// can leave a torn record with no older copy in the log to fall back on.
+	AllowInPlaceUpdate bool
+
+	// The maximum number of distinct keys the database will hold, zero means there's no limit. Once reached,
+	// writes for new keys are rejected, although existing keys can still be updated. Keys which have been deleted or
+	// have expired don't count, as with Len.
+	MaxKeys int
+
+	// The most bytes the database file, appends still in the write buffer included, can take up, zero means there's
+	// no limit. A write which would take it beyond that returns ErrQuotaExceeded, having first
+	// compacted the database if the dead bytes say that would make enough room. Deletes are always let through, as
+	// deleting and then compacting is how room is made. An in-place update doesn't grow the file, so is let through
+	// as well.
+	MaxTotalBytes int64
+
+	// The longest value, in bytes, which can be written, zero means there's no limit. Every read of a record holds
+	// its whole value in memory, which this bounds for anything written since it was set.
+	MaxValueBytes int
+
+	// Validator, when set, is called with every entry before it is written, by Set and every other write of a
+	// value, such as SetBatch or a Transaction. An error from it is returned as it is, with nothing written, so that
+	// values which don't fit a schema, such as those which aren't valid JSON, never reach the file. Writes which
+	// write more than one entry write none of them if any is turned down. It is called with the lock held, so it
+	// must not use the database itself. Deletes aren't passed to it.
+	Validator func(key, value string) error
+
+	// Treat IDs as 64-bit integers, with Set rejecting any ID which isn't one. Scan, Iterator and Keys then go by
+	// numeric order, so that "9" comes before "10", rather than the usual string order.
+	NumericKeys bool
+
+	// Order IDs by KeyComparator, rather than the usual string order, for Scan, Iterator and Keys, including the
+	// bounds of a Scan. It returns a negative number if a comes before b, a positive one if it comes after and zero
+	// if they are the same, and must be a total order, consistent from one call to the next, or scans may leave out
+	// or repeat keys. With NumericKeys as well, this decides the order and NumericKeys only checks the IDs written.
+	KeyComparator func(a, b string) int
+
+	// Run full scans backwards from the end of the file, stopping at the latest entry for the ID, so that recently
+	// written keys are found without decoding the whole file. Records can't be read backwards, so the file is split
+	// into ranges by hopping along the lengths of its records from the first, as for ScanWorkers, and the ranges are
+	// read from the last. A file too small to split falls back to a forward scan, as without this. This takes
+	// precedence over ScanWorkers.
+	ScanFromEnd bool
+
+	// Split full scans of the file between up to this many workers, each reading its own part of the file at the
+	// same time, which suits large files on storage that serves reads in parallel. Finding where to split the file
+	// takes a pass over the lengths of its records, so this only pays off when decoding them is the bottleneck.
+	// Each worker is given at least a megabyte of the file. Zero or one, the default, scans with a single reader.
+	ScanWorkers int
+
+	// Called during a full scan of the file by Get, such as with HashDisabled set, with how far through the file the
+	// scan has got, as the number of bytes behind it, and the size of the file. It is called every scanCheckInterval
+	// records and once more on reaching the end, so bytesScanned only ever goes up and ends on totalBytes. It is
+	// called with the lock held, so it must not use the database itself, although it is never called from more
+	// than one goroutine at a time, ScanWorkers or not.
+	ScanProgress ProgressFunc
+
+	// Debounce writes of the hash index to disk. Rather than persisting the index on every write, the entries of
+	// the IDs written are logged together once there have been no writes for IndexDebounce, with each new write
+	// pushing this back. IndexMaxDelay bounds how long a burst of writes can keep pushing it back for, zero means
+	// there is no bound. Any pending write of the index happens on Close, but a crash in the meantime loses the
+	// index updates since the last one.
+	IndexDebounce time.Duration
+	IndexMaxDelay time.Duration
+
+	// Write the hash index to disk at most once every IndexFlushInterval, which suits bursts of writes better than
+	// IndexDebounce, as a steady stream of writes never holds it back. The entries of the IDs written since the
+	// last write of the index are logged together once the interval since the first of them is up, whilst reads see
+	// every write straight away. This takes the place of IndexDebounce and IndexMaxDelay when set. As with them,
+	// Close and Compact write any pending entries, but a crash loses up to IndexFlushInterval of index updates,
+	// which Open finds again from the records past the end of the index, as the database file is what counts.
+	IndexFlushInterval time.Duration
+
+	// How the hash index is stored on disk, see IndexFormat, the zero value is IndexFormatJSON. Whichever format an
+	// existing index file is in is detected when it is loaded. It is converted to this format the next time the
+	// index is written, so this can be set straight after Open, or CompactIndex called to convert it at once.
+	IndexFormat IndexFormat
+
+	indexFormat       IndexFormat // Format the index file is stored in at the moment.
+	indexTimer        *time.Timer // Pending debounced write of the index, nil when there is nothing to write.
+	indexPendingSince time.Time   // When the first write that hasn't been persisted to the index happened.
+	indexErr          error       // Error from the last debounced write of the index, reported on the next write.
+	indexLogEntries   int         // Entries appended to the index log since the last snapshot of the index.
+	indexLogFailed    bool        // Whether an append to the index log failed, possibly part way through an entry.
+
+	// IDs written whose hash index entries are still to be logged by a debounced write of the index.
+	dirty map[string]bool
+
+	// When appends to the database file are flushed to disk, see SyncPolicy. The zero value is SyncNever.
+	SyncPolicy SyncPolicy
+
+	syncTimer *time.Timer // Pending background sync of the database file, nil when there is nothing to sync.
+	syncErr   error       // Error from the last background sync, reported on the next write.
+
+	closed   bool        // Whether Close has been called, after which the files are no longer usable.
+	readOnly bool        // Whether the database was opened with OpenReadOnly, or is legacy, so nothing can be written.
+	lock     *os.File    // Lock file keeping other writers out until Close, see lockDatabase. Nil when read-only.
+	tempDir  string      // Directory made by OpenMemory or openLegacy for the files, which goes along with them once closed.
+	fileMode os.FileMode // Permissions new files are created with, see Options.FileMode.
+	seq      uint64      // Sequence number of the latest write, see LastSeq.
+	baseSeq  uint64      // Sequence number in the header of the database file, see writeHeader.
+
+	// The files of a legacy database, which is read from a copy of them in tempDir until Upgrade, see openLegacy.
+	// Nil for any other database.
+	legacy *legacyFiles
+
+	// Clock gives the current time, which is stored with each record as it is written, see ScanTimeRange, and tells
+	// whether entries have expired. Nil, the default, uses time.Now. Setting it lets tests control time.
+	Clock func() time.Time
+
+	// Logger is told of what the database does by itself, such as rebuilding an index which can't be used, or
+	// falling back to a full scan. Nil, the default, says nothing. It is set from Options.Logger when the database is
+	// opened, so that what is done whilst opening it is logged as well.
+	Logger *log.Logger
+
+	// Hold up to WriteBufferSize bytes of appends in memory before writing them to the database file, so that a
+	// burst of small writes costs a single write to the file rather than one each. Reads flush the buffer first,
+	// so they always see every write. Appends still in the buffer are lost if the process dies, whatever the
+	// SyncPolicy. Zero, the default, writes each append to the file straight away.
+	WriteBufferSize int
+
+	writer   *bufio.Writer // Buffer of appends not yet written to the file, nil when not buffering.
+	writerMu sync.Mutex    // Guards flushing writer, which reads do whilst only holding the read lock.
+
+	// IDs whose latest entry, which the hash index points to, is a tombstone. This is found when the stored
+	// hash index is loaded by Open and kept up to date by writes.
+	deleted map[string]bool
+
+	// Expiry of the latest entry for each ID which was written with a TTL, found and kept up to date in the same
+	// way as deleted.
+	expiries map[string]int64
+
+	// Bytes taken up by records in the database file which compaction would drop, as they have since been
+	// overwritten or are tombstones. Expired records are left out, as they only become dead with time.
+	deadBytes int64
+
+	// Compact automatically, in the background, once the dead bytes make up at least this fraction of the database
+	// file. Zero, the default, turns this off. Writes carry on as usual whilst the compaction is waiting to start,
+	// and then wait for it to finish, as with any other compaction.
+	CompactionThreshold float64
+
+	// Called by Compact as it copies the database file, with how many of its records have been gone through so far
+	// and how many there are in all. It is called with the lock held, so it must not use the database itself.
+	CompactProgress func(processed, total int)
+
+	compacting bool  // Whether an automatic compaction has been started and not yet finished.
+	compactErr error // Error from the last automatic compaction, reported by Close.
+
+	// Read records through a memory mapping of the database file, rather than with a syscall for each read, which
+	// suits read-heavy workloads. The mapping is extended whenever a read finds that the file has grown past it.
+	// Where memory mapping isn't supported, or fails, reads fall back to ReadAt.
+	MmapReads bool
+
+	mapping    []byte       // Memory mapping of the database file, nil until the first read with MmapReads set.
+	mappingMu  sync.RWMutex // Guards the mapping, which reads extend whilst only holding the read lock.
+	mmapFailed bool         // Whether mapping the file has failed, after which reads no longer try it.
+
+	// Hold recent writes in a memtable, sorted by key, which Get answers from before reading the database file.
+	// Once the memtable holds at least MemtableSize bytes of records, it is flushed to a sorted segment file next
+	// to the database file and emptied, and Get and Scan answer from the segments, newest first, after the
+	// memtable. Writes are still appended to the database file as well, which acts as the log keeping them
+	// durable. The segments are dropped as soon as they could go stale, by a write with the memtable turned off, a
+	// streamed one, or the process dying before Close has flushed the memtable, which loses nothing, see
+	// loadSegments. Zero, the default, turns this off.
+	MemtableSize int
+
+	// Remove segment files flushed from the memtable, along with their sparse indexes, once their latest write is
+	// older than RetentionDuration, each time the database is compacted. This bounds the disk the segments take up
+	// far more cheaply than a TTL on every entry. A segment still holding the latest entry for a live key, one not
+	// written again in a newer segment or the memtable, is kept, so that reads of it carry on being answered from
+	// the segments, as is any newer segment, see removeAgedSegments. Every entry of a segment is in the database
+	// file as well, so nothing is lost either way. Zero, the default, keeps them.
+	RetentionDuration time.Duration
+
+	memtable *memtable  // Recent writes, nil until the first write with MemtableSize set.
+	segments []*segment // Segments the memtable has been flushed to, oldest first.
+
+	// Keep the values most recently read by Get in memory, up to CacheSize bytes of IDs and values, so that reads
+	// of hot keys don't go to the database file every time. The least recently used are evicted to make room, and
+	// writes drop the value cached for their ID. Zero, the default, turns this off. See CacheStats.
+	CacheSize int
+
+	cache *valueCache // Values read by Get, see CacheSize.
+
+	values *valueIndex // Secondary index on the start of each value, nil until CreateValueIndex is called.
+
+	watchers map[chan ChangeEvent]struct{} // Channels handed out by Watch, which are told about every write.
+	feeds    map[chan Record]struct{}      // Live records for each change feed, see Changes.
+
+	// Told about every Get, Set and Delete, for monitoring the database, see the metrics package. Nil, the default,
+	// reports nothing.
+	Metrics Metrics
+
+	// Crash part way through writing, for testing recovery, see CrashPoint. The write which gets there returns
+	// ErrCrashed, leaving the files as they would be had the process died at that point. Never set this otherwise.
+	CrashPoint CrashPoint
+}
+
+// Open opens, or creates, the database file at dbPath and the hash index file at indexPath. If the index file
+// already holds a stored hash index, it is loaded into memory so that reads can make use of it straight away.
+//
+// Only one process can have a database open for writing at a time, whilst it is open any other attempt returns
+// ErrAlreadyLocked. This includes opening it a second time within the same process. OpenReadOnly isn't held back.
+func Open(dbPath, indexPath string, disableIndex bool) (*DB, error) {
+	return OpenWithOptions(dbPath, indexPath, Options{DisableIndex: disableIndex})
+}
+
+// Options are the choices made when opening a database with OpenWithOptions. The zero value opens it as Open does.
+type Options struct {
+
+	// Dir is the directory which dbPath and indexPath are taken relative to, created if it doesn't exist yet. Every
+	// file the database keeps, such as the lock file and the value index, is named after one of the two and so ends
+	// up there as well. Empty means the working directory. Absolute paths are used as they are.
+	Dir string
+
+	// FileMode is the permissions new files are created with, before the umask, with the directory given the
+	// matching execute bits. Zero means 0666. Files which already exist keep theirs, even once compaction has
+	// replaced them.
+	FileMode os.FileMode
+
+	// DisableIndex forces every Get to scan the file rather than use the hash index, see DB.HashDisabled.
+	DisableIndex bool
+
+	// NewIndex makes the Index the hash index is held in, see OpenWithIndex. Nil means NewMapIndex.
+	NewIndex func() Index
+
+	// ReadOnly opens the database only for reading, see OpenReadOnly.
+	ReadOnly bool
+
+	// Logger is what the database logs to, see DB.Logger. Nil logs nothing.
+	Logger *log.Logger
+}
+
+// OpenWithOptions opens the database in the same way as Open, with the choices made in opts.
+func OpenWithOptions(dbPath, indexPath string, opts Options) (*DB, error) {
+	if opts.FileMode == 0 {
+		opts.FileMode = 0666
+	}
+	if opts.NewIndex == nil {
+		opts.NewIndex = NewMapIndex
+	}
+
+	if opts.Dir != "" {
+		if !filepath.IsAbs(dbPath) {
+			dbPath = filepath.Join(opts.Dir, dbPath)
+		}
+		if !filepath.IsAbs(indexPath) {
+			indexPath = filepath.Join(opts.Dir, indexPath)
+		}
+
+		// Read permission on a directory is of little use without execute permission to go into it.
+		if !opts.ReadOnly {
+			if err := os.MkdirAll(opts.Dir, opts.FileMode.Perm()|(opts.FileMode.Perm()&0444)>>2); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return open(dbPath, indexPath, opts)
+}
+
+// OpenWithIndex opens the database in the same way as Open, but holds the hash index in an Index made by
+// newIndex rather than a MapIndex. newIndex is called again whenever the index is built afresh, such as by
+// RebuildIndex and Compact. The index file must have been written by the same kind of Index, otherwise it
+// won't load and is rebuilt from the database file.
+func OpenWithIndex(dbPath, indexPath string, disableIndex bool, newIndex func() Index) (*DB, error) {
+	return OpenWithOptions(dbPath, indexPath, Options{DisableIndex: disableIndex, NewIndex: newIndex})
+}
+
+// OpenReadOnly opens an existing database in the same way as Open, but only for reading, which makes it safe to look
+// into a database which another process is writing to, and for any number of processes to do so at once. Both files
+// are opened read-only and nothing is ever written to them, not even to repair them, so Set, Delete and anything
+// else which would write returns ErrReadOnly.
+//
+// The hash index is loaded as it stands when the database is opened. Entries written since then are still found by
+// Get, by falling back to a full scan of the file, but a compaction by the writer isn't seen until it is reopened.
+func OpenReadOnly(dbPath, indexPath string, disableIndex bool) (*DB, error) {
+	return OpenWithOptions(dbPath, indexPath, Options{DisableIndex: disableIndex, ReadOnly: true})
+}
+
+// open is OpenWithOptions once the paths have been resolved and the defaults filled in.
+func open(dbPath, indexPath string, opts Options) (*DB, error) {
+	if opts.ReadOnly {
+		return openFiles(dbPath, indexPath, opts)
+	}
+
+	// Only one process at a time can write to the database, otherwise their appends would interleave and each would
+	// have an index which knows nothing of the other's writes. The lock is taken before the files are even looked
+	// at, as opening them can already write to them.
+	lock, err := lockDatabase(dbPath, opts.FileMode)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := openFiles(dbPath, indexPath, opts)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	db.lock = lock
+
+	return db, nil
+}
+
+// openFiles opens the database and index files and loads the index, see open.
+func openFiles(dbPath, indexPath string, opts Options) (*DB, error) {
+
+	// A reader leaves the files as they are for the writer to put right, see finishSwap.
+	if !opts.ReadOnly {
+		if err := finishSwap(dbPath, indexPath, opts.Logger); err != nil {
+			return nil, err
+		}
+	}
+
+	// This is an append-only file, writing a new record onto the end of a file is an extremely efficient operation.
+	flag := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	if opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(dbPath, flag, opts.FileMode)
+	if err != nil {
+		return nil, err
+	}
+
+	// A file from before records were versioned has no header to check, and is read from a copy in the current
+	// format instead, see openLegacy.
+	legacy, err := isLegacy(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if legacy {
+		f.Close()
+		return openLegacy(dbPath, indexPath, opts)
+	}
+
+	// Only a writer can write the header of a new file or repair the end of an existing one. A reader never goes
+	// beyond the last complete record anyway.
+	if opts.ReadOnly {
+		err = checkReadableHeader(f)
+	} else if err = checkHeader(f); err == nil {
+		err = repairTail(f, opts.Logger)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// The index is also appended to, a snapshot of the whole hash index followed by a log of the writes since.
+	hashFile, err := os.OpenFile(indexPath, flag, opts.FileMode)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Our hash index is in the format { ID : { byte_offset, length } }
+	// This enables us to jump to the relevant section of the file if the ID we are looking for
+	// is contained within the hash index, and read exactly the record that is there.
+	db := &DB{DB: f, HashStorage: hashFile, Hash: opts.NewIndex(), HashDisabled: opts.DisableIndex, newIndex: opts.NewIndex, readOnly: opts.ReadOnly, fileMode: opts.FileMode, cache: newValueCache(), Logger: opts.Logger}
+
+	// The sequence carries on from the latest write, which is found as the index is loaded, see seenSeq.
+	if db.baseSeq, err = readBaseSeq(f); err != nil {
+		f.Close()
+		hashFile.Close()
+		return nil, err
+	}
+	db.seq = db.baseSeq
+
+	if err := loadIndex(db); err != nil {
+		f.Close()
+		hashFile.Close()
+		return nil, err
+	}
+	if db.deadBytes, err = countDeadBytes(db); err != nil {
+		db.DB.Close()
+		db.HashStorage.Close()
+		return nil, err
+	}
+	if err := loadValueIndex(db); err != nil {
+		db.DB.Close()
+		db.HashStorage.Close()
+		return nil, err
+	}
+	if !opts.ReadOnly {
+		if err := loadSegments(db); err != nil {
+			db.DB.Close()
+			db.HashStorage.Close()
+			return nil, err
+		}
+	}
+
+	return db, nil
+}
+
+// logf writes a message to logger, see DB.Logger, unless it is nil.
+func logf(logger *log.Logger, format string, args ...interface{}) {
+	if logger != nil {
+		logger.Printf(format, args...)
+	}
+}
+
+// loadIndex reads the stored hash index from disk into memory, if there is one.
+func loadIndex(db *DB) error {
+	info, err := db.HashStorage.Stat()
+	if err != nil {
+		return err
+	}
+
+	// A new index file starts out with an empty snapshot, which the log of writes then follows on from.
+	// If the database file already holds records, such as when it has been copied over without its index,
+	// the index is built from them instead.
+	if info.Size() == 0 {
+		dbInfo, err := db.DB.Stat()
+		if err != nil {
+			return err
+		}
+		if dbInfo.Size() > headerSize {
+			logf(db.Logger, "No stored hash index, building it from the database file.")
+			return rebuildIndex(db)
+		}
+		if db.readOnly {
+			return nil
+		}
+		return writeIndexSnapshot(db.HashStorage, db.Hash, db.IndexFormat)
+	}
+
+	logf(db.Logger, "Populating stored hash index")
+
+	// Read our saved hash index from disk, this is our crash tolerance. The snapshot comes first in the file,
+	// in whichever format it was stored in, the index log then follows on from it.
+	// An index which can't be read, for instance because it was cut short or damaged on disk, is rebuilt from
+	// the database file rather than stopping the database from opening.
+	format, entries, end, complete, err := readIndex(db.HashStorage, db.Hash)
+	if err != nil {
+		logf(db.Logger, "Warning: stored hash index is unreadable (%s), rebuilding it from the database file.", err)
+		return rebuildIndex(db)
+	}
+	db.indexFormat = format
+	db.indexLogEntries += entries
+
+	// The last entry of the log may have been cut short by a crash part way through writing it, in which case it
+	// is dropped from the file, unless the database is read-only, the record it pointed to is still found by a
+	// full scan.
+	if !complete && !db.readOnly {
+		if err := db.HashStorage.Truncate(end); err != nil {
+			return err
+		}
+	}
+
+	// The stored index only holds offsets, so we check which of the entries it points to are tombstones
+	// in order to know which IDs have been deleted.
+	// A corrupt record is left for Get to report, rather than stopping the database from opening at all,
+	// whereas an entry pointing somewhere the file can't be read from means the index itself is bad.
+	//
+	// Every ID's latest record is read along the way, which gives us the latest sequence number, bar any records
+	// written after those the stored index knows about. These are all at the end of the file, see indexTail.
+	var problem string
+	indexedEnd := int64(headerSize)
+	db.Hash.Range(func(id string, loc RecordLocation) bool {
+		key, value, expiresAt, seq, _, err := readRecord(db, loc)
+		if errors.Is(err, ErrCorruptRecord) {
+			return true
+		}
+		if err != nil {
+			problem = fmt.Sprintf("entry for %q is unreadable (%s)", id, err)
+			return false
+		}
+		if key != id {
+			problem = fmt.Sprintf("entry for %q points at the record for %q", id, key)
+			return false
+		}
+		setExpiry(db, id, expiresAt)
+		if value == Tombstone {
+			if db.deleted == nil {
+				db.deleted = make(map[string]bool)
+			}
+			db.deleted[id] = true
+		}
+		seenSeq(db, seq)
+		if end := loc.Offset + recordSize(key, value); end > indexedEnd {
+			indexedEnd = end
+		}
+		return true
+	})
+	if problem != "" {
+		logf(db.Logger, "Warning: stored hash index %s, rebuilding it from the database file.", problem)
+		return rebuildIndex(db)
+	}
+
+	return indexTail(db, indexedEnd)
+}
+
+// indexTail puts every record from offset to the end of the database file into the hash index, and logs their
+// entries to the index file. These were written after the last entry in the stored index, so the process must have
+// died before it could store theirs, or in the case of a debounced write of the index, before it got round to it.
+// Without this, reads of an ID would go by its earlier record, even though a later one is in the file.
+//
+// As with eachRecord, the records of a transaction are only indexed once its commit marker is reached. A record
+// which is cut short or damaged ends the walk, it is left for reads to report.
+func indexTail(db *DB, offset int64) error {
+	info, err := db.DB.Stat()
+	if err != nil {
+		return err
+	}
+	if offset >= info.Size() {
+		return nil
+	}
+
+	type tailRecord struct {
+		id, value string
+		expiresAt int64
+		loc       RecordLocation
+	}
+	var ids []string
+	var held []tailRecord
+	inTxn := false
+	index := func(t tailRecord) {
+		db.Hash.Put(t.id, t.loc)
+		setExpiry(db, t.id, t.expiresAt)
+		if t.value == Tombstone {
+			if db.deleted == nil {
+				db.deleted = make(map[string]bool)
+			}
+			db.deleted[t.id] = true
+		} else {
+			delete(db.deleted, t.id)
+		}
+		ids = append(ids, t.id)
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(db.DB, offset, info.Size()-offset))
+	for {
+		id, value, expiresAt, seq, _, err := decodeRecord(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errChecksumMismatch {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		t := tailRecord{id: id, value: value, expiresAt: expiresAt, loc: newRecordLocation(offset, int(recordSize(id, value)))}
+		switch {
+		case id == txnBeginKey:
+			inTxn = true
+			held = held[:0]
+		case id == txnCommitKey:
+			for _, h := range held {
+				index(h)
+			}
+			inTxn = false
+			held = held[:0]
+		case inTxn:
+			held = append(held, t)
+		default:
+			index(t)
+		}
+		seenSeq(db, seq)
+		offset += recordSize(id, value)
+	}
+
+	if len(ids) == 0 || db.readOnly {
+		return nil
+	}
+	logf(db.Logger, "Indexing %d record(s) written after the stored hash index.", len(ids))
+	return appendIndexLog(db, ids)
+}
+
+// repairTail truncates a record which was only partly written to the end of the database file, such as when the
+// process died part way through an append, so that the next append follows on from the last complete record.
+// A transaction at the end of the file which never reached its commit marker is truncated along with it, as
+// otherwise later appends would be taken as part of it. Records can't be told apart when reading backwards, so
+// this reads forwards through the whole file to find them. What is discarded is logged to logger, see DB.Logger.
+func repairTail(f *os.File, logger *log.Logger) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(f, headerSize, info.Size()-headerSize))
+	end := int64(headerSize)
+	txnStart := int64(-1) // Where the transaction still waiting for its commit marker begins, if there is one.
+	partial := false
+	for {
+		id, value, _, _, _, err := decodeRecord(r)
+		if err == io.EOF {
+			break
+		}
+
+		// A record which is damaged, rather than cut short, means we can no longer tell where the records after
+		// it start. It is left for reads to report, see CorruptRecordError, as we can't tell what is safe to drop.
+		if err == errChecksumMismatch {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			partial = true
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch id {
+		case txnBeginKey:
+			txnStart = end
+		case txnCommitKey:
+			txnStart = -1
+		}
+		end += recordSize(id, value)
+	}
+
+	if txnStart >= 0 {
+		logf(logger, "Discarding %d bytes of a transaction which was never committed at the end of the database file.", info.Size()-txnStart)
+		return f.Truncate(txnStart)
+	}
+	if !partial {
+		return nil
+	}
+
+	logf(logger, "Discarding %d bytes of a partly written record at the end of the database file.", info.Size()-end)
+	return f.Truncate(end)
 }
 
 // Get retrieves the entry with the given id from the file. This is intended to imitate the functionality of
 // db_get() {
 //     grep "^$1," database | sed -e "s/^$1,//" | tail -n 1
 // }
-// which is demonstrated in the book.
-func Get(db *DB, id string) (string, error) {
+// which is demonstrated in the book. Like the sed above, only the value is returned, without the id in front of it.
+// If there is no entry for the id, ErrKeyNotFound is returned. If its index entry points past the end of the file,
+// which has been cut short since the index was built, ErrIndexDataMismatch is returned rather than anything being
+// made up for it.
+//
+// Cancelling ctx ends a full scan of the file part way through, returning ctx's error, which bounds how long a read
+// with the index disabled can take on a large file.
+func Get(ctx context.Context, db *DB, id string) (value string, err error) {
+	defer observe(db, OpGet, time.Now(), &err)
+
+	// Reads only need the shared lock, since they never change the file, the index or the shared file offset.
+	// This stops a write, or a compaction swapping the files over, from happening part way through a read.
+	db.RLock()
+	defer db.RUnlock()
+
+	return get(ctx, db, id)
+}
+
+// get is Get without taking the lock, for use whilst it is already held.
+func get(ctx context.Context, db *DB, id string) (string, error) {
+	r, err := lookup(ctx, db, id)
+	if err != nil {
+		return "", err
+	}
+	if r, err = liveRecord(db, r); err != nil {
+		return "", err
+	}
+	return r.Value, nil
+}
 
-	// No locks are required here since we are reading from a file, this is safe.
+// lookup finds the latest record for id, for both Get and GetRecord, so that the two always agree. The record may be
+// a deletion or have expired, which is left to the caller, see liveRecord. The lock must be held.
+func lookup(ctx context.Context, db *DB, id string) (Record, error) {
+	if db.closed {
+		return Record{}, ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return Record{}, err
+	}
+
+	// The most recent writes are held in memory, or in the segments flushed from it, so there is no need to read the
+	// file for them. The index is updated alongside the memtable, so it says where the record is.
+	if n, ok, err := lookupRecent(db, id); err != nil {
+		return Record{}, err
+	} else if ok {
+		loc, _ := db.Hash.Get(id)
+		return newChangeRecord(id, n.value, n.expiresAt, n.seq, n.writtenAt, loc.Offset), nil
+	}
 
-	r := bufio.NewScanner(db.DB)
-	var entry string
+	if db.CacheSize > 0 {
+		if r, ok := db.cache.get(id); ok {
+			return r, nil
+		}
+	}
 
 	// Jump straight into a full scan if the cache is disabled.
 	if db.HashDisabled {
-		fmt.Println("Indexing disabled, running full scan.")
-		return scanFullDB(r, id), nil
+		logf(db.Logger, "Indexing disabled, running full scan.")
+		return fullScan(ctx, db, id)
 	}
 
-	if offset, ok := db.Hash[id]; ok {
+	if loc, ok := db.Hash.Get(id); ok {
 
-		// Seek to our byte offset provided by the hash index, this means we only scan the entry from here
-		// as opposed to the entire file.
-		_, err := db.DB.Seek(offset, io.SeekStart)
+		// Read from our byte offset provided by the hash index, this means we only read the record from here
+		// as opposed to the entire file. The read is positional rather than a Seek followed by a read, since
+		// the file offset is shared and concurrent readers would otherwise move it from underneath each other.
+		// With the length of the record also in the index, this is a single read of exactly the record.
+		key, value, expiresAt, seq, writtenAt, err := readRecord(db, loc)
 		if err != nil {
-			return "", err
+			return Record{}, err
 		}
 
-		// Move to the next token, by default this is our new line ("\n") delimiter which is what we want,
-		// this will be our record.
-		r.Scan()
-
-		// Return the text found at the byte offset, this is our desired entry.
-		entry = r.Text()
-		return entry, nil
+		// The record found at the byte offset should be our desired entry. If it belongs to another ID, the
+		// index doesn't match the file, so we fall back to looking through the file itself.
+		if key == id {
+			r := newChangeRecord(id, value, expiresAt, seq, writtenAt, loc.Offset)
+			if db.CacheSize > 0 {
+				db.cache.put(r, db.CacheSize)
+			}
+			return r, nil
+		}
 	}
 
 	// If the ID is not in our index, we need to scan the all the entries and then pass the latest one.
@@ -59,74 +777,808 @@ func Get(db *DB, id string) (string, error) {
 	// For practically all cases, the index will be present since we hold it in memory and update it
 	// on each write. Although for full functionality, this is included to show that we would require a
 	// full scan to find the latest entry.
-	return scanFullDB(r, id), nil
+	return fullScan(ctx, db, id)
+}
+
+// Has reports whether there is a live entry for id, in the same way as Get but without reading its value. Deleted
+// and expired IDs aren't live. This goes by what is held in memory, only reading the database file when the hash
+// index is disabled, which makes it far cheaper than Get when the value itself isn't needed.
+func (db *DB) Has(id string) (bool, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return false, ErrClosed
+	}
 
+	if db.HashDisabled {
+		r, err := fullScan(context.Background(), db, id)
+		if err == nil {
+			_, err = liveRecord(db, r)
+		}
+		if errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrDeleted) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	// Deleted keys still have an entry in the index, pointing at their tombstone, as do expired ones.
+	if _, ok := db.Hash.Get(id); !ok || db.deleted[id] {
+		return false, nil
+	}
+	return !db.expired(db.expiries[id]), nil
 }
 
-func scanFullDB(sc *bufio.Scanner, id string) string {
-	var entry string
-	for sc.Scan() {
+// fullScan finds the latest record for the given id by reading through every record in the database file, returning
+// ErrKeyNotFound if there isn't one. As with lookup, the record may be a deletion or have expired.
+func fullScan(ctx context.Context, db *DB, id string) (Record, error) {
+	if err := flushWrites(db); err != nil {
+		return Record{}, err
+	}
+
+	info, err := db.DB.Stat()
+	if err != nil {
+		return Record{}, err
+	}
+
+	// The workers of a parallel scan each report their own progress, which is added up here.
+	var progress func(n int64)
+	var progressMu sync.Mutex
+	scanned := int64(headerSize)
+	if db.ScanProgress != nil {
+		progress = func(n int64) {
+			progressMu.Lock()
+			defer progressMu.Unlock()
+
+			scanned += n
+			db.ScanProgress(scanned, info.Size())
+		}
+	}
+
+	var r Record
+	var found bool
+	var records int
+	if db.ScanFromEnd {
+		r, found, records, err = reverseScan(ctx, db, id, info.Size(), progress)
+	} else if workers := scanWorkers(db, info.Size()); workers > 1 {
+		r, found, records, err = parallelScan(ctx, db, id, info.Size(), workers, progress)
+	} else {
 
-		// Values are in format of "<id>,<string>"
-		dbId := strings.Split(sc.Text(), ",")[0]
+		// Reading through a section of the file, rather than the file itself, means that we always start from the
+		// first record regardless of where the shared file offset was left.
+		sr := bufio.NewReader(io.NewSectionReader(db.DB, headerSize, info.Size()-headerSize))
+		r, found, records, err = scanFullDB(ctx, sr, headerSize, id, progress)
+	}
+	if err != nil {
+		return Record{}, err
+	}
+
+	// A record cut short at the end of the file isn't counted by the scan, although it has still been gone through.
+	if progress != nil && scanned < info.Size() {
+		progress(info.Size() - scanned)
+	}
+	if db.Metrics != nil {
+		db.Metrics.ObserveScan(records)
+	}
+	if !found {
+		return Record{}, ErrKeyNotFound
+	}
+	return r, nil
+}
+
+// liveRecord returns r, unless it is a deletion or has expired, in the same way as liveValue.
+func liveRecord(db *DB, r Record) (Record, error) {
+	if r.Op == OpDelete {
+		return Record{}, ErrDeleted
+	}
+	if db.expired(r.ExpiresAt) {
+		return Record{}, ErrKeyNotFound
+	}
+	return r, nil
+}
+
+// liveValue returns the latest value of an ID, unless that value is a tombstone, in which case the ID has been
+// deleted, or it has expired, in which case it is as though the ID was never written.
+func liveValue(db *DB, value string, expiresAt int64) (string, error) {
+	if value == Tombstone {
+		return "", ErrDeleted
+	}
+	if db.expired(expiresAt) {
+		return "", ErrKeyNotFound
+	}
+	return value, nil
+}
+
+// scanCheckInterval is how many records a full scan reads between checks of whether it has been cancelled.
+const scanCheckInterval = 1024
+
+// scanFullDB reads every record from r, which starts at the given offset in the database file, returning the latest
+// one with the given id, along with how many records were read. The scan stops with ctx's error once ctx is
+// cancelled, which is checked every scanCheckInterval records. At the same interval, and once the scan is done,
+// progress is called with how many bytes have been read since it was last called, unless it is nil.
+func scanFullDB(ctx context.Context, r io.Reader, offset int64, id string, progress func(n int64)) (Record, bool, int, error) {
+	var entry Record
+	var found bool
+
+	// A match within a transaction only counts once its commit marker has been read, otherwise it was never
+	// committed. A reader with the file open read-only can see a transaction still being written.
+	var held Record
+	var inTxn, heldFound bool
+
+	// Only the value of a matching record is kept as a string, the rest are looked at in the reader's buffer and
+	// never copied out of it.
+	rr := recordReader{r: r}
+	records := 0
+	reported := offset
+	for ; ; records++ {
+		if records%scanCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return Record{}, false, records, err
+			}
+			if progress != nil && offset > reported {
+				progress(offset - reported)
+				reported = offset
+			}
+		}
+
+		dbId, value, expiresAt, seq, writtenAt, err := rr.next()
+
+		// A final record which has been cut short was only partly written, so it was never stored.
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return Record{}, false, records, corruptAt(err, offset)
+		}
+		start := offset
+		offset += int64(recordOverhead + len(dbId) + len(value))
+
+		switch {
+		case string(dbId) == txnBeginKey:
+			inTxn, heldFound = true, false
+		case string(dbId) == txnCommitKey:
+			if heldFound {
+				entry, found = held, true
+			}
+			inTxn, heldFound = false, false
+		case string(dbId) == id && inTxn:
+			held, heldFound = newChangeRecord(id, string(value), expiresAt, seq, writtenAt, start), true
 
 		// Find all entries which match the ID, there may be multiple
 		// so we find them all and only want the latest entry, which is what we return.
-		// Note: This toy implementation does not include tombstone records for deletions.
-		if dbId == id {
-			entry = sc.Text()
+		// Note: The latest entry may be a tombstone, it is left to the caller to interpret this.
+		case string(dbId) == id:
+			entry = newChangeRecord(id, string(value), expiresAt, seq, writtenAt, start)
+			found = true
 		}
 	}
 
-	if entry == "" {
-		return entry
-	} else {
-		// Return the most recent entry
-		return entry
+	if progress != nil && offset > reported {
+		progress(offset - reported)
 	}
+
+	// Return the most recent entry
+	return entry, found, records, nil
 }
 
-// Set will append an entry into the given file. This attempts to imitate the functionality of
+// Set will append a record of the id and value into the given file. This attempts to imitate the functionality of
 // db_set() {
 //     echo "$1,$2" >> database
 // }
-// from the simplified database in the book.
-func Set(db *DB, entry string) error {
+// from the simplified database in the book. Since the id and value are stored separately, either of them can
+// contain commas. An id can be any string but an empty one, or one made up only of whitespace, which returns
+// ErrInvalidKey. It is stored exactly as it is given, never trimmed.
+//
+// Nothing is written if ctx has been cancelled by the time the lock is acquired, in which case ctx's error is
+// returned.
+//
+// A write either makes it into the database file in full, and is then seen by reads, or not at all. Once it is in
+// the file, the write stands even if storing its hash index entry fails, as when the disk holding the index is
+// full, the error from which is still returned. The database file is what counts, Open finds the write from it
+// again, and the next write of the index replaces the index file with a new snapshot holding the entry.
+func Set(ctx context.Context, db *DB, id, value string) (err error) {
+	defer observe(db, OpSet, time.Now(), &err)
+	return set(ctx, db, id, value, 0)
+}
 
-	info, err := db.DB.Stat()
-	if err != nil {
+// set writes the value for id, which expires at the given Unix time, or never if it is zero.
+func set(ctx context.Context, db *DB, id, value string, expiresAt int64) error {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return writeValue(db, id, value, expiresAt)
+}
+
+// writeValue is set once the lock has been taken and the database checked to be open for writing.
+func writeValue(db *DB, id, value string, expiresAt int64) error {
+	if err := checkKey(db, id); err != nil {
+		return err
+	}
+	if err := checkValue(db, id, value); err != nil {
+		return err
+	}
+
+	if isNewKey(db, id) {
+		if err := checkKeyLimit(db, 1); err != nil {
+			return err
+		}
+	}
+
+	if db.AllowInPlaceUpdate {
+		if loc, ok := db.Hash.Get(id); ok {
+
+			// The sequence number is only taken if the record was written, or may have been in part.
+			seq := db.seq + 1
+			writtenAt := db.clock().UnixNano()
+			updated, err := overwriteInPlace(db, loc, id, value, expiresAt, seq, writtenAt)
+			if updated || err != nil {
+				db.seq = seq
+			}
+			if err != nil {
+				return err
+			}
+
+			if updated {
+				return db.afterWrite(writtenRecord{
+					key: id, offset: loc.Offset,
+					value: value, expiresAt: expiresAt, seq: seq, writtenAt: writtenAt, inPlace: true,
+				})
+			}
+		}
+	}
+
+	if err := checkQuota(db, recordSize(id, value)); err != nil {
 		return err
 	}
+	return appendRecord(db, id, value, expiresAt)
+}
+
+// checkValue makes sure value can be written for id, which it can't be if it is the tombstone, longer than
+// MaxValueBytes or turned down by the Validator.
+func checkValue(db *DB, id, value string) error {
+	if value == Tombstone {
+		return fmt.Errorf("%w: %q is reserved for marking deletions, use Delete instead", ErrInvalidValue, Tombstone)
+	}
+	if db.MaxValueBytes > 0 && len(value) > db.MaxValueBytes {
+		return fmt.Errorf("%w: %d bytes, the most is %d", ErrValueTooLarge, len(value), db.MaxValueBytes)
+	}
+	if db.Validator != nil {
+		return db.Validator(id, value)
+	}
+	return nil
+}
 
-	// The actual implementation would likely write the data as binary, but to show the concept here we can
-	// use string so that we can see the entires plainly in the database file.
-	_, err = db.DB.WriteString(entry + "\n")
+// CheckEntry returns the error Set would return for id and value without writing anything, if they break the rules
+// on what can be written, as with an invalid ID, a value which is the Tombstone or too large, or one turned down by
+// the Validator. It doesn't check the limits which depend on what has been written already, such as MaxKeys.
+func CheckEntry(db *DB, id, value string) error {
+	db.RLock()
+	defer db.RUnlock()
+
+	if err := checkKey(db, id); err != nil {
+		return err
+	}
+	return checkValue(db, id, value)
+}
+
+// Delete removes the given ID from the database. As the file is append-only, we can't remove the existing
+// entries for it, instead a record with the tombstone value is appended. This is the latest entry for
+// the ID, so reads see that it has been deleted, until a later Set writes a new entry for it. As with Set, nothing
+// is written if ctx has been cancelled by the time the lock is acquired.
+func Delete(ctx context.Context, db *DB, id string) (err error) {
+	defer observe(db, OpDelete, time.Now(), &err)
+
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := checkID(id); err != nil {
+		return err
+	}
+	return appendRecord(db, id, Tombstone, 0)
+}
+
+// appendRecord writes a record to the end of the database file and points the hash index for id at it.
+// The lock must be held.
+func appendRecord(db *DB, id, value string, expiresAt int64) error {
+	offset, err := dataSize(db)
 	if err != nil {
 		return err
 	}
 
-	// With the format of our entries, the ID is the 0th element using the comma seperator.
-	id := strings.Split(entry, ",")[0]
+	// Records are written as binary with their lengths up front, see encodeRecord, rather than as the plain
+	// lines of text in the book. This means IDs and values can safely contain commas and newlines.
+	seq := nextSeq(db)
+	writtenAt := db.clock().UnixNano()
+	record := encodeRecord(id, value, expiresAt, seq, writtenAt)
+	if _, err := appendData(db, record); err != nil {
+
+		// As with a transaction, without a write buffer anything which did make it into the file is cut off again,
+		// so that later appends don't follow on from part of a record. A crash leaves it for Open to discard.
+		if db.writer == nil && !db.closed {
+			db.DB.Truncate(offset)
+		}
+		return err
+	}
+	if err := syncAppend(db); err != nil {
+		return err
+	}
+	if err := crash(db, CrashAfterWrite); err != nil {
+		return err
+	}
 
 	// Maintain hash index on writes, this is where a hash index trade-off occurs.
 	// We need to maintain the offsets on writes, but it vastly speeds up reads.
 	// This likely isn't a fully realistic imitation, since we're not doing any
 	// compaction or segmenting of files, but the general concept is there.
-	db.Hash[id] = info.Size()
+	return db.afterWrite(writtenRecord{
+		key: id, offset: offset, size: len(record),
+		value: value, expiresAt: expiresAt, seq: seq, writtenAt: writtenAt,
+	})
+}
 
-	// Seek to the beginning of the file, we can overwrite our map, rather than appending to make it simpler.
-	// We only maintain a single mapping value, rather than multiple and being required to read the latest entry.
-	_, err = db.HashStorage.Seek(0, io.SeekStart)
-	if err != nil {
+// writtenRecord is a record which has just been written to the database file, for afterWrite.
+type writtenRecord struct {
+	key       string
+	offset    int64
+	size      int
+	value     string
+	expiresAt int64
+	seq       uint64
+	writtenAt int64
+
+	// inPlace is set for a record which overwrote the previous one for its key, see AllowInPlaceUpdate, rather than
+	// being appended.
+	inPlace bool
+
+	// partial is set when value is only the start of the value, as for a streamed value too large to hold in
+	// memory, which is enough for the value index but not to be remembered in the memtable or told to change feeds.
+	partial bool
+}
+
+// afterWrite brings everything kept alongside the database file up to date with the given records, once they are
+// in the file: the hash index and its log, the dead bytes, deleted keys and expiries, the cache and memtable, the
+// value index, watchers and change feeds, then starts a compaction if one is due. Every kind of write goes through
+// here, so that none of them is missed out of any of it. The lock must be held.
+func (db *DB) afterWrite(written ...writtenRecord) error {
+	ids := make([]string, 0, len(written))
+	for _, rec := range written {
+		id := rec.key
+
+		// Only a whole value can be the tombstone, not one which merely starts the same way.
+		tombstone := rec.value == Tombstone && !rec.partial
+		if !rec.inPlace {
+			markDead(db, id, tombstone, rec.size)
+			db.Hash.Put(id, newRecordLocation(rec.offset, rec.size))
+			ids = append(ids, id)
+		}
+		if tombstone {
+			if db.deleted == nil {
+				db.deleted = make(map[string]bool)
+			}
+			db.deleted[id] = true
+		} else {
+			delete(db.deleted, id)
+		}
+		setExpiry(db, id, rec.expiresAt)
+		var err error
+		if rec.partial {
+			err = forgetWrite(db, id)
+		} else {
+			err = rememberWrite(db, id, rec.value, rec.expiresAt, rec.seq, rec.writtenAt)
+		}
+		if err != nil {
+			return err
+		}
+		indexValue(db, id, rec.value, tombstone)
+		publish(db, id, rec.value, rec.expiresAt, rec.seq, rec.writtenAt)
+	}
+
+	// The record still lives at the same offset after an update in place, so there is nothing to log for it.
+	if len(ids) > 0 {
+		if err := persistIndex(db, ids...); err != nil {
+			return err
+		}
+		if err := crash(db, CrashAfterIndexLog); err != nil {
+			return err
+		}
+	}
+	if err := markValueIndexStale(db); err != nil {
+		return err
+	}
+	if err := maybeFlushMemtable(db); err != nil {
 		return err
 	}
 
-	// Update our hash index on subsequent data entries
-	g := json.NewEncoder(db.HashStorage)
-	err = g.Encode(db.Hash)
+	maybeCompact(db)
+	return nil
+}
+
+// Close writes out any pending update to the hash index as a final snapshot, flushes the database file to disk
+// and closes both files. Once closed, the database returns ErrClosed from any further use, although closing it
+// again is harmless.
+func (db *DB) Close() error {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+
+	// Nothing has been written, so there is nothing to flush, and the files belong to whoever is writing them.
+	if db.readOnly {
+		return db.closeFiles(nil)
+	}
+
+	// The memtable is flushed along with the latest write, so that the segments can be trusted when the database is
+	// next opened, see loadSegments.
+	err := flush(db)
+	if err == nil && db.MemtableSize > 0 {
+		err = flushMemtable(db)
+	}
+	return db.closeFiles(err)
+}
+
+// closeFiles unmaps and closes both files, and closes the channels of any watchers and change feeds as there will be
+// no more writes to tell them about, then releases the lock on the database. It returns err, an error from earlier
+// in closing the database, or failing that the first error from closing the files. The lock must be held.
+func (db *DB) closeFiles(err error) error {
+	if unmapErr := unmapData(db); err == nil {
+		err = unmapErr
+	}
+	if closeErr := db.DB.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := db.HashStorage.Close(); err == nil {
+		err = closeErr
+	}
+	closeSegments(db)
+
+	for ch := range db.watchers {
+		close(ch)
+	}
+	db.watchers = nil
+	for live := range db.feeds {
+		close(live)
+	}
+	db.feeds = nil
+
+	// Closing the lock file releases the lock, letting another writer in. The lock file itself is left behind, as
+	// removing it could pull it out from under a writer which has just opened it.
+	if db.lock != nil {
+		if closeErr := db.lock.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	// Nothing else can have a database opened by OpenMemory open, or the copy of a legacy one, so its files can go.
+	if db.tempDir != "" {
+		if removeErr := os.RemoveAll(db.tempDir); err == nil {
+			err = removeErr
+		}
+	}
+
+	return err
+}
+
+// GetApprox retrieves the most recent value for the given id, but only looks at the last tailBytes of the
+// database file. Since the file is append-only, the tail holds the most recently written records, so this
+// trades completeness for a bounded amount of reading. If the id was not seen within that window, found is
+// false, even though an older entry may still exist earlier in the file.
+//
+// Only the window itself is read, and the first record within it is found from the window alone, see tailStart, so
+// a record which fails its checksum part way through the window means only the records after it are looked at. A
+// value which holds the bytes of a whole record can be taken for one, should the window start part way through the
+// record it is the value of.
+func GetApprox(db *DB, id string, tailBytes int64) (string, bool, error) {
+	if tailBytes <= 0 {
+		return "", false, nil
+	}
+
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return "", false, ErrClosed
+	}
+
+	if err := flushWrites(db); err != nil {
+		return "", false, err
+	}
+
+	info, err := db.DB.Stat()
+	if err != nil {
+		return "", false, err
+	}
+
+	start := info.Size() - tailBytes
+	if start < headerSize {
+		start = headerSize
+	}
+	window := make([]byte, info.Size()-start)
+	if _, err := readAt(db, window, start); err != nil {
+		return "", false, err
+	}
+
+	// A window which takes in the whole file starts at the first record, so there is nothing to look for.
+	pos := 0
+	if start > headerSize {
+		pos = tailStart(window)
+	}
+
+	rec, found, _, err := scanFullDB(context.Background(), bytes.NewReader(window[pos:]), start+int64(pos), id, nil)
+	if err != nil || !found {
+		return "", false, err
+	}
+
+	rec, err = liveRecord(db, rec)
+	if err != nil {
+		return "", false, err
+	}
+	return rec.Value, true, nil
+}
+
+// tailStart returns where the first record starts in window, which is the end of the database file from an
+// arbitrary offset, or len(window) if no record can be found in it. A record can't be recognised from an arbitrary
+// point, so each offset is tried in turn until one starts a record which matches its checksum, and is followed by
+// nothing but more of them up to the end of the window, bar a last record cut short by a write still under way.
+// Every offset tried only reads as far as the lengths at it say, once they are checked against the window, so
+// this doesn't read beyond the window as hopping along the records from the start of the file would.
+func tailStart(window []byte) int {
+	for pos := 0; pos < len(window); pos++ {
+		n, ok := wholeRecordAt(window[pos:])
+		if !ok {
+			continue
+		}
+		rest := window[pos+n:]
+		for len(rest) > 0 {
+			if n, ok = wholeRecordAt(rest); !ok {
+				break
+			}
+			rest = rest[n:]
+		}
+		if len(rest) == 0 || cutShort(rest) {
+			return pos
+		}
+	}
+	return len(window)
+}
+
+// wholeRecordAt returns the size of the record at the start of b, if the whole of it is in b and it matches its
+// checksum. The lengths are checked against b before the rest is read, as from the wrong offset they could be
+// anything.
+func wholeRecordAt(b []byte) (int, bool) {
+	const fixedSize = checksumSize + expirySize + seqSize + writtenSize + lengthSize
+	if len(b) < fixedSize {
+		return 0, false
+	}
+	keyEnd := fixedSize + int64(binary.BigEndian.Uint32(b[fixedSize-lengthSize:]))
+	if keyEnd+lengthSize > int64(len(b)) {
+		return 0, false
+	}
+	end := keyEnd + lengthSize + int64(binary.BigEndian.Uint32(b[keyEnd:]))
+	if end > int64(len(b)) {
+		return 0, false
+	}
+
+	sum := crc32.ChecksumIEEE(b[checksumSize : fixedSize-lengthSize])
+	sum = crc32.Update(sum, crc32.IEEETable, b[fixedSize:keyEnd])
+	sum = crc32.Update(sum, crc32.IEEETable, b[keyEnd+lengthSize:end])
+	return int(end), sum == binary.BigEndian.Uint32(b)
+}
+
+// cutShort reports whether b holds the start of a record which goes on beyond the end of b.
+func cutShort(b []byte) bool {
+	const fixedSize = checksumSize + expirySize + seqSize + writtenSize + lengthSize
+	if len(b) < fixedSize {
+		return true
+	}
+	keyEnd := fixedSize + int64(binary.BigEndian.Uint32(b[fixedSize-lengthSize:]))
+	if keyEnd+lengthSize > int64(len(b)) {
+		return true
+	}
+	return keyEnd+lengthSize+int64(binary.BigEndian.Uint32(b[keyEnd:])) > int64(len(b))
+}
+
+// recordBoundary returns the offset of the first record which starts at or after the given offset. A record can't
+// be recognised from an arbitrary point in the file, so we hop from the first record along each of their lengths.
+// Only the lengths are read, the checksums, keys and values themselves are skipped over.
+func recordBoundary(db *DB, offset, size int64) (int64, error) {
+	pos := int64(headerSize)
+	length := make([]byte, lengthSize)
+
+	for pos < offset {
+		pos += checksumSize + expirySize + seqSize + writtenSize
+
+		// Skip over the key and then the value.
+		for i := 0; i < 2; i++ {
+			if _, err := readAt(db, length, pos); err != nil {
+				if err == io.EOF {
+					return size, nil
+				}
+				return 0, err
+			}
+			pos += lengthSize + int64(binary.BigEndian.Uint32(length))
+		}
+	}
+
+	return pos, nil
+}
+
+// overwriteInPlace replaces the record at offset if its value is the same length as the new one, reporting whether
+// it did so. Records of a different length cannot be overwritten without clobbering their neighbours, so these are
+// left for the caller to append as usual.
+func overwriteInPlace(db *DB, loc RecordLocation, id, value string, expiresAt int64, seq uint64, writtenAt int64) (bool, error) {
+	_, current, _, _, _, err := readRecord(db, loc)
+	if err != nil {
+		return false, err
+	}
+
+	if len(current) != len(value) {
+		return false, nil
+	}
+
+	// The database file is opened with O_APPEND, which means every write lands at the end of the file regardless
+	// of the offset we ask for. A separate, non-appending handle is needed to write into the middle of the file.
+	f, err := os.OpenFile(db.DB.Name(), os.O_WRONLY, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteAt(encodeRecord(id, value, expiresAt, seq, writtenAt), loc.Offset); err != nil {
+		return false, err
+	}
+
+	// The old value is gone once this returns, so make sure the new one actually reaches the disk.
+	if err := f.Sync(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// readRecord decodes the record at the given location, returning its key, value, expiry, sequence number and write
+// time. When its length is known, this is a single read of exactly the record, otherwise it falls back to
+// readRecordAt. A location running past the end of the file returns ErrIndexDataMismatch.
+func readRecord(db *DB, loc RecordLocation) (string, string, int64, uint64, int64, error) {
+	if err := flushWrites(db); err != nil {
+		return "", "", 0, 0, 0, err
+	}
+
+	if loc.Length <= 0 {
+		key, value, expiresAt, seq, writtenAt, err := readRecordAt(db, loc.Offset)
+		if err == io.ErrUnexpectedEOF {
+			return "", "", 0, 0, 0, pastEOF(db, loc.Offset)
+		}
+		return key, value, expiresAt, seq, writtenAt, err
+	}
+
+	buf := make([]byte, loc.Length)
+	if _, err := readAt(db, buf, loc.Offset); err != nil {
+		if err == io.EOF {
+			return "", "", 0, 0, 0, pastEOF(db, loc.Offset)
+		}
+		return "", "", 0, 0, 0, err
+	}
+
+	key, value, expiresAt, seq, writtenAt, err := decodeRecord(bytes.NewReader(buf))
+	if err == io.EOF {
+		return "", "", 0, 0, 0, io.ErrUnexpectedEOF
+	}
+
+	return key, value, expiresAt, seq, writtenAt, corruptAt(err, loc.Offset)
+}
+
+// pastEOF is the error for an index entry pointing at a record at offset which runs past the end of the database
+// file. Only complete records are ever indexed, so this is never a record cut short by a crash, it means the file
+// no longer holds what the index was built from.
+func pastEOF(db *DB, offset int64) error {
+	size, err := dataSize(db)
 	if err != nil {
 		return err
 	}
+	return fmt.Errorf("%w: entry at offset %d runs past the end of the file, which is %d bytes", ErrIndexDataMismatch, offset, size)
+}
+
+// readRecordAt decodes the record starting at the given byte offset. Only positional reads are used, so the shared
+// file offset is never touched and any number of readers can do this at once.
+func readRecordAt(db *DB, offset int64) (string, string, int64, uint64, int64, error) {
+
+	// Most records are small, so a single read of this size will usually pick up the whole record.
+	buf := make([]byte, readAheadSize)
+	n, err := readAt(db, buf, offset)
+	if err != nil && err != io.EOF {
+		return "", "", 0, 0, 0, err
+	}
+	buf = buf[:n]
 
-	return nil
+	// The lengths tell us exactly how big the record is, so anything past the initial read is picked up with
+	// a single read of precisely the bytes that are missing.
+	size, err := sizeOfRecord(db, buf, offset, n < readAheadSize)
+	if err != nil {
+		return "", "", 0, 0, 0, err
+	}
+	if int64(len(buf)) < size {
+		rest := make([]byte, size-int64(len(buf)))
+		if _, err := readAt(db, rest, offset+int64(len(buf))); err != nil {
+			if err == io.EOF {
+				return "", "", 0, 0, 0, io.ErrUnexpectedEOF
+			}
+			return "", "", 0, 0, 0, err
+		}
+		buf = append(buf, rest...)
+	}
+
+	key, value, expiresAt, seq, writtenAt, err := decodeRecord(bytes.NewReader(buf[:size]))
+	if err == io.EOF {
+		return "", "", 0, 0, 0, io.ErrUnexpectedEOF
+	}
+
+	return key, value, expiresAt, seq, writtenAt, corruptAt(err, offset)
+}
+
+// sizeOfRecord works out the size of the record starting at offset from the start of it held in buf. If the value
+// length isn't in buf, it is read from the file. When atEOF is set, buf runs up to the end of the file.
+func sizeOfRecord(db *DB, buf []byte, offset int64, atEOF bool) (int64, error) {
+	if len(buf) < checksumSize+expirySize+seqSize+writtenSize+lengthSize {
+		return 0, io.ErrUnexpectedEOF
+	}
+	keyEnd := checksumSize + expirySize + seqSize + writtenSize + lengthSize + int64(binary.BigEndian.Uint32(buf[checksumSize+expirySize+seqSize+writtenSize:]))
+
+	var valueLen uint32
+	if int64(len(buf)) >= keyEnd+lengthSize {
+		valueLen = binary.BigEndian.Uint32(buf[keyEnd:])
+	} else {
+		if atEOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		length := make([]byte, lengthSize)
+		if _, err := readAt(db, length, offset+keyEnd); err != nil {
+			if err == io.EOF {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		valueLen = binary.BigEndian.Uint32(length)
+	}
+	size := keyEnd + lengthSize + int64(valueLen)
+
+	if size <= int64(len(buf)) {
+		return size, nil
+	}
+	if atEOF {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	// The lengths come from the file and so may be corrupt. Check the record fits in the file before trusting
+	// them with an allocation.
+	info, err := db.DB.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if offset+size > info.Size() {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	return size, nil
 }
@@ -0,0 +1,168 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentAccess runs writes, compactions and every kind of read against the same database all at once, both
+// as it is opened and with the read cache, write buffer, memmapped reads and memtable all in use, checking that reads
+// only ever see values which were written. This is mostly for running with the race detector, which catches any
+// access to the index or the files which isn't under the lock, see "go test -race".
+func TestConcurrentAccess(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		configure func(db *DB)
+	}{
+		{"defaults", func(db *DB) {}},
+		{"buffered", func(db *DB) {
+			db.CacheSize = 1 << 10
+			db.WriteBufferSize = 1 << 10
+			db.MmapReads = true
+			db.MemtableSize = 1 << 10
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			db, err := Open(filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db"), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			tt.configure(db)
+
+			const writers, writes, keys, rounds = 4, 200, 20, 50
+			var writing, reading sync.WaitGroup
+			errs := make(chan error, 16)
+			fail := func(err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			}
+
+			for w := 0; w < writers; w++ {
+				writing.Add(1)
+				go func(w int) {
+					defer writing.Done()
+					for i := 0; i < writes; i++ {
+						id := fmt.Sprintf("key-%d", i%keys)
+						var err error
+						switch i % 4 {
+						case 0, 1:
+							err = Set(ctx, db, id, fmt.Sprintf("value-%d-%d", w, i))
+						case 2:
+							err = SetBatch(db, map[string]string{id: fmt.Sprintf("value-%d-%d", w, i), "batch": "value"})
+						case 3:
+							err = Delete(ctx, db, id)
+							if errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrDeleted) {
+								err = nil
+							}
+						}
+						if err != nil {
+							fail(fmt.Errorf("write %q: %w", id, err))
+							return
+						}
+					}
+				}(w)
+			}
+
+			check := func(what, id, value string) {
+				if !strings.HasPrefix(value, "value") {
+					fail(fmt.Errorf("%s %q: got %q, which was never written", what, id, value))
+				}
+			}
+			readers := []func() error{
+				func() error {
+					for i := 0; i < keys; i++ {
+						id := fmt.Sprintf("key-%d", i)
+						value, err := Get(ctx, db, id)
+						if errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrDeleted) {
+							continue
+						}
+						if err != nil {
+							return fmt.Errorf("get %q: %w", id, err)
+						}
+						check("get", id, value)
+					}
+					return nil
+				},
+				func() error {
+					_, err := db.Has("key-0")
+					db.Len()
+					db.Keys()
+					db.IndexMemoryBytes()
+					db.CacheStats()
+					db.LastSeq()
+					return err
+				},
+				func() error {
+					values, err := GetMulti(db, []string{"key-0", "key-1", "batch"})
+					for id, value := range values {
+						check("get multi", id, value)
+					}
+					return err
+				},
+				func() error {
+					kvs, err := Scan(db, "", "")
+					for _, kv := range kvs {
+						check("scan", kv.Key, kv.Value)
+					}
+					return err
+				},
+				func() error {
+					it := NewIterator(db)
+					for it.Next() {
+						check("iterator", it.Key(), it.Value())
+					}
+					return it.Err()
+				},
+				func() error {
+					if _, err := Stats(db); err != nil {
+						return err
+					}
+					_, err := Verify(db)
+					return err
+				},
+				func() error {
+					return Snapshot(db, io.Discard)
+				},
+				func() error {
+					return Compact(ctx, db)
+				},
+			}
+			// The readers run alongside the writers for a set number of rounds each, rather than until the writers
+			// finish, which on few CPUs would starve the writers of the lock.
+			for _, read := range readers {
+				reading.Add(1)
+				go func(read func() error) {
+					defer reading.Done()
+					for i := 0; i < rounds; i++ {
+						if err := read(); err != nil {
+							fail(err)
+							return
+						}
+					}
+				}(read)
+			}
+
+			writing.Wait()
+			reading.Wait()
+
+			select {
+			case err := <-errs:
+				t.Fatal(err)
+			default:
+			}
+		})
+	}
+}
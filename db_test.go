@@ -0,0 +1,1005 @@
+package logstructured
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoggerIsToldOfIndexRebuild(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, indexPath := filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db")
+
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Set(context.Background(), db, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(indexPath); err != nil {
+		t.Fatal(err)
+	}
+
+	var logged bytes.Buffer
+	db, err = OpenWithOptions(dbPath, indexPath, Options{Logger: log.New(&logged, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if want := "No stored hash index, building it from the database file.\n"; logged.String() != want {
+		t.Fatalf("logged %q, want %q", logged.String(), want)
+	}
+	if value, err := Get(context.Background(), db, "a"); err != nil || value != "1" {
+		t.Fatalf("get %q after rebuilding the index: got %q (error %v), want %q", "a", value, err, "1")
+	}
+
+	db.HashDisabled = true
+	logged.Reset()
+	if _, err := Get(context.Background(), db, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logged.String(), "full scan") {
+		t.Fatalf("logged %q for a Get with the index disabled, want a full scan", logged.String())
+	}
+}
+
+func TestOpenDiscardsPartlyWrittenRecord(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, indexPath := filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db")
+
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Set(context.Background(), db, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	size := db.WriteOffset()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only part of the next record makes it into the file, as though the process died whilst appending it.
+	record := encodeRecord("b", "2", 0, 2, 0)
+	f, err := os.OpenFile(dbPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(record[:len(record)-1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var logged bytes.Buffer
+	db, err = OpenWithOptions(dbPath, indexPath, Options{Logger: log.New(&logged, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if want := fmt.Sprintf("Discarding %d bytes of a partly written record", len(record)-1); !strings.Contains(logged.String(), want) {
+		t.Fatalf("logged %q, want the partly written record discarded", logged.String())
+	}
+	if got := db.WriteOffset(); got != size {
+		t.Fatalf("database file is %d bytes after opening, want %d", got, size)
+	}
+	if err := Set(context.Background(), db, "b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := Get(context.Background(), db, "b"); err != nil || value != "2" {
+		t.Fatalf("get %q: got %q (error %v), want %q", "b", value, err, "2")
+	}
+}
+
+func TestGetApproxFindsRecordsInWindow(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Values holding whole records of their own are the hardest to find the start of a record among.
+	for i := 0; i < 20; i++ {
+		value := string(encodeRecord("inner", fmt.Sprint("inner", i), 0, uint64(i), 0))
+		if err := Set(ctx, db, fmt.Sprint("key", i%5), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	latest := db.WriteOffset()
+	if err := Set(ctx, db, "key", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	size := db.WriteOffset()
+
+	for tail := int64(1); tail <= size; tail++ {
+		value, found, err := GetApprox(db, "key", tail)
+		if err != nil {
+			t.Fatalf("GetApprox with a window of %d bytes: %v", tail, err)
+		}
+		if want := tail >= size-latest; found != want || (found && value != "latest") {
+			t.Fatalf("GetApprox with a window of %d bytes: got %q (found %t), want found %t", tail, value, found, want)
+		}
+
+		want, err := Get(ctx, db, "key3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, found, err := GetApprox(db, "key3", tail); err != nil || (found && value != want) {
+			t.Fatalf("GetApprox of %q with a window of %d bytes: got %q (found %t, error %v), want %q", "key3", tail, value, found, err, want)
+		}
+	}
+}
+
+func TestTailStart(t *testing.T) {
+	first := encodeRecord("a", "1", 0, 1, 0)
+	second := encodeRecord("b", "2", 0, 2, 0)
+	third := encodeRecord("c", "3", 0, 3, 0)
+
+	tests := []struct {
+		name   string
+		window []byte
+		want   int
+	}{
+		{"whole records", append(append([]byte(nil), first...), second...), 0},
+		{"part way through a record", append(append([]byte(nil), first[5:]...), second...), len(first) - 5},
+		{"last record cut short", append(append(append([]byte(nil), first[5:]...), second...), third[:10]...), len(first) - 5},
+		{"no whole record", third[:len(third)-1], len(third) - 1},
+	}
+	for _, tt := range tests {
+		if got := tailStart(tt.window); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestValidator checks that a value turned down by the Validator is never written to the file, by any of the
+// ways of writing one, with the validator's own error returned.
+func TestValidator(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "validator.db")
+	db, err := Open(dbPath, filepath.Join(dir, "validator-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	errNotJSON := errors.New("not JSON")
+	db.Validator = func(key, value string) error {
+		if !json.Valid([]byte(value)) {
+			return fmt.Errorf("%w: value for %q", errNotJSON, key)
+		}
+		return nil
+	}
+
+	if err := Set(ctx, db, "1", `{"a":1}`); err != nil {
+		t.Fatalf("set valid JSON: %v", err)
+	}
+	rejected := []struct {
+		name  string
+		write func() error
+		grows bool // Whether entries written alongside the rejected one are written regardless.
+	}{
+		{"set", func() error { return Set(ctx, db, "2", "{bad") }, false},
+		{"set with a TTL", func() error { return SetWithTTL(ctx, db, "2", "{bad", time.Hour) }, false},
+		{"batch", func() error { return SetBatch(db, map[string]string{"3": `{"b":2}`, "2": "{bad"}) }, false},
+		{"compare and swap", func() error {
+			_, err := CompareAndSwap(db, "1", `{"a":1}`, "{bad")
+			return err
+		}, false},
+		{"stream", func() error { return SetStream(db, "2", strings.NewReader("{bad"), 4) }, false},
+		{"writer", func() error {
+			w := db.NewWriter()
+			if _, err := w.Write([]byte("3,{\"b\":2}\n2,{bad\n")); err != nil {
+				return err
+			}
+			return w.Close()
+		}, true},
+	}
+	for _, r := range rejected {
+		before, err := db.OnDiskBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.write(); !errors.Is(err, errNotJSON) {
+			t.Fatalf("%s invalid JSON: got error %v, want %v", r.name, err, errNotJSON)
+		}
+		if after, err := db.OnDiskBytes(); err != nil || !r.grows && after != before {
+			t.Fatalf("%s invalid JSON: file went from %d to %d bytes, error %v", r.name, before, after, err)
+		}
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("{bad")) {
+		t.Fatal("a rejected value is in the database file")
+	}
+	if _, err := Get(ctx, db, "2"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("get rejected ID: got error %v, want %v", err, ErrKeyNotFound)
+	}
+
+	// A line before the rejected one is still written by the DBWriter, as Write had already taken it.
+	if got, err := Get(ctx, db, "3"); err != nil || got != `{"b":2}` {
+		t.Fatalf("get %q: got %q and error %v, want %q", "3", got, err, `{"b":2}`)
+	}
+
+	// Deletes are never validated, and without a validator anything goes.
+	if err := Delete(ctx, db, "1"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	db.Validator = nil
+	if err := Set(ctx, db, "2", "{bad"); err != nil {
+		t.Fatalf("set without a validator: %v", err)
+	}
+}
+
+// TestIndexPastEOF checks that an index entry pointing past the end of a database file which has been cut short
+// underneath it is reported as a mismatch, rather than read as an empty value, and that opening the database again
+// rebuilds the index from what is left of the file.
+func TestIndexPastEOF(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "past-eof.db")
+	indexPath := filepath.Join(dir, "past-eof-index.db")
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	if err := Set(ctx, db, "kept", "value"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Set(ctx, db, "lost", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	// As a partial restore would, the file loses its last record whilst the index still has an entry for it.
+	if err := os.Truncate(dbPath, info.Size()); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := Get(ctx, db, "lost"); !errors.Is(err, ErrIndexDataMismatch) {
+		t.Fatalf("get of a record cut off the file: got %q, %v, want error %v", value, err, ErrIndexDataMismatch)
+	}
+	if _, err := GetStream(db, "lost"); !errors.Is(err, ErrIndexDataMismatch) {
+		t.Fatalf("get stream of a record cut off the file: got error %v, want %v", err, ErrIndexDataMismatch)
+	}
+	if value, err := Get(ctx, db, "kept"); err != nil || value != "value" {
+		t.Fatalf("get of a record left in the file: got %q, %v, want %q", value, err, "value")
+	}
+
+	// The index stored on closing still has the entry, which Open finds doesn't match and rebuilds from the file.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath, indexPath, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Get(ctx, db, "lost"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("get of a record cut off the file once reopened: got error %v, want %v", err, ErrKeyNotFound)
+	}
+	if value, err := Get(ctx, db, "kept"); err != nil || value != "value" {
+		t.Fatalf("get of a record left in the file once reopened: got %q, %v, want %q", value, err, "value")
+	}
+}
+
+// TestMultilineValues checks that values with newlines in them, including ones which look like records of the
+// plain "<id>,<string>" format, are read back exactly as written, through the index and by a full scan, and once the
+// database has been opened again and compacted.
+func TestMultilineValues(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "multiline.db")
+	indexPath := filepath.Join(dir, "multiline-index.db")
+	entries := map[string]string{
+		"lines":    "first\nsecond\nthird",
+		"crlf":     "windows\r\nline endings\r\n",
+		"trailing": "ends with a newline\n",
+		"records":  "looks like\n2,another record\n3,and another",
+		"empty":    "\n\n",
+	}
+
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Set(ctx, db, "lines", entries["lines"]); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	if err := SetBatch(db, entries); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+
+	check := func(stage string) error {
+		for _, disabled := range []bool{false, true} {
+			db.HashDisabled = disabled
+			for id, want := range entries {
+				if got, err := Get(ctx, db, id); err != nil || got != want {
+					return fmt.Errorf("%s, index disabled %v: get %q: got %q, %v, want %q", stage, disabled, id, got, err, want)
+				}
+			}
+		}
+		db.HashDisabled = false
+		if n := db.Len(); n != len(entries) {
+			return fmt.Errorf("%s: got %d keys, want %d", stage, n, len(entries))
+		}
+		return nil
+	}
+	if err := check("written"); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = Open(dbPath, indexPath, false); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := check("opened again"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Compact(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := check("compacted"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestScanProgress checks that a full scan, with a single reader and split between workers, reports its progress
+// more than once, only ever going forwards, and finishes on the size of the file.
+func TestScanProgress(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "progress.db")
+	db, err := Open(dbPath, filepath.Join(dir, "progress-index.db"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Enough for each of the workers to be given a part of the file.
+	entries := make(map[string]string)
+	for i := 0; i < 4096; i++ {
+		entries[strconv.Itoa(i)] = strings.Repeat("v", 1024)
+	}
+	if err := SetBatch(db, entries); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, workers := range []int{1, 4} {
+		var calls int
+		var last int64
+		var backwards bool
+		db.ScanWorkers = workers
+		db.ScanProgress = func(scanned, total int64) {
+			calls++
+			if scanned < last || total != info.Size() {
+				backwards = true
+			}
+			last = scanned
+		}
+		if _, err := Get(ctx, db, "0"); err != nil {
+			t.Fatal(err)
+		}
+		if calls < 2 || backwards || last != info.Size() {
+			t.Fatalf("scan progress with %d workers: %d calls ending on %d of %d bytes, went backwards: %v", workers, calls, last, info.Size(), backwards)
+		}
+	}
+}
+
+// TestInvalidKeys checks that empty and whitespace-only IDs are rejected by every kind of write, whilst IDs with
+// commas or surrounding whitespace are kept exactly as they are.
+func TestInvalidKeys(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "keys.db"), filepath.Join(dir, "keys-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, id := range []string{"", " ", "\t\n"} {
+		var txn Transaction
+		txn.Delete(id)
+		writes := map[string]error{
+			"set":         Set(ctx, db, id, "value"),
+			"set batch":   SetBatch(db, map[string]string{"valid": "value", id: "value"}),
+			"delete":      Delete(ctx, db, id),
+			"transaction": txn.Commit(db),
+		}
+		for name, err := range writes {
+			if !errors.Is(err, ErrInvalidKey) {
+				t.Fatalf("%s %q: got error %v, want %v", name, id, err, ErrInvalidKey)
+			}
+		}
+	}
+	if n := db.Len(); n != 0 {
+		t.Fatalf("got %d keys after only invalid writes, want none", n)
+	}
+
+	for _, id := range []string{"a,b", " a", "a"} {
+		if err := Set(ctx, db, id, "value "+id); err != nil {
+			t.Fatalf("set %q: %v", id, err)
+		}
+	}
+	for _, id := range []string{"a,b", " a", "a"} {
+		if got, err := Get(ctx, db, id); err != nil || got != "value "+id {
+			t.Fatalf("get %q: got %q, %v, want %q", id, got, err, "value "+id)
+		}
+	}
+}
+
+// TestOptions checks that the files of a database opened with a Dir and FileMode are all created inside that
+// directory, which is created for them, and with that mode, including those written afresh by compaction.
+func TestOptions(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dataDir := filepath.Join(dir, "options", "data")
+	opts := Options{Dir: dataDir, FileMode: 0640}
+	db, err := OpenWithOptions("options.db", "options-index.db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, id := range []string{"a", "b", "a"} {
+		if err := Set(ctx, db, id, "1"); err != nil {
+			t.Fatalf("set %q: %v", id, err)
+		}
+	}
+	if err := Compact(ctx, db); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if err := CreateValueIndex(db, 1); err != nil {
+		t.Fatalf("create value index: %v", err)
+	}
+
+	if info, err := os.Stat(dataDir); err != nil || info.Mode().Perm() != 0750 {
+		t.Fatalf("directory created for the database: got %v (error %v), want mode %v", info, err, os.FileMode(0750))
+	}
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"options.db", "options-index.db", "options.db.lock", "options-index.db.values"} {
+		found := false
+		for _, entry := range entries {
+			found = found || entry.Name() == want
+		}
+		if !found {
+			t.Fatalf("file %q is missing from the database directory", want)
+		}
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0640 {
+			t.Fatalf("file %q: got mode %v, want %v", entry.Name(), info.Mode().Perm(), os.FileMode(0640))
+		}
+	}
+	if _, err := os.Stat("options.db"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("database file in the working directory: got error %v, want it not to exist", err)
+	}
+}
+
+// TestCompactKeepsFileMode checks that the database and index files keep the permissions they were given after
+// being created, rather than going back to FileMode, once compaction and a snapshot of the index replace them.
+func TestCompactKeepsFileMode(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "mode.db")
+	indexPath := filepath.Join(dir, "mode-index.db")
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{dbPath, indexPath} {
+		if err := os.Chmod(path, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, id := range []string{"a", "b", "a"} {
+		if err := Set(ctx, db, id, "1"); err != nil {
+			t.Fatalf("set %q: %v", id, err)
+		}
+	}
+	if err := Compact(ctx, db); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	for _, path := range []string{dbPath, indexPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Fatalf("file %q: got mode %v, want %v", filepath.Base(path), info.Mode().Perm(), os.FileMode(0600))
+		}
+	}
+}
+
+// TestReadOnly checks that a database opened read-only alongside a writer rejects every write, reads what was
+// there when it was opened along with what the writer has added since, and leaves the index file untouched.
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "readonly.db")
+	indexPath := filepath.Join(dir, "readonly-index.db")
+	writer, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	if err := Set(ctx, writer, "a", "1"); err != nil {
+		t.Fatalf("set %q: %v", "a", err)
+	}
+	index, err := os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := OpenReadOnly(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatalf("open read-only: %v", err)
+	}
+	var txn Transaction
+	txn.Set("b", "1")
+	writes := map[string]error{
+		"set":           Set(ctx, reader, "b", "1"),
+		"delete":        Delete(ctx, reader, "a"),
+		"set batch":     SetBatch(reader, map[string]string{"b": "1"}),
+		"commit":        txn.Commit(reader),
+		"compact":       Compact(ctx, reader),
+		"rebuild index": RebuildIndex(reader),
+	}
+	for name, err := range writes {
+		if !errors.Is(err, ErrReadOnly) {
+			reader.Close()
+			t.Fatalf("%s when read-only: got error %v, want %v", name, err, ErrReadOnly)
+		}
+	}
+
+	if err := Set(ctx, writer, "c", "2"); err != nil {
+		reader.Close()
+		t.Fatalf("set %q whilst open read-only: %v", "c", err)
+	}
+	for id, want := range map[string]string{"a": "1", "c": "2"} {
+		if entry, err := Get(ctx, reader, id); err != nil || entry != want {
+			reader.Close()
+			t.Fatalf("get %q when read-only: got %q (error %v), want %q", id, entry, err, want)
+		}
+	}
+	if _, err := Get(ctx, reader, "b"); !errors.Is(err, ErrKeyNotFound) {
+		reader.Close()
+		t.Fatalf("get rejected %q when read-only: got error %v, want %v", "b", err, ErrKeyNotFound)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatalf("close read-only: %v", err)
+	}
+
+	// The writer's set of c is in the index log, the reader must not have folded it into a snapshot of its own.
+	after, err := os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(after), string(index)) {
+		t.Fatal("index file was rewritten by a read-only open")
+	}
+}
+
+// TestHas checks that Has only reports live keys, with and without the hash index.
+func TestHas(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "has.db"), filepath.Join(dir, "has-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, id := range []string{"live", "deleted"} {
+		if err := Set(ctx, db, id, "value"); err != nil {
+			t.Fatalf("set %q: %v", id, err)
+		}
+	}
+	if err := Delete(ctx, db, "deleted"); err != nil {
+		t.Fatalf("delete %q: %v", "deleted", err)
+	}
+
+	for _, disabled := range []bool{false, true} {
+		db.HashDisabled = disabled
+		for id, want := range map[string]bool{"live": true, "deleted": false, "never-set": false} {
+			if got, err := db.Has(id); err != nil || got != want {
+				t.Fatalf("has %q with index disabled %v: got %v (error %v), want %v", id, disabled, got, err, want)
+			}
+		}
+	}
+}
+
+// TestMaxValueBytes checks that values longer than MaxValueBytes are rejected, whilst those up to it, which
+// here are larger than a read ahead or a default bufio buffer, are written and read back whole.
+func TestMaxValueBytes(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "large.db"), filepath.Join(dir, "large-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.MaxValueBytes = 100 * 1024
+	large := strings.Repeat("v", db.MaxValueBytes)
+	if err := Set(ctx, db, "large", large); err != nil {
+		t.Fatalf("set value of %d bytes: %v", len(large), err)
+	}
+	if err := Set(ctx, db, "too-large", large+"v"); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("set value over MaxValueBytes: got error %v, want %v", err, ErrValueTooLarge)
+	}
+	if err := SetBatch(db, map[string]string{"too-large": large + "v"}); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("set batch with value over MaxValueBytes: got error %v, want %v", err, ErrValueTooLarge)
+	}
+
+	for _, disabled := range []bool{false, true} {
+		db.HashDisabled = disabled
+		if entry, err := Get(ctx, db, "large"); err != nil || entry != large {
+			t.Fatalf("get value of %d bytes with index disabled %v: got %d bytes (error %v)", len(large), disabled, len(entry), err)
+		}
+	}
+	if _, err := Get(ctx, db, "too-large"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("get rejected value: got error %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+// TestIndexAgreesWithFullScan checks that the hash index and a full scan see the same latest entries, missing IDs
+// and deletes, and that rebuilding the index from the file gives exactly what the writes stored in it.
+func TestIndexAgreesWithFullScan(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Overwriting one of the entries means there are multiple records for it.
+	for _, kv := range []KV{{"1", "foo"}, {"2", "bar"}, {"1", "baz"}} {
+		if err := Set(ctx, db, kv.Key, kv.Value); err != nil {
+			t.Fatalf("set %q: %v", kv.Key, err)
+		}
+	}
+	for _, disabled := range []bool{false, true} {
+		db.HashDisabled = disabled
+		for id, want := range map[string]string{"1": "baz", "2": "bar"} {
+			if value, err := Get(ctx, db, id); err != nil || value != want {
+				t.Fatalf("get %q (index disabled: %t): got %q (error %v), want %q", id, disabled, value, err, want)
+			}
+		}
+		if _, err := Get(ctx, db, "3"); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("get missing %q (index disabled: %t): got error %v, want %v", "3", disabled, err, ErrKeyNotFound)
+		}
+	}
+
+	// A full scan should stop once it is cancelled, rather than reading through the rest of the file.
+	db.HashDisabled = true
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := Get(cancelled, db, "1"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("get %q with a cancelled context: got error %v, want %v", "1", err, context.Canceled)
+	}
+
+	// Deleting an entry should hide it from both paths, until it is written again.
+	db.HashDisabled = false
+	if err := Delete(ctx, db, "2"); err != nil {
+		t.Fatalf("delete %q: %v", "2", err)
+	}
+	for _, disabled := range []bool{false, true} {
+		db.HashDisabled = disabled
+		if _, err := Get(ctx, db, "2"); !errors.Is(err, ErrDeleted) {
+			t.Fatalf("get deleted %q (index disabled: %t): got error %v, want %v", "2", disabled, err, ErrDeleted)
+		}
+	}
+	db.HashDisabled = false
+	if err := Set(ctx, db, "2", "qux"); err != nil {
+		t.Fatalf("set %q: %v", "2", err)
+	}
+	if value, err := Get(ctx, db, "2"); err != nil || value != "qux" {
+		t.Fatalf("get %q after re-setting: got %q (error %v), want %q", "2", value, err, "qux")
+	}
+
+	incremental := indexContents(db.Hash)
+	if err := RebuildIndex(db); err != nil {
+		t.Fatalf("rebuild index: %v", err)
+	}
+	if err := sameIndex(indexContents(db.Hash), incremental); err != nil {
+		t.Fatalf("rebuilt hash index: %v", err)
+	}
+}
+
+// benchDB opens a database in a temporary directory holding keys entries, "key-0" onwards, with values of
+// valueSize bytes, written in batches so that filling it takes little of the benchmark's time.
+func benchDB(b *testing.B, keys, valueSize int) *DB {
+	b.Helper()
+	dir := b.TempDir()
+	db, err := Open(filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db"), false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+
+	value := strings.Repeat("v", valueSize)
+	batch := make(map[string]string)
+	for i := 0; i < keys; i++ {
+		batch[fmt.Sprint("key-", i)] = value
+		if len(batch) == 1000 || i == keys-1 {
+			if err := SetBatch(db, batch); err != nil {
+				b.Fatal(err)
+			}
+			batch = make(map[string]string)
+		}
+	}
+	return db
+}
+
+// readRecordSection reads the record at offset through a buffered reader over the rest of the file, the way
+// indexed records were read before readRecordAt, kept here to compare the two.
+func readRecordSection(db *DB, offset int64) (string, error) {
+	info, err := db.DB.Stat()
+	if err != nil {
+		return "", err
+	}
+	_, value, _, _, _, err := decodeRecord(bufio.NewReader(io.NewSectionReader(db.DB, offset, info.Size()-offset)))
+	return value, err
+}
+
+func BenchmarkGetParallel(b *testing.B) {
+	const keys = 1000
+	for _, valueSize := range []int{100, 4096} {
+		db := benchDB(b, keys, valueSize)
+
+		b.Run(fmt.Sprintf("ReadAt/%dB", valueSize), func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				ctx := context.Background()
+				for i := 0; pb.Next(); i++ {
+					if _, err := Get(ctx, db, fmt.Sprint("key-", i%keys)); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+		b.Run(fmt.Sprintf("section reader/%dB", valueSize), func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					db.RLock()
+					loc, _ := db.Hash.Get(fmt.Sprint("key-", i%keys))
+					_, err := readRecordSection(db, loc.Offset)
+					db.RUnlock()
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkFullScan looks for a missing key in a file of 1M records with the hash index disabled, so that every Get
+// reads through the whole file.
+func BenchmarkFullScan(b *testing.B) {
+	db := benchScanDB(b, 1000000)
+	b.SetBytes(db.WriteOffset())
+
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Get(ctx, db, "missing"); !errors.Is(err, ErrKeyNotFound) {
+			b.Fatalf("get %q: got %v, want %v", "missing", err, ErrKeyNotFound)
+		}
+	}
+}
+
+// BenchmarkParallelScan is BenchmarkFullScan with the file split between more and more ScanWorkers, one of them
+// being the sequential scan the others are compared against.
+func BenchmarkParallelScan(b *testing.B) {
+	db := benchScanDB(b, 1000000)
+	ctx := context.Background()
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			db.ScanWorkers = workers
+			b.SetBytes(db.WriteOffset())
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := Get(ctx, db, "missing"); !errors.Is(err, ErrKeyNotFound) {
+					b.Fatalf("get %q: got %v, want %v", "missing", err, ErrKeyNotFound)
+				}
+			}
+		})
+	}
+}
+
+// benchScanDB opens a database of the given number of records with the hash index disabled, for the full scan
+// benchmarks.
+func benchScanDB(b *testing.B, records int) *DB {
+	b.Helper()
+	dir := b.TempDir()
+	dbPath := filepath.Join(dir, "data.db")
+
+	// Writing the records out directly is far quicker than setting them one by one.
+	f, err := os.Create(dbPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := bufio.NewWriter(f)
+	if err := writeHeader(w, 0); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < records; i++ {
+		if _, err := w.Write(encodeRecord(fmt.Sprint("key-", i), "value", 0, uint64(i+1), 0)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		b.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	db, err := Open(dbPath, filepath.Join(dir, "index.db"), true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+	return db
+}
+
+// TestAllowInPlaceUpdate checks that overwriting a value with one of the same length replaces its record without
+// growing the file, that one of another length is appended as usual, and that the records are still whole, checksums
+// and lengths included, both as written and once the database is opened again.
+func TestAllowInPlaceUpdate(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dbPath, indexPath := filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db")
+
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+	db.AllowInPlaceUpdate = true
+
+	for _, kv := range []KV{{"a", "1111"}, {"b", "22"}} {
+		if err := Set(ctx, db, kv.Key, kv.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	locA, _ := db.Hash.Get("a")
+	locB, _ := db.Hash.Get("b")
+	size := db.WriteOffset()
+
+	if err := Set(ctx, db, "a", "3333"); err != nil {
+		t.Fatalf("same length overwrite: %v", err)
+	}
+	if got := db.WriteOffset(); got != size {
+		t.Fatalf("same length overwrite: file went from %d to %d bytes, want it unchanged", size, got)
+	}
+	if loc, _ := db.Hash.Get("a"); loc.Offset != locA.Offset {
+		t.Fatalf("same length overwrite: record moved from %d to %d", locA.Offset, loc.Offset)
+	}
+
+	if err := Set(ctx, db, "b", "444"); err != nil {
+		t.Fatalf("longer overwrite: %v", err)
+	}
+	if got, want := db.WriteOffset(), size+recordSize("b", "444"); got != want {
+		t.Fatalf("longer overwrite: file went from %d to %d bytes, want %d", size, got, want)
+	}
+	if loc, _ := db.Hash.Get("b"); loc.Offset != size {
+		t.Fatalf("longer overwrite: record at %d, want it appended at %d", loc.Offset, size)
+	}
+	lastSeq := db.LastSeq()
+
+	want := map[string]string{"a": "3333", "b": "444"}
+	check := func(stage string) {
+		t.Helper()
+		for id, value := range want {
+			if got, err := Get(ctx, db, id); err != nil || got != value {
+				t.Fatalf("get %q %s: got %q (error %v), want %q", id, stage, got, err, value)
+			}
+		}
+		if corrupt, err := Verify(db); err != nil || len(corrupt) != 0 {
+			t.Fatalf("verify %s: got corrupt records at %v (error %v)", stage, corrupt, err)
+		}
+
+		// Hopping along the lengths of the records still lands on each of them, and then on the end of the file.
+		end := db.WriteOffset()
+		for _, tt := range []struct{ from, want int64 }{{locA.Offset + 1, locB.Offset}, {locB.Offset + 1, size}, {size + 1, end}} {
+			if got, err := recordBoundary(db, tt.from, end); err != nil || got != tt.want {
+				t.Fatalf("record boundary from %d %s: got %d (error %v), want %d", tt.from, stage, got, err, tt.want)
+			}
+		}
+		if got := db.LastSeq(); got != lastSeq {
+			t.Fatalf("last sequence number %s: got %d, want %d", stage, got, lastSeq)
+		}
+	}
+	check("after the overwrites")
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath, indexPath, false); err != nil {
+		t.Fatal(err)
+	}
+	check("once opened again")
+
+	// Without the stored index, the records are read back from the file alone.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(indexPath); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath, indexPath, false); err != nil {
+		t.Fatal(err)
+	}
+	check("once the index is rebuilt")
+}
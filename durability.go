@@ -0,0 +1,134 @@
+package logstructured
+
+import (
+	"time"
+)
+
+// SyncPolicy controls when appends to the database file are flushed to disk with an fsync. Until then, a
+// write which has returned successfully may only be held by the operating system, and so can be lost if
+// the machine, rather than just the process, goes down.
+type SyncPolicy struct {
+	always   bool
+	interval time.Duration
+}
+
+var (
+	// SyncNever leaves flushing appends to disk up to the operating system. A crash of the machine can lose
+	// any number of recently acknowledged writes, although one of just the process loses nothing, unless
+	// appends are being buffered, see DB.WriteBufferSize.
+	SyncNever = SyncPolicy{}
+
+	// SyncAlways flushes every append to disk before the write returns, and before the hash index is updated
+	// to point at it, so the index never refers to a record which isn't on disk. An acknowledged write
+	// survives a crash of the machine, at the cost of an fsync for every write.
+	SyncAlways = SyncPolicy{always: true}
+)
+
+// SyncInterval flushes appends to disk in the background, at most d after the first one that hasn't yet
+// been flushed. A crash of the machine loses at most the writes acknowledged in the last d, and the hash
+// index may be left pointing past the end of the file, which Open recovers from by rebuilding it.
+func SyncInterval(d time.Duration) SyncPolicy {
+	if d <= 0 {
+		return SyncAlways
+	}
+	return SyncPolicy{interval: d}
+}
+
+// Flush makes everything written so far durable without closing the database, whatever the SyncPolicy. Appends held
+// in the write buffer are written out and the database file is flushed to disk, then any pending update to the hash
+// index is written out as a new snapshot, as on Close. Once it returns, a copy of the files, such as an external
+// backup, holds every write made before it was called. Everything is attempted, even after a failure, with the first
+// error returned. This includes a failure of a background sync, index write or compaction which hasn't been reported
+// to a write yet.
+func (db *DB) Flush() error {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	return flush(db)
+}
+
+// flush is Flush without taking the lock, which Close shares. The lock must be held.
+func flush(db *DB) error {
+
+	// A failed background write may not have been reported yet, as that only happens on the next write.
+	err := db.indexErr
+	if err == nil {
+		err = db.syncErr
+	}
+	if err == nil {
+		err = db.compactErr
+	}
+	db.indexErr, db.syncErr, db.compactErr = nil, nil, nil
+
+	if db.syncTimer != nil {
+		db.syncTimer.Stop()
+		db.syncTimer = nil
+	}
+	if flushErr := flushWrites(db); err == nil {
+		err = flushErr
+	}
+	if syncErr := db.DB.Sync(); err == nil {
+		err = syncErr
+	}
+
+	if db.indexTimer != nil || db.indexLogEntries > 0 || len(db.dirty) > 0 || db.indexLogFailed {
+		if db.indexTimer != nil {
+			db.indexTimer.Stop()
+			db.indexTimer = nil
+		}
+		if indexErr := writeIndex(db); err == nil {
+			err = indexErr
+		}
+	}
+	if valuesErr := storeValueIndex(db); err == nil {
+		err = valuesErr
+	}
+
+	return err
+}
+
+// syncAppend carries out the SyncPolicy following an append to the database file. The lock must be held.
+func syncAppend(db *DB) error {
+
+	// A background sync can only report its failure to the next write.
+	if err := db.syncErr; err != nil {
+		db.syncErr = nil
+		return err
+	}
+
+	switch {
+	case db.SyncPolicy.always:
+		if err := flushWrites(db); err != nil {
+			return err
+		}
+		return db.DB.Sync()
+	case db.SyncPolicy.interval > 0 && db.syncTimer == nil:
+
+		// As with the debounced index writes, the timer is handed to its own callback so that it can tell
+		// whether it is still the pending one once it has the lock.
+		var t *time.Timer
+		t = time.AfterFunc(db.SyncPolicy.interval, func() {
+			db.Lock()
+			defer db.Unlock()
+
+			if db.syncTimer != t {
+				return
+			}
+			db.syncTimer = nil
+			db.syncErr = flushWrites(db)
+			if db.syncErr == nil {
+				db.syncErr = db.DB.Sync()
+			}
+		})
+		db.syncTimer = t
+	}
+
+	return nil
+}
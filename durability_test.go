@@ -0,0 +1,191 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestFlush checks that a copy of the files taken after Flush, as an external backup would, opens with every write
+// made before it, even with the writes buffered and the index debounced for longer than the test runs, and that the
+// database carries on being written to afterwards.
+func TestFlush(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "flush.db")
+	indexPath := filepath.Join(dir, "flush-index.db")
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.WriteBufferSize = 1 << 20
+	db.IndexDebounce = time.Hour
+	const keys = 50
+	for i := 0; i < keys; i++ {
+		if err := Set(ctx, db, fmt.Sprint(i), fmt.Sprint("value ", i)); err != nil {
+			t.Fatalf("set %q: %v", fmt.Sprint(i), err)
+		}
+	}
+
+	// Copies the files as they are on disk, then opens the copy.
+	backup := func(name string) (*DB, error) {
+		copyPath, copyIndexPath := filepath.Join(dir, name+".db"), filepath.Join(dir, name+"-index.db")
+		for from, to := range map[string]string{dbPath: copyPath, indexPath: copyIndexPath} {
+			b, err := os.ReadFile(from)
+			if err != nil {
+				return nil, err
+			}
+			if err := os.WriteFile(to, b, 0666); err != nil {
+				return nil, err
+			}
+		}
+		return Open(copyPath, copyIndexPath, false)
+	}
+
+	// Until the flush, the writes are all still in the buffer.
+	early, err := backup("flush-early")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := early.Len()
+	early.Close()
+	if n != 0 {
+		t.Fatalf("got %d keys in a copy taken before flushing buffered writes, want none", n)
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	copied, err := backup("flush-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Close()
+	for i := 0; i < keys; i++ {
+		id, want := fmt.Sprint(i), fmt.Sprint("value ", i)
+		if got, err := Get(ctx, copied, id); err != nil || got != want {
+			t.Fatalf("get %q from a copy taken after flushing: got %q, %v, want %q", id, got, err, want)
+		}
+	}
+	stored, err := ReadIndexFile(indexPath, NewMapIndex)
+	if err != nil {
+		t.Fatalf("read index file: %v", err)
+	}
+	if err := sameIndex(indexContents(stored), indexContents(db.Hash)); err != nil {
+		t.Fatalf("stored hash index after flushing: %v", err)
+	}
+
+	if err := Set(ctx, db, "after", "flush"); err != nil {
+		t.Fatalf("set %q after flushing: %v", "after", err)
+	}
+	if got, err := Get(ctx, db, "after"); err != nil || got != "flush" {
+		t.Fatalf("get %q after flushing: got %q, %v, want %q", "after", got, err, "flush")
+	}
+}
+
+// TestSyncPolicy checks that writes made under each SyncPolicy are all there once the database is opened again, and
+// that under SyncAlways a write which has returned survives a crash even with appends otherwise being buffered,
+// whereas under SyncNever it is lost along with the buffer.
+func TestSyncPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	policies := []struct {
+		name   string
+		policy SyncPolicy
+	}{
+		{"never", SyncNever},
+		{"always", SyncAlways},
+		{"interval", SyncInterval(time.Millisecond)},
+		{"zero interval", SyncInterval(0)},
+		{"negative interval", SyncInterval(-time.Second)},
+	}
+	for _, tt := range policies {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			dbPath, indexPath := filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db")
+			db, err := Open(dbPath, indexPath, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.SyncPolicy = tt.policy
+
+			if err := Set(ctx, db, "a", "1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := SetBatch(db, map[string]string{"b": "2", "c": "3"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := Delete(ctx, db, "c"); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if db, err = Open(dbPath, indexPath, false); err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for id, want := range map[string]string{"a": "1", "b": "2"} {
+				if got, err := Get(ctx, db, id); err != nil || got != want {
+					t.Fatalf("get %q once opened again: got %q (error %v), want %q", id, got, err, want)
+				}
+			}
+			if _, err := Get(ctx, db, "c"); !errors.Is(err, ErrDeleted) {
+				t.Fatalf("get of a deleted key once opened again: got %v, want %v", err, ErrDeleted)
+			}
+		})
+	}
+
+	if SyncInterval(0) != SyncAlways {
+		t.Fatalf("SyncInterval(0): got %+v, want SyncAlways", SyncInterval(0))
+	}
+
+	crashes := []struct {
+		name     string
+		policy   SyncPolicy
+		survives bool
+	}{
+		{"always", SyncAlways, true},
+		{"never", SyncNever, false},
+	}
+	for _, tt := range crashes {
+		t.Run("crash under "+tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			dbPath, indexPath := filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db")
+			db, err := Open(dbPath, indexPath, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.SyncPolicy = tt.policy
+			db.WriteBufferSize = 1 << 20
+
+			if err := Set(ctx, db, "acked", "value"); err != nil {
+				t.Fatal(err)
+			}
+			db.CrashPoint = CrashAfterWrite
+			if err := Set(ctx, db, "crashed", "value"); !errors.Is(err, ErrCrashed) {
+				t.Fatalf("set at the crash point: got %v, want %v", err, ErrCrashed)
+			}
+
+			if db, err = Open(dbPath, indexPath, false); err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			got, err := Get(ctx, db, "acked")
+			switch {
+			case tt.survives && (err != nil || got != "value"):
+				t.Fatalf("get of an acknowledged write after a crash: got %q (error %v), want %q", got, err, "value")
+			case !tt.survives && !errors.Is(err, ErrKeyNotFound):
+				t.Fatalf("get of a buffered write after a crash: got %q (error %v), want %v", got, err, ErrKeyNotFound)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package logstructured
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The files every namespace of an Engine keeps within its own directory.
+const (
+	engineDBFile    = "data.db"
+	engineIndexFile = "index.db"
+)
+
+// ErrInvalidNamespace is returned by Engine.DB for a name which can't be used as the directory of a namespace.
+var ErrInvalidNamespace = errors.New("invalid namespace")
+
+// Engine keeps several independent databases, or namespaces, under a single base directory, opening each of them the
+// first time it is asked for. Each namespace has a directory of its own, named after it, holding its database and
+// index files along with everything else kept alongside them, so namespaces never share any state. An Engine is
+// safe for concurrent use.
+type Engine struct {
+	dir  string
+	opts Options
+
+	mu     sync.Mutex
+	dbs    map[string]*DB
+	closed bool
+}
+
+// NewEngine returns an Engine keeping its namespaces in dir, which each open with opts, bar opts.Dir, which is the
+// namespace's own directory. Nothing is opened or created until a namespace is first asked for.
+func NewEngine(dir string, opts Options) *Engine {
+	return &Engine{dir: dir, opts: opts, dbs: make(map[string]*DB)}
+}
+
+// DB returns the database for the namespace called name, opening it, or creating it if it doesn't exist yet, the
+// first time it is asked for. Later calls return the same *DB, unless it has been closed in the meantime, in which
+// case it is opened again. The name is used as a directory name, so it can't be empty, "." or "..", or contain a
+// path separator.
+func (e *Engine) DB(name string) (*DB, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("%w: %q, a namespace name can't be empty, '.' or '..', or contain a path separator", ErrInvalidNamespace, name)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return nil, ErrClosed
+	}
+	if db, ok := e.dbs[name]; ok && !isClosed(db) {
+		return db, nil
+	}
+
+	opts := e.opts
+	opts.Dir = filepath.Join(e.dir, name)
+	db, err := OpenWithOptions(engineDBFile, engineIndexFile, opts)
+	if err != nil {
+		return nil, fmt.Errorf("open namespace %q: %w", name, err)
+	}
+	e.dbs[name] = db
+	return db, nil
+}
+
+// Namespaces returns the names of the namespaces which are open, in sorted order.
+func (e *Engine) Namespaces() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	names := make([]string, 0, len(e.dbs))
+	for name, db := range e.dbs {
+		if !isClosed(db) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close closes the database of every namespace which has been opened, returning the first error from closing them,
+// although all of them are closed regardless. The Engine returns ErrClosed from any further use.
+func (e *Engine) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+
+	var err error
+	for name, db := range e.dbs {
+		if closeErr := db.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("close namespace %q: %w", name, closeErr)
+		}
+	}
+	e.dbs = nil
+	return err
+}
+
+// isClosed reports whether db has been closed.
+func isClosed(db *DB) bool {
+	db.RLock()
+	defer db.RUnlock()
+
+	return db.closed
+}
@@ -0,0 +1,98 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// TestEngine checks that the namespaces of an engine are kept apart, each seeing only its own keys, and that
+// they are still there once the engine has been closed and created again.
+func TestEngine(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	engineDir := filepath.Join(dir, "engine")
+
+	engine := NewEngine(engineDir, Options{})
+	defer func() { engine.Close() }()
+
+	users, err := engine.DB("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders, err := engine.DB("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := engine.DB("users"); err != nil || again != users {
+		t.Fatalf("namespace %q asked for again: got a different database (%v)", "users", err)
+	}
+	for _, name := range []string{"", "..", "a/b"} {
+		if _, err := engine.DB(name); !errors.Is(err, ErrInvalidNamespace) {
+			t.Fatalf("namespace %q: got error %v, want %v", name, err, ErrInvalidNamespace)
+		}
+	}
+
+	writes := map[*DB]map[string]string{
+		users:  {"alice": "admin", "shared": "from users"},
+		orders: {"1001": "shipped", "shared": "from orders"},
+	}
+	for db, entries := range writes {
+		if err := SetBatch(db, entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(users, orders *DB) error {
+		for _, c := range []struct {
+			db      *DB
+			id      string
+			want    string
+			missing bool
+		}{
+			{db: users, id: "alice", want: "admin"},
+			{db: users, id: "shared", want: "from users"},
+			{db: users, id: "1001", missing: true},
+			{db: orders, id: "1001", want: "shipped"},
+			{db: orders, id: "shared", want: "from orders"},
+			{db: orders, id: "alice", missing: true},
+		} {
+			got, err := Get(ctx, c.db, c.id)
+			if c.missing {
+				if !errors.Is(err, ErrKeyNotFound) {
+					return fmt.Errorf("get %q from the other namespace: got %q, %v, want %v", c.id, got, err, ErrKeyNotFound)
+				}
+				continue
+			}
+			if err != nil || got != c.want {
+				return fmt.Errorf("get %q: got %q, %v, want %q", c.id, got, err, c.want)
+			}
+		}
+		return nil
+	}
+	if err := check(users, orders); err != nil {
+		t.Fatal(err)
+	}
+
+	if names := engine.Namespaces(); fmt.Sprint(names) != "[orders users]" {
+		t.Fatalf("namespaces: got %v, want [orders users]", names)
+	}
+	if err := engine.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := engine.DB("users"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("namespace of a closed engine: got error %v, want %v", err, ErrClosed)
+	}
+
+	engine = NewEngine(engineDir, Options{})
+	if users, err = engine.DB("users"); err != nil {
+		t.Fatal(err)
+	}
+	if orders, err = engine.DB("orders"); err != nil {
+		t.Fatal(err)
+	}
+	if err := check(users, orders); err != nil {
+		t.Fatalf("after opening again: %v", err)
+	}
+}
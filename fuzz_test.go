@@ -0,0 +1,74 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// FuzzRoundTrip writes an arbitrary ID and value, which must either read back exactly, through the hash index, a
+// full scan and once opened again, or be rejected with ErrInvalidKey or ErrInvalidValue.
+func FuzzRoundTrip(f *testing.F) {
+	for _, seed := range [][2]string{
+		{"a", "1"},
+		{"a,b", "1,2\n3,4"},
+		{"a\nb", "\n"},
+		{"\x00", "\x00\xff"},
+		{"", "empty id"},
+		{" ", "whitespace id"},
+		{"tombstone", Tombstone},
+		{txnBeginKey, "marker"},
+		{"empty value", ""},
+	} {
+		f.Add(seed[0], seed[1])
+	}
+
+	f.Fuzz(func(t *testing.T, id, value string) {
+		ctx := context.Background()
+		dir := t.TempDir()
+		dbPath, indexPath := filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db")
+
+		db, err := Open(dbPath, indexPath, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { db.Close() }()
+
+		if err := Set(ctx, db, id, value); err != nil {
+			if !errors.Is(err, ErrInvalidKey) && !errors.Is(err, ErrInvalidValue) {
+				t.Fatalf("set %q to %q: got %v, want it written or rejected with %v or %v", id, value, err, ErrInvalidKey, ErrInvalidValue)
+			}
+			if n := db.Len(); n != 0 {
+				t.Fatalf("rejected set of %q to %q left %d keys", id, value, n)
+			}
+			return
+		}
+
+		check := func(stage string) {
+			for _, disabled := range []bool{false, true} {
+				db.HashDisabled = disabled
+				if got, err := Get(ctx, db, id); err != nil || got != value {
+					t.Fatalf("%s, index disabled %t: get %q: got %q (error %v), want %q", stage, disabled, id, got, err, value)
+				}
+			}
+			db.HashDisabled = false
+		}
+		check("written")
+
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = Open(dbPath, indexPath, false); err != nil {
+			t.Fatal(err)
+		}
+		check("opened again")
+
+		if err := Delete(ctx, db, id); err != nil {
+			t.Fatalf("delete %q: %v", id, err)
+		}
+		if _, err := Get(ctx, db, id); !errors.Is(err, ErrDeleted) {
+			t.Fatalf("get %q once deleted: got %v, want %v", id, err, ErrDeleted)
+		}
+	})
+}
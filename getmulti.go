@@ -0,0 +1,114 @@
+package logstructured
+
+import (
+	"errors"
+	"sort"
+)
+
+// GetMulti looks up each of ids in the same way as Get, returning the live value of each which has one. IDs which
+// are missing, deleted or expired are left out of the result rather than reported as errors, anything else which
+// goes wrong stops the lookups and is returned.
+//
+// This is cheaper than a Get for each ID, as the lock is only taken once, the records the hash index points at are
+// read in the order they are in the file, and any IDs which have to be looked for by reading through the whole file
+// are all found in the same pass over it.
+func GetMulti(db *DB, ids []string) (map[string]string, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	values := make(map[string]string, len(ids))
+	keep := func(id, value string, err error) error {
+		if errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrDeleted) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		values[id] = value
+		return nil
+	}
+
+	type lookup struct {
+		id  string
+		loc RecordLocation
+	}
+	var lookups []lookup
+	scans := make(map[string]bool)
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		if db.MemtableSize > 0 && db.memtable != nil {
+			if n, ok := db.memtable.get(id); ok {
+				value, err := liveValue(db, n.value, n.expiresAt)
+				if err := keep(id, value, err); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+		if loc, ok := db.Hash.Get(id); ok && !db.HashDisabled {
+			lookups = append(lookups, lookup{id: id, loc: loc})
+			continue
+		}
+		scans[id] = true
+	}
+
+	// Reading forwards through the file, rather than jumping back and forth, makes the most of read ahead.
+	sort.Slice(lookups, func(i, j int) bool { return lookups[i].loc.Offset < lookups[j].loc.Offset })
+	for _, l := range lookups {
+		key, value, expiresAt, _, _, err := readRecord(db, l.loc)
+		if err != nil {
+			return nil, err
+		}
+
+		// As with Get, an index entry pointing at the record for another ID means the index doesn't match the file.
+		if key != l.id {
+			scans[l.id] = true
+			continue
+		}
+		value, err = liveValue(db, value, expiresAt)
+		if err := keep(l.id, value, err); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(scans) == 0 {
+		return values, nil
+	}
+
+	type latest struct {
+		value     string
+		expiresAt int64
+	}
+	found := make(map[string]latest, len(scans))
+	records := 0
+	err := eachRecord(db, func(offset int64, id, value string, expiresAt int64, seq uint64, writtenAt int64) error {
+		records++
+		if scans[id] {
+			found[id] = latest{value: value, expiresAt: expiresAt}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if db.Metrics != nil {
+		db.Metrics.ObserveScan(records)
+	}
+	for id, l := range found {
+		value, err := liveValue(db, l.value, l.expiresAt)
+		if err := keep(id, value, err); err != nil {
+			return nil, err
+		}
+	}
+
+	return values, nil
+}
@@ -0,0 +1,43 @@
+package logstructured
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// TestGetMulti checks that looking up several IDs at once returns exactly the live ones, leaving out those which
+// are missing or deleted, both through the hash index and with a full scan.
+func TestGetMulti(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "multi.db"), filepath.Join(dir, "multi-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, id := range []string{"c", "a", "b", "d", "a"} {
+		if err := Set(ctx, db, id, "value of "+id); err != nil {
+			t.Fatalf("set %q: %v", id, err)
+		}
+	}
+	if err := Delete(ctx, db, "b"); err != nil {
+		t.Fatalf("delete %q: %v", "b", err)
+	}
+
+	want := map[string]string{"a": "value of a", "c": "value of c"}
+	for _, disabled := range []bool{false, true} {
+		db.HashDisabled = disabled
+		got, err := GetMulti(db, []string{"a", "b", "c", "missing", "a"})
+		if err != nil {
+			t.Fatalf("get multi with the index disabled %t: %v", disabled, err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("get multi with the index disabled %t: got %v, want %v", disabled, got, want)
+		}
+	}
+	db.HashDisabled = false
+}
@@ -0,0 +1,17 @@
+package logstructured
+
+import "context"
+
+// GetRecord looks up id in the same way as Get, returning the latest record written for it along with where it is
+// in the database file, rather than the value alone. Deleted and expired IDs are reported with ErrDeleted and
+// ErrKeyNotFound, as with Get, which finds the record in the same way, see lookup.
+func GetRecord(db *DB, id string) (Record, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	r, err := lookup(context.Background(), db, id)
+	if err != nil {
+		return Record{}, err
+	}
+	return liveRecord(db, r)
+}
@@ -0,0 +1,124 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetRecordAgreesWithGet(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		setup func(db *DB)
+	}{
+		{"index", func(db *DB) {}},
+		{"memtable", func(db *DB) { db.MemtableSize = 1 << 20 }},
+		{"cache", func(db *DB) { db.CacheSize = 1 << 20 }},
+		{"full scan", func(db *DB) { db.HashDisabled = true }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			db, err := Open(filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db"), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			tt.setup(db)
+
+			for _, kv := range []KV{{"a", "1"}, {"b", "2"}, {"a", "3"}, {"c", "4"}} {
+				if err := Set(ctx, db, kv.Key, kv.Value); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := Delete(ctx, db, "c"); err != nil {
+				t.Fatal(err)
+			}
+
+			// Reading twice means the second read is answered from the cache, when there is one.
+			for i := 0; i < 2; i++ {
+				for _, id := range []string{"a", "b", "c", "missing"} {
+					value, getErr := Get(ctx, db, id)
+					r, err := GetRecord(db, id)
+					if !errors.Is(err, getErr) || (err == nil && r.Value != value) {
+						t.Fatalf("GetRecord(%q): got %q (error %v), Get gave %q (error %v)", id, r.Value, err, value, getErr)
+					}
+					if err != nil {
+						continue
+					}
+
+					// The record is where it says it is in the file.
+					at, err := db.ReadAtOffset(r.Offset)
+					if err != nil {
+						t.Fatalf("ReadAtOffset(%d) for %q: %v", r.Offset, id, err)
+					}
+					if at != r {
+						t.Fatalf("GetRecord(%q): got %+v, the file holds %+v", id, r, at)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestGetRecord checks that GetRecord returns the latest record for an ID with the sequence number it was written
+// with and the offset and length the hash index holds for it, both through the index and with a full scan, that
+// the change feed reports the same, and that deleted and missing IDs get the same errors as from Get.
+func TestGetRecord(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "record.db"), filepath.Join(dir, "record-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	seqs := make(map[string]uint64)
+	for _, kv := range [][2]string{{"a", "first"}, {"b", "value"}, {"a", "second"}, {"c", "deleted"}} {
+		if err := Set(ctx, db, kv[0], kv[1]); err != nil {
+			t.Fatalf("set %q: %v", kv[0], err)
+		}
+		seqs[kv[0]] = db.LastSeq()
+	}
+	if err := Delete(ctx, db, "c"); err != nil {
+		t.Fatalf("delete %q: %v", "c", err)
+	}
+
+	changes, err := Changes(ctx, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fed := make(map[string]Record)
+	for len(fed) < 3 {
+		r := <-changes
+		fed[r.Key] = r
+	}
+
+	for _, disabled := range []bool{false, true} {
+		db.HashDisabled = disabled
+		for id, want := range map[string]string{"a": "second", "b": "value"} {
+			r, err := GetRecord(db, id)
+			if err != nil {
+				t.Fatalf("index disabled %v: get record %q: %v", disabled, id, err)
+			}
+			loc, _ := db.Hash.Get(id)
+			if r.Key != id || r.Value != want || r.Seq != seqs[id] || r.Offset != loc.Offset || r.Size != int64(loc.Length) {
+				t.Fatalf("index disabled %v: get record %q: got %+v, want value %q, seq %d, offset %d and size %d",
+					disabled, id, r, want, seqs[id], loc.Offset, loc.Length)
+			}
+			if fed[id] != r {
+				t.Fatalf("index disabled %v: get record %q: got %+v, but the change feed had %+v", disabled, id, r, fed[id])
+			}
+		}
+		if _, err := GetRecord(db, "c"); !errors.Is(err, ErrDeleted) {
+			t.Fatalf("index disabled %v: get record of a deleted ID: got error %v, want %v", disabled, err, ErrDeleted)
+		}
+		if _, err := GetRecord(db, "missing"); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("index disabled %v: get record of a missing ID: got error %v, want %v", disabled, err, ErrKeyNotFound)
+		}
+	}
+}
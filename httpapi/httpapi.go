@@ -0,0 +1,127 @@
+// Package httpapi exposes a log-structured database over a small REST interface, meant for debugging:
+//
+//	GET    /keys/{id}   returns the value for id as the body
+//	PUT    /keys/{id}   writes the body as the value for id
+//	DELETE /keys/{id}   removes id
+//
+// Errors are returned as JSON in the form {"error": {"status": 404, "message": "key not found"}}.
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	logstructured "github.com/jdockerty/log-structured-db-engine"
+)
+
+const keysPrefix = "/keys/"
+
+// errorBody is the envelope that every error is returned in.
+type errorBody struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// Handler returns a handler serving the REST interface for db. The database's own lock keeps concurrent
+// requests apart.
+func Handler(db *logstructured.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, keysPrefix)
+		if id == r.URL.Path || id == "" {
+			writeError(w, http.StatusNotFound, "no such endpoint, use /keys/{id}")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			get(db, w, r, id)
+		case http.MethodPut:
+			put(db, w, r, id)
+		case http.MethodDelete:
+			del(db, w, r, id)
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			writeError(w, http.StatusMethodNotAllowed, r.Method+" is not supported, use GET, PUT or DELETE")
+		}
+	})
+}
+
+func get(db *logstructured.DB, w http.ResponseWriter, r *http.Request, id string) {
+	value, err := logstructured.Get(r.Context(), db, id)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.WriteString(w, value)
+}
+
+// put writes the request body for id, answering 201 if id had no value before and 200 if one was replaced.
+// Whether a value was there is checked before writing, so with PUTs for the same id racing each other, more than
+// one of them may be told it created it.
+func put(db *logstructured.DB, w http.ResponseWriter, r *http.Request, id string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "reading body: "+err.Error())
+		return
+	}
+
+	existed, err := db.Has(id)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	if err := logstructured.Set(r.Context(), db, id, string(body)); err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	if !existed {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func del(db *logstructured.DB, w http.ResponseWriter, r *http.Request, id string) {
+	if err := logstructured.Delete(r.Context(), db, id); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeDBError writes an error from the database with a status code that describes it.
+func writeDBError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, logstructured.ErrKeyNotFound), errors.Is(err, logstructured.ErrDeleted):
+		status = http.StatusNotFound
+	case errors.Is(err, logstructured.ErrKeyLimitReached), errors.Is(err, logstructured.ErrQuotaExceeded):
+		status = http.StatusInsufficientStorage
+	case errors.Is(err, logstructured.ErrValueTooLarge):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, logstructured.ErrInvalidKey), errors.Is(err, logstructured.ErrInvalidValue):
+		status = http.StatusBadRequest
+	case errors.Is(err, logstructured.ErrReadOnly):
+		status = http.StatusForbidden
+	case errors.Is(err, logstructured.ErrClosed):
+		status = http.StatusServiceUnavailable
+	}
+	writeError(w, status, err.Error())
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorBody{Error: errorDetail{Status: status, Message: message}})
+}
@@ -0,0 +1,129 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	logstructured "github.com/jdockerty/log-structured-db-engine"
+)
+
+// do sends a request to h, returning the status code and body of the response.
+func do(t *testing.T, h http.Handler, method, path, body string) (int, string) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	b, err := io.ReadAll(rec.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, string(b)
+}
+
+// TestHandler puts, gets and deletes a key through the handler, checking the status code of each, along with the
+// errors for a missing key, the reserved Tombstone value and writes to a read-only database.
+func TestHandler(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, indexPath := filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db")
+
+	db, err := logstructured.Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := Handler(db)
+
+	steps := []struct {
+		method, path, body string
+		wantCode           int
+		wantBody           string
+	}{
+		{http.MethodPut, "/keys/a", "1", http.StatusCreated, ""},
+		{http.MethodGet, "/keys/a", "", http.StatusOK, "1"},
+		{http.MethodPut, "/keys/a", "2", http.StatusOK, ""},
+		{http.MethodGet, "/keys/a", "", http.StatusOK, "2"},
+		{http.MethodDelete, "/keys/a", "", http.StatusNoContent, ""},
+		{http.MethodGet, "/keys/a", "", http.StatusNotFound, ""},
+		{http.MethodPut, "/keys/a", "3", http.StatusCreated, ""},
+		{http.MethodGet, "/keys/missing", "", http.StatusNotFound, ""},
+		{http.MethodPut, "/keys/b", logstructured.Tombstone, http.StatusBadRequest, ""},
+		{http.MethodGet, "/keys/b", "", http.StatusNotFound, ""},
+		{http.MethodPost, "/keys/a", "", http.StatusMethodNotAllowed, ""},
+		{http.MethodGet, "/other", "", http.StatusNotFound, ""},
+	}
+	for _, step := range steps {
+		code, body := do(t, h, step.method, step.path, step.body)
+		if code != step.wantCode {
+			t.Fatalf("%s %s: got status %d, want %d, with body %q", step.method, step.path, code, step.wantCode, body)
+		}
+		if code >= 400 {
+			var e errorBody
+			if err := json.Unmarshal([]byte(body), &e); err != nil || e.Error.Status != code {
+				t.Fatalf("%s %s: got error body %q, want one with status %d", step.method, step.path, body, code)
+			}
+		} else if body != step.wantBody {
+			t.Fatalf("%s %s: got body %q, want %q", step.method, step.path, body, step.wantBody)
+		}
+	}
+
+	readOnly, err := logstructured.OpenReadOnly(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readOnly.Close()
+	if code, body := do(t, Handler(readOnly), http.MethodPut, "/keys/c", "1"); code != http.StatusForbidden {
+		t.Fatalf("put on a read-only database: got status %d, want %d, with body %q", code, http.StatusForbidden, body)
+	}
+}
+
+// TestHandlerConcurrent sends requests for several keys at once, checking that each key reads back with the value
+// last put for it.
+func TestHandlerConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	db, err := logstructured.Open(filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := Handler(db)
+
+	const keys, writes = 8, 50
+	var wg sync.WaitGroup
+	errs := make(chan error, keys)
+	for k := 0; k < keys; k++ {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			path := fmt.Sprintf("/keys/key-%d", k)
+			for i := 0; i < writes; i++ {
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, path, strings.NewReader(fmt.Sprint(i))))
+				if rec.Code != http.StatusCreated && rec.Code != http.StatusOK {
+					errs <- fmt.Errorf("put %s: got status %d", path, rec.Code)
+					return
+				}
+
+				rec = httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+				if got := rec.Body.String(); rec.Code != http.StatusOK || got != fmt.Sprint(i) {
+					errs <- fmt.Errorf("get %s: got status %d and %q, want %d and %q", path, rec.Code, got, http.StatusOK, fmt.Sprint(i))
+					return
+				}
+			}
+		}(k)
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+}
@@ -0,0 +1,417 @@
+package logstructured
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// indexLogCompactThreshold is how many entries the index log can build up before it is folded into a new
+// snapshot, provided there are also more of them than there are keys in the snapshot.
+const indexLogCompactThreshold = 1024
+
+// RecordLocation is where the latest record for a key lives in the database file.
+type RecordLocation struct {
+	Offset int64 `json:"offset"` // Byte offset of the start of the record.
+	Length int32 `json:"length"` // Size of the record in bytes, zero if this isn't known.
+}
+
+// newRecordLocation returns the location of a record of the given size at offset. A record too large for its
+// length to be held in the location has it left as unknown, it is then found by reading the record itself.
+func newRecordLocation(offset int64, size int) RecordLocation {
+	if size > math.MaxInt32 {
+		return RecordLocation{Offset: offset}
+	}
+	return RecordLocation{Offset: offset, Length: int32(size)}
+}
+
+// UnmarshalJSON loads a stored location. Indexes stored before record lengths were kept hold nothing but a bare
+// offset for each key, which loads as a location with an unknown length.
+func (l *RecordLocation) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] != '{' {
+		*l = RecordLocation{}
+		return json.Unmarshal(b, &l.Offset)
+	}
+
+	// A distinct type without this method, otherwise we would end up back here.
+	type location RecordLocation
+	return json.Unmarshal(b, (*location)(l))
+}
+
+// Index maps each ID to the location of its latest record in the database file. MapIndex, a plain map, is the
+// default, OpenWithIndex lets another implementation be used in its place, such as one which keeps its keys in
+// order. The database's lock is held around every call, so an implementation needs no locking of its own.
+type Index interface {
+	Get(id string) (RecordLocation, bool)
+	Put(id string, loc RecordLocation)
+	Delete(id string)
+	Len() int
+
+	// Range calls fn for each ID in the index, in any order, stopping early if fn returns false. fn must not
+	// change the index.
+	Range(fn func(id string, loc RecordLocation) bool)
+
+	// Persist writes a snapshot of the whole index to w, which Load reads back in place of whatever the index
+	// held before. The snapshot is followed by the index log in the index file, so it must be a single JSON
+	// value for the two to be told apart. These are only used for IndexFormatJSON, in IndexFormatGob the
+	// entries are stored through Range and loaded back through Put.
+	Persist(w io.Writer) error
+	Load(r io.Reader) error
+}
+
+// MapIndex is the default Index, held in a map and stored as a JSON object of { ID : { offset, length } }.
+type MapIndex map[string]RecordLocation
+
+// NewMapIndex returns an empty MapIndex, for use with OpenWithIndex.
+func NewMapIndex() Index {
+	return make(MapIndex)
+}
+
+func (m MapIndex) Get(id string) (RecordLocation, bool) {
+	loc, ok := m[id]
+	return loc, ok
+}
+
+func (m MapIndex) Put(id string, loc RecordLocation) {
+	m[id] = loc
+}
+
+func (m MapIndex) Delete(id string) {
+	delete(m, id)
+}
+
+func (m MapIndex) Len() int {
+	return len(m)
+}
+
+func (m MapIndex) Range(fn func(id string, loc RecordLocation) bool) {
+	for id, loc := range m {
+		if !fn(id, loc) {
+			return
+		}
+	}
+}
+
+func (m MapIndex) Persist(w io.Writer) error {
+	return json.NewEncoder(w).Encode(map[string]RecordLocation(m))
+}
+
+// Load replaces the contents of the map with the snapshot in r. Snapshots stored before record lengths were kept
+// only hold offsets, see RecordLocation.UnmarshalJSON, which still load.
+func (m MapIndex) Load(r io.Reader) error {
+	loaded := make(map[string]RecordLocation)
+	if err := json.NewDecoder(r).Decode(&loaded); err != nil {
+		return err
+	}
+
+	for id := range m {
+		delete(m, id)
+	}
+	for id, loc := range loaded {
+		m[id] = loc
+	}
+	return nil
+}
+
+// indexLogEntry is a single line of the index log, recording where the latest record for ID was written.
+type indexLogEntry struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+	Length int32  `json:"length"`
+}
+
+// ReadIndexFile reads the hash index stored in the index file at path, snapshot and index log both, into an Index
+// made by newIndex, such as NewMapIndex, without opening the database file. The file is only read, so a last
+// entry in the index log which was cut short is left out rather than dropped from the file, as Open would. This is
+// meant for looking into an index file, for instance to see whether it matches its database file.
+func ReadIndexFile(path string, newIndex func() Index) (Index, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	index := newIndex()
+	if _, _, _, _, err := readIndex(f, index); err != nil {
+		return nil, fmt.Errorf("read index snapshot: %w", err)
+	}
+
+	return index, nil
+}
+
+// persistIndex stores the hash index entries for ids following a write, by appending them to the index log.
+// When debouncing, or with IndexFlushInterval, the IDs are instead marked as dirty and their entries logged together
+// later on, see flushIndex, rather than touching the index on every write. The lock must be held.
+func persistIndex(db *DB, ids ...string) error {
+	if db.IndexDebounce > 0 || db.IndexFlushInterval > 0 {
+		if db.dirty == nil {
+			db.dirty = make(map[string]bool)
+		}
+		for _, id := range ids {
+			db.dirty[id] = true
+		}
+		return db.scheduleIndexFlush()
+	}
+
+	return appendIndexLog(db, ids)
+}
+
+// flushIndex logs the entries of every ID which has been marked as dirty since the last flush, each of them once
+// however many times it was written in the meantime. The lock must be held.
+func flushIndex(db *DB) error {
+	ids := make([]string, 0, len(db.dirty))
+	for id := range db.dirty {
+		ids = append(ids, id)
+	}
+
+	// Logged in the order of their records, so that a crash which cuts the log short only loses entries for records
+	// after those it kept, which Open picks up again from the end of the database file, see indexTail.
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := db.Hash.Get(ids[i])
+		b, _ := db.Hash.Get(ids[j])
+		return a.Offset < b.Offset
+	})
+	if err := appendIndexLog(db, ids); err != nil {
+		return err
+	}
+
+	// Kept on failure, so the next flush tries them again.
+	db.dirty = nil
+	return nil
+}
+
+// appendIndexLog appends the hash index entries for ids to the index log, folding the log into a new snapshot once
+// it has grown long enough. The lock must be held.
+func appendIndexLog(db *DB, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	// An index file stored in another format than the one asked for is converted by writing a new snapshot, rather
+	// than having entries in the one format logged after a snapshot in the other.
+	if db.indexFormat != db.IndexFormat {
+		return writeIndex(db)
+	}
+
+	// The entries go in a single write, so that a crash can only cut short the last of them.
+	buf, err := encodeIndexLog(db.Hash, db.indexFormat, ids)
+	if err != nil {
+		return err
+	}
+	if db.CrashPoint == CrashTornIndexLog {
+		if _, err := db.HashStorage.Write(buf[:len(buf)/2]); err != nil {
+			return err
+		}
+		return crash(db, CrashTornIndexLog)
+	}
+	// A failed append, as when the disk is full, may leave part of an entry on the end of the log, which anything
+	// appended after it would then follow on from. The index is written as a new snapshot instead until one has
+	// succeeded, which holds these entries along with the rest, and until then Open finds the writes from the file.
+	if db.indexLogFailed {
+		return writeIndex(db)
+	}
+	if _, err := db.HashStorage.Write(buf); err != nil {
+		db.indexLogFailed = true
+		return err
+	}
+	db.indexLogEntries += len(ids)
+
+	// Replaying the log on startup gets slower the longer it is, so once it holds more entries than the index
+	// itself it is folded into a new snapshot.
+	if db.indexLogEntries >= indexLogCompactThreshold && db.indexLogEntries > db.Hash.Len() {
+		return writeIndex(db)
+	}
+
+	return nil
+}
+
+// CompactIndex writes a fresh snapshot of the hash index to disk, replacing the index log that has built up
+// since the last one. This happens by itself as the log grows, but can also be done by hand, for instance
+// to make the next Open quicker.
+func CompactIndex(db *DB) error {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	// The snapshot holds everything that a pending debounced write would have.
+	if db.indexTimer != nil {
+		db.indexTimer.Stop()
+		db.indexTimer = nil
+	}
+
+	return writeIndex(db)
+}
+
+// RebuildIndex throws away the hash index and builds it again by scanning the whole database file, then stores
+// it on disk. The rebuilt index holds the same locations that writing each record would have stored, so this
+// can be used to recover from an index which has been lost or doesn't match the database file.
+//
+// Open does this by itself when the stored hash index can't be read.
+func RebuildIndex(db *DB) error {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	// The rebuilt index is stored straight away, so there is nothing left for a pending debounced write to do.
+	if db.indexTimer != nil {
+		db.indexTimer.Stop()
+		db.indexTimer = nil
+	}
+
+	return rebuildIndex(db)
+}
+
+// rebuildIndex is RebuildIndex without taking the lock, for use whilst it is already held. A read-only database
+// keeps the rebuilt index in memory alone.
+func rebuildIndex(db *DB) error {
+	hash := db.newIndex()
+	deleted := make(map[string]bool)
+	expiries := make(map[string]int64)
+
+	// Later records for an ID replace earlier ones, leaving the location of the latest.
+	err := eachRecord(db, func(offset int64, id, value string, expiresAt int64, seq uint64, writtenAt int64) error {
+		hash.Put(id, newRecordLocation(offset, int(recordSize(id, value))))
+		seenSeq(db, seq)
+		if expiresAt != 0 {
+			expiries[id] = expiresAt
+		} else {
+			delete(expiries, id)
+		}
+		if value == Tombstone {
+			deleted[id] = true
+		} else {
+			delete(deleted, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	db.Hash = hash
+	db.deleted = deleted
+	db.expiries = expiries
+	if db.deadBytes, err = countDeadBytes(db); err != nil {
+		return err
+	}
+
+	if db.readOnly {
+		return nil
+	}
+	return writeIndex(db)
+}
+
+// writeIndex replaces the index file with a snapshot of the in-memory hash index and an empty index log.
+// The snapshot is written alongside the original, which is only replaced once the new one is fully on disk,
+// so a crash part way through leaves the original in place. The lock must be held.
+func writeIndex(db *DB) error {
+	indexPath := db.HashStorage.Name()
+	snapshotPath := indexPath + ".compact"
+
+	if err := writeCompactedIndex(db, snapshotPath, db.Hash); err != nil {
+		os.Remove(snapshotPath)
+		return err
+	}
+	mode, err := copyMode(snapshotPath, db.HashStorage)
+	if err != nil {
+		os.Remove(snapshotPath)
+		return err
+	}
+	if err := crash(db, CrashBeforeIndexSwap); err != nil {
+		return err
+	}
+	if err := os.Rename(snapshotPath, indexPath); err != nil {
+		os.Remove(snapshotPath)
+		return err
+	}
+	if err := syncDir(filepath.Dir(indexPath)); err != nil {
+		return err
+	}
+
+	hashFile, err := os.OpenFile(indexPath, os.O_RDWR|os.O_APPEND, mode)
+	if err != nil {
+		return err
+	}
+
+	db.HashStorage.Close()
+	db.HashStorage = hashFile
+	db.indexFormat = db.IndexFormat
+	db.indexLogEntries = 0
+	db.indexLogFailed = false
+	db.dirty = nil
+
+	return storeValueIndex(db)
+}
+
+// scheduleIndexFlush arranges for the dirty hash index entries to be written to disk once writes have been quiet for
+// IndexDebounce, or IndexMaxDelay has passed since the first unpersisted write. With IndexFlushInterval, it is once
+// the interval has passed since the first unpersisted write, however many more there are. The lock must be held.
+func (db *DB) scheduleIndexFlush() error {
+
+	// A debounced write happens in the background, so the only place to surface its failure is the next write.
+	if err := db.indexErr; err != nil {
+		db.indexErr = nil
+		return err
+	}
+
+	// The pending write already covers this one.
+	if db.IndexFlushInterval > 0 && db.indexTimer != nil {
+		return nil
+	}
+
+	now := time.Now()
+	if db.indexTimer == nil {
+		db.indexPendingSince = now
+	}
+
+	wait := db.IndexDebounce
+	if db.IndexFlushInterval > 0 {
+		wait = db.IndexFlushInterval
+	} else if db.IndexMaxDelay > 0 {
+		remaining := db.IndexMaxDelay - now.Sub(db.indexPendingSince)
+		if remaining < 0 {
+			remaining = 0
+		}
+		if remaining < wait {
+			wait = remaining
+		}
+	}
+
+	if db.indexTimer != nil {
+		db.indexTimer.Stop()
+	}
+
+	// The timer is handed to its own callback so that a callback which has already fired, but was then
+	// superseded by a newer write before it got the lock, can tell that it is no longer the pending one.
+	var t *time.Timer
+	t = time.AfterFunc(wait, func() {
+		db.Lock()
+		defer db.Unlock()
+
+		if db.indexTimer != t {
+			return
+		}
+		db.indexTimer = nil
+		db.indexErr = flushIndex(db)
+	})
+	db.indexTimer = t
+
+	return nil
+}
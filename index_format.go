@@ -0,0 +1,182 @@
+package logstructured
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// IndexFormat is how the hash index is stored in the index file, see DB.IndexFormat.
+type IndexFormat int
+
+const (
+	// IndexFormatJSON stores the snapshot as written by the index's own Persist, followed by a log of one JSON
+	// object per line. It is the default, and the format all index files were stored in before there was a choice.
+	IndexFormatJSON IndexFormat = iota
+
+	// IndexFormatGob stores the snapshot as a gob encoded list of entries, followed by a log of entries laid out
+	// much like records, [id_len uint32][id bytes][offset int64][length int32]. Both are smaller and quicker to
+	// read and write than JSON, which counts for an index of millions of keys.
+	IndexFormatGob
+)
+
+func (f IndexFormat) String() string {
+	switch f {
+	case IndexFormatJSON:
+		return "json"
+	case IndexFormatGob:
+		return "gob"
+	}
+	return fmt.Sprintf("IndexFormat(%d)", int(f))
+}
+
+// gobIndexMagic starts every index file stored in IndexFormatGob. No JSON value can start with it, so a file
+// without it is taken to be JSON, as every index file stored before the format could be chosen is.
+const gobIndexMagic = "\x00LSIDX-GOB\x01"
+
+// gobLogEntrySize is the size of an entry of the index log in IndexFormatGob, less its ID.
+const gobLogEntrySize = lengthSize + 8 + 4
+
+// writeIndexSnapshot writes a snapshot of the whole of hash to w in format, as starts an index file.
+func writeIndexSnapshot(w io.Writer, hash Index, format IndexFormat) error {
+	if format != IndexFormatGob {
+		return hash.Persist(w)
+	}
+
+	// The snapshot is length prefixed, as the gob decoder reads ahead and would otherwise eat into the index log.
+	entries := make([]indexLogEntry, 0, hash.Len())
+	hash.Range(func(id string, loc RecordLocation) bool {
+		entries = append(entries, indexLogEntry{ID: id, Offset: loc.Offset, Length: loc.Length})
+		return true
+	})
+	var snapshot bytes.Buffer
+	if err := gob.NewEncoder(&snapshot).Encode(entries); err != nil {
+		return err
+	}
+
+	buf := make([]byte, len(gobIndexMagic)+8, len(gobIndexMagic)+8+snapshot.Len())
+	copy(buf, gobIndexMagic)
+	binary.BigEndian.PutUint64(buf[len(gobIndexMagic):], uint64(snapshot.Len()))
+	_, err := w.Write(append(buf, snapshot.Bytes()...))
+	return err
+}
+
+// encodeIndexLog lays out the index log entries for ids, with their locations in hash, in format.
+func encodeIndexLog(hash Index, format IndexFormat, ids []string) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, id := range ids {
+		loc, _ := hash.Get(id)
+		if format != IndexFormatGob {
+			if err := enc.Encode(indexLogEntry{ID: id, Offset: loc.Offset, Length: loc.Length}); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var entry [gobLogEntrySize]byte
+		binary.BigEndian.PutUint32(entry[:], uint32(len(id)))
+		binary.BigEndian.PutUint64(entry[lengthSize:], uint64(loc.Offset))
+		binary.BigEndian.PutUint32(entry[lengthSize+8:], uint32(loc.Length))
+		buf.Write(entry[:lengthSize])
+		buf.WriteString(id)
+		buf.Write(entry[lengthSize:])
+	}
+	return buf.Bytes(), nil
+}
+
+// readIndex reads an index file from r, in whichever format it was stored in, loading its snapshot into index and
+// then putting each entry of the index log which follows into it. It stops at the end of the log or at an entry
+// which can't be read, and returns the format of the file, how many log entries were applied, where the last of them
+// ended, and whether the whole log was read. An error is returned only for a snapshot which can't be read.
+func readIndex(r io.Reader, index Index) (IndexFormat, int, int64, bool, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(gobIndexMagic)); string(magic) == gobIndexMagic {
+		entries, end, complete, err := readGobIndex(br, index)
+		return IndexFormatGob, entries, end, complete, err
+	}
+
+	entries, end, complete, err := readJSONIndex(br, index)
+	return IndexFormatJSON, entries, end, complete, err
+}
+
+// readJSONIndex is readIndex for an index file in IndexFormatJSON. The snapshot is the first JSON value in the file,
+// which is handed to the index to load on its own.
+func readJSONIndex(r io.Reader, index Index) (int, int64, bool, error) {
+	d := json.NewDecoder(r)
+	var snapshot json.RawMessage
+	if err := d.Decode(&snapshot); err != nil {
+		return 0, 0, false, err
+	}
+	if err := index.Load(bytes.NewReader(snapshot)); err != nil {
+		return 0, 0, false, err
+	}
+
+	entries := 0
+	for {
+		end := d.InputOffset()
+
+		var e indexLogEntry
+		err := d.Decode(&e)
+		if err == io.EOF {
+			return entries, end, true, nil
+		}
+		if err != nil {
+			return entries, end, false, nil
+		}
+
+		index.Put(e.ID, RecordLocation{Offset: e.Offset, Length: e.Length})
+		entries++
+	}
+}
+
+// readGobIndex is readIndex for an index file in IndexFormatGob, with r at the start of its magic.
+func readGobIndex(r io.Reader, index Index) (int, int64, bool, error) {
+	var prefix [len(gobIndexMagic) + 8]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return 0, 0, false, err
+	}
+	size := int64(binary.BigEndian.Uint64(prefix[len(gobIndexMagic):]))
+
+	var snapshot []indexLogEntry
+	lr := &io.LimitedReader{R: r, N: size}
+	if err := gob.NewDecoder(lr).Decode(&snapshot); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, 0, false, err
+	}
+	if lr.N != 0 {
+		return 0, 0, false, fmt.Errorf("index snapshot is %d bytes shorter than its stated size", lr.N)
+	}
+	for _, e := range snapshot {
+		index.Put(e.ID, RecordLocation{Offset: e.Offset, Length: e.Length})
+	}
+
+	entries := 0
+	end := int64(len(prefix)) + size
+	for {
+		id, err := readField(r)
+		if err == io.EOF {
+			return entries, end, true, nil
+		}
+		var fixed [gobLogEntrySize - lengthSize]byte
+		if err == nil {
+			_, err = io.ReadFull(r, fixed[:])
+		}
+		if err != nil {
+			return entries, end, false, nil
+		}
+
+		index.Put(id, RecordLocation{
+			Offset: int64(binary.BigEndian.Uint64(fixed[:])),
+			Length: int32(binary.BigEndian.Uint32(fixed[8:])),
+		})
+		entries++
+		end += gobLogEntrySize + int64(len(id))
+	}
+}
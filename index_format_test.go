@@ -0,0 +1,130 @@
+package logstructured
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestIndexFormat checks that the hash index is converted to gob and back again on the next write after the
+// format is changed, and that a gob index file loads, index log and all, with a cut short last entry dropped.
+func TestIndexFormat(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "format.db")
+	indexPath := filepath.Join(dir, "format-index.db")
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes := []string{"a", "b", "c", "d", "e"}
+	for i, id := range writes {
+		if i == 2 {
+			db.IndexFormat = IndexFormatGob
+		}
+		if err := Set(ctx, db, id, "value of "+id); err != nil {
+			db.Close()
+			t.Fatalf("set %q: %v", id, err)
+		}
+	}
+
+	// Copy the index file as it is, before Close folds the index log into a snapshot.
+	index, err := os.ReadFile(indexPath)
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(index) == 0 || index[0] == '{' {
+		t.Fatalf("index file after switching to gob: got %q, want it no longer stored as JSON", index)
+	}
+	if err := os.WriteFile(indexPath, append(index, 0, 0, 0, 9, 'f'), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if n := db.Hash.Len(); n != len(writes) {
+		t.Fatalf("gob index entries: got %d, want %d", n, len(writes))
+	}
+	for _, id := range writes {
+		if value, err := Get(ctx, db, id); err != nil || value != "value of "+id {
+			t.Fatalf("get %q from gob index: got %q (error %v), want %q", id, value, err, "value of "+id)
+		}
+	}
+	info, err := db.HashStorage.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(index)) {
+		t.Fatalf("gob index file with a cut short entry: got %d bytes, want %d", info.Size(), len(index))
+	}
+	stored, err := ReadIndexFile(indexPath, NewMapIndex)
+	if err != nil {
+		t.Fatalf("read gob index file: %v", err)
+	}
+	if stored.Len() != len(writes) {
+		t.Fatalf("read gob index file: got %d entries, want %d", stored.Len(), len(writes))
+	}
+
+	// Left as the default, the next write goes back to JSON.
+	if err := Set(ctx, db, "f", "value of f"); err != nil {
+		t.Fatalf("set %q: %v", "f", err)
+	}
+	index, err = os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index) == 0 || index[0] != '{' {
+		t.Fatalf("index file after switching back to JSON: got %q, want it stored as JSON", index)
+	}
+}
+
+// BenchmarkIndexFormat encodes and decodes a snapshot of an index of 1M entries in each format, reporting the size of
+// the snapshot alongside.
+func BenchmarkIndexFormat(b *testing.B) {
+	const entries = 1000000
+	index := make(MapIndex, entries)
+	for i := 0; i < entries; i++ {
+		index[fmt.Sprint("key-", i)] = newRecordLocation(int64(i)*128, 128)
+	}
+
+	for _, format := range []IndexFormat{IndexFormatJSON, IndexFormatGob} {
+		var snapshot bytes.Buffer
+		if err := writeIndexSnapshot(&snapshot, index, format); err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(format.String()+"/encode", func(b *testing.B) {
+			var buf bytes.Buffer
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				if err := writeIndexSnapshot(&buf, index, format); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(buf.Len()), "bytes")
+		})
+		b.Run(format.String()+"/decode", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				loaded := make(MapIndex, entries)
+				if _, _, _, _, err := readIndex(bytes.NewReader(snapshot.Bytes()), loaded); err != nil {
+					b.Fatal(err)
+				}
+				if len(loaded) != entries {
+					b.Fatalf("decoded %d entries, want %d", len(loaded), entries)
+				}
+			}
+			b.ReportMetric(float64(snapshot.Len()), "bytes")
+		})
+	}
+}
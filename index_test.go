@@ -0,0 +1,261 @@
+package logstructured
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestIndexWriteFailure checks that an overwrite which makes it into the database file stands when storing its
+// hash index entry fails, as it would with the disk holding the index full, which is stood in for by swapping the
+// index file for one opened read-only. The newest record should be read straight away, from a copy of the files
+// taken whilst the index on disk is still behind, after rebuilding the index, and once the database has been closed
+// and opened again, with the failed entry not getting in the way of later writes.
+func TestIndexWriteFailure(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "index-failure.db")
+	indexPath := filepath.Join(dir, "index-failure-index.db")
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	if err := Set(ctx, db, "k", "old"); err != nil {
+		t.Fatalf("set %q: %v", "k", err)
+	}
+
+	readOnly, err := os.Open(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := db.HashStorage
+	db.HashStorage = readOnly
+	err = Set(ctx, db, "k", "new")
+	db.HashStorage = index
+	readOnly.Close()
+	if err == nil {
+		t.Fatalf("set %q with the index file read-only: got no error", "k")
+	}
+
+	get := func(db *DB, stage string) error {
+		if got, err := Get(ctx, db, "k"); err != nil || got != "new" {
+			return fmt.Errorf("%s: get %q: got %q, %v, want %q", stage, "k", got, err, "new")
+		}
+		return nil
+	}
+	if err := get(db, "after failing to store the index"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The index on disk still points at the old record, as it would if the process died now.
+	copyPath, copyIndexPath := filepath.Join(dir, "index-failure-copy.db"), filepath.Join(dir, "index-failure-copy-index.db")
+	for from, to := range map[string]string{dbPath: copyPath, indexPath: copyIndexPath} {
+		b, err := os.ReadFile(from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(to, b, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	copied, err := Open(copyPath, copyIndexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = get(copied, "copy taken whilst the index was behind")
+	if err == nil {
+		if err = RebuildIndex(copied); err == nil {
+			err = get(copied, "copy with its index rebuilt")
+		}
+	}
+	copied.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Set(ctx, db, "other", "value"); err != nil {
+		t.Fatalf("set %q after failing to store the index: %v", "other", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath, indexPath, false); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ReadIndexFile(indexPath, NewMapIndex)
+	if err != nil {
+		t.Fatalf("read index file: %v", err)
+	}
+	if err := sameIndex(indexContents(stored), indexContents(db.Hash)); err != nil {
+		t.Fatalf("stored hash index after failing to store it once: %v", err)
+	}
+	if err := get(db, "opened again"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestIndexFlushInterval checks that a burst of writes to the same ID logs its index entry once for each
+// IndexFlushInterval, rather than once for each write, and that the index left on disk after Close matches the one
+// in memory.
+func TestIndexFlushInterval(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "flush-interval.db")
+	indexPath := filepath.Join(dir, "flush-interval-index.db")
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	const writes, interval = 200, 20 * time.Millisecond
+	db.IndexFlushInterval = interval
+	start := time.Now()
+	for i := 0; i < writes; i++ {
+		if err := Set(ctx, db, "burst", fmt.Sprint(i)); err != nil {
+			t.Fatalf("set %q: %v", "burst", err)
+		}
+		if i%20 == 0 {
+			time.Sleep(interval / 4)
+		}
+	}
+	took := time.Since(start)
+	time.Sleep(2 * interval)
+
+	// Each write of the index logs the one entry, after the empty snapshot the new index file starts out with, and
+	// there is at most one for each interval the writes took, plus the last one after them.
+	index, err := os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged := strings.Count(string(index), "\n") - 1
+	if most := int(took/interval) + 2; logged < 1 || logged > most {
+		t.Fatalf("%d writes over %v: got %d index entries logged, want between 1 and %d", writes, took, logged, most)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath, indexPath, false); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ReadIndexFile(indexPath, NewMapIndex)
+	if err != nil {
+		t.Fatalf("read index file: %v", err)
+	}
+	if err := sameIndex(indexContents(stored), indexContents(db.Hash)); err != nil {
+		t.Fatalf("stored hash index after writing with IndexFlushInterval: %v", err)
+	}
+	if got, err := Get(ctx, db, "burst"); err != nil || got != fmt.Sprint(writes-1) {
+		t.Fatalf("get %q: got %q, %v, want %q", "burst", got, err, fmt.Sprint(writes-1))
+	}
+}
+
+// TestIndexDebounce checks that a debounced write of the hash index logs an entry for each ID written since the
+// last one, however many times it was written, rather than writing a snapshot of the whole index.
+func TestIndexDebounce(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	indexPath := filepath.Join(dir, "debounce-index.db")
+	db, err := Open(filepath.Join(dir, "debounce.db"), indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.IndexDebounce = 10 * time.Millisecond
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprint(i % 3)
+		if err := Set(ctx, db, id, fmt.Sprint(i)); err != nil {
+			t.Fatalf("set %q: %v", id, err)
+		}
+	}
+
+	// The new index file starts out with an empty snapshot, which should be followed by the three entries alone.
+	var index []byte
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if index, err = os.ReadFile(indexPath); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Count(string(index), "\n") > 1 {
+			break
+		}
+	}
+	if lines := strings.Split(strings.TrimSuffix(string(index), "\n"), "\n"); len(lines) != 4 || lines[0] != "{}" {
+		t.Fatalf("index file after a debounced write: got %q, want an empty snapshot and 3 log entries", index)
+	}
+	stored, err := ReadIndexFile(indexPath, NewMapIndex)
+	if err != nil {
+		t.Fatalf("read index file: %v", err)
+	}
+	if err := sameIndex(indexContents(stored), indexContents(db.Hash)); err != nil {
+		t.Fatalf("stored hash index after a debounced write: %v", err)
+	}
+}
+
+// indexContents copies every entry out of index into a map, so that two indexes can be compared.
+func indexContents(index Index) map[string]RecordLocation {
+	contents := make(map[string]RecordLocation, index.Len())
+	index.Range(func(id string, loc RecordLocation) bool {
+		contents[id] = loc
+		return true
+	})
+	return contents
+}
+
+// sameIndex reports how got differs from want, if it does at all.
+func sameIndex(got, want map[string]RecordLocation) error {
+	if len(got) != len(want) {
+		return fmt.Errorf("got %d entries, want %d", len(got), len(want))
+	}
+	for id, loc := range want {
+		if got[id] != loc {
+			return fmt.Errorf("entry for %q: got %+v, want %+v", id, got[id], loc)
+		}
+	}
+	return nil
+}
+
+// BenchmarkSetAsIndexGrows overwrites keys of databases holding 1k, 10k and 100k of them, logging each write's
+// index entry straight away, debounced, and at a flush interval. Only the entries written are logged in each case,
+// so the time a Set takes should stay flat as the index grows.
+func BenchmarkSetAsIndexGrows(b *testing.B) {
+	ctx := context.Background()
+	modes := []struct {
+		name      string
+		configure func(db *DB)
+	}{
+		{"every write", func(db *DB) {}},
+		{"IndexDebounce", func(db *DB) {
+			db.IndexDebounce = time.Millisecond
+			db.IndexMaxDelay = 10 * time.Millisecond
+		}},
+		{"IndexFlushInterval", func(db *DB) { db.IndexFlushInterval = 10 * time.Millisecond }},
+	}
+	for _, keys := range []int{1000, 10000, 100000} {
+		for _, mode := range modes {
+			b.Run(fmt.Sprintf("%s/%d", mode.name, keys), func(b *testing.B) {
+				db := benchDB(b, keys, 100)
+				mode.configure(db)
+				value := strings.Repeat("w", 100)
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := Set(ctx, db, fmt.Sprint("key-", i%keys), value); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package logstructured
+
+// Iterator walks every key in the database in sorted order, numeric order with NumericKeys, reading the latest value
+// for each one as it goes rather than all up front. Keys are visited by calling Next until it returns false, after
+// which Err reports whether the walk stopped because of an error rather than running out of keys.
+//
+// The keys to visit are taken when the iterator is created. A key which is deleted or expires before the
+// iterator reaches it is skipped, and a key which is overwritten is returned with its newer value, whereas keys
+// written after the iterator was created are not visited.
+type Iterator struct {
+	db    *DB
+	keys  []string
+	key   string
+	value string
+	err   error
+}
+
+// NewIterator returns an iterator over the keys currently held in db, positioned before the first of them.
+func NewIterator(db *DB) *Iterator {
+	db.RLock()
+	defer db.RUnlock()
+
+	keys := make([]string, 0, db.Hash.Len()-len(db.deleted))
+	db.Hash.Range(func(id string, _ RecordLocation) bool {
+		if !db.deleted[id] {
+			keys = append(keys, id)
+		}
+		return true
+	})
+	sortKeys(db, keys)
+
+	return &Iterator{db: db, keys: keys}
+}
+
+// Next moves the iterator on to the next key, reporting whether there was one.
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	// Each key is read under the lock on its own, so that writes aren't held up for the whole walk.
+	it.db.RLock()
+	defer it.db.RUnlock()
+
+	if it.db.closed {
+		it.err = ErrClosed
+		it.key, it.value = "", ""
+		return false
+	}
+
+	for len(it.keys) > 0 {
+		id := it.keys[0]
+		it.keys = it.keys[1:]
+
+		// The key may have been deleted, or removed by compaction, since the iterator was created.
+		loc, ok := it.db.Hash.Get(id)
+		if !ok || it.db.deleted[id] {
+			continue
+		}
+
+		_, value, expiresAt, _, _, err := readRecord(it.db, loc)
+		if err != nil {
+			it.err = err
+			it.key, it.value = "", ""
+			return false
+		}
+		if it.db.expired(expiresAt) {
+			continue
+		}
+
+		it.key, it.value = id, value
+		return true
+	}
+
+	it.key, it.value = "", ""
+	return false
+}
+
+// Key returns the key the iterator is positioned at.
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value returns the latest value for the key the iterator is positioned at.
+func (it *Iterator) Value() string {
+	return it.value
+}
+
+// Err returns the error which stopped the iterator, if there was one. This includes ErrClosed if the
+// database was closed part way through.
+func (it *Iterator) Err() error {
+	return it.err
+}
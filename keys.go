@@ -0,0 +1,144 @@
+package logstructured
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// checkKey makes sure id can be written, see checkID, which with NumericKeys also means it must be a 64-bit integer
+// written in its plain decimal form. Without this, "7", "07" and "+7" would all be the same number held under
+// different keys.
+func checkKey(db *DB, id string) error {
+	if err := checkID(id); err != nil {
+		return err
+	}
+	if !db.NumericKeys {
+		return nil
+	}
+
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != id {
+		return fmt.Errorf("%w: %q is not a 64-bit integer in decimal form, which NumericKeys requires", ErrInvalidKey, id)
+	}
+	return nil
+}
+
+// checkID makes sure id can be written or deleted at all. Any string of bytes can be an ID, commas and newlines
+// included, as records store it with its length rather than between delimiters, apart from the empty string, one
+// made up only of whitespace, which is easily written by mistake and then can't be told apart from another, and
+// the keys which mark transactions. IDs are never trimmed, so " a" and "a" are different keys.
+func checkID(id string) error {
+	if strings.TrimSpace(id) == "" {
+		return fmt.Errorf("%w: %q, an id can't be empty or only whitespace", ErrInvalidKey, id)
+	}
+	if isTxnMarker(id) {
+		return fmt.Errorf("%w: %q is reserved for marking transactions", ErrInvalidKey, id)
+	}
+	return nil
+}
+
+// isNewKey reports whether writing id would add a key to those which are live, as it has no entry in the hash index,
+// or only one for a key which has been deleted or has expired.
+func isNewKey(db *DB, id string) bool {
+	_, ok := db.Hash.Get(id)
+	return !ok || db.deleted[id] || db.expired(db.expiries[id])
+}
+
+// checkKeyLimit returns ErrKeyLimitReached if writing newKeys keys which aren't live, see isNewKey, would take the
+// database beyond MaxKeys. Live keys are counted as Len counts them, so deleted and expired keys don't count towards
+// the limit, even though they keep their entries in the hash index until compaction.
+func checkKeyLimit(db *DB, newKeys int) error {
+	if db.MaxKeys <= 0 || newKeys == 0 {
+		return nil
+	}
+
+	live := db.Hash.Len() - len(db.deleted)
+	for id, expiresAt := range db.expiries {
+		if !db.deleted[id] && db.expired(expiresAt) {
+			live--
+		}
+	}
+	if live+newKeys > db.MaxKeys {
+		return ErrKeyLimitReached
+	}
+	return nil
+}
+
+// keyRange is the [start, end) range of keys for Scan, where an empty bound is unbounded.
+type keyRange struct {
+	start, end       string
+	compare          func(a, b string) int
+	numeric          bool
+	startInt, endInt int64
+}
+
+// newKeyRange returns the range of keys between start and end. With a KeyComparator, the bounds are compared with
+// it. Otherwise, with NumericKeys, the bounds are compared as integers, so they must be integers themselves.
+func newKeyRange(db *DB, start, end string) (keyRange, error) {
+	if db.KeyComparator != nil {
+		return keyRange{start: start, end: end, compare: db.KeyComparator}, nil
+	}
+
+	r := keyRange{start: start, end: end, numeric: db.NumericKeys}
+	if !r.numeric {
+		return r, nil
+	}
+
+	var err error
+	if start != "" {
+		if r.startInt, err = strconv.ParseInt(start, 10, 64); err != nil {
+			return keyRange{}, fmt.Errorf("start of range %q is not a 64-bit integer: %w", start, err)
+		}
+	}
+	if end != "" {
+		if r.endInt, err = strconv.ParseInt(end, 10, 64); err != nil {
+			return keyRange{}, fmt.Errorf("end of range %q is not a 64-bit integer: %w", end, err)
+		}
+	}
+	return r, nil
+}
+
+// contains reports whether id lies within the range. With numeric bounds, an id which isn't an integer, such as
+// one written before NumericKeys was turned on, is never within it.
+func (r keyRange) contains(id string) bool {
+	if r.compare != nil {
+		return (r.start == "" || r.compare(id, r.start) >= 0) && (r.end == "" || r.compare(id, r.end) < 0)
+	}
+	if !r.numeric {
+		return id >= r.start && (r.end == "" || id < r.end)
+	}
+
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return false
+	}
+	return (r.start == "" || n >= r.startInt) && (r.end == "" || n < r.endInt)
+}
+
+// sortKeys puts keys into order, which is KeyComparator's if there is one, or with NumericKeys numeric order. Any
+// keys which aren't integers come after those which are, in the usual string order.
+func sortKeys(db *DB, keys []string) {
+	if db.KeyComparator != nil {
+		sort.Slice(keys, func(i, j int) bool { return db.KeyComparator(keys[i], keys[j]) < 0 })
+		return
+	}
+	if !db.NumericKeys {
+		sort.Strings(keys)
+		return
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, errA := strconv.ParseInt(keys[i], 10, 64)
+		b, errB := strconv.ParseInt(keys[j], 10, 64)
+		switch {
+		case errA == nil && errB == nil:
+			return a < b
+		case errA == nil || errB == nil:
+			return errA == nil
+		default:
+			return keys[i] < keys[j]
+		}
+	})
+}
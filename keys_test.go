@@ -0,0 +1,202 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyLimitLeavesOutDeletedAndExpiredKeys(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Unix(1700000000, 0)
+	db.Clock = func() time.Time { return now }
+	db.MaxKeys = 2
+
+	if err := Set(ctx, db, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetWithTTL(ctx, db, "b", "2", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := Set(ctx, db, "c", "3"); !errors.Is(err, ErrKeyLimitReached) {
+		t.Fatalf("set of a third key: got %v, want %v", err, ErrKeyLimitReached)
+	}
+	if err := Set(ctx, db, "a", "updated"); err != nil {
+		t.Fatalf("update of an existing key at the limit: %v", err)
+	}
+
+	// Once b has expired there is room again, through every way of writing.
+	now = now.Add(time.Hour)
+	if err := Set(ctx, db, "c", "3"); err != nil {
+		t.Fatalf("set once a key has expired: %v", err)
+	}
+	if err := SetBatch(db, map[string]string{"d": "4"}); !errors.Is(err, ErrKeyLimitReached) {
+		t.Fatalf("batch beyond the limit: got %v, want %v", err, ErrKeyLimitReached)
+	}
+
+	if err := Delete(ctx, db, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetBatch(db, map[string]string{"d": "4"}); err != nil {
+		t.Fatalf("batch once a key has been deleted: %v", err)
+	}
+
+	var txn Transaction
+	txn.Set("e", "5")
+	if err := txn.Commit(db); !errors.Is(err, ErrKeyLimitReached) {
+		t.Fatalf("transaction beyond the limit: got %v, want %v", err, ErrKeyLimitReached)
+	}
+	if err := SetWithTTL(ctx, db, "a", "1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Hour)
+	if err := txn.Commit(db); err != nil {
+		t.Fatalf("transaction once a key has expired: %v", err)
+	}
+	if n := db.Len(); n != 2 {
+		t.Fatalf("Len: got %d, want 2", n)
+	}
+}
+
+// TestKeyComparator checks that Scan, including its bounds, Iterator and Keys go by KeyComparator when there is
+// one, here putting numbers in numeric order, and by string order otherwise.
+func TestKeyComparator(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "comparator.db"), filepath.Join(dir, "comparator-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, id := range []string{"100", "3", "20", "1", "10", "2"} {
+		if err := Set(ctx, db, id, "value "+id); err != nil {
+			t.Fatalf("set %q: %v", id, err)
+		}
+	}
+
+	ordered := func(what string, got []string, want ...string) error {
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			return fmt.Errorf("%s: got keys %q, want %q", what, got, want)
+		}
+		return nil
+	}
+	scan := func(start, end string) ([]string, error) {
+		kvs, err := Scan(db, start, end)
+		keys := make([]string, 0, len(kvs))
+		for _, kv := range kvs {
+			keys = append(keys, kv.Key)
+		}
+		return keys, err
+	}
+
+	keys, err := scan("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ordered("scan in string order", keys, "1", "10", "100", "2", "20", "3"); err != nil {
+		t.Fatal(err)
+	}
+
+	db.KeyComparator = func(a, b string) int {
+		x, errA := strconv.Atoi(a)
+		y, errB := strconv.Atoi(b)
+		switch {
+		case errA != nil || errB != nil:
+			return strings.Compare(a, b)
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	if keys, err = scan("2", "101"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ordered("scan of [2, 101) in numeric order", keys, "2", "3", "10", "20", "100"); err != nil {
+		t.Fatal(err)
+	}
+	var iterated []string
+	it := NewIterator(db)
+	for it.Next() {
+		iterated = append(iterated, it.Key())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ordered("iterator in numeric order", iterated, "1", "2", "3", "10", "20", "100"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ordered("keys in numeric order", db.Keys(), "1", "2", "3", "10", "20", "100"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNumericKeys(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.NumericKeys = true
+
+	// Written from the highest, so that the order they come back in is down to NumericKeys alone.
+	for i := 300; i >= 0; i-- {
+		if err := Set(ctx, db, strconv.Itoa(i), "value "+strconv.Itoa(i)); err != nil {
+			t.Fatalf("set %d: %v", i, err)
+		}
+	}
+	for _, id := range []string{"abc", "07", "+7", "1.5", "99999999999999999999"} {
+		if err := Set(ctx, db, id, "value"); !errors.Is(err, ErrInvalidKey) {
+			t.Fatalf("set %q: got %v, want %v", id, err, ErrInvalidKey)
+		}
+	}
+	if _, err := Get(ctx, db, "abc"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("get of a rejected key: got %v, want %v", err, ErrKeyNotFound)
+	}
+
+	// In string order, [100, 200) would hold "11" to "19" as well, and "1000" if it had been written.
+	kvs, err := Scan(db, "100", "200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 100 {
+		t.Fatalf("scan of [100, 200): got %d keys, want %d", len(kvs), 100)
+	}
+	for i, kv := range kvs {
+		if want := strconv.Itoa(100 + i); kv.Key != want || kv.Value != "value "+want {
+			t.Fatalf("scan of [100, 200): got %q=%q at %d, want %q=%q", kv.Key, kv.Value, i, want, "value "+want)
+		}
+	}
+
+	keys := db.Keys()
+	if len(keys) != 301 {
+		t.Fatalf("keys: got %d, want %d", len(keys), 301)
+	}
+	for i, id := range keys {
+		if want := strconv.Itoa(i); id != want {
+			t.Fatalf("keys: got %q at %d, want %q", id, i, want)
+		}
+	}
+	if _, err := Scan(db, "abc", ""); err == nil {
+		t.Fatal("scan from a bound which isn't an integer: got no error")
+	}
+}
@@ -0,0 +1,234 @@
+package logstructured
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// legacySniffSize is how much of the start of a database file is looked at to tell whether it is a legacy one.
+const legacySniffSize = 512
+
+// legacyFiles are the paths of a legacy database's own files, whilst it is read from an upgraded copy of them.
+type legacyFiles struct {
+	dbPath, indexPath string
+	readOnly          bool // Whether the database was opened with OpenReadOnly, which rules out Upgrade.
+}
+
+// isLegacy reports whether the database file at f is in the format from before records were versioned, which is
+// plain text with a "<id>,<value>" line for each write, as in the simplified database from the book. Every versioned
+// file starts with a header holding a sequence number, see writeHeader, so has a zero byte in its first few, which
+// text never does.
+func isLegacy(f *os.File) (bool, error) {
+	start := make([]byte, legacySniffSize)
+	n, err := f.ReadAt(start, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	start = start[:n]
+	if len(start) == 0 || bytes.IndexByte(start, 0) >= 0 {
+		return false, nil
+	}
+
+	line := start
+	if i := bytes.IndexByte(start, '\n'); i >= 0 {
+		line = start[:i]
+	}
+	return bytes.IndexByte(line, ',') >= 0, nil
+}
+
+// openLegacy opens the legacy database at dbPath, see isLegacy, by writing its records out in the current format to
+// a temporary directory of its own, then reading from there, as the database files would be read after Upgrade.
+// The legacy files are left as they are, and the stored hash index isn't read at all, as it points into a file of
+// text lines. Each record takes its sequence number from its line, in order, and has no write time, as the legacy
+// format had neither.
+//
+// The copy is thrown away again when the database is closed. Nothing can be written to it until after Upgrade, so
+// writes return ErrReadOnly until then.
+func openLegacy(dbPath, indexPath string, opts Options) (*DB, error) {
+	logf(opts.Logger, "Database file is in the legacy text format, reading it from an upgraded copy until Upgrade is called.")
+
+	dir, err := os.MkdirTemp("", "logstructured-legacy-")
+	if err != nil {
+		return nil, err
+	}
+	copyPath := filepath.Join(dir, "data.db")
+	if err := convertLegacy(dbPath, copyPath); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	copyOpts := opts
+	copyOpts.ReadOnly = false
+	db, err := openFiles(copyPath, filepath.Join(dir, "index.db"), copyOpts)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	db.readOnly = true
+	db.tempDir = dir
+	db.legacy = &legacyFiles{dbPath: dbPath, indexPath: indexPath, readOnly: opts.ReadOnly}
+	return db, nil
+}
+
+// convertLegacy writes every line of the legacy database file at legacyPath to a new database file at path, as a
+// record in the current format. The ID is everything before the first comma of a line, the value everything after
+// it, as the CLI's -set takes them. A line without a comma means this isn't a legacy file after all.
+func convertLegacy(legacyPath, path string) error {
+	in, err := os.Open(legacyPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	if err := writeHeader(w, 0); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(in)
+	for seq := uint64(1); ; seq++ {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line == "" && err == io.EOF {
+			break
+		}
+
+		id, value, ok := strings.Cut(strings.TrimSuffix(line, "\n"), ",")
+		if !ok {
+			return fmt.Errorf("%w: line %d of the legacy database file has no comma between the id and value", ErrUnsupportedFormat, seq)
+		}
+		if _, err := w.Write(encodeRecord(id, value, 0, seq, 0)); err != nil {
+			return err
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// Upgrade rewrites a database opened from a legacy text file, see openLegacy, in the current format, after which it
+// is written to like any other, and will be opened as one. Every record is kept, overwritten entries included, so
+// reads give the same results after as they did before. A database which is already in the current format is left
+// as it is.
+//
+// The upgraded database file and its hash index are written alongside the legacy ones, which are only replaced once
+// the new files are fully on disk, in the same way as with Compact. If the process dies part way through, the legacy
+// files are either left as they were or replaced by the upgraded ones.
+func Upgrade(db *DB) error {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if db.legacy == nil {
+		return nil
+	}
+	if db.legacy.readOnly {
+		return ErrReadOnly
+	}
+
+	dbPath, indexPath := db.legacy.dbPath, db.legacy.indexPath
+	upgradePath := dbPath + ".compact"
+	upgradeIndexPath := indexPath + ".compact"
+
+	if err := copyDataFile(db, upgradePath); err != nil {
+		os.Remove(upgradePath)
+		return err
+	}
+	if err := writeCompactedIndex(db, upgradeIndexPath, db.Hash); err != nil {
+		os.Remove(upgradePath)
+		os.Remove(upgradeIndexPath)
+		return err
+	}
+
+	dbMode, err := copyMode(upgradePath, db.DB)
+	if err != nil {
+		os.Remove(upgradePath)
+		os.Remove(upgradeIndexPath)
+		return err
+	}
+	indexMode, err := copyMode(upgradeIndexPath, db.HashStorage)
+	if err != nil {
+		os.Remove(upgradePath)
+		os.Remove(upgradeIndexPath)
+		return err
+	}
+
+	// As with compaction, a crash between these two renames is finished off by the next Open, see finishSwap.
+	if err := os.Rename(upgradePath, dbPath); err != nil {
+		os.Remove(upgradePath)
+		os.Remove(upgradeIndexPath)
+		return err
+	}
+	if err := os.Rename(upgradeIndexPath, indexPath); err != nil {
+		os.Remove(upgradeIndexPath)
+		return err
+	}
+	if err := syncDir(filepath.Dir(dbPath)); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(dbPath, os.O_RDWR|os.O_APPEND, dbMode)
+	if err != nil {
+		return err
+	}
+	hashFile, err := os.OpenFile(indexPath, os.O_RDWR|os.O_APPEND, indexMode)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	// The upgraded file is a byte for byte copy of the one read from until now, so the index still points at the
+	// same records.
+	unmapData(db)
+	db.DB.Close()
+	db.HashStorage.Close()
+	db.DB = f
+	db.HashStorage = hashFile
+	db.indexFormat = db.IndexFormat
+	db.indexLogEntries = 0
+
+	os.RemoveAll(db.tempDir)
+	db.tempDir = ""
+	db.legacy = nil
+	db.readOnly = false
+	return nil
+}
+
+// copyDataFile copies the whole of the database file to a new file at path, and flushes it to disk.
+func copyDataFile(db *DB, path string) error {
+	size, err := dataSize(db)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, db.fileMode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, io.NewSectionReader(db.DB, 0, size)); err != nil {
+		return err
+	}
+	return out.Sync()
+}
@@ -0,0 +1,145 @@
+package logstructured
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenLegacyFile(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, indexPath := filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db")
+	if err := os.WriteFile(dbPath, []byte("1,foo\n2,bar,baz\n1,qux\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var logged bytes.Buffer
+	db, err := OpenWithOptions(dbPath, indexPath, Options{Logger: log.New(&logged, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if !strings.Contains(logged.String(), "legacy text format") {
+		t.Fatalf("logged %q, want the legacy format noted", logged.String())
+	}
+	for id, want := range map[string]string{"1": "qux", "2": "bar,baz"} {
+		if value, err := Get(context.Background(), db, id); err != nil || value != want {
+			t.Fatalf("get %q: got %q (error %v), want %q", id, value, err, want)
+		}
+	}
+	if err := Set(context.Background(), db, "3", "new"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("set before Upgrade: got %v, want %v", err, ErrReadOnly)
+	}
+}
+
+// TestLegacy checks that a database file in the legacy text format is read as it is, without being changed,
+// until it is upgraded, after which it reads the same, takes writes and opens as any other database would.
+func TestLegacy(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "legacy.db")
+	indexPath := filepath.Join(dir, "legacy-index.db")
+	lines := "1,foo\n2,bar,baz\n1,qux\n3,gone\n3," + Tombstone + "\n4,last line without a newline"
+	if err := os.WriteFile(dbPath, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stored index of a legacy database points into its lines, so it is never read.
+	if err := os.WriteFile(indexPath, []byte(`{"1": 0}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(stage string, db *DB, wantKeys string) error {
+		for id, want := range map[string]string{"1": "qux", "2": "bar,baz", "4": "last line without a newline"} {
+			if got, err := Get(ctx, db, id); err != nil || got != want {
+				return fmt.Errorf("legacy %s: get %q: got %q and error %v, want %q", stage, id, got, err, want)
+			}
+		}
+		if _, err := Get(ctx, db, "3"); !errors.Is(err, ErrDeleted) {
+			return fmt.Errorf("legacy %s: get deleted ID: got error %v, want %v", stage, err, ErrDeleted)
+		}
+		if keys := strings.Join(db.Keys(), ","); keys != wantKeys {
+			return fmt.Errorf("legacy %s: got keys %q, want %q", stage, keys, wantKeys)
+		}
+		return nil
+	}
+
+	reader, err := OpenReadOnly(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatalf("open read-only: %v", err)
+	}
+	if err := check("read-only", reader, "1,2,4"); err != nil {
+		reader.Close()
+		t.Fatal(err)
+	}
+	if err := Upgrade(reader); !errors.Is(err, ErrReadOnly) {
+		reader.Close()
+		t.Fatalf("upgrade read-only: got error %v, want %v", err, ErrReadOnly)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer func() { db.Close() }()
+	if err := check("before upgrading", db, "1,2,4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Set(ctx, db, "5", "new"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("set before upgrading: got error %v, want %v", err, ErrReadOnly)
+	}
+	if b, err := os.ReadFile(dbPath); err != nil || string(b) != lines {
+		t.Fatalf("file changed before upgrading, error %v", err)
+	}
+
+	if err := Upgrade(db); err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+	if err := check("after upgrading", db, "1,2,4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Set(ctx, db, "5", "new"); err != nil {
+		t.Fatalf("set after upgrading: %v", err)
+	}
+	if err := Upgrade(db); err != nil {
+		t.Fatalf("upgrade again: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opened again, it is a database like any other, with nothing left to upgrade.
+	if db, err = Open(dbPath, indexPath, false); err != nil {
+		t.Fatalf("open after upgrading: %v", err)
+	}
+	if err := check("reopened", db, "1,2,4,5"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Get(ctx, db, "5"); err != nil || got != "new" {
+		t.Fatalf("legacy reopened: get %q: got %q and error %v, want %q", "5", got, err, "new")
+	}
+	if err := Set(ctx, db, "1", "written again"); err != nil {
+		t.Fatalf("legacy reopened: set: %v", err)
+	}
+	it := LogIterator(db)
+	records := 0
+	for it.Next() {
+		records++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if records != 8 {
+		t.Fatalf("legacy reopened: got %d records, want the 6 lines and 2 writes since", records)
+	}
+}
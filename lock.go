@@ -0,0 +1,26 @@
+package logstructured
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrAlreadyLocked is returned by Open when another writer already has the database open.
+var ErrAlreadyLocked = errors.New("database is already open for writing")
+
+// lockDatabase takes an exclusive advisory lock on the lock file alongside the database file at dbPath, which is
+// held for as long as the returned file stays open. The database file itself can't carry the lock, since compaction
+// replaces it with another file, which would be left unlocked. Where advisory locks aren't supported, see lockFile,
+// nothing keeps other writers out.
+func lockDatabase(dbPath string, mode os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(dbPath+".lock", os.O_RDWR|os.O_CREATE, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
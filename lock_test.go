@@ -0,0 +1,44 @@
+package logstructured
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// TestLocking checks that a second writer is kept out whilst the database is open, though a read-only open
+// isn't, and that it is let in once the first writer has closed the database.
+func TestLocking(t *testing.T) {
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "locked.db")
+	indexPath := filepath.Join(dir, "locked-index.db")
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if second, err := Open(dbPath, indexPath, false); !errors.Is(err, ErrAlreadyLocked) {
+		if err == nil {
+			second.Close()
+		}
+		db.Close()
+		t.Fatalf("open a second writer: got error %v, want %v", err, ErrAlreadyLocked)
+	}
+	reader, err := OpenReadOnly(dbPath, indexPath, false)
+	if err != nil {
+		db.Close()
+		t.Fatalf("open read-only alongside a writer: %v", err)
+	}
+	reader.Close()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath, indexPath, false); err != nil {
+		t.Fatalf("open once the first writer has closed: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd
+
+package logstructured
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive flock on f without waiting for it, returning ErrAlreadyLocked if someone else holds
+// it. The lock belongs to the open file, so it is released when f is closed, or when the process dies.
+func lockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return ErrAlreadyLocked
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+package logstructured
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// ErrLogCompacted is returned by a LogIter when the database was compacted part way through the walk, which
+// replaces the file it was walking with one laid out differently.
+var ErrLogCompacted = errors.New("database file was compacted whilst walking its log")
+
+// LogIter walks every record in the database file from front to back, in the order they were written, as opposed to
+// Iterator, which only visits the latest entry for each key. Overwritten entries and tombstones are all included, as
+// are the markers surrounding the records of a transaction, which makes this the raw view of the log, for debugging
+// compaction or building an index outside of the database. Records are visited by calling Next until it returns
+// false, after which Err reports whether the walk stopped because of an error rather than reaching the end.
+//
+// Records appended whilst walking are visited too, as the walk carries on until it catches up with the end of the
+// file. Having caught up, Next can be called again later to carry on with any appended since. An in-place update,
+// see AllowInPlaceUpdate, is only seen if the walk hasn't passed its record yet.
+type LogIter struct {
+	db   *DB
+	file *os.File // Database file being walked, which compaction swaps for another.
+	next int64    // Where the record after the current one starts.
+	end  int64    // End of the file when it was last looked at, Next only looks again on reaching it.
+
+	offset    int64
+	key       string
+	value     string
+	expiresAt int64
+	seq       uint64
+	err       error
+}
+
+// LogIterator returns an iterator over the records in db's file, positioned before the first of them.
+func LogIterator(db *DB) *LogIter {
+	db.RLock()
+	defer db.RUnlock()
+
+	return &LogIter{db: db, file: db.DB, next: headerSize, end: headerSize}
+}
+
+// Next moves the iterator on to the next record, reporting whether there was one.
+func (it *LogIter) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	// Each record is read under the lock on its own, so that writes aren't held up for the whole walk.
+	it.db.RLock()
+	defer it.db.RUnlock()
+
+	switch {
+	case it.db.closed:
+		return it.stop(ErrClosed)
+	case it.db.DB != it.file:
+		return it.stop(ErrLogCompacted)
+	}
+
+	if it.next >= it.end {
+		if err := flushWrites(it.db); err != nil {
+			return it.stop(err)
+		}
+		info, err := it.db.DB.Stat()
+		if err != nil {
+			return it.stop(err)
+		}
+		it.end = info.Size()
+		if it.next >= it.end {
+			return it.stop(nil)
+		}
+	}
+
+	// A final record which has been cut short, such as one another process is part way through writing to a file
+	// opened with OpenReadOnly, is where the log ends for now.
+	key, value, expiresAt, seq, _, err := readRecordAt(it.db, it.next)
+	if err == io.ErrUnexpectedEOF {
+		return it.stop(nil)
+	}
+	if err != nil {
+		return it.stop(err)
+	}
+
+	it.offset, it.key, it.value, it.expiresAt, it.seq = it.next, key, value, expiresAt, seq
+	it.next += recordSize(key, value)
+	return true
+}
+
+// stop ends the walk because of err, or having reached the end of the file if it is nil, returning false for Next.
+func (it *LogIter) stop(err error) bool {
+	it.err = err
+	it.offset, it.key, it.value, it.expiresAt, it.seq = 0, "", "", 0, 0
+	return false
+}
+
+// Offset returns the byte offset in the database file which the current record starts at.
+func (it *LogIter) Offset() int64 {
+	return it.offset
+}
+
+// Key returns the ID the current record was written for.
+func (it *LogIter) Key() string {
+	return it.key
+}
+
+// Value returns the value the current record holds, which is Tombstone for a delete.
+func (it *LogIter) Value() string {
+	return it.value
+}
+
+// Tombstone reports whether the current record marks its ID as deleted.
+func (it *LogIter) Tombstone() bool {
+	return it.value == Tombstone
+}
+
+// TxnMarker reports whether the current record marks the start or the end of the records written by a transaction,
+// rather than being an entry of its own. See Transaction.
+func (it *LogIter) TxnMarker() bool {
+	return isTxnMarker(it.key)
+}
+
+// ExpiresAt returns the Unix time, in seconds, after which the current record expires, or zero if it never does.
+func (it *LogIter) ExpiresAt() int64 {
+	return it.expiresAt
+}
+
+// Seq returns the sequence number of the current record, see LastSeq. Transaction markers have none, so it is zero.
+func (it *LogIter) Seq() uint64 {
+	return it.seq
+}
+
+// Err returns the error which stopped the iterator, if there was one. This includes ErrClosed if the database was
+// closed, and ErrLogCompacted if it was compacted, part way through.
+func (it *LogIter) Err() error {
+	return it.err
+}
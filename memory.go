@@ -0,0 +1,25 @@
+package logstructured
+
+import (
+	"os"
+)
+
+// OpenMemory opens a new, empty database which is thrown away when it is closed, for tests and anything else with
+// no need to keep what it holds. Its files are kept in a temporary directory of their own, which Close removes, on a
+// filesystem held in memory where there is one, see memoryDir, so that nothing it does touches the disk. They are the
+// same files as any other database's, so Get, Set, Delete, compaction and everything else behave exactly as they do
+// for a database opened with Open, including on a crash, which loses everything, much as losing the memory would.
+func OpenMemory() (*DB, error) {
+	dir, err := os.MkdirTemp(memoryDir(), "logstructured-")
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := OpenWithOptions("data.db", "index.db", Options{Dir: dir})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	db.tempDir = dir
+	return db, nil
+}
@@ -0,0 +1,14 @@
+package logstructured
+
+import (
+	"os"
+)
+
+// memoryDir returns /dev/shm, the filesystem held in memory which Linux has for shared memory, if it can be used,
+// or the usual temporary directory otherwise.
+func memoryDir() string {
+	if info, err := os.Stat("/dev/shm"); err == nil && info.IsDir() {
+		return "/dev/shm"
+	}
+	return os.TempDir()
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package logstructured
+
+import (
+	"os"
+)
+
+// memoryDir returns the usual temporary directory, as there is no filesystem held in memory that can be relied on
+// here.
+func memoryDir() string {
+	return os.TempDir()
+}
@@ -0,0 +1,77 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMemory runs the same writes, reads, deletes and compaction against a database on disk and one opened with
+// OpenMemory, checking that both give the same results, and that the files of the one in memory go once it is
+// closed.
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	run := func(db *DB) ([]KV, error) {
+		for i := 0; i < 100; i++ {
+			if err := Set(ctx, db, fmt.Sprintf("key-%02d", i%20), fmt.Sprintf("value-%d", i)); err != nil {
+				return nil, err
+			}
+		}
+		for i := 0; i < 20; i += 3 {
+			if err := Delete(ctx, db, fmt.Sprintf("key-%02d", i)); err != nil {
+				return nil, err
+			}
+		}
+		if err := Compact(ctx, db); err != nil {
+			return nil, err
+		}
+		if value, err := Get(ctx, db, "key-19"); err != nil || value != "value-99" {
+			return nil, fmt.Errorf("get after compaction: got %q, %v, want %q", value, err, "value-99")
+		}
+		if _, err := Get(ctx, db, "key-00"); !errors.Is(err, ErrKeyNotFound) && !errors.Is(err, ErrDeleted) {
+			return nil, fmt.Errorf("get of a deleted key after compaction: got error %v", err)
+		}
+		return Scan(db, "", "")
+	}
+
+	disk, err := Open(filepath.Join(dir, "memory-disk.db"), filepath.Join(dir, "memory-disk-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { disk.Close() }()
+	want, err := run(disk)
+	if err != nil {
+		t.Fatalf("on disk: %v", err)
+	}
+
+	memory, err := OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { memory.Close() }()
+	got, err := run(memory)
+	if err != nil {
+		t.Fatalf("in memory: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("in memory: scanned %d entries, want %d as on disk", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("in memory: scanned %+v at %d, want %+v as on disk", got[i], i, want[i])
+		}
+	}
+
+	memoryDir := filepath.Dir(memory.DB.Name())
+	if err := memory.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(memoryDir); !os.IsNotExist(err) {
+		t.Fatalf("files of a database in memory still there once closed: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package logstructured
+
+import (
+	"math/rand"
+)
+
+// memtableMaxLevel bounds the height of the skiplist, which with a branching factor of 4 is plenty for far more
+// entries than a memtable is ever allowed to hold.
+const memtableMaxLevel = 12
+
+// memtable holds the most recent writes in memory, in key order, backed by a skiplist. With MemtableSize set, Get
+// answers from it before going to the database file, and once it grows past MemtableSize it is flushed to a
+// sorted segment file, see flushMemtable.
+type memtable struct {
+	head  *memtableNode
+	level int
+	size  int // Bytes the entries would take up as records, which is what MemtableSize is measured against.
+	rand  *rand.Rand
+}
+
+type memtableNode struct {
+	key       string
+	value     string
+	expiresAt int64
+	seq       uint64
+	writtenAt int64
+	next      []*memtableNode
+}
+
+func newMemtable() *memtable {
+	return &memtable{
+		head:  &memtableNode{next: make([]*memtableNode, memtableMaxLevel)},
+		level: 1,
+		rand:  rand.New(rand.NewSource(1)),
+	}
+}
+
+// put writes the entry for key, replacing any which is already held.
+func (m *memtable) put(key, value string, expiresAt int64, seq uint64, writtenAt int64) {
+	var update [memtableMaxLevel]*memtableNode
+	n := m.head
+	for i := m.level - 1; i >= 0; i-- {
+		for n.next[i] != nil && n.next[i].key < key {
+			n = n.next[i]
+		}
+		update[i] = n
+	}
+
+	if next := n.next[0]; next != nil && next.key == key {
+		m.size += int(recordSize(key, value) - recordSize(key, next.value))
+		next.value, next.expiresAt, next.seq, next.writtenAt = value, expiresAt, seq, writtenAt
+		return
+	}
+
+	level := 1
+	for level < memtableMaxLevel && m.rand.Intn(4) == 0 {
+		level++
+	}
+	for i := m.level; i < level; i++ {
+		update[i] = m.head
+	}
+	if level > m.level {
+		m.level = level
+	}
+
+	node := &memtableNode{key: key, value: value, expiresAt: expiresAt, seq: seq, writtenAt: writtenAt, next: make([]*memtableNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	m.size += int(recordSize(key, value))
+}
+
+// get returns the entry held for key, if there is one.
+func (m *memtable) get(key string) (*memtableNode, bool) {
+	n := m.head
+	for i := m.level - 1; i >= 0; i-- {
+		for n.next[i] != nil && n.next[i].key < key {
+			n = n.next[i]
+		}
+	}
+
+	n = n.next[0]
+	if n == nil || n.key != key {
+		return nil, false
+	}
+	return n, true
+}
+
+// each calls fn with every entry held, in key order.
+func (m *memtable) each(fn func(n *memtableNode)) {
+	for n := m.head.next[0]; n != nil; n = n.next[0] {
+		fn(n)
+	}
+}
+
+// rememberWrite keeps the entry just written for id in the memtable, alongside the update to the hash index so
+// that the two never disagree. With MemtableSize at zero, any memtable left from before it was turned off is
+// dropped, since it would otherwise go stale, along with the segments. The value cached for id, if any, is dropped
+// for the same reason, see CacheSize. The lock must be held.
+func rememberWrite(db *DB, id, value string, expiresAt int64, seq uint64, writtenAt int64) error {
+	if db.CacheSize > 0 {
+		db.cache.forget(id)
+	} else {
+		db.cache.clear()
+	}
+
+	if db.MemtableSize <= 0 {
+		db.memtable = nil
+		if len(db.segments) > 0 {
+			return dropSegments(db)
+		}
+		return nil
+	}
+
+	if db.memtable == nil {
+		db.memtable = newMemtable()
+	}
+	db.memtable.put(id, value, expiresAt, seq, writtenAt)
+	return nil
+}
+
+// forgetWrite is rememberWrite for a value which isn't held in memory, as for a streamed one. The memtable or a
+// segment would otherwise carry on answering with the value from before, so if either holds id, the memtable and
+// segments are dropped, losing nothing, as everything they held is in the database file as well. The lock must be
+// held.
+func forgetWrite(db *DB, id string) error {
+	if db.CacheSize > 0 {
+		db.cache.forget(id)
+	} else {
+		db.cache.clear()
+	}
+
+	if db.MemtableSize <= 0 {
+		db.memtable = nil
+		if len(db.segments) > 0 {
+			return dropSegments(db)
+		}
+		return nil
+	}
+
+	_, held, err := lookupRecent(db, id)
+	if err != nil || held {
+		return dropSegments(db)
+	}
+	return nil
+}
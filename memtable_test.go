@@ -0,0 +1,395 @@
+package logstructured
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemtableKeepsKeysSorted(t *testing.T) {
+	m := newMemtable()
+	want := make(map[string]string)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint(r.Intn(300))
+		value := fmt.Sprint(i)
+		m.put(key, value, 0, uint64(i), 0)
+		want[key] = value
+	}
+
+	var keys []string
+	m.each(func(n *memtableNode) {
+		keys = append(keys, n.key)
+		if n.value != want[n.key] {
+			t.Errorf("entry for %q: got %q, want the latest, %q", n.key, n.value, want[n.key])
+		}
+	})
+	if !sort.StringsAreSorted(keys) {
+		t.Fatalf("memtable entries are out of order: %v", keys)
+	}
+	if len(keys) != len(want) {
+		t.Fatalf("memtable holds %d entries, want one for each of the %d keys", len(keys), len(want))
+	}
+	for key, value := range want {
+		if n, ok := m.get(key); !ok || n.value != value {
+			t.Fatalf("get %q: got %v (found %t), want %q", key, n, ok, value)
+		}
+	}
+}
+
+func TestGetSeesMemtableWrites(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "data.db")
+	db, err := Open(dbPath, filepath.Join(dir, "index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.MemtableSize = 1024
+	for _, kv := range []KV{{"b", "1"}, {"a", "2"}, {"b", "3"}} {
+		if err := Set(ctx, db, kv.Key, kv.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Delete(ctx, db, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.memtable.get("b"); !ok {
+		t.Fatalf("%q isn't held in the memtable", "b")
+	}
+	if value, err := Get(ctx, db, "b"); err != nil || value != "3" {
+		t.Fatalf("get %q from the memtable: got %q (error %v), want %q", "b", value, err, "3")
+	}
+	if _, err := Get(ctx, db, "a"); !errors.Is(err, ErrDeleted) {
+		t.Fatalf("get deleted %q from the memtable: got %v, want %v", "a", err, ErrDeleted)
+	}
+
+	// Passing MemtableSize flushes the memtable to a segment, which reads then find the entries in.
+	if err := Set(ctx, db, "c", strings.Repeat("x", 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if db.memtable.size != 0 {
+		t.Fatalf("memtable holds %d bytes after passing MemtableSize, want none", db.memtable.size)
+	}
+	if segments, err := segmentPaths(db); err != nil || len(segments) != 1 {
+		t.Fatalf("got segment files %v (error %v), want one", segments, err)
+	}
+	if value, err := Get(ctx, db, "b"); err != nil || value != "3" {
+		t.Fatalf("get %q from the segment: got %q (error %v), want %q", "b", value, err, "3")
+	}
+	if _, err := Get(ctx, db, "a"); !errors.Is(err, ErrDeleted) {
+		t.Fatalf("get deleted %q from the segment: got %v, want %v", "a", err, ErrDeleted)
+	}
+}
+
+// segmentKeys returns the keys of the segment file at path, in the order they are stored.
+func segmentKeys(t *testing.T, path string) []string {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var keys []string
+	rr := recordReader{r: bufio.NewReader(io.NewSectionReader(f, headerSize, 1<<62))}
+	for {
+		key, _, _, _, _, err := rr.next()
+		if err == io.EOF {
+			return keys
+		}
+		if err != nil {
+			t.Fatalf("segment %s: %v", path, err)
+		}
+		keys = append(keys, string(key))
+	}
+}
+
+// TestMemtableFlushesSortedSegments checks that each segment the memtable is flushed to holds its keys in order,
+// and that Get and Scan see the latest entry for every key, whether it is still held in the memtable, or in one
+// segment or several, without reading the database file even with the hash index disabled.
+func TestMemtableFlushesSortedSegments(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.MemtableSize = 4096
+	want := make(map[string]string)
+	written := make(map[string]bool)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		id := fmt.Sprintf("key-%03d", r.Intn(500))
+		if i%10 == 9 {
+			if err := Delete(ctx, db, id); err != nil && !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("delete %q: %v", id, err)
+			}
+			delete(want, id)
+			continue
+		}
+		value := fmt.Sprintf("value %d", i)
+		if err := Set(ctx, db, id, value); err != nil {
+			t.Fatalf("set %q: %v", id, err)
+		}
+		want[id] = value
+		written[id] = true
+	}
+	if err := Set(ctx, db, "resident", "still in the memtable"); err != nil {
+		t.Fatal(err)
+	}
+	want["resident"] = "still in the memtable"
+	if _, ok := db.memtable.get("resident"); !ok {
+		t.Fatalf("%q isn't held in the memtable", "resident")
+	}
+
+	segments, err := segmentPaths(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 2 {
+		t.Fatalf("got segment files %v, want several", segments)
+	}
+	for _, path := range segments {
+		keys := segmentKeys(t, path)
+		for i := 1; i < len(keys); i++ {
+			if keys[i-1] >= keys[i] {
+				t.Fatalf("segment %s: key %q follows %q", filepath.Base(path), keys[i], keys[i-1])
+			}
+		}
+	}
+
+	counter := &scanCounter{records: -1}
+	db.Metrics = counter
+	db.HashDisabled = true
+	for id := range written {
+		got, err := Get(ctx, db, id)
+		if value, ok := want[id]; ok {
+			if err != nil || got != value {
+				t.Fatalf("get %q: got %q (error %v), want %q", id, got, err, value)
+			}
+		} else if !errors.Is(err, ErrDeleted) {
+			t.Fatalf("get deleted %q: got %q (error %v), want %v", id, got, err, ErrDeleted)
+		}
+	}
+	if got, err := Get(ctx, db, "resident"); err != nil || got != want["resident"] {
+		t.Fatalf("get %q: got %q (error %v), want %q", "resident", got, err, want["resident"])
+	}
+	if counter.records >= 0 {
+		t.Fatalf("a get went through the database file, reading %d records", counter.records)
+	}
+	db.HashDisabled = false
+
+	kvs, err := Scan(db, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != len(want) {
+		t.Fatalf("scan: got %d keys, want %d", len(kvs), len(want))
+	}
+	for _, kv := range kvs {
+		if kv.Value != want[kv.Key] {
+			t.Fatalf("scan: got %q for %q, want %q", kv.Value, kv.Key, want[kv.Key])
+		}
+	}
+}
+
+// TestSegmentsAfterReopen checks that the segments are read again once the database is reopened after Close has
+// flushed the memtable, but removed if the process died with writes still in the memtable, with either way every
+// key reading as it was written.
+func TestSegmentsAfterReopen(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "data.db")
+	indexPath := filepath.Join(dir, "index.db")
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.MemtableSize = 64
+	for i := 0; i < 10; i++ {
+		if err := Set(ctx, db, fmt.Sprint(i%3), fmt.Sprintf("value %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.segments) == 0 {
+		t.Fatal("no segments were loaded after Close flushed the memtable")
+	}
+	if got, err := Get(ctx, db, "0"); err != nil || got != "value 9" {
+		t.Fatalf("get %q after reopening: got %q (error %v), want %q", "0", got, err, "value 9")
+	}
+
+	// The latest write is in the database file, but not in any segment.
+	db.MemtableSize = 4096
+	db.CrashPoint = CrashAfterIndexLog
+	if err := Set(ctx, db, "0", "after the crash"); !errors.Is(err, ErrCrashed) {
+		t.Fatalf("set with a crash point: got %v, want %v", err, ErrCrashed)
+	}
+
+	db, err = Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if len(db.segments) != 0 {
+		t.Fatalf("got %d segments loaded after a crash, want them removed", len(db.segments))
+	}
+	if segments, err := segmentPaths(db); err != nil || len(segments) != 0 {
+		t.Fatalf("got segment files %v (error %v) after a crash, want none", segments, err)
+	}
+	for id, want := range map[string]string{"0": "after the crash", "1": "value 7", "2": "value 8"} {
+		if got, err := Get(ctx, db, id); err != nil || got != want {
+			t.Fatalf("get %q after the crash: got %q (error %v), want %q", id, got, err, want)
+		}
+	}
+}
+
+// TestSegmentsDroppedByBypassingWrites checks that a write which doesn't go through the memtable, with it turned
+// off or for a streamed value, drops the segments, which would otherwise answer with the value from before.
+func TestSegmentsDroppedByBypassingWrites(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		write func(db *DB) error
+	}{
+		{"memtable turned off", func(db *DB) error {
+			db.MemtableSize = 0
+			return Set(ctx, db, "a", "new")
+		}},
+		{"streamed value", func(db *DB) error {
+			return SetStream(db, "a", strings.NewReader("new"), 3)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			db, err := Open(filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db"), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			db.MemtableSize = 1
+			if err := Set(ctx, db, "a", "old"); err != nil {
+				t.Fatal(err)
+			}
+			if len(db.segments) != 1 {
+				t.Fatalf("got %d segments, want one", len(db.segments))
+			}
+
+			if err := tt.write(db); err != nil {
+				t.Fatal(err)
+			}
+			if len(db.segments) != 0 {
+				t.Fatalf("got %d segments after the write, want none", len(db.segments))
+			}
+			if got, err := Get(ctx, db, "a"); err != nil || got != "new" {
+				t.Fatalf("get %q: got %q (error %v), want %q", "a", got, err, "new")
+			}
+		})
+	}
+}
+
+// TestRetention checks that compacting removes the segments whose latest write is older than RetentionDuration,
+// whilst every key written to them, superseded or not, can still be read, and that an aged segment holding the
+// latest entry for a live key is kept, along with every segment after it, until that key is written again.
+func TestRetention(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "retention.db")
+	db, err := Open(dbPath, filepath.Join(dir, "retention-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Unix(1700000000, 0)
+	db.Clock = func() time.Time { return now }
+	db.RetentionDuration = time.Hour
+
+	// Every write takes the memtable past its size, so each is flushed to a segment of its own.
+	db.MemtableSize = 1
+	set := func(id, value string) {
+		t.Helper()
+		if err := Set(ctx, db, id, value); err != nil {
+			t.Fatalf("set %q: %v", id, err)
+		}
+	}
+	segments := func() []string {
+		t.Helper()
+		paths, err := segmentPaths(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return paths
+	}
+	compact := func() {
+		t.Helper()
+		if err := Compact(ctx, db); err != nil {
+			t.Fatalf("compact: %v", err)
+		}
+	}
+
+	set("a", "old a")
+	set("b", "old b")
+	if err := Delete(ctx, db, "gone"); err != nil {
+		t.Fatal(err)
+	}
+	set("kept", "only written once")
+	set("c", "old c")
+	now = now.Add(2 * time.Hour)
+	set("a", "new a")
+	set("b", "new b")
+	written := segments()
+
+	// The first two segments are superseded, as is the one with the tombstone, but the next holds the only entry
+	// for a live key, so it and everything after it stay.
+	compact()
+	if got := segments(); len(got) != len(written)-3 || got[0] != written[3] {
+		t.Fatalf("got segments %v after compacting, want those from %v on", got, written[3])
+	}
+	for id, want := range map[string]string{"a": "new a", "b": "new b", "c": "old c", "kept": "only written once"} {
+		if got, err := Get(ctx, db, id); err != nil || got != want {
+			t.Fatalf("get %q after removing aged segments: got %q, %v, want %q", id, got, err, want)
+		}
+	}
+
+	// Once the live key is written again, its aged segment goes, up to the next which holds the only entry for c.
+	set("kept", "written again")
+	compact()
+	if got := segments(); len(got) != len(written)-3 || got[0] != written[4] {
+		t.Fatalf("got segments %v after compacting again, want those from %v on", got, written[4])
+	}
+	for id, want := range map[string]string{"a": "new a", "b": "new b", "c": "old c", "kept": "written again"} {
+		if got, err := Get(ctx, db, id); err != nil || got != want {
+			t.Fatalf("get %q after removing aged segments: got %q, %v, want %q", id, got, err, want)
+		}
+	}
+}
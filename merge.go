@@ -0,0 +1,86 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+)
+
+// Merge folds the contents of src into dst. The latest entry for every key in src is written into dst, when
+// the key is present in both databases onConflict is called with the current value from each to decide which
+// value dst should end up with. If onConflict is nil, the value from src wins.
+//
+// Keys which have been deleted in src are also deleted in dst, without consulting onConflict, whereas keys which
+// have expired in src are left alone. Entries written with a TTL keep their expiry in dst. src is only read
+// from, its own files are left untouched.
+func Merge(dst *DB, src *DB, onConflict func(key, dstVal, srcVal string) string) error {
+	if dst == src {
+		return errors.New("cannot merge a database into itself")
+	}
+
+	// Take a copy of the latest entries in src first, this means we aren't holding the lock on src whilst also
+	// acquiring the one on dst for each write.
+	src.RLock()
+	if src.closed {
+		src.RUnlock()
+		return ErrClosed
+	}
+	values := make(map[string]string, src.Hash.Len())
+	expiries := make(map[string]int64)
+	var readErr error
+	src.Hash.Range(func(id string, loc RecordLocation) bool {
+		_, value, expiresAt, _, _, err := readRecord(src, loc)
+		if err != nil {
+			readErr = err
+			return false
+		}
+
+		// An expired entry is as good as never written, so there is nothing of it to merge.
+		if src.expired(expiresAt) {
+			return true
+		}
+		values[id] = value
+		if expiresAt != 0 {
+			expiries[id] = expiresAt
+		}
+		return true
+	})
+	src.RUnlock()
+	if readErr != nil {
+		return readErr
+	}
+
+	for id, srcVal := range values {
+
+		if srcVal == Tombstone {
+			if err := Delete(context.Background(), dst, id); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if onConflict != nil {
+			dst.RLock()
+			loc, ok := dst.Hash.Get(id)
+			var current string
+			var expiresAt int64
+			var err error
+			if ok {
+				_, current, expiresAt, _, _, err = readRecord(dst, loc)
+			}
+			dst.RUnlock()
+			if err != nil {
+				return err
+			}
+			if ok && current != Tombstone && !dst.expired(expiresAt) {
+				srcVal = onConflict(id, current, srcVal)
+			}
+		}
+
+		// The entry keeps its expiry from src, if it has one.
+		if err := set(context.Background(), dst, id, srcVal, expiries[id]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
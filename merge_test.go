@@ -0,0 +1,81 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// TestMerge checks that keys only in src are copied into dst, that onConflict is given the value from each side for
+// keys in both and decides what dst ends up with, and that keys deleted in src are deleted in dst without it.
+func TestMerge(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	open := func(name string) *DB {
+		t.Helper()
+		db, err := Open(filepath.Join(dir, name+".db"), filepath.Join(dir, name+"-index.db"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+	write := func(db *DB, kvs ...KV) {
+		t.Helper()
+		for _, kv := range kvs {
+			if err := Set(ctx, db, kv.Key, kv.Value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	dst, src := open("dst"), open("src")
+
+	write(dst, KV{"both", "dst-both"}, KV{"deleted", "dst-deleted"}, KV{"dst-only", "kept"})
+	write(src, KV{"src-only", "copied"}, KV{"both", "old-src-both"}, KV{"both", "src-both"}, KV{"deleted", "src-deleted"}, KV{"gone", "src-gone"})
+	for _, id := range []string{"deleted", "gone"} {
+		if err := Delete(ctx, src, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type conflict struct{ key, dstVal, srcVal string }
+	var conflicts []conflict
+	err := Merge(dst, src, func(key, dstVal, srcVal string) string {
+		conflicts = append(conflicts, conflict{key, dstVal, srcVal})
+		return dstVal + "+" + srcVal
+	})
+	if err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+
+	if want := (conflict{"both", "dst-both", "src-both"}); len(conflicts) != 1 || conflicts[0] != want {
+		t.Fatalf("merge: got conflicts %+v, want only %+v", conflicts, want)
+	}
+	for id, want := range map[string]string{"src-only": "copied", "both": "dst-both+src-both", "dst-only": "kept"} {
+		if got, err := Get(ctx, dst, id); err != nil || got != want {
+			t.Fatalf("get %q after merge: got %q (error %v), want %q", id, got, err, want)
+		}
+	}
+	for _, id := range []string{"deleted", "gone"} {
+		if _, err := Get(ctx, dst, id); !errors.Is(err, ErrDeleted) {
+			t.Fatalf("get of %q, deleted in src, after merge: got %v, want %v", id, err, ErrDeleted)
+		}
+	}
+
+	// Without onConflict, src wins, and src itself is left as it was.
+	if err := Merge(dst, src, nil); err != nil {
+		t.Fatalf("merge without onConflict: %v", err)
+	}
+	if got, err := Get(ctx, dst, "both"); err != nil || got != "src-both" {
+		t.Fatalf("get %q after merge without onConflict: got %q (error %v), want %q", "both", got, err, "src-both")
+	}
+	if _, err := Get(ctx, src, "dst-only"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("get of a key only in dst from src: got %v, want %v", err, ErrKeyNotFound)
+	}
+
+	if err := Merge(dst, dst, nil); err == nil {
+		t.Fatal("merge of a database into itself: got no error")
+	}
+}
@@ -0,0 +1,37 @@
+package logstructured
+
+import (
+	"time"
+)
+
+// Op names an operation on the database, as reported to Metrics and to watchers, see Watch.
+type Op string
+
+const (
+	OpGet    Op = "get"
+	OpSet    Op = "set"
+	OpDelete Op = "delete"
+)
+
+// Metrics is told about the operations run against a database, for monitoring it. The metrics package reports
+// them to Prometheus, this interface keeps the database itself free of any particular metrics library.
+//
+// Its methods are called from whichever goroutine ran the operation, so they must be safe for concurrent use.
+type Metrics interface {
+
+	// Observe is called as each Get, Set and Delete returns, with how long it took, waiting for the lock included,
+	// and the error it returned, if any.
+	Observe(op Op, d time.Duration, err error)
+
+	// ObserveScan is called when a Get has read through the database file, rather than going by the hash index,
+	// with how many records it read.
+	ObserveScan(records int)
+}
+
+// observe reports the operation op, started at start, to the database's Metrics, if there are any. It is deferred
+// by the operation itself, so err points at the error it is about to return.
+func observe(db *DB, op Op, start time.Time, err *error) {
+	if db.Metrics != nil {
+		db.Metrics.Observe(op, time.Since(start), *err)
+	}
+}
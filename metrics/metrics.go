@@ -0,0 +1,92 @@
+// Package metrics reports what a log-structured database is doing to Prometheus:
+//
+//	logstructured_operations_total           counter of Get, Set and Delete calls, by op
+//	logstructured_operation_errors_total     counter of those which failed, by op
+//	logstructured_operation_duration_seconds histogram of how long they took, by op
+//	logstructured_scan_records               histogram of records read by each Get which fell back to a full scan
+//	logstructured_live_keys                  gauge of live keys
+//	logstructured_file_size_bytes            gauge of the size of the database file
+//
+// A Get for an ID which isn't there, or has been deleted, isn't counted as failing.
+package metrics
+
+import (
+	"errors"
+	"time"
+
+	logstructured "github.com/jdockerty/log-structured-db-engine"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics implements logstructured.Metrics by recording operations in Prometheus collectors.
+type Metrics struct {
+	operations *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+	durations  *prometheus.HistogramVec
+	scans      prometheus.Histogram
+}
+
+// Register registers the metrics for db with reg and sets them as db's Metrics, so that from then on every Get,
+// Set and Delete is recorded. The gauges are read from the database whenever reg is gathered.
+func Register(reg prometheus.Registerer, db *logstructured.DB) (*Metrics, error) {
+	m := &Metrics{
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "logstructured_operations_total",
+			Help: "Number of Get, Set and Delete calls made against the database.",
+		}, []string{"op"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "logstructured_operation_errors_total",
+			Help: "Number of Get, Set and Delete calls which returned an error.",
+		}, []string{"op"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "logstructured_operation_duration_seconds",
+			Help:    "How long Get, Set and Delete calls took, including waiting for the lock.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, []string{"op"}),
+		scans: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "logstructured_scan_records",
+			Help:    "Number of records read by each Get which fell back to a full scan of the database file.",
+			Buckets: prometheus.ExponentialBuckets(1, 10, 8),
+		}),
+	}
+
+	// The gauges are only worth anything whilst the database is open, once closed they stop being reported.
+	liveKeys := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "logstructured_live_keys",
+		Help: "Number of live keys in the database.",
+	}, func() float64 {
+		return float64(db.Len())
+	})
+	fileSize := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "logstructured_file_size_bytes",
+		Help: "Size of the database file in bytes.",
+	}, func() float64 {
+		stats, err := logstructured.Stats(db)
+		if err != nil {
+			return 0
+		}
+		return float64(stats.FileSize)
+	})
+
+	for _, c := range []prometheus.Collector{m.operations, m.errors, m.durations, m.scans, liveKeys, fileSize} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	db.Metrics = m
+	return m, nil
+}
+
+func (m *Metrics) Observe(op logstructured.Op, d time.Duration, err error) {
+	m.operations.WithLabelValues(string(op)).Inc()
+	m.durations.WithLabelValues(string(op)).Observe(d.Seconds())
+
+	if err != nil && !errors.Is(err, logstructured.ErrKeyNotFound) && !errors.Is(err, logstructured.ErrDeleted) {
+		m.errors.WithLabelValues(string(op)).Inc()
+	}
+}
+
+func (m *Metrics) ObserveScan(records int) {
+	m.scans.Observe(float64(records))
+}
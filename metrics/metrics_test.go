@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	logstructured "github.com/jdockerty/log-structured-db-engine"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestMetrics checks that the metrics registered for a database count each kind of operation, and errors apart
+// from keys which aren't there, along with the records read by a full scan.
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := logstructured.Open(filepath.Join(dir, "metrics.db"), filepath.Join(dir, "metrics-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	reg := prometheus.NewRegistry()
+	if _, err := Register(reg, db); err != nil {
+		t.Fatalf("register metrics: %v", err)
+	}
+
+	for _, id := range []string{"a", "b", "a"} {
+		if err := logstructured.Set(ctx, db, id, "value"); err != nil {
+			t.Fatalf("set %q with metrics: %v", id, err)
+		}
+	}
+	logstructured.Get(ctx, db, "a")
+	logstructured.Get(ctx, db, "missing")
+	logstructured.Delete(ctx, db, "b")
+	if err := logstructured.Set(ctx, db, "c", logstructured.Tombstone); err == nil {
+		t.Fatal("set of the tombstone value with metrics succeeded")
+	}
+
+	// Both the missing key, which isn't in the index, and this read, which bypasses it, read through the file,
+	// taking three records and then four.
+	db.HashDisabled = true
+	logstructured.Get(ctx, db, "a")
+	db.HashDisabled = false
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gather metrics: %v", err)
+	}
+	got := make(map[string]float64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			name := family.GetName()
+			for _, label := range m.GetLabel() {
+				name += "{" + label.GetValue() + "}"
+			}
+			switch {
+			case m.Counter != nil:
+				got[name] = m.GetCounter().GetValue()
+			case m.Gauge != nil:
+				got[name] = m.GetGauge().GetValue()
+			case m.Histogram != nil:
+				got[name+"_count"] = float64(m.GetHistogram().GetSampleCount())
+				got[name+"_sum"] = m.GetHistogram().GetSampleSum()
+			}
+		}
+	}
+
+	want := map[string]float64{
+		"logstructured_operations_total{get}":                 3,
+		"logstructured_operations_total{set}":                 4,
+		"logstructured_operations_total{delete}":              1,
+		"logstructured_operation_errors_total{set}":           1,
+		"logstructured_operation_duration_seconds{set}_count": 4,
+		"logstructured_scan_records_count":                    2,
+		"logstructured_scan_records_sum":                      7,
+		"logstructured_live_keys":                             1,
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Fatalf("metric %s: got %v, want %v", name, got[name], value)
+		}
+	}
+	if _, ok := got["logstructured_operation_errors_total{get}"]; ok {
+		t.Fatal("get of a missing key with metrics was counted as an error")
+	}
+}
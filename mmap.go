@@ -0,0 +1,87 @@
+package logstructured
+
+import (
+	"io"
+)
+
+// readAt reads len(buf) bytes of the database file starting at offset, in the same way as ReadAt. With MmapReads
+// set, they are copied out of a memory mapping of the file instead, which saves a syscall for every read. The
+// mapping only covers the file as it was when it was made, so a read past its end maps the file again at its
+// current size. Should mapping the file not work, reads go back to ReadAt for good.
+func readAt(db *DB, buf []byte, offset int64) (int, error) {
+	if !db.MmapReads {
+		return db.DB.ReadAt(buf, offset)
+	}
+
+	db.mappingMu.RLock()
+	n, ok := readMapped(db, buf, offset)
+	db.mappingMu.RUnlock()
+	if ok {
+		return n, nil
+	}
+
+	// The first reader to find the mapping too short extends it, those after it find it already done.
+	db.mappingMu.Lock()
+	defer db.mappingMu.Unlock()
+
+	if n, ok := readMapped(db, buf, offset); ok {
+		return n, nil
+	}
+	if !db.mmapFailed && remapData(db) != nil {
+		db.mmapFailed = true
+	}
+	if db.mmapFailed {
+		return db.DB.ReadAt(buf, offset)
+	}
+	if n, ok := readMapped(db, buf, offset); ok {
+		return n, nil
+	}
+
+	// Even the fresh mapping is too short, so the read goes past the end of the file.
+	if offset >= 0 && offset < int64(len(db.mapping)) {
+		return copy(buf, db.mapping[offset:]), io.EOF
+	}
+	return 0, io.EOF
+}
+
+// readMapped copies the bytes at offset out of the mapping, reporting whether it covered all of them.
+// The mapping lock must be held.
+func readMapped(db *DB, buf []byte, offset int64) (int, bool) {
+	if offset < 0 || offset+int64(len(buf)) > int64(len(db.mapping)) {
+		return 0, false
+	}
+	return copy(buf, db.mapping[offset:]), true
+}
+
+// remapData maps the whole of the database file as it is now, in place of any earlier mapping.
+// The mapping lock must be held.
+func remapData(db *DB) error {
+	info, err := db.DB.Stat()
+	if err != nil {
+		return err
+	}
+
+	mapping, err := mmapFile(db.DB, info.Size())
+	if err != nil {
+		return err
+	}
+
+	if err := unmapData(db); err != nil {
+		munmapFile(mapping)
+		return err
+	}
+	db.mapping = mapping
+	return nil
+}
+
+// unmapData drops the mapping of the database file, if there is one, which must happen before the file is
+// replaced or closed. The mapping lock must be held, or the database lock held exclusively.
+func unmapData(db *DB) error {
+	if db.mapping == nil {
+		return nil
+	}
+
+	err := munmapFile(db.mapping)
+	db.mapping = nil
+	return err
+}
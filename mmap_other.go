@@ -0,0 +1,17 @@
+//go:build !(aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris)
+
+package logstructured
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapFile always fails where memory mapping isn't supported, so MmapReads falls back to ReadAt.
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("memory mapped reads are not supported on this platform")
+}
+
+func munmapFile(b []byte) error {
+	return nil
+}
@@ -0,0 +1,33 @@
+package logstructured
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// BenchmarkGetRandom reads random keys out of 10k, through ReadAt and through a memory mapping of the file.
+func BenchmarkGetRandom(b *testing.B) {
+	const keys = 10000
+	ctx := context.Background()
+	db := benchDB(b, keys, 100)
+
+	r := rand.New(rand.NewSource(1))
+	ids := make([]string, 1<<16)
+	for i := range ids {
+		ids[i] = fmt.Sprint("key-", r.Intn(keys))
+	}
+
+	for _, mmap := range []bool{false, true} {
+		b.Run(fmt.Sprint("MmapReads=", mmap), func(b *testing.B) {
+			db.MmapReads = mmap
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := Get(ctx, db, ids[i%len(ids)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
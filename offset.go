@@ -0,0 +1,93 @@
+package logstructured
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrInvalidOffset is returned by ReadAtOffset for an offset which isn't the start of a record of an entry.
+var ErrInvalidOffset = errors.New("invalid record offset")
+
+// WriteOffset returns the end of the database file, which is where the next record appended to it starts, for
+// keeping alongside offsets read with ReadAtOffset. An in-place update, see AllowInPlaceUpdate, writes over its old
+// record instead, and compaction moves every record, so offsets from before a compaction no longer point at the same
+// records, or any at all. It returns -1 once the database is closed, or if the size of the file can't be found.
+func (db *DB) WriteOffset() int64 {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return -1
+	}
+	size, err := dataSize(db)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// ReadAtOffset returns the record which starts at offset in the database file, going straight to it rather than
+// looking up its key, for indexes of the database kept elsewhere, see WriteOffset. The record is returned as it is,
+// tombstones as an OpDelete and whether or not it has since been overwritten or has expired, as with LogIterator.
+//
+// An offset which isn't the start of a record returns ErrInvalidOffset, as does one of a record marking a
+// transaction. Records can only be told apart by hopping along them from the start of the file, see recordBoundary,
+// so every call reads the length of each record before offset, and takes longer the further into the file it is. A
+// record which does start at offset, but fails its checksum, returns a CorruptRecordError.
+func (db *DB) ReadAtOffset(offset int64) (Record, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return Record{}, ErrClosed
+	}
+	if err := flushWrites(db); err != nil {
+		return Record{}, err
+	}
+	size, err := dataSize(db)
+	if err != nil {
+		return Record{}, err
+	}
+	if offset < headerSize || offset >= size {
+		return Record{}, fmt.Errorf("%w: %d, the records are between %d and %d", ErrInvalidOffset, offset, headerSize, size)
+	}
+
+	// What is at an offset inside a record can still read as one, checksum and all, should a value hold the bytes of
+	// a record of its own, so the offset has to be found by hopping from the start whether or not it reads.
+	boundary, err := recordBoundary(db, offset, size)
+	if err != nil {
+		return Record{}, err
+	}
+	if boundary != offset {
+		return Record{}, fmt.Errorf("%w: %d isn't the start of a record", ErrInvalidOffset, offset)
+	}
+
+	// The lengths are checked against the file before reading the rest, as a corrupt record's could be anything.
+	var key, value string
+	var expiresAt, writtenAt int64
+	var seq uint64
+	h, err := readStreamHeader(db, offset)
+	if err == nil && h.valueOffset+h.valueSize > size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		buf := make([]byte, h.valueOffset+h.valueSize-offset)
+		if _, err = readAt(db, buf, offset); err == nil {
+			key, value, expiresAt, seq, writtenAt, err = decodeRecord(bytes.NewReader(buf))
+		}
+		err = unexpectedEOF(err)
+	}
+	if err == errChecksumMismatch || err == io.ErrUnexpectedEOF {
+		return Record{}, corruptAt(err, offset)
+	}
+	if err != nil {
+		return Record{}, err
+	}
+
+	if isTxnMarker(key) {
+		return Record{}, fmt.Errorf("%w: %d is a record marking a transaction", ErrInvalidOffset, offset)
+	}
+	return newChangeRecord(key, value, expiresAt, seq, writtenAt, offset), nil
+}
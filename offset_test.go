@@ -0,0 +1,154 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadAtOffsetRejectsRecordInsideValue(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The value is a whole record in itself, so reading from where it starts passes the checksum.
+	inner := encodeRecord("inner", "hidden", 0, 1, 0)
+	offset := db.WriteOffset()
+	if err := Set(ctx, db, "outer", string(inner)); err != nil {
+		t.Fatal(err)
+	}
+	innerOffset := offset + recordSize("outer", string(inner)) - int64(len(inner))
+
+	if _, _, _, _, _, err := readRecordAt(db, innerOffset); err != nil {
+		t.Fatalf("the value should read as a record of its own: %v", err)
+	}
+	if _, err := db.ReadAtOffset(innerOffset); !errors.Is(err, ErrInvalidOffset) {
+		t.Fatalf("ReadAtOffset inside a value: got %v, want %v", err, ErrInvalidOffset)
+	}
+
+	rec, err := db.ReadAtOffset(offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Key != "outer" || rec.Value != string(inner) {
+		t.Fatalf("ReadAtOffset(%d): got %q=%q, want %q", offset, rec.Key, rec.Value, "outer")
+	}
+}
+
+// TestReadAtOffset checks that every record can be read back by the offset the hash index has for it, that
+// WriteOffset is where the next record lands, and that offsets which aren't the start of a record are turned down.
+func TestReadAtOffset(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "offset.db")
+	db, err := Open(dbPath, filepath.Join(dir, "offset-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	var offsets []int64
+	for i, kv := range [][2]string{{"1", "foo"}, {"2", strings.Repeat("b", 1000)}, {"1", "baz"}, {"3", ""}} {
+		next := db.WriteOffset()
+		if err := Set(ctx, db, kv[0], kv[1]); err != nil {
+			t.Fatal(err)
+		}
+		r, err := GetRecord(db, kv[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Offset != next {
+			t.Fatalf("write %d landed at %d, WriteOffset said %d", i, r.Offset, next)
+		}
+		offsets = append(offsets, next)
+	}
+	if err := Delete(ctx, db, "3"); err != nil {
+		t.Fatal(err)
+	}
+	var txn Transaction
+	txn.Set("4", "in a transaction")
+	if err := txn.Commit(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each key's record, read by its offset in the index, is the one GetRecord finds. Deleted ones read as deletes.
+	for id, loc := range indexContents(db.Hash) {
+		got, err := db.ReadAtOffset(loc.Offset)
+		if err != nil {
+			t.Fatalf("read %q at %d: %v", id, loc.Offset, err)
+		}
+		if id == "3" {
+			if got.Op != OpDelete || got.Key != id {
+				t.Fatalf("read %q at %d: got %+v, want its delete", id, loc.Offset, got)
+			}
+			continue
+		}
+		want, err := GetRecord(db, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("read %q at %d: got %+v, want %+v", id, loc.Offset, got, want)
+		}
+	}
+
+	// An overwritten record is still there to be read.
+	if got, err := db.ReadAtOffset(offsets[0]); err != nil || got.Key != "1" || got.Value != "foo" {
+		t.Fatalf("read overwritten record: got %+v and error %v, want %q", got, err, "foo")
+	}
+
+	var marker int64
+	it := LogIterator(db)
+	for it.Next() {
+		if it.TxnMarker() {
+			marker = it.Offset()
+			break
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []int64{-1, 0, offsets[0] + 1, offsets[1] + 9, offsets[1] + 500, marker, db.WriteOffset(), db.WriteOffset() + 100} {
+		if _, err := db.ReadAtOffset(offset); !errors.Is(err, ErrInvalidOffset) {
+			t.Fatalf("read at %d: got error %v, want %v", offset, err, ErrInvalidOffset)
+		}
+	}
+
+	// Damage the value of the second record, which still starts where it did.
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(dbPath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("x"), offsets[1]+100)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ReadAtOffset(offsets[1]); !errors.Is(err, ErrCorruptRecord) {
+		t.Fatalf("read damaged record: got error %v, want %v", err, ErrCorruptRecord)
+	}
+	if _, err := db.ReadAtOffset(offsets[1] + 1); !errors.Is(err, ErrInvalidOffset) {
+		t.Fatalf("read inside damaged record: got error %v, want %v", err, ErrInvalidOffset)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ReadAtOffset(offsets[0]); !errors.Is(err, ErrClosed) {
+		t.Fatalf("read after close: got error %v, want %v", err, ErrClosed)
+	}
+	if got := db.WriteOffset(); got != -1 {
+		t.Fatalf("WriteOffset after close: got %d, want -1", got)
+	}
+}
@@ -0,0 +1,175 @@
+package logstructured
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// minScanRangeSize is the least each worker of a parallel full scan is given to read. Below this, splitting the
+// file up costs more than reading it with a single reader.
+const minScanRangeSize = 1 << 20
+
+// scanWorkers is how many workers a full scan of a database file of the given size is split between, at most
+// ScanWorkers, but with each given at least minScanRangeSize of the file.
+func scanWorkers(db *DB, size int64) int {
+	workers := db.ScanWorkers
+	if n := (size - headerSize) / minScanRangeSize; int64(workers) > n {
+		workers = int(n)
+	}
+	if workers < 1 {
+		return 1
+	}
+	return workers
+}
+
+// parallelScan finds the latest entry for id in the first size bytes of the database file, in the same way as
+// scanFullDB, but with the file split into a range for each of workers which are read at the same time. The
+// latest match is the one from the last range holding any match, as the ranges are in file order. It returns the
+// same as scanFullDB, with the records read by all of the workers added together. Each worker calls progress, if it
+// isn't nil, for the bytes it has read, so it must be safe to call from several goroutines at once.
+func parallelScan(ctx context.Context, db *DB, id string, size int64, workers int, progress func(n int64)) (Record, bool, int, error) {
+	splits, err := scanSplits(db, size, workers)
+	if err != nil {
+		return Record{}, false, 0, err
+	}
+
+	type result struct {
+		record  Record
+		found   bool
+		records int
+		err     error
+	}
+	results := make([]result, len(splits)-1)
+
+	// A failure in one range settles the outcome, so the others are stopped early.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			start, end := splits[i], splits[i+1]
+			r := bufio.NewReader(io.NewSectionReader(db.DB, start, end-start))
+			res := &results[i]
+			res.record, res.found, res.records, res.err = scanFullDB(ctx, r, start, id, progress)
+			if res.err != nil {
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// The error which stopped the other ranges is the one to report, rather than the cancellation it caused.
+	var latest result
+	var firstErr error
+	records := 0
+	for _, res := range results {
+		records += res.records
+		if res.err != nil && (firstErr == nil || firstErr == context.Canceled) {
+			firstErr = res.err
+		}
+		if res.found {
+			latest = res
+		}
+	}
+	if firstErr != nil {
+		return Record{}, false, records, firstErr
+	}
+
+	return latest.record, latest.found, records, nil
+}
+
+// reverseScanRangeSize is roughly how much of the file each range of a reverse full scan holds, see ScanFromEnd.
+const reverseScanRangeSize = 256 << 10
+
+// reverseScan finds the latest entry for id in the first size bytes of the database file, in the same way as
+// scanFullDB, but starting from the end of the file. The file is split into ranges of about reverseScanRangeSize,
+// as for parallelScan, which are read one at a time from the last, stopping at the first holding a match, as that
+// is the latest. It returns the same as scanFullDB, with the records of every range read added together.
+func reverseScan(ctx context.Context, db *DB, id string, size int64, progress func(n int64)) (Record, bool, int, error) {
+	n := int((size - headerSize) / reverseScanRangeSize)
+	if n < 1 {
+		n = 1
+	}
+	splits, err := scanSplits(db, size, n)
+	if err != nil {
+		return Record{}, false, 0, err
+	}
+
+	records := 0
+	for i := len(splits) - 2; i >= 0; i-- {
+		start, end := splits[i], splits[i+1]
+		r := bufio.NewReader(io.NewSectionReader(db.DB, start, end-start))
+		record, found, read, err := scanFullDB(ctx, r, start, id, progress)
+		records += read
+		if err != nil || found {
+			return record, found, records, err
+		}
+	}
+	return Record{}, false, records, nil
+}
+
+// scanSplits returns the offsets which split the first size bytes of the database file into up to n ranges of
+// roughly equal size, starting with the first record and ending with size. Records can't be recognised from an
+// arbitrary point in the file, so, as with recordBoundary, we hop from the first record along each of their
+// lengths, reading little more than the lengths themselves. Splits are only made between transactions, never
+// within one, so that each range can tell on its own whether the transactions it holds were committed.
+func scanSplits(db *DB, size int64, n int) ([]int64, error) {
+	splits := []int64{headerSize}
+	step := (size - headerSize) / int64(n)
+	next := headerSize + step
+
+	var fixed [checksumSize + expirySize + seqSize + writtenSize + lengthSize]byte
+	var length [lengthSize]byte
+	key := make([]byte, len(txnCommitKey))
+	inTxn := false
+
+	pos := int64(headerSize)
+	for len(splits) < n && pos < size {
+		if pos >= next && !inTxn {
+			splits = append(splits, pos)
+			next = pos + step
+		}
+
+		if _, err := readAt(db, fixed[:], pos); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		keyLen := int64(binary.BigEndian.Uint32(fixed[checksumSize+expirySize+seqSize+writtenSize:]))
+		keyAt := pos + int64(len(fixed))
+
+		// Only a key the length of a marker can be one, anything else is skipped over without being read.
+		if keyLen == int64(len(txnBeginKey)) || keyLen == int64(len(txnCommitKey)) {
+			if _, err := readAt(db, key[:keyLen], keyAt); err != nil {
+				if err == io.EOF {
+					break
+				}
+				return nil, err
+			}
+			switch string(key[:keyLen]) {
+			case txnBeginKey:
+				inTxn = true
+			case txnCommitKey:
+				inTxn = false
+			}
+		}
+
+		if _, err := readAt(db, length[:], keyAt+keyLen); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		pos = keyAt + keyLen + lengthSize + int64(binary.BigEndian.Uint32(length[:]))
+	}
+
+	return append(splits, size), nil
+}
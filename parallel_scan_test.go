@@ -0,0 +1,132 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParallelScan checks that a full scan split between workers finds the same latest entries as one with a
+// single reader, for keys written throughout the file, some of them by transactions.
+func TestParallelScan(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "parallel.db"), filepath.Join(dir, "parallel-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Enough to give each of three workers the megabyte they need at least.
+	padding := strings.Repeat("x", 1000)
+	db.IndexDebounce = time.Hour
+	for i := 0; i < 3300; i++ {
+		id := fmt.Sprintf("key-%d", i%50)
+		if i%100 == 0 {
+			var txn Transaction
+			txn.Set(id, fmt.Sprintf("%d %s", i, padding))
+			txn.Set("txn", fmt.Sprint(i))
+			if err := txn.Commit(db); err != nil {
+				t.Fatalf("commit transaction %d: %v", i, err)
+			}
+			continue
+		}
+		if err := Set(ctx, db, id, fmt.Sprintf("%d %s", i, padding)); err != nil {
+			t.Fatalf("set %q: %v", id, err)
+		}
+	}
+	if err := Set(ctx, db, "first", "only written once"); err != nil {
+		t.Fatalf("set %q: %v", "first", err)
+	}
+	if err := Delete(ctx, db, "key-7"); err != nil {
+		t.Fatalf("delete %q: %v", "key-7", err)
+	}
+
+	db.HashDisabled = true
+	defer func() { db.HashDisabled = false }()
+	for _, id := range []string{"key-0", "key-7", "key-49", "txn", "first", "missing"} {
+		db.ScanWorkers = 1
+		want, wantErr := Get(ctx, db, id)
+		db.ScanWorkers = 3
+		got, err := Get(ctx, db, id)
+		if got != want || !errors.Is(err, wantErr) {
+			t.Fatalf("parallel scan for %q: got %.10q (error %v), want %.10q (error %v)", id, got, err, want, wantErr)
+		}
+	}
+}
+
+// scanCounter is a Metrics which keeps how many records the last full scan read.
+type scanCounter struct {
+	records int
+}
+
+func (c *scanCounter) Observe(Op, time.Duration, error) {}
+
+func (c *scanCounter) ObserveScan(records int) {
+	c.records = records
+}
+
+// TestScanFromEnd checks that a full scan from the end of the file finds the same latest entries as one from the
+// start, for keys written throughout the file, some of them by transactions, and that a key written recently is
+// found without reading most of the records.
+func TestScanFromEnd(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "reverse.db"), filepath.Join(dir, "reverse-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Enough for the file to be split into several ranges.
+	padding := strings.Repeat("x", 1000)
+	db.IndexDebounce = time.Hour
+	for i := 0; i < 2000; i++ {
+		id := fmt.Sprintf("key-%d", i%50)
+		if i%100 == 0 {
+			var txn Transaction
+			txn.Set(id, fmt.Sprintf("%d %s", i, padding))
+			txn.Set("txn", fmt.Sprint(i))
+			if err := txn.Commit(db); err != nil {
+				t.Fatalf("commit transaction %d: %v", i, err)
+			}
+			continue
+		}
+		if err := Set(ctx, db, id, fmt.Sprintf("%d %s", i, padding)); err != nil {
+			t.Fatalf("set %q: %v", id, err)
+		}
+	}
+	if err := Delete(ctx, db, "key-7"); err != nil {
+		t.Fatalf("delete %q: %v", "key-7", err)
+	}
+	if err := Set(ctx, db, "last", "written last"); err != nil {
+		t.Fatalf("set %q: %v", "last", err)
+	}
+
+	counter := &scanCounter{}
+	db.Metrics = counter
+	db.HashDisabled = true
+	defer func() { db.HashDisabled = false }()
+	for _, id := range []string{"key-0", "key-7", "key-49", "txn", "last", "missing"} {
+		db.ScanFromEnd = false
+		want, wantErr := Get(ctx, db, id)
+		db.ScanFromEnd = true
+		got, err := Get(ctx, db, id)
+		if got != want || !errors.Is(err, wantErr) {
+			t.Fatalf("scan from the end for %q: got %.10q (error %v), want %.10q (error %v)", id, got, err, want, wantErr)
+		}
+	}
+
+	if _, err := Get(ctx, db, "last"); err != nil {
+		t.Fatalf("get %q: %v", "last", err)
+	}
+	if counter.records >= 1000 {
+		t.Fatalf("scan from the end for the last key written: read %d records, want fewer than half of them", counter.records)
+	}
+}
@@ -0,0 +1,51 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrQuotaExceeded is returned by a write which would take the database's files beyond MaxTotalBytes.
+var ErrQuotaExceeded = errors.New("disk quota exceeded")
+
+// checkQuota makes sure n more bytes can be appended to the database file without its files taking up more than
+// MaxTotalBytes. When they can't, but the dead bytes say compacting would free up enough room, the database is
+// compacted first, which holds up the write until it is done. The lock must be held.
+func checkQuota(db *DB, n int64) error {
+	if db.MaxTotalBytes <= 0 {
+		return nil
+	}
+
+	used, err := diskUsage(db)
+	if err != nil {
+		return err
+	}
+	if used+n <= db.MaxTotalBytes {
+		return nil
+	}
+
+	if db.deadBytes > 0 && used-db.deadBytes+n <= db.MaxTotalBytes {
+		if err := compact(context.Background(), db); err != nil {
+			return err
+		}
+		if used, err = diskUsage(db); err != nil {
+			return err
+		}
+		if used+n <= db.MaxTotalBytes {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: writing %d bytes would take the database to %d bytes, the most is %d", ErrQuotaExceeded, n, used+n, db.MaxTotalBytes)
+}
+
+// diskUsage is the number of bytes taken up by the database file, appends still in the write buffer included, and
+// the segment files flushed from the memtable, which is what MaxTotalBytes bounds.
+func diskUsage(db *DB) (int64, error) {
+	used, err := dataSize(db)
+	if err != nil {
+		return 0, err
+	}
+	return used + segmentBytes(db), nil
+}
@@ -0,0 +1,63 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestQuota checks that writes succeed up to MaxTotalBytes and the first one beyond it is rejected, unless
+// compacting makes room for it, whilst deletes are always let through.
+func TestQuota(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "quota.db")
+	db, err := Open(dbPath, filepath.Join(dir, "quota-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Room for three records the size of the first, which all of these are.
+	if err := Set(ctx, db, "k1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := int64(9)
+	db.MaxTotalBytes = header + 3*(info.Size()-header)
+
+	for _, id := range []string{"k2", "k3"} {
+		if err := Set(ctx, db, id, "v1"); err != nil {
+			t.Fatalf("set %q within the quota: %v", id, err)
+		}
+	}
+	if err := Set(ctx, db, "k4", "v1"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("set beyond the quota: got error %v, want %v", err, ErrQuotaExceeded)
+	}
+	if err := SetBatch(db, map[string]string{"k4": "v1"}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("set batch beyond the quota: got error %v, want %v", err, ErrQuotaExceeded)
+	}
+	if info, err := os.Stat(dbPath); err != nil || info.Size() != db.MaxTotalBytes {
+		t.Fatalf("database file after rejected writes: %v, want it to be %d bytes", err, db.MaxTotalBytes)
+	}
+
+	// Deleting is always allowed, after which compacting makes room for the write.
+	if err := Delete(ctx, db, "k3"); err != nil {
+		t.Fatalf("delete beyond the quota: %v", err)
+	}
+	if err := Set(ctx, db, "k4", "v1"); err != nil {
+		t.Fatalf("set once compacting makes room: %v", err)
+	}
+	if info, err := os.Stat(dbPath); err != nil || info.Size() > db.MaxTotalBytes {
+		t.Fatalf("database file after compacting to make room: %v, want it within %d bytes", err, db.MaxTotalBytes)
+	}
+	if _, err := Get(ctx, db, "k3"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("get %q after compacting: got %v, want %v", "k3", err, ErrKeyNotFound)
+	}
+}
@@ -0,0 +1,276 @@
+package logstructured
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// formatVersion is stored in the header at the start of every database file. Should the layout of records
+// change in future, this lets us tell which layout a file was written with.
+const formatVersion byte = 5
+
+// headerSize is the number of bytes at the start of the database file which come before the first record, which
+// are the format version followed by the sequence number the file's writes follow on from, see writeHeader.
+const headerSize = 1 + seqSize
+
+// The sizes of the fixed fields which surround the key and value of a record.
+const (
+	checksumSize = 4
+	expirySize   = 8
+	seqSize      = 8
+	writtenSize  = 8
+	lengthSize   = 4
+)
+
+// readAheadSize is how much is read in one go when reading a record whose size we don't yet know.
+const readAheadSize = 512
+
+// ErrUnsupportedFormat is returned when opening a database file whose header is not one we know how to read.
+var ErrUnsupportedFormat = errors.New("unsupported database format")
+
+// ErrCorruptRecord is matched, using errors.Is, by the CorruptRecordError returned when a record fails its checksum.
+var ErrCorruptRecord = errors.New("corrupt record")
+
+// errChecksumMismatch is returned by decodeRecord, which doesn't know where in the file the record was read from.
+// Callers which do know turn it into a CorruptRecordError, see corruptAt.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// CorruptRecordError is returned when the record at Offset doesn't match its checksum, which means that it
+// was only partly written or has since been damaged on disk.
+type CorruptRecordError struct {
+	Offset int64
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("corrupt record at offset %d", e.Offset)
+}
+
+func (e *CorruptRecordError) Is(target error) bool {
+	return target == ErrCorruptRecord
+}
+
+// corruptAt reports a failed checksum from decodeRecord as a CorruptRecordError for the record at offset.
+// Any other error is returned as it is.
+func corruptAt(err error, offset int64) error {
+	if err == errChecksumMismatch {
+		return &CorruptRecordError{Offset: offset}
+	}
+	return err
+}
+
+// encodeRecord lays out a record as it is stored on disk, which is
+//
+//	[crc32 uint32][expires_at int64][seq uint64][written_at int64][key_len uint32][key bytes][value_len uint32][value bytes]
+//
+// with the numbers in big endian byte order. As the lengths are known up front, keys and values can contain
+// any bytes at all, including the commas and newlines which the plain "<id>,<string>\n" format couldn't.
+// expiresAt is the Unix time, in seconds, after which the record no longer counts, or zero if it never expires.
+// seq is the sequence number of the write which made the record, see DB.LastSeq, or zero for a transaction marker.
+// writtenAt is the Unix time, in nanoseconds, of the write which made the record, see DB.Clock, or zero for a
+// transaction marker. The CRC32 checksum covers the expiry, sequence number, write time, key and value, so that a
+// partly written or damaged record is caught on read rather than returned as garbage.
+func encodeRecord(key, value string, expiresAt int64, seq uint64, writtenAt int64) []byte {
+	buf := make([]byte, recordSize(key, value))
+
+	binary.BigEndian.PutUint32(buf, checksum(key, value, expiresAt, seq, writtenAt))
+	binary.BigEndian.PutUint64(buf[4:], uint64(expiresAt))
+	binary.BigEndian.PutUint64(buf[12:], seq)
+	binary.BigEndian.PutUint64(buf[20:], uint64(writtenAt))
+	binary.BigEndian.PutUint32(buf[28:], uint32(len(key)))
+	copy(buf[32:], key)
+	binary.BigEndian.PutUint32(buf[32+len(key):], uint32(len(value)))
+	copy(buf[36+len(key):], value)
+
+	return buf
+}
+
+// decodeRecord reads the next record from r. If r has no more records, io.EOF is returned, whereas a record
+// which has been cut short returns io.ErrUnexpectedEOF. A record which doesn't match its checksum returns
+// errChecksumMismatch.
+func decodeRecord(r io.Reader) (key, value string, expiresAt int64, seq uint64, writtenAt int64, err error) {
+	rr := recordReader{r: r}
+	k, v, expiresAt, seq, writtenAt, err := rr.next()
+	if err != nil {
+		return "", "", 0, 0, 0, err
+	}
+	return string(k), string(v), expiresAt, seq, writtenAt, nil
+}
+
+// recordReader reads one record after another from r in the same way as decodeRecord, but into a buffer which is
+// kept from one record to the next, so that reading through the whole file, as a full scan does, doesn't allocate
+// for every record.
+type recordReader struct {
+	r   io.Reader
+	buf []byte
+}
+
+// next reads the next record, returning errors as decodeRecord does. The key and value are only good until next is
+// called again, as they are read into the same buffer each time.
+func (rr *recordReader) next() (key, value []byte, expiresAt int64, seq uint64, writtenAt int64, err error) {
+	const fixedSize = checksumSize + expirySize + seqSize + writtenSize + lengthSize
+	if rr.buf, err = rr.read(rr.buf[:0], fixedSize); err != nil {
+		return nil, nil, 0, 0, 0, err
+	}
+	sum := binary.BigEndian.Uint32(rr.buf)
+	expiresAt = int64(binary.BigEndian.Uint64(rr.buf[checksumSize:]))
+	seq = binary.BigEndian.Uint64(rr.buf[checksumSize+expirySize:])
+	writtenAt = int64(binary.BigEndian.Uint64(rr.buf[checksumSize+expirySize+seqSize:]))
+	keySize := int(binary.BigEndian.Uint32(rr.buf[checksumSize+expirySize+seqSize+writtenSize:]))
+
+	// The value's length is read along with the key, so that it takes one read rather than two.
+	if rr.buf, err = rr.read(rr.buf, keySize+lengthSize); err != nil {
+		return nil, nil, 0, 0, 0, unexpectedEOF(err)
+	}
+	valueSize := int(binary.BigEndian.Uint32(rr.buf[fixedSize+keySize:]))
+	if rr.buf, err = rr.read(rr.buf, valueSize); err != nil {
+		return nil, nil, 0, 0, 0, unexpectedEOF(err)
+	}
+	key = rr.buf[fixedSize : fixedSize+keySize]
+	value = rr.buf[fixedSize+keySize+lengthSize:]
+
+	// The expiry, sequence number and write time are checked as they are in the buffer, the same bytes checksum
+	// works them into.
+	got := crc32.ChecksumIEEE(rr.buf[checksumSize : checksumSize+expirySize+seqSize+writtenSize])
+	got = crc32.Update(got, crc32.IEEETable, key)
+	if crc32.Update(got, crc32.IEEETable, value) != sum {
+		return nil, nil, 0, 0, 0, errChecksumMismatch
+	}
+	return key, value, expiresAt, seq, writtenAt, nil
+}
+
+// read appends the next n bytes from r to buf. The lengths in a record come from the file, so they may well be
+// corrupt. Rather than growing buf to however much is claimed up front, it grows as bytes are actually read, so a
+// bogus length can't cost much more than the file holds.
+func (rr *recordReader) read(buf []byte, n int) ([]byte, error) {
+	for n > 0 {
+		chunk := n
+		if free := cap(buf) - len(buf); chunk > free {
+			grow := len(buf)
+			if grow < readAheadSize {
+				grow = readAheadSize
+			}
+			if chunk > grow {
+				chunk = grow
+			}
+			if chunk > free {
+				buf = append(buf[:cap(buf)], make([]byte, chunk-free)...)[:len(buf)]
+			}
+		}
+		if _, err := io.ReadFull(rr.r, buf[len(buf):len(buf)+chunk]); err != nil {
+			return buf, err
+		}
+		buf = buf[:len(buf)+chunk]
+		n -= chunk
+	}
+	return buf, nil
+}
+
+// readField reads a single length prefixed field of a record.
+func readField(r io.Reader) (string, error) {
+	var length [lengthSize]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return "", err
+	}
+
+	// The length comes from the file, so it may well be corrupt. Rather than allocating however much it claims
+	// up front, the field grows as bytes are actually read, so a bogus length can't cost more than the file holds.
+	var field bytes.Buffer
+	if _, err := io.CopyN(&field, r, int64(binary.BigEndian.Uint32(length[:]))); err != nil {
+		if err == io.EOF {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+
+	return field.String(), nil
+}
+
+// checksum is the CRC32 of a record's expiry, sequence number, write time, key and value bytes.
+func checksum(key, value string, expiresAt int64, seq uint64, writtenAt int64) uint32 {
+	var fixed [expirySize + seqSize + writtenSize]byte
+	binary.BigEndian.PutUint64(fixed[:], uint64(expiresAt))
+	binary.BigEndian.PutUint64(fixed[expirySize:], seq)
+	binary.BigEndian.PutUint64(fixed[expirySize+seqSize:], uint64(writtenAt))
+
+	sum := crc32.ChecksumIEEE(fixed[:])
+	sum = crc32.Update(sum, crc32.IEEETable, []byte(key))
+	return crc32.Update(sum, crc32.IEEETable, []byte(value))
+}
+
+// recordOverhead is the number of bytes a record takes up on disk besides its key and value.
+const recordOverhead = checksumSize + expirySize + seqSize + writtenSize + 2*lengthSize
+
+// recordSize is the number of bytes the record takes up on disk.
+func recordSize(key, value string) int64 {
+	return int64(recordOverhead + len(key) + len(value))
+}
+
+// writeHeader writes the header to a new, empty, database file, which is [version byte][base_seq uint64]. The
+// records of the file carry sequence numbers following on from baseSeq. A compacted file can leave out the record
+// with the latest one, such as when the last write was a delete, so the header keeps the sequence from going back.
+func writeHeader(w io.Writer, baseSeq uint64) error {
+	var header [headerSize]byte
+	header[0] = formatVersion
+	binary.BigEndian.PutUint64(header[1:], baseSeq)
+	_, err := w.Write(header[:])
+	return err
+}
+
+// readBaseSeq returns the sequence number stored in the header of the database file, see writeHeader. A new,
+// empty, file has none.
+func readBaseSeq(f io.ReaderAt) (uint64, error) {
+	var header [headerSize]byte
+	if _, err := f.ReadAt(header[:], 0); err != nil {
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(header[1:]), nil
+}
+
+// checkReadableHeader makes sure the database file is in a format we can read, as checkHeader does, but without
+// writing anything. A new, empty, file has no header to check and holds no records, which is left for reads to find.
+func checkReadableHeader(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return nil
+	}
+
+	return checkVersion(f)
+}
+
+// checkHeader makes sure the database file is in a format we can read, writing the header if the file is new.
+func checkHeader(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() == 0 {
+		return writeHeader(f, 0)
+	}
+
+	return checkVersion(f)
+}
+
+// checkVersion makes sure the header of the database file holds a format version we can read.
+func checkVersion(f *os.File) error {
+	version := make([]byte, 1)
+	if _, err := f.ReadAt(version, 0); err != nil {
+		return err
+	}
+	if version[0] != formatVersion {
+		return fmt.Errorf("%w: version %d", ErrUnsupportedFormat, version[0])
+	}
+
+	return nil
+}
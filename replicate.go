@@ -0,0 +1,73 @@
+package logstructured
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// Replicator keeps a follower database up to date with a primary, by applying each record of the primary's change
+// feed to the follower, see Changes. It keeps track of the sequence number of the last record it applied, so that
+// following can be stopped and picked up again later from the same place. The zero value starts from the beginning.
+type Replicator struct {
+	applied uint64
+}
+
+// NewReplicator returns a Replicator which carries on from lastApplied, as returned by LastApplied, for instance
+// after it was stored away by an earlier run of the process.
+func NewReplicator(lastApplied uint64) *Replicator {
+	return &Replicator{applied: lastApplied}
+}
+
+// LastApplied returns the primary's sequence number of the last record applied to the follower. It is safe to call
+// whilst Follow is running.
+func (r *Replicator) LastApplied() uint64 {
+	return atomic.LoadUint64(&r.applied)
+}
+
+// Follow applies the records of the primary's change feed to the follower, starting after the last one applied,
+// until ctx is cancelled or the primary is closed, which is returned as ctx's error or ErrClosed. Any other error
+// stops it too, leaving the follower as it was after the last record which was applied. Follow can then be called
+// again to carry on.
+//
+// Each record is written to the follower as the same Set, with its expiry, or Delete as it was on the primary,
+// although with the follower's own sequence numbers. The records of a transaction are applied one by one. A record
+// no later than the last one applied is ignored, so a record is never applied twice even if it were delivered
+// again. Falling too far behind the primary closes its change feed, in which case it is simply started again.
+//
+// Only one Follow should run for a Replicator at a time, and nothing else should write to the follower.
+func (r *Replicator) Follow(ctx context.Context, primary, follower *DB) error {
+	for {
+		changes, err := Changes(ctx, primary, r.LastApplied())
+		if err != nil {
+			return err
+		}
+
+		for record := range changes {
+			if record.Seq <= r.LastApplied() {
+				continue
+			}
+			if err := apply(ctx, follower, record); err != nil {
+				return fmt.Errorf("apply %q at sequence number %d: %w", record.Key, record.Seq, err)
+			}
+			atomic.StoreUint64(&r.applied, record.Seq)
+		}
+
+		// The feed is closed when ctx is done, otherwise it fell behind or the primary was closed, which Changes
+		// reports when it is called again.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// apply writes record to db as it was written to the database it came from.
+func apply(ctx context.Context, db *DB, record Record) error {
+	switch record.Op {
+	case OpSet:
+		return set(ctx, db, record.Key, record.Value, record.ExpiresAt)
+	case OpDelete:
+		return Delete(ctx, db, record.Key)
+	}
+	return fmt.Errorf("unknown operation %q", record.Op)
+}
@@ -0,0 +1,85 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestReplicator checks that a follower converges on the same entries as its primary, and carries on from where
+// it left off when following is stopped and started again.
+func TestReplicator(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	primary, err := Open(filepath.Join(dir, "primary.db"), filepath.Join(dir, "primary-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	follower, err := Open(filepath.Join(dir, "follower.db"), filepath.Join(dir, "follower-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+
+	// Each round of writes is followed by a separate run of the replicator, which has to pick up from the last.
+	var r Replicator
+	rounds := []func() error{
+		func() error {
+			if err := Set(ctx, primary, "a", "1"); err != nil {
+				return err
+			}
+			if err := SetWithTTL(ctx, primary, "b", "2", time.Hour); err != nil {
+				return err
+			}
+			return SetBatch(primary, map[string]string{"c": "3", "d": "4"})
+		},
+		func() error {
+			var txn Transaction
+			txn.Set("a", "10")
+			txn.Delete("c")
+			if err := txn.Commit(primary); err != nil {
+				return err
+			}
+			return Delete(ctx, primary, "d")
+		},
+	}
+	for i, round := range rounds {
+		if err := round(); err != nil {
+			t.Fatalf("write round %d to the primary: %v", i, err)
+		}
+
+		followCtx, stop := context.WithCancel(ctx)
+		done := make(chan error, 1)
+		go func() { done <- r.Follow(followCtx, primary, follower) }()
+		for deadline := time.Now().Add(time.Second); r.LastApplied() < primary.LastSeq() && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		stop()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Fatalf("follow round %d: %v", i, err)
+		}
+		if applied, latest := r.LastApplied(), primary.LastSeq(); applied != latest {
+			t.Fatalf("follow round %d: applied up to %d, want %d", i, applied, latest)
+		}
+	}
+
+	want, err := Scan(primary, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Scan(follower, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) || len(want) != 2 {
+		t.Fatalf("follower entries: got %v, want %v", got, want)
+	}
+	if n := follower.Len(); n != primary.Len() {
+		t.Fatalf("follower len: got %d, want %d", n, primary.Len())
+	}
+}
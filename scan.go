@@ -0,0 +1,65 @@
+package logstructured
+
+// KV is a single key along with the latest value stored for it.
+type KV struct {
+	Key   string
+	Value string
+}
+
+// Scan returns the latest value for every key within [startKey, endKey), ordered by key. An empty endKey has
+// no upper bound, so that every key from startKey onwards is returned. Keys which have been deleted, or have
+// expired, are left out. With NumericKeys, keys and bounds are compared as integers, or with a KeyComparator, by
+// that, and an empty startKey has no lower bound either.
+//
+// The hash index is unordered, so the keys within the range are picked out of it and sorted on each call. The
+// index only points at the latest record for each key, which means that older records for a key which has since
+// been overwritten are never looked at.
+func Scan(db *DB, startKey, endKey string) ([]KV, error) {
+
+	// Hold the lock so that the index doesn't change underneath us whilst we walk it.
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	r, err := newKeyRange(db, startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	db.Hash.Range(func(id string, _ RecordLocation) bool {
+		if r.contains(id) && !db.deleted[id] {
+			keys = append(keys, id)
+		}
+		return true
+	})
+	sortKeys(db, keys)
+
+	// As with Get, entries held in the memtable or its segments are read from there rather than the database file.
+	results := make([]KV, 0, len(keys))
+	for _, id := range keys {
+		n, ok, err := lookupRecent(db, id)
+		if err != nil {
+			return nil, err
+		}
+		var value string
+		var expiresAt int64
+		if ok {
+			value, expiresAt = n.value, n.expiresAt
+		} else {
+			loc, _ := db.Hash.Get(id)
+			if _, value, expiresAt, _, _, err = readRecord(db, loc); err != nil {
+				return nil, err
+			}
+		}
+		if db.expired(expiresAt) {
+			continue
+		}
+		results = append(results, KV{Key: id, Value: value})
+	}
+
+	return results, nil
+}
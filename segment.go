@@ -0,0 +1,377 @@
+package logstructured
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// segmentIndexInterval is how many records of a segment there are for each key kept in its sparse index, and so the
+// most a lookup in a segment reads.
+const segmentIndexInterval = 16
+
+// segment is a file the memtable has been flushed to, holding the entries the memtable held in key order, see
+// MemtableSize. It is laid out as a database file, header included, but with the sequence number of the latest
+// write to the database when it was flushed in place of the base sequence, which is what tells Open whether the
+// segments have kept up with the database file, see loadSegments.
+type segment struct {
+	path  string
+	f     *os.File
+	size  int64
+	seq   uint64
+	index []segmentKey // Every segmentIndexInterval-th key with where its record starts, in key order.
+
+	// When the latest of the writes in the segment was made, in nanoseconds since the epoch, see RetentionDuration.
+	lastWrittenAt int64
+}
+
+// segmentKey is an entry of a segment's sparse index.
+type segmentKey struct {
+	key    string
+	offset int64
+}
+
+// get returns the entry the segment holds for id, if there is one. The sparse index narrows it down to the records
+// between two of its keys, which are read through until id is found or passed.
+func (s *segment) get(id string) (*memtableNode, bool, error) {
+	i := sort.Search(len(s.index), func(i int) bool { return s.index[i].key > id })
+	if i == 0 {
+		return nil, false, nil
+	}
+	start, end := s.index[i-1].offset, s.size
+	if i < len(s.index) {
+		end = s.index[i].offset
+	}
+
+	rr := recordReader{r: bufio.NewReader(io.NewSectionReader(s.f, start, end-start))}
+	for offset := start; offset < end; {
+		key, value, expiresAt, seq, writtenAt, err := rr.next()
+		if err != nil {
+			return nil, false, fmt.Errorf("segment %s: %w", s.path, unexpectedEOF(corruptAt(err, offset)))
+		}
+		switch {
+		case string(key) == id:
+			return &memtableNode{key: id, value: string(value), expiresAt: expiresAt, seq: seq, writtenAt: writtenAt}, true, nil
+		case string(key) > id:
+			return nil, false, nil
+		}
+		offset += int64(recordOverhead + len(key) + len(value))
+	}
+	return nil, false, nil
+}
+
+// lookupRecent returns the latest entry for id if it is held in the memtable or a segment, going by the memtable
+// then the segments from the newest, which between them always hold the latest entry for any key they hold at all.
+// The lock must be held.
+func lookupRecent(db *DB, id string) (*memtableNode, bool, error) {
+	if db.MemtableSize > 0 && db.memtable != nil {
+		if n, ok := db.memtable.get(id); ok {
+			return n, true, nil
+		}
+	}
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		n, ok, err := db.segments[i].get(id)
+		if ok || err != nil {
+			return n, ok, err
+		}
+	}
+	return nil, false, nil
+}
+
+// maybeFlushMemtable flushes the memtable once it has grown to MemtableSize. The lock must be held.
+func maybeFlushMemtable(db *DB) error {
+	if db.memtable == nil || db.memtable.size < db.MemtableSize {
+		return nil
+	}
+	return flushMemtable(db)
+}
+
+// flushMemtable writes the entries in the memtable to a new segment, then empties the memtable. Every entry was
+// also appended to the database file, which stays the source of truth, so nothing is lost if the flush fails or the
+// process dies with entries still in memory, reads find them in the file instead. The lock must be held.
+func flushMemtable(db *DB) error {
+	if db.memtable == nil || db.memtable.size == 0 {
+		return nil
+	}
+
+	path, err := nextSegmentPath(db)
+	if err != nil {
+		return err
+	}
+	s, err := writeSegment(db, path)
+	if err != nil {
+		return err
+	}
+
+	db.segments = append(db.segments, s)
+	db.memtable = newMemtable()
+	return nil
+}
+
+// writeSegment writes the entries in the memtable to a new segment file at path, in key order. The segment is
+// written alongside and renamed into place once it is on disk in full, so that a segment found by Open is never
+// missing entries.
+func writeSegment(db *DB, path string) (*segment, error) {
+	tmpPath := path + ".tmp"
+	out, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, db.fileMode)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*segment, error) {
+		out.Close()
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	w := bufio.NewWriter(out)
+	if err := writeHeader(w, db.seq); err != nil {
+		return fail(err)
+	}
+	s := &segment{path: path, f: out, size: headerSize, seq: db.seq}
+	var writeErr error
+	records := 0
+	db.memtable.each(func(n *memtableNode) {
+		if writeErr != nil {
+			return
+		}
+		if records%segmentIndexInterval == 0 {
+			s.index = append(s.index, segmentKey{key: n.key, offset: s.size})
+		}
+		if n.writtenAt > s.lastWrittenAt {
+			s.lastWrittenAt = n.writtenAt
+		}
+		record := encodeRecord(n.key, n.value, n.expiresAt, n.seq, n.writtenAt)
+		_, writeErr = w.Write(record)
+		s.size += int64(len(record))
+		records++
+	})
+	if writeErr != nil {
+		return fail(writeErr)
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := out.Sync(); err != nil {
+		return fail(err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fail(err)
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		out.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// readSegment opens the segment file at path and builds its sparse index by reading through it.
+func readSegment(path string) (*segment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &segment{path: path, f: f, size: headerSize}
+
+	err = func() error {
+		if err := checkVersion(f); err != nil {
+			return err
+		}
+		if s.seq, err = readBaseSeq(f); err != nil {
+			return err
+		}
+
+		rr := recordReader{r: bufio.NewReader(io.NewSectionReader(f, headerSize, 1<<63-1-headerSize))}
+		previous := ""
+		for records := 0; ; records++ {
+			key, value, _, _, writtenAt, err := rr.next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return unexpectedEOF(corruptAt(err, s.size))
+			}
+			if records > 0 && string(key) <= previous {
+				return fmt.Errorf("%w: keys out of order at offset %d", ErrCorruptRecord, s.size)
+			}
+			previous = string(key)
+			if writtenAt > s.lastWrittenAt {
+				s.lastWrittenAt = writtenAt
+			}
+			if records%segmentIndexInterval == 0 {
+				s.index = append(s.index, segmentKey{key: previous, offset: s.size})
+			}
+			s.size += int64(recordOverhead + len(key) + len(value))
+		}
+	}()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("segment %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// loadSegments opens the segment files flushed for the database before it was last closed. These are only of use if
+// they hold the latest entry for every key they hold at all, which is only certain if the memtable was flushed with
+// the latest write to the database file, as Close does. Otherwise, as when the process died with writes in the
+// memtable, or a segment can't be read, they are all removed, losing nothing, as every entry of a segment is in the
+// database file as well. The lock must be held, or the database not yet shared.
+func loadSegments(db *DB) error {
+	if tmpPaths, err := filepath.Glob(db.DB.Name() + ".seg-*.tmp"); err == nil {
+		for _, path := range tmpPaths {
+			os.Remove(path)
+		}
+	}
+
+	paths, err := segmentPaths(db)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		s, err := readSegment(path)
+		if err != nil {
+			logf(db.Logger, "Removing the segment files, %v.", err)
+			return dropSegments(db)
+		}
+		db.segments = append(db.segments, s)
+	}
+
+	if n := len(db.segments); n > 0 && db.segments[n-1].seq != db.seq {
+		logf(db.Logger, "Removing the segment files, which are behind the database file.")
+		return dropSegments(db)
+	}
+	return nil
+}
+
+// dropSegments empties the memtable and removes every segment file, which is how they are kept from going stale
+// when the database file gets ahead of them, see rememberWrite. The lock must be held.
+func dropSegments(db *DB) error {
+	if db.memtable != nil {
+		db.memtable = newMemtable()
+	}
+	closeSegments(db)
+
+	// Any file a failure left behind is removed by the next Open, as it is then behind the database file.
+	paths, err := segmentPaths(db)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	return syncDir(filepath.Dir(db.DB.Name()))
+}
+
+// closeSegments closes the segment files and forgets them, leaving the files themselves where they are.
+func closeSegments(db *DB) {
+	for _, s := range db.segments {
+		s.f.Close()
+	}
+	db.segments = nil
+}
+
+// segmentBytes is how many bytes the segment files take up.
+func segmentBytes(db *DB) int64 {
+	var n int64
+	for _, s := range db.segments {
+		n += s.size
+	}
+	return n
+}
+
+// segmentPaths returns the paths of the segment files which have been flushed for the database, oldest first.
+func segmentPaths(db *DB) ([]string, error) {
+	return filepath.Glob(db.DB.Name() + ".seg-[0-9][0-9][0-9][0-9][0-9][0-9]")
+}
+
+// nextSegmentPath returns the path for a new segment file, numbered one on from the newest which already exists.
+func nextSegmentPath(db *DB) (string, error) {
+	paths, err := segmentPaths(db)
+	if err != nil {
+		return "", err
+	}
+
+	next := 0
+	if len(paths) > 0 {
+		last := paths[len(paths)-1]
+		if _, err := fmt.Sscanf(last[len(db.DB.Name()+".seg-"):], "%06d", &next); err != nil {
+			return "", fmt.Errorf("unexpected segment file name %q: %w", last, err)
+		}
+		next++
+	}
+
+	return fmt.Sprintf("%s.seg-%06d", db.DB.Name(), next), nil
+}
+
+// removeAgedSegments removes the segments whose latest write was longer than RetentionDuration ago, if it is set,
+// unless a segment still holds the latest entry for a live key, see holdsOnlyLive. Only the oldest segments are
+// ever removed, as a newer one going would leave reads of its keys to older segments, which have older entries for
+// them, so the first segment kept keeps every one after it as well. The lock must be held.
+func removeAgedSegments(db *DB) error {
+	if db.RetentionDuration <= 0 {
+		return nil
+	}
+
+	now := db.clock()
+	for len(db.segments) > 0 {
+		s := db.segments[0]
+		if now.Sub(time.Unix(0, s.lastWrittenAt)) <= db.RetentionDuration {
+			return nil
+		}
+		live, err := holdsOnlyLive(db, 0)
+		if err != nil || live {
+			return err
+		}
+
+		s.f.Close()
+		db.segments = db.segments[1:]
+		if err := os.Remove(s.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// holdsOnlyLive reports whether the i-th segment holds the latest entry for a live key, one which isn't a tombstone
+// and hasn't expired, with no later entry for it in the memtable or a newer segment. The lock must be held.
+func holdsOnlyLive(db *DB, i int) (bool, error) {
+	s := db.segments[i]
+	rr := recordReader{r: bufio.NewReader(io.NewSectionReader(s.f, headerSize, s.size-headerSize))}
+	for offset := int64(headerSize); offset < s.size; {
+		key, value, expiresAt, _, _, err := rr.next()
+		if err != nil {
+			return false, fmt.Errorf("segment %s: %w", s.path, unexpectedEOF(corruptAt(err, offset)))
+		}
+		offset += int64(recordOverhead + len(key) + len(value))
+		if string(value) == Tombstone || db.expired(expiresAt) {
+			continue
+		}
+
+		id := string(key)
+		overridden := false
+		if db.memtable != nil {
+			_, overridden = db.memtable.get(id)
+		}
+		for _, newer := range db.segments[i+1:] {
+			if overridden {
+				break
+			}
+			if _, overridden, err = newer.get(id); err != nil {
+				return false, err
+			}
+		}
+		if !overridden {
+			return true, nil
+		}
+	}
+	return false, nil
+}
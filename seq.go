@@ -0,0 +1,27 @@
+package logstructured
+
+// LastSeq returns the sequence number of the latest write to the database, or zero if nothing has been written.
+// Every record written by Set, Delete, SetBatch or a Transaction is given the next number in the sequence, which
+// is stored in the record itself, so the sequence carries on from where it left off when the database is opened
+// again. Numbers only ever go up, although a failed write can leave a gap, and an entry keeps its number when
+// it is copied over by compaction.
+func (db *DB) LastSeq() uint64 {
+	db.RLock()
+	defer db.RUnlock()
+
+	return db.seq
+}
+
+// nextSeq takes the next sequence number for a record about to be written. The lock must be held.
+func nextSeq(db *DB) uint64 {
+	db.seq++
+	return db.seq
+}
+
+// seenSeq takes note of the sequence number of a record read whilst loading the database, so that the sequence
+// carries on from the latest of them.
+func seenSeq(db *DB, seq uint64) {
+	if seq > db.seq {
+		db.seq = seq
+	}
+}
@@ -0,0 +1,88 @@
+package logstructured
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSeq checks that every write takes the next sequence number, and that the sequence carries on from the
+// latest of them once the database is opened again, after a compaction which drops the latest record and after the
+// hash index has been rebuilt.
+func TestSeq(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "seq.db")
+	indexPath := filepath.Join(dir, "seq-index.db")
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var txn Transaction
+	txn.Set("e", "5")
+	txn.Delete("b")
+	writes := []struct {
+		seqs  uint64
+		write func() error
+	}{
+		{1, func() error { return Set(ctx, db, "a", "1") }},
+		{1, func() error { return Set(ctx, db, "b", "2") }},
+		{2, func() error { return SetBatch(db, map[string]string{"c": "3", "d": "4"}) }},
+		{2, func() error { return txn.Commit(db) }},
+		{1, func() error { return Delete(ctx, db, "a") }},
+	}
+	want := uint64(0)
+	for i, w := range writes {
+		if err := w.write(); err != nil {
+			db.Close()
+			t.Fatalf("write %d: %v", i, err)
+		}
+		want += w.seqs
+		if seq := db.LastSeq(); seq != want {
+			db.Close()
+			t.Fatalf("last seq after write %d: got %d, want %d", i, seq, want)
+		}
+	}
+
+	// The latest write is a delete, which compaction drops along with the record it was the sequence number of.
+	if err := Compact(ctx, db); err != nil {
+		db.Close()
+		t.Fatalf("compact: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopen := func(what string) error {
+		db, err := Open(dbPath, indexPath, false)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		if seq := db.LastSeq(); seq != want {
+			return fmt.Errorf("last seq after %s: got %d, want %d", what, seq, want)
+		}
+		if err := Set(ctx, db, "f", "6"); err != nil {
+			return fmt.Errorf("set %q: %w", "f", err)
+		}
+		want++
+		if seq := db.LastSeq(); seq != want {
+			return fmt.Errorf("last seq of a write after %s: got %d, want %d", what, seq, want)
+		}
+		return nil
+	}
+	if err := reopen("compacting and reopening"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(indexPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopen("rebuilding the index"); err != nil {
+		t.Fatal(err)
+	}
+}
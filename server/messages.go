@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages of the DB service, see db.proto. Every field is a string, so rather than generating code for them,
+// they are encoded in the protobuf wire format by hand. This keeps them compatible with clients generated from
+// db.proto without needing protoc to build the server.
+
+// GetRequest asks for the latest value of Key.
+type GetRequest struct {
+	Key string
+}
+
+// GetResponse holds the value asked for by a GetRequest.
+type GetResponse struct {
+	Value string
+}
+
+// SetRequest writes Value for Key.
+type SetRequest struct {
+	Key   string
+	Value string
+}
+
+// SetResponse is returned once a SetRequest has been written.
+type SetResponse struct{}
+
+// DeleteRequest removes Key.
+type DeleteRequest struct {
+	Key string
+}
+
+// DeleteResponse is returned once a DeleteRequest has been written.
+type DeleteResponse struct{}
+
+// message is implemented by each of the messages, for codec to encode and decode them.
+type message interface {
+	marshal() []byte
+	unmarshal(b []byte) error
+}
+
+func (m *GetRequest) marshal() []byte {
+	return appendString(nil, 1, m.Key)
+}
+
+func (m *GetRequest) unmarshal(b []byte) error {
+	return unmarshalStrings(b, map[protowire.Number]*string{1: &m.Key})
+}
+
+func (m *GetResponse) marshal() []byte {
+	return appendString(nil, 1, m.Value)
+}
+
+func (m *GetResponse) unmarshal(b []byte) error {
+	return unmarshalStrings(b, map[protowire.Number]*string{1: &m.Value})
+}
+
+func (m *SetRequest) marshal() []byte {
+	return appendString(appendString(nil, 1, m.Key), 2, m.Value)
+}
+
+func (m *SetRequest) unmarshal(b []byte) error {
+	return unmarshalStrings(b, map[protowire.Number]*string{1: &m.Key, 2: &m.Value})
+}
+
+func (m *SetResponse) marshal() []byte {
+	return nil
+}
+
+func (m *SetResponse) unmarshal(b []byte) error {
+	return unmarshalStrings(b, nil)
+}
+
+func (m *DeleteRequest) marshal() []byte {
+	return appendString(nil, 1, m.Key)
+}
+
+func (m *DeleteRequest) unmarshal(b []byte) error {
+	return unmarshalStrings(b, map[protowire.Number]*string{1: &m.Key})
+}
+
+func (m *DeleteResponse) marshal() []byte {
+	return nil
+}
+
+func (m *DeleteResponse) unmarshal(b []byte) error {
+	return unmarshalStrings(b, nil)
+}
+
+// appendString appends a string field to b. As in proto3, an empty string is the default and so isn't written.
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// unmarshalStrings decodes the string fields in b into fields, by their field number. Fields which aren't in
+// fields are skipped, so that messages from a newer version of db.proto can still be read.
+func unmarshalStrings(b []byte, fields map[protowire.Number]*string) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if field, ok := fields[num]; ok {
+			if typ != protowire.BytesType {
+				return fmt.Errorf("field %d has wire type %d, want a string", num, typ)
+			}
+			s, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			*field = s
+			b = b[n:]
+			continue
+		}
+
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+
+	return nil
+}
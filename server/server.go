@@ -0,0 +1,176 @@
+// Package server exposes a log-structured database as a network service over gRPC, implementing the DB service
+// described in db.proto.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	logstructured "github.com/jdockerty/log-structured-db-engine"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Server serves Get, Set and Delete requests against a single database. The database's own lock keeps concurrent
+// requests apart, so the server needs no locking of its own.
+type Server struct {
+	db   *logstructured.DB
+	grpc *grpc.Server
+}
+
+// New returns a server for db. The database stays owned by the caller, who should close it once the server has
+// been stopped.
+func New(db *logstructured.DB) *Server {
+	s := &Server{db: db}
+
+	// The messages encode themselves, see messages.go, so the server is given a codec for them in place of the
+	// usual one for generated protobuf code.
+	s.grpc = grpc.NewServer(grpc.ForceServerCodec(codec{}))
+	s.grpc.RegisterService(&serviceDesc, s)
+
+	return s
+}
+
+// Serve accepts connections on lis until Stop is called.
+func (s *Server) Serve(lis net.Listener) error {
+	return s.grpc.Serve(lis)
+}
+
+// Stop stops accepting connections and waits for requests which are already under way to finish.
+func (s *Server) Stop() {
+	s.grpc.GracefulStop()
+}
+
+// Get returns the latest value for the key in req.
+func (s *Server) Get(ctx context.Context, req *GetRequest) (*GetResponse, error) {
+	value, err := logstructured.Get(ctx, s.db, req.Key)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &GetResponse{Value: value}, nil
+}
+
+// Set writes the value in req for its key.
+func (s *Server) Set(ctx context.Context, req *SetRequest) (*SetResponse, error) {
+	if err := logstructured.Set(ctx, s.db, req.Key, req.Value); err != nil {
+		return nil, toStatus(err)
+	}
+	return &SetResponse{}, nil
+}
+
+// Delete removes the key in req.
+func (s *Server) Delete(ctx context.Context, req *DeleteRequest) (*DeleteResponse, error) {
+	if err := logstructured.Delete(ctx, s.db, req.Key); err != nil {
+		return nil, toStatus(err)
+	}
+	return &DeleteResponse{}, nil
+}
+
+// toStatus turns an error from the database into a gRPC status with a code that describes it.
+func toStatus(err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, logstructured.ErrKeyNotFound), errors.Is(err, logstructured.ErrDeleted):
+		code = codes.NotFound
+	case errors.Is(err, logstructured.ErrKeyLimitReached), errors.Is(err, logstructured.ErrQuotaExceeded):
+		code = codes.ResourceExhausted
+	case errors.Is(err, logstructured.ErrValueTooLarge), errors.Is(err, logstructured.ErrInvalidKey),
+		errors.Is(err, logstructured.ErrInvalidValue):
+		code = codes.InvalidArgument
+	case errors.Is(err, logstructured.ErrReadOnly):
+		code = codes.FailedPrecondition
+	case errors.Is(err, logstructured.ErrClosed):
+		code = codes.Unavailable
+	case errors.Is(err, logstructured.ErrCorruptRecord), errors.Is(err, logstructured.ErrIndexDataMismatch):
+		code = codes.DataLoss
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	}
+	return status.Error(code, err.Error())
+}
+
+// codec encodes the messages of the DB service in the protobuf wire format, see messages.go.
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(message)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T, it is not a message of the DB service", v)
+	}
+	return m.marshal(), nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(message)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal into %T, it is not a message of the DB service", v)
+	}
+	return m.unmarshal(data)
+}
+
+// Name is that of the usual protobuf codec, as this is what clients generated from db.proto ask for.
+func (codec) Name() string {
+	return "proto"
+}
+
+// serviceDesc describes the DB service in db.proto to gRPC, as generated code otherwise would.
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "logstructured.DB",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Get", Handler: getHandler},
+		{MethodName: "Set", Handler: setHandler},
+		{MethodName: "Delete", Handler: deleteHandler},
+	},
+	Metadata: "db.proto",
+}
+
+func getHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := new(GetRequest)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(*Server).Get(ctx, req)
+	}
+
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/logstructured.DB/Get"}
+	return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(*Server).Get(ctx, req.(*GetRequest))
+	})
+}
+
+func setHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := new(SetRequest)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(*Server).Set(ctx, req)
+	}
+
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/logstructured.DB/Set"}
+	return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(*Server).Set(ctx, req.(*SetRequest))
+	})
+}
+
+func deleteHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := new(DeleteRequest)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(*Server).Delete(ctx, req)
+	}
+
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/logstructured.DB/Delete"}
+	return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(*Server).Delete(ctx, req.(*DeleteRequest))
+	})
+}
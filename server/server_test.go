@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	logstructured "github.com/jdockerty/log-structured-db-engine"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// serve starts a server for db on a free port and returns a connection to it, which encodes messages with the same
+// codec as the server, as a client generated from db.proto would in the protobuf wire format.
+func serve(t *testing.T, db *logstructured.DB) *grpc.ClientConn {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(db)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial(lis.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// TestServer sets, gets and deletes a key over a connection to the server, checking that the key is then reported
+// as not found, and that writes to a read-only database are refused with FailedPrecondition.
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dbPath, indexPath := filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db")
+
+	db, err := logstructured.Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	conn := serve(t, db)
+
+	if err := conn.Invoke(ctx, "/logstructured.DB/Set", &SetRequest{Key: "a", Value: "1"}, &SetResponse{}); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	got := &GetResponse{}
+	if err := conn.Invoke(ctx, "/logstructured.DB/Get", &GetRequest{Key: "a"}, got); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if got.Value != "1" {
+		t.Fatalf("get: got %q, want %q", got.Value, "1")
+	}
+
+	if err := conn.Invoke(ctx, "/logstructured.DB/Delete", &DeleteRequest{Key: "a"}, &DeleteResponse{}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	err = conn.Invoke(ctx, "/logstructured.DB/Get", &GetRequest{Key: "a"}, &GetResponse{})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Fatalf("get after delete: got %v (%v), want %v", code, err, codes.NotFound)
+	}
+	err = conn.Invoke(ctx, "/logstructured.DB/Get", &GetRequest{Key: "missing"}, &GetResponse{})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Fatalf("get of a missing key: got %v (%v), want %v", code, err, codes.NotFound)
+	}
+
+	readOnly, err := logstructured.OpenReadOnly(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readOnly.Close()
+	readOnlyConn := serve(t, readOnly)
+
+	err = readOnlyConn.Invoke(ctx, "/logstructured.DB/Set", &SetRequest{Key: "b", Value: "2"}, &SetResponse{})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Fatalf("set on a read-only database: got %v (%v), want %v", code, err, codes.FailedPrecondition)
+	}
+}
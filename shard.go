@@ -0,0 +1,169 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"sort"
+)
+
+// ErrInvalidShard is returned by a ShardedDB whose ShardFunc puts a key in a shard which doesn't exist.
+var ErrInvalidShard = errors.New("invalid shard")
+
+// ShardOptions are the choices made when opening a database split into shards with OpenSharded.
+type ShardOptions struct {
+
+	// Options are what each shard is opened with, bar Dir, which is the shard's own directory.
+	Options
+
+	// NumShards is how many shards the keys are split between, which must be at least one.
+	NumShards int
+
+	// ShardFunc picks the shard for a key, from 0 up to NumShards-1. It must always pick the same shard for the same
+	// key, otherwise what was written is looked for in the wrong one. Nil spreads keys across the shards by a hash of
+	// them, see RangeShards for keeping ranges of keys together instead.
+	ShardFunc func(key string) int
+}
+
+// ShardedDB is a database split into shards by key, each a DB of its own, with its own database file, hash index and
+// lock, so that writes to keys in different shards don't wait on each other as they would within a single DB. Each
+// key lives in exactly one shard, so everything but Scan goes to that shard alone. A ShardedDB is safe for concurrent
+// use.
+//
+// Which shard a key is in isn't stored anywhere, it is worked out by ShardFunc every time, so a ShardedDB must be
+// opened again with the same NumShards and ShardFunc, otherwise keys are looked for in the wrong shard.
+type ShardedDB struct {
+	shards    []*DB
+	shardFunc func(key string) int
+}
+
+// OpenSharded opens the database split into opts.NumShards shards under dir, creating any which don't exist yet.
+// Each shard has a directory of its own named after its number, such as "shard-0", holding its files, in the same way
+// as an Engine's namespaces.
+func OpenSharded(dir string, opts ShardOptions) (*ShardedDB, error) {
+	if opts.NumShards < 1 {
+		return nil, fmt.Errorf("%w: %d shards, there must be at least one", ErrInvalidShard, opts.NumShards)
+	}
+
+	s := &ShardedDB{shardFunc: opts.ShardFunc}
+	if s.shardFunc == nil {
+		n := uint32(opts.NumShards)
+		s.shardFunc = func(key string) int {
+			h := fnv.New32a()
+			h.Write([]byte(key))
+			return int(h.Sum32() % n)
+		}
+	}
+
+	for i := 0; i < opts.NumShards; i++ {
+		shardOpts := opts.Options
+		shardOpts.Dir = filepath.Join(dir, fmt.Sprintf("shard-%d", i))
+		db, err := OpenWithOptions(engineDBFile, engineIndexFile, shardOpts)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("open shard %d: %w", i, err)
+		}
+		s.shards = append(s.shards, db)
+	}
+	return s, nil
+}
+
+// RangeShards returns a ShardFunc which splits keys into ranges at bounds, which must be in sorted order. Shard 0
+// holds the keys before bounds[0], shard i those from bounds[i-1] up to bounds[i], and the last shard those from the
+// last bound onwards, so there are len(bounds)+1 shards. Keys are compared as strings.
+func RangeShards(bounds ...string) func(key string) int {
+	return func(key string) int {
+		return sort.Search(len(bounds), func(i int) bool { return key < bounds[i] })
+	}
+}
+
+// Shard returns the shard which id is kept in, for anything not done by the ShardedDB itself, such as SetWithTTL or
+// Compact, or for setting fields such as CacheSize on it.
+func (s *ShardedDB) Shard(id string) (*DB, error) {
+	i := s.shardFunc(id)
+	if i < 0 || i >= len(s.shards) {
+		return nil, fmt.Errorf("%w: ShardFunc put %q in shard %d, there are %d", ErrInvalidShard, id, i, len(s.shards))
+	}
+	return s.shards[i], nil
+}
+
+// Shards returns every shard, in order of their number.
+func (s *ShardedDB) Shards() []*DB {
+	return append([]*DB(nil), s.shards...)
+}
+
+// Set writes value for id to the shard which id is kept in, see Set.
+func (s *ShardedDB) Set(ctx context.Context, id, value string) error {
+	db, err := s.Shard(id)
+	if err != nil {
+		return err
+	}
+	return Set(ctx, db, id, value)
+}
+
+// Get returns the live value for id from the shard which id is kept in, see Get.
+func (s *ShardedDB) Get(ctx context.Context, id string) (string, error) {
+	db, err := s.Shard(id)
+	if err != nil {
+		return "", err
+	}
+	return Get(ctx, db, id)
+}
+
+// Delete deletes id from the shard which id is kept in, see Delete.
+func (s *ShardedDB) Delete(ctx context.Context, id string) error {
+	db, err := s.Shard(id)
+	if err != nil {
+		return err
+	}
+	return Delete(ctx, db, id)
+}
+
+// Scan returns the latest value for every key within [startKey, endKey) across all of the shards, ordered by key,
+// see Scan. The keys from every shard are put into order together, by the first shard's NumericKeys and
+// KeyComparator, so the shards should all be given the same ones. Each shard is scanned in turn, so keys written
+// whilst it runs may or may not be included, depending on which shard they are in.
+func (s *ShardedDB) Scan(startKey, endKey string) ([]KV, error) {
+	values := make(map[string]string)
+	var keys []string
+	for i, db := range s.shards {
+		kvs, err := Scan(db, startKey, endKey)
+		if err != nil {
+			return nil, fmt.Errorf("scan shard %d: %w", i, err)
+		}
+		for _, kv := range kvs {
+			keys = append(keys, kv.Key)
+			values[kv.Key] = kv.Value
+		}
+	}
+	sortKeys(s.shards[0], keys)
+
+	results := make([]KV, len(keys))
+	for i, id := range keys {
+		results[i] = KV{Key: id, Value: values[id]}
+	}
+	return results, nil
+}
+
+// Len returns how many live keys there are across all of the shards, see DB.Len.
+func (s *ShardedDB) Len() int {
+	n := 0
+	for _, db := range s.shards {
+		n += db.Len()
+	}
+	return n
+}
+
+// Close closes every shard, returning the first error from closing them, although all of them are closed
+// regardless. The ShardedDB returns ErrClosed from any further use.
+func (s *ShardedDB) Close() error {
+	var err error
+	for i, db := range s.shards {
+		if closeErr := db.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("close shard %d: %w", i, closeErr)
+		}
+	}
+	return err
+}
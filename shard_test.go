@@ -0,0 +1,163 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSharded checks that a ShardedDB keeps each key in the shard its ShardFunc picks, merges the shards in key
+// order for a scan, and that a write to one shard doesn't wait on another shard's lock.
+func TestSharded(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	shardDir := filepath.Join(dir, "sharded")
+	opts := ShardOptions{NumShards: 2, ShardFunc: RangeShards("m")}
+
+	if _, err := OpenSharded(shardDir, ShardOptions{}); !errors.Is(err, ErrInvalidShard) {
+		t.Fatalf("open with no shards: got error %v, want %v", err, ErrInvalidShard)
+	}
+
+	s, err := OpenSharded(shardDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { s.Close() }()
+
+	want := map[string]string{"a": "1", "k": "2", "n": "3", "z": "4"}
+	for id, value := range want {
+		if err := s.Set(ctx, id, value); err != nil {
+			t.Fatalf("set %q: %v", id, err)
+		}
+	}
+
+	// Each key is in its own shard's file, and only there.
+	shards := s.Shards()
+	for id, value := range want {
+		in, other := shards[0], shards[1]
+		if id >= "m" {
+			in, other = shards[1], shards[0]
+		}
+		if db, err := s.Shard(id); err != nil || db != in {
+			t.Fatalf("%q routed to the wrong shard, error %v", id, err)
+		}
+		if got, err := Get(ctx, in, id); err != nil || got != value {
+			t.Fatalf("get %q from its shard: got %q and error %v, want %q", id, got, err, value)
+		}
+		if _, err := Get(ctx, other, id); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("get %q from the other shard: got error %v, want %v", id, err, ErrKeyNotFound)
+		}
+		if got, err := s.Get(ctx, id); err != nil || got != value {
+			t.Fatalf("get %q: got %q and error %v, want %q", id, got, err, value)
+		}
+	}
+
+	for _, c := range []struct {
+		start, end string
+		want       []string
+	}{
+		{"", "", []string{"a", "k", "n", "z"}},
+		{"b", "p", []string{"k", "n"}},
+	} {
+		kvs, err := s.Scan(c.start, c.end)
+		if err != nil {
+			t.Fatalf("scan [%q, %q): %v", c.start, c.end, err)
+		}
+		var got []string
+		for _, kv := range kvs {
+			if kv.Value != want[kv.Key] {
+				t.Fatalf("scan [%q, %q): got %q for %q, want %q", c.start, c.end, kv.Value, kv.Key, want[kv.Key])
+			}
+			got = append(got, kv.Key)
+		}
+		if strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Fatalf("scan [%q, %q): got keys %q, want %q", c.start, c.end, got, c.want)
+		}
+	}
+
+	if err := s.Delete(ctx, "n"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := s.Get(ctx, "n"); !errors.Is(err, ErrDeleted) {
+		t.Fatalf("get after delete: got error %v, want %v", err, ErrDeleted)
+	}
+
+	// With the first shard's lock held, a write to the second goes ahead, whilst one to the first waits for it.
+	shards[0].Lock()
+	other, same := make(chan error, 1), make(chan error, 1)
+	go func() { other <- s.Set(ctx, "y", "5") }()
+	go func() { same <- s.Set(ctx, "b", "6") }()
+	select {
+	case err := <-other:
+		if err != nil {
+			shards[0].Unlock()
+			t.Fatalf("set in the unlocked shard: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		shards[0].Unlock()
+		t.Fatal("set in one shard waited on the lock of another")
+	}
+	select {
+	case <-same:
+		shards[0].Unlock()
+		t.Fatal("set went ahead without the lock of its shard")
+	case <-time.After(50 * time.Millisecond):
+	}
+	shards[0].Unlock()
+	if err := <-same; err != nil {
+		t.Fatalf("set once its shard was unlocked: %v", err)
+	}
+
+	// Writers to both shards at once all land.
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				id := fmt.Sprintf("%c-%d-%d", "cx"[w%2], w, i)
+				if err := s.Set(ctx, id, id); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		t.Fatalf("concurrent set: %v", err)
+	}
+	if got := s.Len(); got != 3+2+200 {
+		t.Fatalf("got %d live keys, want %d", got, 3+2+200)
+	}
+
+	bad, err := OpenSharded(filepath.Join(dir, "sharded-bad"), ShardOptions{NumShards: 2, ShardFunc: func(string) int { return 2 }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	if err := bad.Set(ctx, "a", "1"); !errors.Is(err, ErrInvalidShard) {
+		t.Fatalf("set with a ShardFunc out of range: got error %v, want %v", err, ErrInvalidShard)
+	}
+
+	// Opened again in the same way, every key is found where it was written.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(ctx, "a", "1"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("set after close: got error %v, want %v", err, ErrClosed)
+	}
+	if s, err = OpenSharded(shardDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Get(ctx, "y"); err != nil || got != "5" {
+		t.Fatalf("get after reopening: got %q and error %v, want %q", got, err, "5")
+	}
+}
@@ -0,0 +1,106 @@
+package logstructured
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Snapshot writes the latest live entry for every key to w, leaving out the entries which have since been
+// overwritten, deleted or have expired. This is a compaction which targets w rather than a new database file,
+// so it makes for a backup of the database without the dead entries that build up in the file.
+//
+// The snapshot is laid out in the same way as a database file, header included, so it says which format it was
+// written in and each record carries its own checksum. Restore loads it back into a database.
+func Snapshot(db *DB, w io.Writer) error {
+
+	// Only reads happen here, but hold the lock so that nothing is written part way through the snapshot.
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	latest, _, err := latestOffsets(context.Background(), db)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := writeLive(context.Background(), db, bw, latest, nil); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// Restore opens a new database at dbPath and indexPath, in the same way as Open, and loads the entries from a
+// snapshot written by Snapshot into it. Entries keep any expiry they were written with. The database must not
+// already hold any records, otherwise the snapshot would be mixed in with them.
+//
+// If the snapshot can't be read in full, the error is returned and the database is closed, having been left with
+// whatever entries were loaded before it.
+func Restore(r io.Reader, dbPath, indexPath string) (*DB, error) {
+	br := bufio.NewReader(r)
+
+	version := make([]byte, headerSize)
+	if _, err := io.ReadFull(br, version); err != nil {
+		return nil, err
+	}
+	if version[0] != formatVersion {
+		return nil, fmt.Errorf("%w: version %d", ErrUnsupportedFormat, version[0])
+	}
+
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := restoreRecords(db, br); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Loading the records appended an entry to the index log for each of them, fold them into a snapshot.
+	if err := CompactIndex(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// restoreRecords writes each record read from r into db, which must be empty.
+func restoreRecords(db *DB, r io.Reader) error {
+	db.Lock()
+	size, err := dataSize(db)
+	db.Unlock()
+	if err != nil {
+		return err
+	}
+	if size > headerSize {
+		return errors.New("cannot restore into a database which already holds records")
+	}
+
+	offset := int64(headerSize)
+	for {
+		id, value, expiresAt, _, _, err := decodeRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("snapshot cut short at offset %d: %w", offset, err)
+		}
+		if err != nil {
+			return corruptAt(err, offset)
+		}
+		offset += recordSize(id, value)
+
+		if err := set(context.Background(), db, id, value, expiresAt); err != nil {
+			return fmt.Errorf("restore %q: %w", id, err)
+		}
+	}
+}
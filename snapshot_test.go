@@ -0,0 +1,95 @@
+package logstructured
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestSnapshotRestore snapshots a database with overwritten and deleted keys, restores it into a new one and checks
+// that every live key reads back the same, whereas the deleted keys and the older values leave no trace, either in
+// the snapshot or in the restored database.
+func TestSnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 50; i++ {
+		if err := Set(ctx, db, fmt.Sprintf("key-%02d", i), fmt.Sprintf("old-%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 50; i += 2 {
+		if err := Set(ctx, db, fmt.Sprintf("key-%02d", i), fmt.Sprintf("new-%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 50; i += 5 {
+		if err := Delete(ctx, db, fmt.Sprintf("key-%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var snapshot bytes.Buffer
+	if err := Snapshot(db, &snapshot); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	for _, gone := range []string{"old-00", "old-02", "key-05", Tombstone} {
+		if bytes.Contains(snapshot.Bytes(), []byte(gone)) {
+			t.Fatalf("snapshot holds %q, which was overwritten or deleted", gone)
+		}
+	}
+
+	restored, err := Restore(bytes.NewReader(snapshot.Bytes()), filepath.Join(dir, "restored.db"), filepath.Join(dir, "restored-index.db"))
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	defer restored.Close()
+
+	want, err := Scan(db, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Scan(restored, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != 40 || !reflect.DeepEqual(got, want) {
+		t.Fatalf("scan of the restored database: got %v, want %v", got, want)
+	}
+	for i := 0; i < 50; i += 5 {
+		id := fmt.Sprintf("key-%02d", i)
+		if _, err := Get(ctx, restored, id); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("get of %q, deleted before the snapshot: got %v, want %v", id, err, ErrKeyNotFound)
+		}
+	}
+	if _, ok := restored.Hash.Get("key-05"); ok {
+		t.Fatal(`the restored index holds "key-05", which was deleted before the snapshot`)
+	}
+
+	// The restored database holds one record for each live key, and nothing else.
+	if stats, err := Stats(restored); err != nil || stats.DeadBytes != 0 {
+		t.Fatalf("stats of the restored database: got %+v (error %v), want no dead bytes", stats, err)
+	}
+	if got, want := restored.WriteOffset(), int64(snapshot.Len()); got != want {
+		t.Fatalf("restored database file: got %d bytes, want the %d of the snapshot", got, want)
+	}
+
+	if err := restored.Close(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := Restore(bytes.NewReader(snapshot.Bytes()), filepath.Join(dir, "restored.db"), filepath.Join(dir, "restored-index.db"))
+	if err == nil {
+		again.Close()
+		t.Fatal("restore into a database which holds records: got no error")
+	}
+}
@@ -0,0 +1,263 @@
+package logstructured
+
+import (
+	"strings"
+)
+
+// PrefixUsage is the usage attributed to a single key prefix.
+type PrefixUsage struct {
+	Keys       int   // Number of distinct keys with the prefix.
+	ValueBytes int64 // Total size of the latest value held for each of those keys.
+}
+
+// PrefixStats groups the keys in the database by their leading prefix, up to the first occurrence of separator,
+// and reports how many keys and how many bytes of values each prefix holds. For example, with a separator
+// of ":" the keys "acme:1" and "acme:2" are both counted under "acme". Keys which don't contain the separator
+// are counted under the empty prefix.
+//
+// Only the latest record for each key is counted, older records which have since been overwritten are ignored,
+// as are keys which have been deleted or have expired.
+// The hash index tells us where the latest record for every key lives, so this reads one record per key rather
+// than scanning the whole file.
+func (db *DB) PrefixStats(separator string) (map[string]PrefixUsage, error) {
+
+	// Hold the lock so that the index doesn't change underneath us whilst we walk it.
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	stats := make(map[string]PrefixUsage)
+	var err error
+	db.Hash.Range(func(id string, loc RecordLocation) bool {
+		var value string
+		var expiresAt int64
+		if _, value, expiresAt, _, _, err = readRecord(db, loc); err != nil {
+			return false
+		}
+
+		// Deleted keys still have an entry in the index, pointing at their tombstone, as do expired ones.
+		if value == Tombstone || db.expired(expiresAt) {
+			return true
+		}
+
+		var prefix string
+		if i := strings.Index(id, separator); separator != "" && i >= 0 {
+			prefix = id[:i]
+		}
+
+		usage := stats[prefix]
+		usage.Keys++
+		usage.ValueBytes += int64(len(value))
+		stats[prefix] = usage
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// Len returns the number of live keys in the database, which leaves out those which have been deleted or have
+// expired. This is worked out from what is held in memory, without reading the database file.
+func (db *DB) Len() int {
+	db.RLock()
+	defer db.RUnlock()
+
+	// Deleted keys still have an entry in the index, pointing at their tombstone, as do expired ones.
+	n := db.Hash.Len() - len(db.deleted)
+	for _, expiresAt := range db.expiries {
+		if db.expired(expiresAt) {
+			n--
+		}
+	}
+
+	return n
+}
+
+// Keys returns the live keys in the database in sorted order, leaving out those which have been deleted or
+// have expired. The slice is a copy, so later writes don't change it.
+func (db *DB) Keys() []string {
+	db.RLock()
+	defer db.RUnlock()
+
+	keys := make([]string, 0, db.Hash.Len()-len(db.deleted))
+	db.Hash.Range(func(id string, _ RecordLocation) bool {
+		if !db.deleted[id] && !db.expired(db.expiries[id]) {
+			keys = append(keys, id)
+		}
+		return true
+	})
+	sortKeys(db, keys)
+
+	return keys
+}
+
+// indexEntryOverhead is roughly how much memory each entry of a MapIndex takes up besides the bytes of its ID: the
+// string header and location in its slot, and the share of the slots left empty for the map to grow into. It was
+// measured with the map at various sizes, between which it varies by around a quarter either way depending on how
+// recently the map grew.
+const indexEntryOverhead = 64
+
+// indexSampleSize is the most IDs IndexMemoryBytes reads to work out their average length.
+const indexSampleSize = 1024
+
+// IndexMemoryBytes estimates how much memory the hash index takes up, as the number of entries times their average
+// size, that is the average length of an ID plus indexEntryOverhead. The average is taken from a sample of the IDs
+// rather than all of them, so this is cheap however big the index is. It goes by how a MapIndex is laid out, an
+// Index of another kind may take more or less. Deleted and expired keys count, as they keep their index entries
+// until compaction.
+func (db *DB) IndexMemoryBytes() int64 {
+	db.RLock()
+	defer db.RUnlock()
+
+	n := db.Hash.Len()
+	if n == 0 {
+		return 0
+	}
+
+	var sampled, keyBytes int64
+	db.Hash.Range(func(id string, _ RecordLocation) bool {
+		// IDs are allocated in multiples of 8 bytes.
+		keyBytes += int64(len(id)+7) &^ 7
+		sampled++
+		return sampled < indexSampleSize
+	})
+	if sampled == 0 {
+		return 0
+	}
+
+	return int64(n) * (keyBytes/sampled + indexEntryOverhead)
+}
+
+// OnDiskBytes returns how many bytes the database's records take up, which is the size of the database file plus
+// that of any segment files flushed from the memtable. Appends still held in the write buffer are counted as though
+// they had been written, so this is the size the files will be once the buffer is flushed, and it grows with every
+// write whether or not WriteBufferSize is set.
+func (db *DB) OnDiskBytes() (int64, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return 0, ErrClosed
+	}
+
+	size, err := dataSize(db)
+	if err != nil {
+		return 0, err
+	}
+	return size + segmentBytes(db), nil
+}
+
+// IndexBytes returns the size of the hash index file. Entries which haven't been written to it yet, with
+// IndexDebounce or IndexFlushInterval set, aren't counted until they are.
+func (db *DB) IndexBytes() (int64, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return 0, ErrClosed
+	}
+
+	info, err := db.HashStorage.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// DBStats describes how much of the database file is taken up by live entries, which helps decide when it is
+// worth compacting.
+type DBStats struct {
+	FileSize    int64   // Size of the database file in bytes.
+	LiveKeys    int     // Number of live keys, as given by Len.
+	DeadBytes   int64   // Bytes taken up by records which compaction would drop.
+	Reclaimable float64 // Fraction of the file which compaction would reclaim, between 0 and 1.
+}
+
+// Stats reports the size of the database file and how much of it is dead, that is records which have since been
+// overwritten, tombstones and entries which have expired. This is how much compaction would reclaim.
+//
+// The dead bytes are kept up to date as records are written, so this doesn't need to read through the file.
+func Stats(db *DB) (DBStats, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return DBStats{}, ErrClosed
+	}
+
+	size, err := dataSize(db)
+	if err != nil {
+		return DBStats{}, err
+	}
+
+	stats := DBStats{FileSize: size, LiveKeys: db.Hash.Len() - len(db.deleted), DeadBytes: db.deadBytes}
+
+	// Expired records only become dead with time, so they are counted now rather than as they are written.
+	for id, expiresAt := range db.expiries {
+		if db.expired(expiresAt) {
+			stats.LiveKeys--
+			loc, _ := db.Hash.Get(id)
+			stats.DeadBytes += recordLength(db, loc)
+		}
+	}
+
+	if size > 0 {
+		stats.Reclaimable = float64(stats.DeadBytes) / float64(size)
+	}
+
+	return stats, nil
+}
+
+// markDead accounts for the record about to be written for id, of the given size, in the dead bytes. The record
+// it replaces is now dead, unless that was a tombstone, which was counted as dead when it was written, as is the
+// new record if it is a tombstone. The lock must be held.
+func markDead(db *DB, id string, tombstone bool, size int) {
+	if loc, ok := db.Hash.Get(id); ok && !db.deleted[id] {
+		db.deadBytes += recordLength(db, loc)
+	}
+	if tombstone {
+		db.deadBytes += int64(size)
+	}
+}
+
+// countDeadBytes works out the dead bytes from scratch, as everything in the database file after the header that
+// isn't the latest record for a live key. The lock must be held, or the database not yet shared.
+func countDeadBytes(db *DB) (int64, error) {
+	size, err := dataSize(db)
+	if err != nil {
+		return 0, err
+	}
+
+	dead := size - headerSize
+	db.Hash.Range(func(id string, loc RecordLocation) bool {
+		if !db.deleted[id] {
+			dead -= recordLength(db, loc)
+		}
+		return true
+	})
+
+	// An index which doesn't match the file could take this below zero, which would make no sense.
+	if dead < 0 {
+		dead = 0
+	}
+	return dead, nil
+}
+
+// recordLength is the size of the record at loc. If the length isn't held in the index, the record is read to
+// find it, a record which can't be read counts as zero. Used for the dead bytes, which are only an estimate.
+func recordLength(db *DB, loc RecordLocation) int64 {
+	if loc.Length > 0 {
+		return int64(loc.Length)
+	}
+
+	key, value, _, _, _, err := readRecord(db, loc)
+	if err != nil {
+		return 0
+	}
+	return recordSize(key, value)
+}
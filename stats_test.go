@@ -0,0 +1,168 @@
+package logstructured
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestOnDiskBytes checks that the sizes reported for the database and index files count every byte written,
+// including appends still held in the write buffer, and match the files once flushed.
+func TestOnDiskBytes(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "disk-bytes.db")
+	indexPath := filepath.Join(dir, "disk-bytes-index.db")
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+	db.WriteBufferSize = 1 << 20
+
+	for i := 0; i < 100; i++ {
+		if err := Set(ctx, db, fmt.Sprintf("key-%d", i), strings.Repeat("v", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Everything is still in the write buffer, yet counts all the same.
+	buffered, err := db.OnDiskBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buffered <= info.Size() {
+		t.Fatalf("on disk bytes with writes buffered: got %d, no more than the %d bytes already in the file", buffered, info.Size())
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []struct {
+		path string
+		size func() (int64, error)
+	}{{dbPath, db.OnDiskBytes}, {indexPath, db.IndexBytes}} {
+		got, err := f.size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(f.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != info.Size() {
+			t.Fatalf("%s after a flush: reported %d bytes, the file holds %d", filepath.Base(f.path), got, info.Size())
+		}
+		if f.path == dbPath && got != buffered {
+			t.Fatalf("on disk bytes after a flush: got %d, want %d as whilst the writes were buffered", got, buffered)
+		}
+	}
+}
+
+// TestIndexMemory checks that the estimate of the index's memory grows in proportion with the keys in it, for
+// keys of the same length, and that an empty index is estimated at nothing.
+func TestIndexMemory(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "index-memory.db"), filepath.Join(dir, "index-memory-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if n := db.IndexMemoryBytes(); n != 0 {
+		t.Fatalf("empty index: estimated %d bytes, want 0", n)
+	}
+
+	const keys = 1000
+	insert := func(from int) error {
+		for i := from; i < from+keys; i++ {
+			if err := Set(ctx, db, fmt.Sprintf("key-%06d", i), "value"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := insert(0); err != nil {
+		t.Fatal(err)
+	}
+	first := db.IndexMemoryBytes()
+	if first < keys*int64(len("key-000000")) {
+		t.Fatalf("%d keys: estimated %d bytes, less than the keys themselves", keys, first)
+	}
+	if err := insert(keys); err != nil {
+		t.Fatal(err)
+	}
+	if second := db.IndexMemoryBytes(); second != 2*first {
+		t.Fatalf("%d keys: estimated %d bytes, want twice the %d estimated for %d", 2*keys, second, first, keys)
+	}
+}
+
+// TestPrefixStats checks that keys are counted under the prefix before the separator, those without it under the
+// empty prefix, with only the latest value of each key counting towards the bytes, and deleted and expired keys left
+// out altogether.
+func TestPrefixStats(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	now := time.Unix(1700000000, 0)
+	db.Clock = func() time.Time { return now }
+
+	for _, kv := range []KV{
+		{"acme:1", "aaaaaa"}, {"acme:2", "bbb"}, {"acme:1", "a"}, {"beta:x", "cccc"}, {"beta:y", "deleted"},
+		{"plain", "dd"}, {"beta:sub:z", "e"},
+	} {
+		if err := Set(ctx, db, kv.Key, kv.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Delete(ctx, db, "beta:y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetWithTTL(ctx, db, "acme:3", "expired", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetWithTTL(ctx, db, "gone", "expired", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Hour)
+
+	tests := []struct {
+		separator string
+		want      map[string]PrefixUsage
+	}{
+		{":", map[string]PrefixUsage{
+			"acme": {Keys: 2, ValueBytes: 4},
+			"beta": {Keys: 2, ValueBytes: 5},
+			"":     {Keys: 1, ValueBytes: 2},
+		}},
+		{"", map[string]PrefixUsage{"": {Keys: 5, ValueBytes: 11}}},
+		{"/", map[string]PrefixUsage{"": {Keys: 5, ValueBytes: 11}}},
+	}
+	for _, tt := range tests {
+		got, err := db.PrefixStats(tt.separator)
+		if err != nil {
+			t.Fatalf("prefix stats with %q: %v", tt.separator, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("prefix stats with %q: got %+v, want %+v", tt.separator, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package logstructured
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// streamChunkSize is the most of a streamed value which SetStream holds in memory at once.
+const streamChunkSize = 32 << 10
+
+// SetStream writes the size bytes read from r as the value for id, in the same way as Set, but without holding more
+// than streamChunkSize bytes of the value in memory at once, for values too large to want as a string. As the
+// record's checksum comes before the value, the value is first copied to a temporary file alongside the database
+// file, without holding the lock, then appended to the database file from there. A reader which fails, or runs out
+// before size bytes, leaves the database as it was.
+//
+// The value is never held whole, so it isn't kept in the memtable or the read cache either, from which a Get would
+// otherwise answer, and reads of it go to the database file instead. The exception is when there are change feeds,
+// see Changes, as each Record carries its value, which is then read back from the temporary file for them. The
+// same goes for a Validator, which is given the whole value.
+func SetStream(db *DB, id string, r io.Reader, size int64) (err error) {
+	defer observe(db, OpSet, time.Now(), &err)
+
+	if size < 0 || size > math.MaxUint32 {
+		return fmt.Errorf("%w: %d bytes, a value can't be negative or %d bytes or more", ErrInvalidValue, size, int64(math.MaxUint32)+1)
+	}
+
+	// Nothing is staged for a database which can't be written to, although it is checked again once the lock is held
+	// for the append, as it could be closed in the meantime.
+	db.RLock()
+	closed, readOnly := db.closed, db.readOnly
+	dbPath := db.DB.Name()
+	db.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+	if readOnly {
+		return ErrReadOnly
+	}
+
+	staged, err := os.CreateTemp(filepath.Dir(dbPath), filepath.Base(dbPath)+".stream-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staged.Name())
+	defer staged.Close()
+
+	n, err := io.CopyBuffer(staged, io.LimitReader(r, size), make([]byte, streamChunkSize))
+	if err != nil {
+		return err
+	}
+	if n < size {
+		return fmt.Errorf("value for %q ended after %d of %d bytes: %w", id, n, size, io.ErrUnexpectedEOF)
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	return writeStream(db, id, staged, size)
+}
+
+// writeStream appends a record for id with the size bytes in staged as its value, much as writeValue does for a
+// value held in memory. The lock must be held.
+func writeStream(db *DB, id string, staged *os.File, size int64) error {
+	if err := checkKey(db, id); err != nil {
+		return err
+	}
+	if db.MaxValueBytes > 0 && size > int64(db.MaxValueBytes) {
+		return fmt.Errorf("%w: %d bytes, the most is %d", ErrValueTooLarge, size, db.MaxValueBytes)
+	}
+
+	// Only the start of the value is needed, to rule out the tombstone and for the value index.
+	headSize := int64(len(Tombstone))
+	if db.values != nil && int64(db.values.prefixLen) > headSize {
+		headSize = int64(db.values.prefixLen)
+	}
+	if headSize > size {
+		headSize = size
+	}
+	head := make([]byte, headSize)
+	if _, err := staged.ReadAt(head, 0); err != nil {
+		return err
+	}
+	if size == int64(len(Tombstone)) && string(head) == Tombstone {
+		return checkValue(db, id, Tombstone)
+	}
+
+	// The Validator needs the whole value, which is only read into memory for it.
+	if db.Validator != nil {
+		value := make([]byte, size)
+		if _, err := staged.ReadAt(value, 0); err != nil && !(err == io.EOF && size == 0) {
+			return err
+		}
+		if err := db.Validator(id, string(value)); err != nil {
+			return err
+		}
+	}
+
+	if isNewKey(db, id) {
+		if err := checkKeyLimit(db, 1); err != nil {
+			return err
+		}
+	}
+	total := recordSize(id, "") + size
+	if err := checkQuota(db, total); err != nil {
+		return err
+	}
+
+	offset, err := dataSize(db)
+	if err != nil {
+		return err
+	}
+	seq := nextSeq(db)
+	writtenAt := db.clock().UnixNano()
+
+	// The checksum is worked out by reading the staged value through once, then it is read through again to append
+	// it after the start of the record, see encodeRecord.
+	sum := checksum(id, "", 0, seq, writtenAt)
+	buf := make([]byte, streamChunkSize)
+	for read := int64(0); read < size; {
+		n, err := staged.ReadAt(buf[:minInt64(streamChunkSize, size-read)], read)
+		if err != nil && !(err == io.EOF && int64(n) == size-read) {
+			return err
+		}
+		sum = crc32.Update(sum, crc32.IEEETable, buf[:n])
+		read += int64(n)
+	}
+	start := encodeRecord(id, "", 0, seq, writtenAt)
+	binary.BigEndian.PutUint32(start, sum)
+	binary.BigEndian.PutUint32(start[len(start)-lengthSize:], uint32(size))
+
+	appendErr := func() error {
+		if _, err := appendData(db, start); err != nil {
+			return err
+		}
+		for written := int64(0); written < size; {
+			n, err := staged.ReadAt(buf[:minInt64(streamChunkSize, size-written)], written)
+			if err != nil && !(err == io.EOF && int64(n) == size-written) {
+				return err
+			}
+			if _, err := appendData(db, buf[:n]); err != nil {
+				return err
+			}
+			written += int64(n)
+		}
+		return nil
+	}()
+	if appendErr != nil {
+
+		// As with Set, anything which did make it into the file is cut off again.
+		if db.writer == nil && !db.closed {
+			db.DB.Truncate(offset)
+		}
+		return appendErr
+	}
+	if err := syncAppend(db); err != nil {
+		return err
+	}
+	if err := crash(db, CrashAfterWrite); err != nil {
+		return err
+	}
+
+	// Only change feeds need the value itself, watchers are told no more than the key. Without any feeds, the
+	// start of the value is enough for the rest.
+	rec := writtenRecord{
+		key: id, offset: offset, size: int(total),
+		value: string(head), seq: seq, writtenAt: writtenAt, partial: true,
+	}
+	if len(db.feeds) > 0 {
+		b := make([]byte, size)
+		if _, err := staged.ReadAt(b, 0); err != nil && !(err == io.EOF && size == 0) {
+			return err
+		}
+		rec.value, rec.partial = string(b), false
+	}
+	return db.afterWrite(rec)
+}
+
+// GetStream returns a reader of the live value for id, in the same way as Get, but reading it from the database file
+// as it is read rather than all at once, for values too large to want as a string. The reader has a handle on the
+// file of its own, so it carries on reading the same record even if the database is compacted or closed in the
+// meantime, and must be closed once done with. Once the whole value has been read, it is checked against the
+// record's checksum, with a CorruptRecordError in place of io.EOF if it doesn't match, as it wouldn't were the
+// record overwritten in place by a Set with AllowInPlaceUpdate whilst it was being read.
+//
+// With the hash index disabled, or not matching the file, the record is found by reading through the whole file,
+// which does hold each value in memory as it goes.
+func GetStream(db *DB, id string) (io.ReadCloser, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+	if err := flushWrites(db); err != nil {
+		return nil, err
+	}
+
+	offset := int64(-1)
+	if loc, ok := db.Hash.Get(id); ok && !db.HashDisabled {
+		offset = loc.Offset
+	}
+	var h streamHeader
+	var err error
+	if offset >= 0 {
+		if h, err = readStreamHeader(db, offset); err == io.ErrUnexpectedEOF {
+			return nil, pastEOF(db, offset)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if offset < 0 || h.key != id {
+		found := false
+		err := eachRecord(db, func(at int64, key, _ string, _ int64, _ uint64, _ int64) error {
+			if key == id {
+				found, offset = true, at
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, ErrKeyNotFound
+		}
+		if h, err = readStreamHeader(db, offset); err != nil {
+			return nil, err
+		}
+	}
+
+	if h.valueSize == int64(len(Tombstone)) {
+		b := make([]byte, h.valueSize)
+		if _, err := readAt(db, b, h.valueOffset); err != nil {
+			return nil, err
+		}
+		if string(b) == Tombstone {
+			return nil, ErrDeleted
+		}
+	}
+	if db.expired(h.expiresAt) {
+		return nil, ErrKeyNotFound
+	}
+
+	f, err := os.Open(db.DB.Name())
+	if err != nil {
+		return nil, err
+	}
+	return &valueReader{
+		f:      f,
+		r:      io.NewSectionReader(f, h.valueOffset, h.valueSize),
+		sum:    checksum(id, "", h.expiresAt, h.seq, h.writtenAt),
+		want:   h.sum,
+		offset: offset,
+	}, nil
+}
+
+// streamHeader is everything in a record but its value, along with where the value is.
+type streamHeader struct {
+	sum                    uint32
+	expiresAt              int64
+	seq                    uint64
+	writtenAt              int64
+	key                    string
+	valueOffset, valueSize int64
+}
+
+// readStreamHeader reads the record at offset up to the start of its value.
+func readStreamHeader(db *DB, offset int64) (streamHeader, error) {
+	fixed := make([]byte, checksumSize+expirySize+seqSize+writtenSize+lengthSize)
+	if _, err := readAt(db, fixed, offset); err != nil {
+		return streamHeader{}, unexpectedEOF(err)
+	}
+	h := streamHeader{
+		sum:       binary.BigEndian.Uint32(fixed),
+		expiresAt: int64(binary.BigEndian.Uint64(fixed[checksumSize:])),
+		seq:       binary.BigEndian.Uint64(fixed[checksumSize+expirySize:]),
+		writtenAt: int64(binary.BigEndian.Uint64(fixed[checksumSize+expirySize+seqSize:])),
+	}
+
+	// The length of the key comes from the file, so it is read as far as the file goes rather than trusted.
+	keyOffset := offset + int64(len(fixed))
+	keySize := int64(binary.BigEndian.Uint32(fixed[checksumSize+expirySize+seqSize+writtenSize:]))
+	size, err := dataSize(db)
+	if err != nil {
+		return streamHeader{}, err
+	}
+	if keyOffset+keySize+lengthSize > size {
+		return streamHeader{}, io.ErrUnexpectedEOF
+	}
+	key := make([]byte, keySize)
+	if _, err := readAt(db, key, keyOffset); err != nil {
+		return streamHeader{}, unexpectedEOF(err)
+	}
+	h.key = string(key)
+
+	var length [lengthSize]byte
+	if _, err := readAt(db, length[:], keyOffset+int64(len(key))); err != nil {
+		return streamHeader{}, unexpectedEOF(err)
+	}
+	h.valueOffset = keyOffset + int64(len(key)) + lengthSize
+	h.valueSize = int64(binary.BigEndian.Uint32(length[:]))
+	return h, nil
+}
+
+// unexpectedEOF is err, unless it is io.EOF, which part way through a record means it has been cut short.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// valueReader reads a value from the database file for GetStream, checking it against the record's checksum once
+// it has all been read.
+type valueReader struct {
+	f      *os.File
+	r      *io.SectionReader
+	sum    uint32 // Checksum of the record so far, which is added to as the value is read.
+	want   uint32 // Checksum stored in the record.
+	offset int64  // Where the record starts, for reporting it as corrupt.
+}
+
+func (v *valueReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.sum = crc32.Update(v.sum, crc32.IEEETable, p[:n])
+	if err == io.EOF && v.sum != v.want {
+		return n, corruptAt(errChecksumMismatch, v.offset)
+	}
+	return n, err
+}
+
+func (v *valueReader) Close() error {
+	return v.f.Close()
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
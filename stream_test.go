@@ -0,0 +1,142 @@
+package logstructured
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// TestStream checks that a value larger than the memory allocated whilst writing and reading it can be streamed
+// in and read back byte for byte, including once another write has compacted the file from underneath the reader,
+// and that a value which comes up short leaves the database as it was.
+func TestStream(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "stream.db")
+	indexPath := filepath.Join(dir, "stream-index.db")
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	const size = 16 << 20
+	allocated := func() uint64 {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return stats.TotalAlloc
+	}
+	check := func(stage string) error {
+		before := allocated()
+		r, err := GetStream(db, "blob")
+		if err != nil {
+			return fmt.Errorf("%s: get stream: %w", stage, err)
+		}
+		defer r.Close()
+
+		want := &patternReader{}
+		got, expected := make([]byte, 64<<10), make([]byte, 64<<10)
+		var read int64
+		for {
+			n, err := r.Read(got)
+			want.Read(expected[:n])
+			if !bytes.Equal(got[:n], expected[:n]) {
+				return fmt.Errorf("%s: value read back differs within bytes %d to %d", stage, read, read+int64(n))
+			}
+			read += int64(n)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("%s: read value: %w", stage, err)
+			}
+		}
+		if read != size {
+			return fmt.Errorf("%s: read back %d bytes, want %d", stage, read, size)
+		}
+		if n := allocated() - before; n > size/4 {
+			return fmt.Errorf("%s: allocated %d bytes reading a %d byte value", stage, n, size)
+		}
+		return nil
+	}
+
+	before := allocated()
+	if err := SetStream(db, "blob", &patternReader{}, size); err != nil {
+		t.Fatalf("set stream: %v", err)
+	}
+	if n := allocated() - before; n > size/4 {
+		t.Fatalf("allocated %d bytes streaming in a %d byte value", n, size)
+	}
+	if err := check("written"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := Get(ctx, db, "blob"); err != nil || len(value) != size {
+		t.Fatalf("get of a streamed value: got %d bytes, %v, want %d", len(value), err, size)
+	}
+
+	// A value which comes up short isn't written at all.
+	err = SetStream(db, "blob", strings.NewReader("short"), size)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("set stream of a short value: got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if err := check("after a value which came up short"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reader holds on to the file it was reading, even once compaction has replaced it.
+	r, err := GetStream(db, "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := make([]byte, 1024)
+	if _, err := io.ReadFull(r, first); err != nil {
+		r.Close()
+		t.Fatal(err)
+	}
+	if err := Set(ctx, db, "other", "value"); err == nil {
+		err = Compact(ctx, db)
+	}
+	if err != nil {
+		r.Close()
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, r)
+	r.Close()
+	if err != nil || n != size-int64(len(first)) {
+		t.Fatalf("read value across a compaction: got %d more bytes, %v, want %d", n, err, size-len(first))
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath, indexPath, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := check("opened again"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetStream(db, "missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("get stream of a missing ID: got error %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+// patternReader reads a repeating pattern of bytes, so that a large value can be streamed in and checked on the way
+// back out without either being held in memory.
+type patternReader struct {
+	offset int64
+}
+
+func (p *patternReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = byte(p.offset*7 + p.offset>>9)
+		p.offset++
+	}
+	return len(b), nil
+}
@@ -0,0 +1,52 @@
+package logstructured
+
+import (
+	"sort"
+	"time"
+)
+
+// ScanTimeRange returns the records written within [from, to), going by the write time stored in each, see
+// Record.WrittenAt and DB.Clock, so from is included and to isn't. A zero from or to leaves that end of the range
+// open. Only the latest record for each key written within the range is returned, in order of sequence number.
+// Deletes are returned as records too, with OpDelete, as are records which have since expired, so that the result
+// shows what was written, rather than what is live now.
+//
+// The write times aren't indexed, so this reads through the whole database file. Compaction drops every record but
+// the latest live one for each key, so the records in the range are only all there until the file is compacted.
+func ScanTimeRange(db *DB, from, to time.Time) ([]Record, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	var records []Record
+	latest := make(map[string]int)
+	err := eachRecord(db, func(offset int64, id, value string, expiresAt int64, seq uint64, writtenAt int64) error {
+		if !from.IsZero() && writtenAt < from.UnixNano() {
+			return nil
+		}
+		if !to.IsZero() && writtenAt >= to.UnixNano() {
+			return nil
+		}
+
+		// A key's later records always come later in the file, so the last one read is its latest.
+		r := newChangeRecord(id, value, expiresAt, seq, writtenAt, offset)
+		if i, ok := latest[id]; ok {
+			records[i] = r
+			return nil
+		}
+		latest[id] = len(records)
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Each key's place in records is where its first record in the range was, and updates in place are out of
+	// order in the file anyway.
+	sort.Slice(records, func(i, j int) bool { return records[i].Seq < records[j].Seq })
+	return records, nil
+}
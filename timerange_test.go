@@ -0,0 +1,91 @@
+package logstructured
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestTimeRange checks that records are stored with the time they were written at, by the database's clock,
+// that a time range includes its start but not its end, returning the latest record for each key written within it,
+// and that compaction keeps the time each record was first written at.
+func TestTimeRange(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "time-range.db")
+	indexPath := filepath.Join(dir, "time-range-index.db")
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	start := time.Unix(1700000000, 0)
+	times := []time.Time{start, start.Add(time.Second), start.Add(2 * time.Second), start.Add(3 * time.Second)}
+	var now time.Time
+	db.Clock = func() time.Time { return now }
+
+	writes := []func() error{
+		func() error { return Set(ctx, db, "a", "1") },
+		func() error { return Set(ctx, db, "b", "1") },
+		func() error { return Set(ctx, db, "a", "2") },
+		func() error { return Delete(ctx, db, "b") },
+	}
+	for i, write := range writes {
+		now = times[i]
+		if err := write(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each range gives the key, value, or "-" for a delete, and write time of the records it should return.
+	type want struct {
+		key, value string
+		at         time.Time
+	}
+	for _, tc := range []struct {
+		name     string
+		from, to time.Time
+		want     []want
+	}{
+		{"before any writes", start.Add(-time.Hour), start, nil},
+		{"up to the second write", times[0], times[1], []want{{"a", "1", times[0]}}},
+		{"from the second write to the third", times[1], times[2], []want{{"b", "1", times[1]}}},
+		{"the second write alone", times[1], times[1].Add(time.Nanosecond), []want{{"b", "1", times[1]}}},
+		{"up to the delete", times[0], times[3], []want{{"b", "1", times[1]}, {"a", "2", times[2]}}},
+		{"from the delete onwards", times[3], time.Time{}, []want{{"b", "-", times[3]}}},
+		{"everything", time.Time{}, time.Time{}, []want{{"a", "2", times[2]}, {"b", "-", times[3]}}},
+	} {
+		records, err := ScanTimeRange(db, tc.from, tc.to)
+		if err != nil {
+			t.Fatalf("scan time range %s: %v", tc.name, err)
+		}
+		var got []want
+		for _, r := range records {
+			w := want{r.Key, r.Value, time.Unix(0, r.WrittenAt)}
+			if r.Op == OpDelete {
+				w.value = "-"
+			}
+			got = append(got, w)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Fatalf("scan time range %s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// Compaction copies records over as they are, write time included.
+	now = start.Add(time.Hour)
+	if err := Compact(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	r, err := GetRecord(db, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.WrittenAt != times[2].UnixNano() {
+		t.Fatalf("write time once compacted: got %v, want %v", time.Unix(0, r.WrittenAt), times[2])
+	}
+}
@@ -0,0 +1,70 @@
+package logstructured
+
+import (
+	"os"
+)
+
+// Truncate removes every entry from the database, leaving it as empty as a newly created one, which is far cheaper
+// than deleting each key. Everything held in memory for the entries goes along with them, the memtable, the read
+// cache and the value index included, as do the segment files flushed from the memtable.
+//
+// The empty files are written alongside the originals and swapped in, as with Compact, so a crash part way through
+// leaves either the original entries or none, never a mixture of the two, see finishSwap. The sequence carries on
+// from the last write, rather than starting again, so change feeds are closed, and Changes returns
+// ErrChangesCompacted to a follower trying to carry on from before. Watchers aren't told of the entries going.
+func (db *DB) Truncate() error {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	// The segments go first, as were they left behind by a crash part way through, they would carry on answering
+	// for the entries once the database is opened again, see loadSegments.
+	if err := dropSegments(db); err != nil {
+		return err
+	}
+
+	compactPath := db.DB.Name() + ".compact"
+	compactIndexPath := db.HashStorage.Name() + ".compact"
+	hash := db.newIndex()
+
+	if err := writeEmpty(db, compactPath); err != nil {
+		os.Remove(compactPath)
+		return err
+	}
+	if err := writeCompactedIndex(db, compactIndexPath, hash); err != nil {
+		os.Remove(compactPath)
+		os.Remove(compactIndexPath)
+		return err
+	}
+	if err := swapCompacted(db, compactPath, compactIndexPath, hash); err != nil {
+		return err
+	}
+
+	db.memtable = nil
+	for live := range db.feeds {
+		close(live)
+	}
+	db.feeds = nil
+	return nil
+}
+
+// writeEmpty writes a database file holding nothing but its header to path, carrying on the sequence from the
+// latest write.
+func writeEmpty(db *DB, path string) error {
+	out, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, db.fileMode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := writeHeader(out, db.seq); err != nil {
+		return err
+	}
+	return out.Sync()
+}
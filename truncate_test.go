@@ -0,0 +1,86 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestTruncate checks that truncating the database leaves nothing of what was written before, that writes
+// afterwards start from the first record of the file as in a new database, and that a crash part way through
+// truncating leaves the database either as it was or empty.
+func TestTruncate(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "truncate.db")
+	indexPath := filepath.Join(dir, "truncate-index.db")
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+	db.MemtableSize = 1 << 20
+	db.CacheSize = 1 << 20
+
+	firstOffset := func() (int64, error) {
+		it := LogIterator(db)
+		if !it.Next() {
+			return 0, fmt.Errorf("no records in the log (%v)", it.Err())
+		}
+		return it.Offset(), nil
+	}
+
+	if err := Set(ctx, db, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := firstOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetWithTTL(ctx, db, "b", "2", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := Delete(ctx, db, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Get(ctx, db, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Truncate(); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if _, err := Get(ctx, db, id); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("get %q after truncate: got %v, want %v", id, err, ErrKeyNotFound)
+		}
+	}
+	if n := db.Len(); n != 0 {
+		t.Fatalf("got %d keys after truncate, want none", n)
+	}
+	if err := Set(ctx, db, "c", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := firstOffset(); err != nil || got != want {
+		t.Fatalf("first record after truncate: got offset %d, %v, want %d", got, err, want)
+	}
+
+	// Crashing between the two files being swapped in still leaves an empty database once it is opened again.
+	db.CrashPoint = CrashMidCompactionSwap
+	if err := db.Truncate(); !errors.Is(err, ErrCrashed) {
+		t.Fatalf("truncate with a crash: got %v, want %v", err, ErrCrashed)
+	}
+	if db, err = Open(dbPath, indexPath, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Get(ctx, db, "c"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("get %q after crashed truncate: got %v, want %v", "c", err, ErrKeyNotFound)
+	}
+	if mismatched, err := CheckIndex(db); err != nil || len(mismatched) > 0 {
+		t.Fatalf("index after crashed truncate doesn't match for %v (%v)", mismatched, err)
+	}
+}
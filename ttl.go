@@ -0,0 +1,55 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidTTL is returned by SetWithTTL when the ttl isn't positive.
+var ErrInvalidTTL = errors.New("ttl must be positive")
+
+// SetWithTTL writes the value for id in the same way as Set, but the entry expires once ttl has passed. From then
+// on, reads treat the ID as though it was never written, and the next compaction drops it, although its record
+// stays in the file until that happens. Writing the ID again replaces the expiry, with Set making it permanent.
+//
+// Expiry is kept to the second, so an entry may outlive its ttl by up to a second.
+func SetWithTTL(ctx context.Context, db *DB, id, value string, ttl time.Duration) (err error) {
+	defer observe(db, OpSet, time.Now(), &err)
+
+	if ttl <= 0 {
+		return fmt.Errorf("%w: %v", ErrInvalidTTL, ttl)
+	}
+
+	expiresAt := db.clock().Add(ttl + time.Second - 1).Unix()
+	return set(ctx, db, id, value, expiresAt)
+}
+
+// setExpiry records the expiry of the latest entry for id, where zero means that it never expires.
+// The lock must be held.
+func setExpiry(db *DB, id string, expiresAt int64) {
+	if expiresAt == 0 {
+		delete(db.expiries, id)
+		return
+	}
+
+	if db.expiries == nil {
+		db.expiries = make(map[string]int64)
+	}
+	db.expiries[id] = expiresAt
+}
+
+// clock returns the current time, using Clock if it has been set.
+func (db *DB) clock() time.Time {
+	if db.Clock != nil {
+		return db.Clock()
+	}
+	return time.Now()
+}
+
+// expired reports whether an entry which expires at the given Unix time has done so. Entries with an expiry of
+// zero never expire.
+func (db *DB) expired(expiresAt int64) bool {
+	return expiresAt != 0 && db.clock().Unix() >= expiresAt
+}
@@ -0,0 +1,57 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSetWithTTL checks that an entry is read back until its ttl has passed and not after, that writing it again
+// with Set makes it permanent, and that a ttl which isn't positive is rejected without anything being written.
+func TestSetWithTTL(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Unix(1700000000, 0)
+	db.Clock = func() time.Time { return now }
+
+	for _, ttl := range []time.Duration{0, -time.Second} {
+		if err := SetWithTTL(ctx, db, "bad", "value", ttl); !errors.Is(err, ErrInvalidTTL) {
+			t.Fatalf("set with a ttl of %v: got %v, want %v", ttl, err, ErrInvalidTTL)
+		}
+	}
+	if _, err := Get(ctx, db, "bad"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("get of a key set with a bad ttl: got %v, want %v", err, ErrKeyNotFound)
+	}
+
+	if err := SetWithTTL(ctx, db, "a", "1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetWithTTL(ctx, db, "b", "2", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := Set(ctx, db, "b", "permanent"); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(30 * time.Second)
+	if got, err := Get(ctx, db, "a"); err != nil || got != "1" {
+		t.Fatalf("get before the ttl has passed: got %q, %v, want %q", got, err, "1")
+	}
+
+	now = now.Add(time.Minute)
+	if _, err := Get(ctx, db, "a"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("get once the ttl has passed: got %v, want %v", err, ErrKeyNotFound)
+	}
+	if got, err := Get(ctx, db, "b"); err != nil || got != "permanent" {
+		t.Fatalf("get of a key made permanent by Set: got %q, %v, want %q", got, err, "permanent")
+	}
+}
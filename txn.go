@@ -0,0 +1,150 @@
+package logstructured
+
+// The keys of the marker records which surround the records written by a transaction. Readers of the database
+// file only take the records between the two as written once the commit marker has been reached, see eachRecord.
+// Since they are reserved, no entry can be written under either of them.
+const (
+	txnBeginKey  = "\x00TXN-BEGIN"
+	txnCommitKey = "\x00TXN-COMMIT"
+)
+
+// Transaction stages writes to several IDs, which Commit then makes to the database all at once, or not at all.
+// The zero value is an empty transaction, ready to use.
+type Transaction struct {
+	writes []txnWrite
+}
+
+type txnWrite struct {
+	id     string
+	value  string
+	delete bool
+}
+
+// Set stages a write of value for id. Nothing is written until the transaction is committed.
+func (t *Transaction) Set(id, value string) {
+	t.writes = append(t.writes, txnWrite{id: id, value: value})
+}
+
+// Delete stages the deletion of id. Nothing is written until the transaction is committed.
+func (t *Transaction) Delete(id string) {
+	t.writes = append(t.writes, txnWrite{id: id, value: Tombstone, delete: true})
+}
+
+// Commit writes every staged write to db as a single append, in the order they were staged, between a begin
+// marker and a commit marker. The database file is flushed to disk once the commit marker is written, whatever
+// the SyncPolicy, and the hash index is only updated after that. Should the process die before the commit marker
+// is on disk, the records before it are discarded when the database is next opened, so either all of the writes
+// are seen or none of them are. Once committed, the transaction is emptied so that it can be used again.
+//
+// As with SetBatch, the writes are checked up front and an error means nothing at all is written. AllowInPlaceUpdate
+// is not applied to a transaction.
+func (t *Transaction) Commit(db *DB) error {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if len(t.writes) == 0 {
+		return nil
+	}
+
+	newKeys := make(map[string]bool)
+	for _, w := range t.writes {
+		if w.delete {
+			if err := checkID(w.id); err != nil {
+				return err
+			}
+			delete(newKeys, w.id)
+			continue
+		}
+		if err := checkKey(db, w.id); err != nil {
+			return err
+		}
+		if err := checkValue(db, w.id, w.value); err != nil {
+			return err
+		}
+		if isNewKey(db, w.id) {
+			newKeys[w.id] = true
+		}
+	}
+	if err := checkKeyLimit(db, len(newKeys)); err != nil {
+		return err
+	}
+
+	// As with Delete, a transaction which only deletes is let through, so that room can always be made.
+	size := recordSize(txnBeginKey, "") + recordSize(txnCommitKey, "")
+	sets := false
+	for _, w := range t.writes {
+		size += recordSize(w.id, w.value)
+		sets = sets || !w.delete
+	}
+	if sets {
+		if err := checkQuota(db, size); err != nil {
+			return err
+		}
+	}
+
+	start, err := dataSize(db)
+	if err != nil {
+		return err
+	}
+
+	// The markers aren't writes of their own, so they don't take a sequence number or a write time.
+	begin := encodeRecord(txnBeginKey, "", 0, 0, 0)
+	commit := encodeRecord(txnCommitKey, "", 0, 0, 0)
+	sizes := make([]int, 0, len(t.writes))
+	batch := append([]byte(nil), begin...)
+	firstSeq := db.seq + 1
+	writtenAt := db.clock().UnixNano()
+	for _, w := range t.writes {
+		record := encodeRecord(w.id, w.value, 0, nextSeq(db), writtenAt)
+		batch = append(batch, record...)
+		sizes = append(sizes, len(record))
+	}
+	batch = append(batch, commit...)
+
+	if _, err := appendData(db, batch); err != nil {
+
+		// Without a write buffer, anything which did make it into the file is cut off again, so that later appends
+		// don't follow on from a transaction that was never committed. A failed write buffer fails every later
+		// write too, so the transaction is left at the end of the file for Open to discard instead.
+		if db.writer == nil {
+			db.DB.Truncate(start)
+		}
+		return err
+	}
+	if err := flushWrites(db); err != nil {
+		return err
+	}
+	if err := db.DB.Sync(); err != nil {
+		return err
+	}
+	if err := crash(db, CrashAfterWrite); err != nil {
+		return err
+	}
+
+	// The commit marker is on disk, so the writes can now be seen. The markers are only needed until the next
+	// compaction, which drops them.
+	offset := start + int64(len(begin))
+	written := make([]writtenRecord, 0, len(t.writes))
+	for i, w := range t.writes {
+		written = append(written, writtenRecord{
+			key: w.id, offset: offset, size: sizes[i],
+			value: w.value, seq: firstSeq + uint64(i), writtenAt: writtenAt,
+		})
+		offset += int64(sizes[i])
+	}
+	db.deadBytes += int64(len(begin) + len(commit))
+	t.writes = nil
+
+	return db.afterWrite(written...)
+}
+
+// isTxnMarker reports whether id is one of the keys reserved for the markers around a transaction.
+func isTxnMarker(id string) bool {
+	return id == txnBeginKey || id == txnCommitKey
+}
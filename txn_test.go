@@ -0,0 +1,96 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestTransaction checks that a committed transaction's writes are all seen, and that when the process dies
+// before the commit marker is on disk, none of them are, whether the index is loaded or rebuilt.
+func TestTransaction(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "txn.db")
+	indexPath := filepath.Join(dir, "txn-index.db")
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Set(ctx, db, "a", "before"); err != nil {
+		db.Close()
+		t.Fatalf("set %q: %v", "a", err)
+	}
+
+	var txn Transaction
+	txn.Set("a", "committed")
+	txn.Set("b", "committed")
+	txn.Delete("a")
+	txn.Set("a", "committed again")
+	if err := txn.Commit(db); err != nil {
+		db.Close()
+		t.Fatalf("commit transaction: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	storedIndex, err := os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = Open(dbPath, indexPath, false); err != nil {
+		t.Fatal(err)
+	}
+	txn.Set("a", "uncommitted")
+	txn.Set("c", "uncommitted")
+	if err := txn.Commit(db); err != nil {
+		db.Close()
+		t.Fatalf("commit transaction: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dying whilst the commit marker was being written leaves it cut short, with the index as it was before.
+	info, err := os.Stat(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(dbPath, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(indexPath, storedIndex, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = Open(dbPath, indexPath, false); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	check := func(when string) error {
+		for id, want := range map[string]string{"a": "committed again", "b": "committed"} {
+			if entry, err := Get(ctx, db, id); err != nil || entry != want {
+				return fmt.Errorf("get %q %s: got %q (error %v), want %q", id, when, entry, err, want)
+			}
+		}
+		if _, err := Get(ctx, db, "c"); !errors.Is(err, ErrKeyNotFound) {
+			return fmt.Errorf("get uncommitted %q %s: got error %v, want %v", "c", when, err, ErrKeyNotFound)
+		}
+		return nil
+	}
+	if err := check("after a crash before commit"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RebuildIndex(db); err != nil {
+		t.Fatalf("rebuild index after a crash before commit: %v", err)
+	}
+	if err := check("after rebuilding the index"); err != nil {
+		t.Fatal(err)
+	}
+}
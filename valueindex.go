@@ -0,0 +1,291 @@
+package logstructured
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// valueIndex is a secondary index from the start of each live value to the IDs which hold it, for finding entries
+// by value rather than by ID. It is kept up to date by writes, in the same way as the hash index.
+type valueIndex struct {
+	prefixLen int
+	buckets   map[string][]string // Value prefix to the IDs whose value starts with it.
+	prefixes  map[string]string   // ID to the prefix it is held under, so overwrites can find the old bucket.
+
+	// Whether the index has changed since it was last stored. The stored copy is marked as stale on the first
+	// change, so that a crash before it is next stored leaves it to be rebuilt rather than loaded out of date.
+	dirty bool
+}
+
+// storedValueIndex is how the value index is laid out in its file, next to the hash index file.
+type storedValueIndex struct {
+	PrefixLen int                 `json:"prefix_len"`
+	Stale     bool                `json:"stale,omitempty"`
+	Buckets   map[string][]string `json:"buckets,omitempty"`
+}
+
+// CreateValueIndex builds a secondary index over the first prefixLen bytes of every live value, which
+// GetByValuePrefix then looks entries up in. From then on it is kept up to date by writes and stored alongside the
+// hash index, so it is loaded again by Open. Creating it again with a different prefixLen replaces it.
+func CreateValueIndex(db *DB, prefixLen int) error {
+	if prefixLen <= 0 {
+		return errors.New("value index prefix length must be positive")
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	v, err := buildValueIndex(db, prefixLen)
+	if err != nil {
+		return err
+	}
+	db.values = v
+
+	return storeValueIndex(db)
+}
+
+// GetByValuePrefix returns every live entry whose value starts with prefix, sorted by key in the same way as Scan.
+// CreateValueIndex must have been called first.
+func GetByValuePrefix(db *DB, prefix string) ([]KV, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+	if db.values == nil {
+		return nil, errors.New("there is no value index, create one with CreateValueIndex")
+	}
+
+	// A prefix longer than those in the index narrows it down to a single bucket, whereas a shorter one could be
+	// the start of any number of them.
+	var ids []string
+	if len(prefix) >= db.values.prefixLen {
+		ids = append(ids, db.values.buckets[prefix[:db.values.prefixLen]]...)
+	} else {
+		for bucket, bucketIDs := range db.values.buckets {
+			if strings.HasPrefix(bucket, prefix) {
+				ids = append(ids, bucketIDs...)
+			}
+		}
+	}
+	sortKeys(db, ids)
+
+	results := make([]KV, 0, len(ids))
+	for _, id := range ids {
+		loc, ok := db.Hash.Get(id)
+		if !ok {
+			continue
+		}
+		_, value, expiresAt, _, _, err := readRecord(db, loc)
+		if err != nil {
+			return nil, err
+		}
+		if db.expired(expiresAt) || !strings.HasPrefix(value, prefix) {
+			continue
+		}
+		results = append(results, KV{Key: id, Value: value})
+	}
+
+	return results, nil
+}
+
+// buildValueIndex reads the latest value of every live key to build a value index from scratch.
+// The lock must be held.
+func buildValueIndex(db *DB, prefixLen int) (*valueIndex, error) {
+	v := &valueIndex{prefixLen: prefixLen, buckets: make(map[string][]string), prefixes: make(map[string]string), dirty: true}
+
+	var err error
+	db.Hash.Range(func(id string, loc RecordLocation) bool {
+		if db.deleted[id] {
+			return true
+		}
+
+		var value string
+		if _, value, _, _, _, err = readRecord(db, loc); err != nil {
+			err = fmt.Errorf("read %q for the value index: %w", id, err)
+			return false
+		}
+		v.put(id, value)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// put files id under the prefix of value, taking it out of the bucket for its previous value.
+func (v *valueIndex) put(id, value string) {
+	v.remove(id)
+
+	prefix := value
+	if len(prefix) > v.prefixLen {
+		prefix = prefix[:v.prefixLen]
+	}
+	v.buckets[prefix] = append(v.buckets[prefix], id)
+	v.prefixes[id] = prefix
+}
+
+// remove takes id out of the index, if it is held.
+func (v *valueIndex) remove(id string) {
+	prefix, ok := v.prefixes[id]
+	if !ok {
+		return
+	}
+	delete(v.prefixes, id)
+
+	ids := v.buckets[prefix]
+	for i, held := range ids {
+		if held == id {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(v.buckets, prefix)
+	} else {
+		v.buckets[prefix] = ids
+	}
+}
+
+// indexValue updates the value index, if there is one, for the entry just written for id, alongside the update
+// to the hash index. A tombstone takes id out of the index. The lock must be held.
+func indexValue(db *DB, id, value string, tombstone bool) {
+	if db.values == nil {
+		return
+	}
+
+	if tombstone {
+		db.values.remove(id)
+	} else {
+		db.values.put(id, value)
+	}
+}
+
+// markValueIndexStale marks the stored value index as out of date, if this hasn't been done since it was last
+// stored, following a write which changed the index in memory. The lock must be held.
+func markValueIndexStale(db *DB) error {
+	if db.values == nil || db.values.dirty {
+		return nil
+	}
+
+	if err := writeValueIndexFile(db, storedValueIndex{PrefixLen: db.values.prefixLen, Stale: true}); err != nil {
+		return err
+	}
+	db.values.dirty = true
+	return nil
+}
+
+// storeValueIndex writes the whole value index to its file, if it has changed since it was last stored. This is
+// done whenever a snapshot of the hash index is written. The lock must be held.
+func storeValueIndex(db *DB) error {
+	if db.values == nil || !db.values.dirty {
+		return nil
+	}
+
+	stored := storedValueIndex{PrefixLen: db.values.prefixLen, Buckets: db.values.buckets}
+	if err := writeValueIndexFile(db, stored); err != nil {
+		return err
+	}
+	db.values.dirty = false
+	return nil
+}
+
+// loadValueIndex loads the stored value index, if there is one. One which is stale or can't be read is rebuilt
+// from the database file instead, which a read-only database keeps in memory alone. The hash index must already
+// have been loaded.
+func loadValueIndex(db *DB) error {
+	b, err := os.ReadFile(valueIndexPath(db))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var stored storedValueIndex
+	if err := json.Unmarshal(b, &stored); err != nil || stored.PrefixLen <= 0 {
+		logf(db.Logger, "Warning: stored value index is unreadable, it needs creating again with CreateValueIndex.")
+		return nil
+	}
+
+	if stored.Stale {
+		logf(db.Logger, "Stored value index is out of date, rebuilding it from the database file.")
+		v, err := buildValueIndex(db, stored.PrefixLen)
+		if err != nil {
+			return err
+		}
+		db.values = v
+		if db.readOnly {
+			v.dirty = false
+			return nil
+		}
+		return storeValueIndex(db)
+	}
+
+	v := &valueIndex{prefixLen: stored.PrefixLen, buckets: stored.Buckets, prefixes: make(map[string]string)}
+	if v.buckets == nil {
+		v.buckets = make(map[string][]string)
+	}
+	for prefix, ids := range v.buckets {
+		for _, id := range ids {
+			v.prefixes[id] = prefix
+		}
+	}
+	db.values = v
+	return nil
+}
+
+// writeValueIndexFile replaces the value index file with stored, writing it alongside and renaming it over the
+// original so that a crash part way through leaves the original in place.
+func writeValueIndexFile(db *DB, stored storedValueIndex) error {
+	path := valueIndexPath(db)
+	tmpPath := path + ".tmp"
+
+	b, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, db.fileMode)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(b); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// valueIndexPath is where the value index is stored, next to the hash index file.
+func valueIndexPath(db *DB) string {
+	return db.HashStorage.Name() + ".values"
+}
@@ -0,0 +1,50 @@
+package logstructured
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestValueIndex checks that the value index follows inserts, overwrites which change the prefix of a value,
+// and deletes.
+func TestValueIndex(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "values.db"), filepath.Join(dir, "values-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := Set(ctx, db, "1", "apple"); err != nil {
+		t.Fatalf("set %q: %v", "1", err)
+	}
+	if err := CreateValueIndex(db, 2); err != nil {
+		t.Fatalf("create value index: %v", err)
+	}
+	for _, kv := range [][2]string{{"2", "apricot"}, {"3", "banana"}, {"2", "blueberry"}} {
+		if err := Set(ctx, db, kv[0], kv[1]); err != nil {
+			t.Fatalf("set %q: %v", kv[0], err)
+		}
+	}
+	if err := Delete(ctx, db, "1"); err != nil {
+		t.Fatalf("delete %q: %v", "1", err)
+	}
+
+	for prefix, want := range map[string]string{"ap": "", "a": "", "b": "2=blueberry 3=banana", "blue": "2=blueberry"} {
+		kvs, err := GetByValuePrefix(db, prefix)
+		if err != nil {
+			t.Fatalf("get by value prefix %q: %v", prefix, err)
+		}
+		got := make([]string, 0, len(kvs))
+		for _, kv := range kvs {
+			got = append(got, kv.Key+"="+kv.Value)
+		}
+		if strings.Join(got, " ") != want {
+			t.Fatalf("get by value prefix %q: got %q, want %q", prefix, strings.Join(got, " "), want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package logstructured
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// Verify checks every record in the database file against its checksum, returning the offsets of any which are
+// corrupt. A record whose checksum doesn't match is skipped over using its lengths so that the rest of the file
+// can still be checked. If the lengths themselves have been damaged they are likely to point beyond the end of
+// the file, in which case that record is reported and nothing after it can be checked.
+func Verify(db *DB) ([]int64, error) {
+
+	// Hold the lock so that a compaction can't swap the file over part way through.
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	if err := flushWrites(db); err != nil {
+		return nil, err
+	}
+
+	info, err := db.DB.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(db.DB, headerSize, info.Size()-headerSize))
+	offset := int64(headerSize)
+	var corrupt []int64
+
+	for {
+		size, ok, err := verifyRecord(r)
+		if err == io.EOF {
+			return corrupt, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return append(corrupt, offset), nil
+		}
+		if err != nil {
+			return corrupt, err
+		}
+
+		if !ok {
+			corrupt = append(corrupt, offset)
+		}
+		offset += size
+	}
+}
+
+// CheckIndex reads the record which the hash index points at for every key, returning the keys, in sorted order,
+// whose record belongs to another key or can't be read at all. These are where the index no longer matches the
+// database file, such as after a crash, which RebuildIndex puts right.
+func CheckIndex(db *DB) ([]string, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	// Failing to write out the buffer would otherwise look like every record after it is missing.
+	if err := flushWrites(db); err != nil {
+		return nil, err
+	}
+
+	var mismatched []string
+	db.Hash.Range(func(id string, loc RecordLocation) bool {
+		if key, _, _, _, _, err := readRecord(db, loc); err != nil || key != id {
+			mismatched = append(mismatched, id)
+		}
+		return true
+	})
+	sortKeys(db, mismatched)
+
+	return mismatched, nil
+}
+
+// verifyRecord reads the next record from r, returning its size and whether it matches its checksum.
+func verifyRecord(r io.Reader) (int64, bool, error) {
+	var fixed [checksumSize + expirySize + seqSize + writtenSize]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return 0, false, err
+	}
+	expiresAt := int64(binary.BigEndian.Uint64(fixed[checksumSize:]))
+	seq := binary.BigEndian.Uint64(fixed[checksumSize+expirySize:])
+	writtenAt := int64(binary.BigEndian.Uint64(fixed[checksumSize+expirySize+seqSize:]))
+
+	key, err := readField(r)
+	if err == io.EOF {
+		return 0, false, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	value, err := readField(r)
+	if err == io.EOF {
+		return 0, false, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	return recordSize(key, value), checksum(key, value, expiresAt, seq, writtenAt) == binary.BigEndian.Uint32(fixed[:checksumSize]), nil
+}
@@ -0,0 +1,87 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestVerifyFindsCorruptRecord flips a byte in the value of one record, checking that both Get and Verify report
+// that record, and only that one, before and after the database is opened again.
+func TestVerifyFindsCorruptRecord(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dbPath, indexPath := filepath.Join(dir, "data.db"), filepath.Join(dir, "index.db")
+
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	for _, kv := range []KV{{"a", "first"}, {"b", "second"}, {"c", "third"}} {
+		if err := Set(ctx, db, kv.Key, kv.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if corrupt, err := Verify(db); err != nil || len(corrupt) != 0 {
+		t.Fatalf("verify before the damage: got %v (error %v), want no corrupt records", corrupt, err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	loc, ok := db.Hash.Get("b")
+	if !ok {
+		t.Fatal(`no index entry for "b"`)
+	}
+
+	// The value is the last part of a record, after every fixed size field and the key.
+	valueOffset := loc.Offset + recordOverhead + int64(len("b"))
+	f, err := os.OpenFile(dbPath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, valueOffset); err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != 's' {
+		t.Fatalf("got %q at the start of the value of %q, want %q", b, "b", "s")
+	}
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, valueOffset)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		if _, err := Get(ctx, db, "b"); !errors.Is(err, ErrCorruptRecord) {
+			t.Fatalf("get of the damaged record %s: got %v, want %v", stage, err, ErrCorruptRecord)
+		}
+		for id, want := range map[string]string{"a": "first", "c": "third"} {
+			if got, err := Get(ctx, db, id); err != nil || got != want {
+				t.Fatalf("get %q %s: got %q (error %v), want %q", id, stage, got, err, want)
+			}
+		}
+		corrupt, err := Verify(db)
+		if err != nil {
+			t.Fatalf("verify %s: %v", stage, err)
+		}
+		if len(corrupt) != 1 || corrupt[0] != loc.Offset {
+			t.Fatalf("verify %s: got corrupt records at %v, want only %d", stage, corrupt, loc.Offset)
+		}
+	}
+	check("after the damage")
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath, indexPath, false); err != nil {
+		t.Fatalf("open with a corrupt record: %v", err)
+	}
+	check("once opened again")
+}
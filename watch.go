@@ -0,0 +1,68 @@
+package logstructured
+
+// watchBufferSize is how many events a watcher can fall behind by before further events for it are dropped.
+const watchBufferSize = 64
+
+// ChangeEvent describes a single write to the database, as delivered to watchers. Op is OpSet or OpDelete.
+type ChangeEvent struct {
+	Key string
+	Op  Op
+}
+
+// Watch returns a channel which receives an event for every write made to db from then on, along with a function
+// which stops the events and closes the channel. Each call gets its own channel. The event for a write is sent once
+// its record is in the database file, and flushed to disk if the SyncPolicy calls for it, before the write returns.
+// Closing the database closes every watcher's channel.
+//
+// Writers never wait for watchers. Events are held for a watcher which falls behind, up to a bound, after which
+// further events for it are dropped until it catches up. A watcher which must not miss any should read the
+// database again once it has caught up.
+func Watch(db *DB) (<-chan ChangeEvent, func()) {
+	db.Lock()
+	defer db.Unlock()
+
+	ch := make(chan ChangeEvent, watchBufferSize)
+	if db.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if db.watchers == nil {
+		db.watchers = make(map[chan ChangeEvent]struct{})
+	}
+	db.watchers[ch] = struct{}{}
+
+	unsubscribe := func() {
+		db.Lock()
+		defer db.Unlock()
+
+		if _, ok := db.watchers[ch]; ok {
+			delete(db.watchers, ch)
+			close(ch)
+		}
+	}
+	return ch, unsubscribe
+}
+
+// publish tells every watcher and change feed about the write just made of value for id, which is a delete if value
+// is the tombstone. The hash index has to hold the write already, as that is where its offset comes from. The lock
+// must be held, which keeps watchers from being closed whilst an event is sent to them.
+func publish(db *DB, id, value string, expiresAt int64, seq uint64, writtenAt int64) {
+	if len(db.feeds) > 0 {
+		loc, _ := db.Hash.Get(id)
+		publishChange(db, newChangeRecord(id, value, expiresAt, seq, writtenAt, loc.Offset))
+	}
+	if len(db.watchers) == 0 {
+		return
+	}
+
+	event := ChangeEvent{Key: id, Op: OpSet}
+	if value == Tombstone {
+		event.Op = OpDelete
+	}
+	for ch := range db.watchers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
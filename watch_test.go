@@ -0,0 +1,46 @@
+package logstructured
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+// TestWatch checks that watchers are told about sets and deletes, and that unsubscribing stops the events.
+func TestWatch(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := Open(filepath.Join(dir, "watch.db"), filepath.Join(dir, "watch-index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	events, unsubscribe := Watch(db)
+	if err := Set(ctx, db, "a", "1"); err != nil {
+		t.Fatalf("set %q whilst watching: %v", "a", err)
+	}
+	if err := Delete(ctx, db, "a"); err != nil {
+		t.Fatalf("delete %q whilst watching: %v", "a", err)
+	}
+
+	for _, want := range []ChangeEvent{{Key: "a", Op: OpSet}, {Key: "a", Op: OpDelete}} {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("watch: got event %+v, want %+v", got, want)
+			}
+		default:
+			t.Fatalf("watch: no event, want %+v", want)
+		}
+	}
+
+	unsubscribe()
+	if err := Set(ctx, db, "b", "1"); err != nil {
+		t.Fatalf("set %q after unsubscribing: %v", "b", err)
+	}
+	if got, ok := <-events; ok {
+		t.Fatalf("watch: got event %+v after unsubscribing, want the channel closed", got)
+	}
+}
@@ -0,0 +1,155 @@
+package logstructured
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// writerBatchSize is roughly how many bytes of records a DBWriter holds before writing them out as a batch.
+const writerBatchSize = 1 << 20
+
+// ErrMalformedLine is returned by a DBWriter for a line which isn't of the form "<id>,<value>".
+var ErrMalformedLine = errors.New("malformed line")
+
+// DBWriter is an io.Writer which writes entries to the database from a stream of "<id>,<value>\n" lines, as in
+// the simplified database from the book, so that entries can be copied in from a pipeline with io.Copy. The ID runs
+// up to the first comma, the value is the rest of the line, so values can contain commas, but not newlines, such
+// a value needs writing with Set. A line can be split across any number of calls to Write.
+//
+// Entries are held until there are around writerBatchSize bytes of them, then written with SetBatch, which
+// persists the hash index once for the whole batch rather than once for each entry as Set does. Within a batch, the
+// last line for an ID is the only one written. Flush writes out what is held, Close does too, along with a final
+// line without a newline at the end. A DBWriter isn't safe for concurrent use.
+type DBWriter struct {
+	db      *DB
+	partial []byte            // Start of a line whose newline is yet to be written.
+	entries map[string]string // Entries held for the next batch.
+	size    int64             // Size of the records for entries, see recordSize.
+	lines   int               // Number of lines read so far, for reporting where a malformed one is.
+	err     error             // First error, which every later call returns.
+	closed  bool
+}
+
+// NewWriter returns a DBWriter which writes to db.
+func (db *DB) NewWriter() *DBWriter {
+	return &DBWriter{db: db, entries: make(map[string]string)}
+}
+
+// Write reads the lines from p, holding on to the start of a line which p doesn't finish for the next call. A line
+// without a comma, or with an ID or value which Set wouldn't accept, returns an error, along with the bytes of p
+// which came before it, whose lines are written out straight away. Every call after that returns the same error.
+func (w *DBWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, ErrClosed
+	}
+
+	n := 0
+	for {
+		i := bytes.IndexByte(p[n:], '\n')
+		if i < 0 {
+			break
+		}
+		line := p[n : n+i]
+		if len(w.partial) > 0 {
+			w.partial = append(w.partial, line...)
+			line = w.partial
+		}
+		if err := w.add(line); err != nil {
+			w.fail(err)
+			return n, w.err
+		}
+		w.partial = w.partial[:0]
+		n += i + 1
+	}
+	w.partial = append(w.partial, p[n:]...)
+	return len(p), nil
+}
+
+// add holds the entry from line for the next batch, writing the batch out once it is big enough.
+func (w *DBWriter) add(line []byte) error {
+	w.lines++
+	i := bytes.IndexByte(line, ',')
+	if i < 0 {
+		return fmt.Errorf("%w: line %d has no comma between the id and value", ErrMalformedLine, w.lines)
+	}
+	id, value := string(line[:i]), string(line[i+1:])
+
+	// Checked now, rather than by SetBatch, so that the error says which line it is.
+	if err := checkKey(w.db, id); err != nil {
+		return fmt.Errorf("line %d: %w", w.lines, err)
+	}
+	if err := checkValue(w.db, id, value); err != nil {
+		return fmt.Errorf("line %d: %w", w.lines, err)
+	}
+
+	if previous, ok := w.entries[id]; ok {
+		w.size -= recordSize(id, previous)
+	}
+	w.entries[id] = value
+	w.size += recordSize(id, value)
+	if w.size < writerBatchSize {
+		return nil
+	}
+	return w.writeBatch()
+}
+
+// fail stops the DBWriter with err from a line which can't be written. The lines before it are written out first,
+// as Write has already said they were written, unless that fails too, in which case the error from it is kept
+// instead.
+func (w *DBWriter) fail(err error) {
+	if batchErr := w.writeBatch(); batchErr != nil {
+		err = batchErr
+	}
+	w.err = err
+}
+
+// writeBatch writes out the entries held, if there are any.
+func (w *DBWriter) writeBatch() error {
+	if len(w.entries) == 0 {
+		return nil
+	}
+	err := SetBatch(w.db, w.entries)
+	w.entries = make(map[string]string)
+	w.size = 0
+	return err
+}
+
+// Flush writes the entries held so far to the database. The start of a line which hasn't been finished yet is kept
+// for the next Write.
+func (w *DBWriter) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.closed {
+		return ErrClosed
+	}
+
+	w.err = w.writeBatch()
+	return w.err
+}
+
+// Close writes the entries held to the database, including one from a final line without a newline at the end.
+// The database itself is left open. The DBWriter returns ErrClosed from any further use.
+func (w *DBWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	if w.err != nil {
+		return w.err
+	}
+	w.closed = true
+
+	if len(w.partial) > 0 {
+		if err := w.add(w.partial); err != nil {
+			w.fail(err)
+			return w.err
+		}
+		w.partial = nil
+	}
+	w.err = w.writeBatch()
+	return w.err
+}
@@ -0,0 +1,87 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestWriter checks that entries copied into the database through a DBWriter, with their lines split across
+// writes, all read back, in more than one batch, including a final line without a newline, and that a malformed
+// line stops the copy.
+func TestWriter(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "writer.db")
+	indexPath := filepath.Join(dir, "writer-index.db")
+	db, err := Open(dbPath, indexPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	// Enough to fill more than one batch, with commas in the values.
+	const records = 3000
+	var stream strings.Builder
+	want := make(map[string]string)
+	for i := 0; i < records; i++ {
+		id, value := fmt.Sprintf("key-%d", i), fmt.Sprintf("value,%d,%s", i, strings.Repeat("x", i%700))
+		want[id] = value
+		stream.WriteString(id + "," + value)
+		if i < records-1 {
+			stream.WriteString("\n")
+		}
+	}
+
+	w := db.NewWriter()
+	if _, err := io.Copy(w, &chunkReader{r: strings.NewReader(stream.String())}); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for id, value := range want {
+		if got, err := Get(ctx, db, id); err != nil || got != value {
+			t.Fatalf("get of %q written through a writer: got %q, %v, want %q", id, got, err, value)
+		}
+	}
+	if _, err := w.Write([]byte("more,value\n")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("write to a closed writer: got error %v, want %v", err, ErrClosed)
+	}
+
+	// The lines before a malformed one are written, none after it are.
+	w = db.NewWriter()
+	n, err := w.Write([]byte("before,value\nno comma\nafter,value\n"))
+	if !errors.Is(err, ErrMalformedLine) || n != len("before,value\n") {
+		t.Fatalf("write of a malformed line: got %d, %v, want %d, %v", n, err, len("before,value\n"), ErrMalformedLine)
+	}
+	if err := w.Close(); !errors.Is(err, ErrMalformedLine) {
+		t.Fatalf("close after a malformed line: got error %v, want %v", err, ErrMalformedLine)
+	}
+	if value, err := Get(ctx, db, "before"); err != nil || value != "value" {
+		t.Fatalf("get of the line before a malformed one: got %q, %v, want %q", value, err, "value")
+	}
+	if _, err := Get(ctx, db, "after"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("get of the line after a malformed one: got error %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+// chunkReader reads from r a few bytes at a time, varying how many, so that lines are split across writes at every
+// point within them.
+type chunkReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *chunkReader) Read(b []byte) (int, error) {
+	c.n++
+	if size := c.n%13 + 1; len(b) > size {
+		b = b[:size]
+	}
+	return c.r.Read(b)
+}